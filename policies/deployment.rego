@@ -0,0 +1,50 @@
+# Example deployment policy evaluated by scripts/policy-check.sh before provisioning.
+# Every message added to "deny" blocks the deployment. Copy this file, adjust the
+# lists to the organization rules and point --policy-source at the copy or a git repo.
+package istio_azure.deployment
+
+import rego.v1
+
+allowed_vm_sizes := {"Standard_B2s", "Standard_B2ms", "Standard_D2s_v5", "Standard_D4s_v5"}
+
+allowed_locations := {"westus", "westus2", "eastus", "eastus2"}
+
+required_tags := {"owner", "environment"}
+
+# Namespaces that must never host VM workloads
+reserved_namespaces := {"default", "kube-system", "istio-system"}
+
+deny contains msg if {
+	not input.vm.size in allowed_vm_sizes
+	msg := sprintf("VM size %s is not allowed (allowed: %v)", [input.vm.size, allowed_vm_sizes])
+}
+
+deny contains msg if {
+	not input.location in allowed_locations
+	msg := sprintf("Location %s is not allowed (allowed: %v)", [input.location, allowed_locations])
+}
+
+deny contains msg if {
+	some tag in required_tags
+	not input.vm.tags[tag]
+	msg := sprintf("Required tag %q is missing, add it with --tags %s=VALUE", [tag, tag])
+}
+
+deny contains msg if {
+	input.vm.public_ip
+	input.vm.tags.environment == "production"
+	msg := "Production VMs cannot have a public IP, use --no-public-ip --outbound-type nat-gateway|firewall"
+}
+
+deny contains msg if {
+	input.mesh.namespace in reserved_namespaces
+	msg := sprintf("Namespace %s is reserved and cannot host VM workloads", [input.mesh.namespace])
+}
+
+deny contains msg if {
+	input.vm.tags.environment == "production"
+	some key in input.vm.ssh_keys
+	key.type == "RSA"
+	key.bits < 3072
+	msg := sprintf("SSH key %s is RSA %d bits, production VMs need 3072 bits or an ed25519 key", [key.source, key.bits])
+}
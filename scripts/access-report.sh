@@ -0,0 +1,168 @@
+#!/bin/bash
+
+# VM Access Report Script
+# Summarizes, for security reviews, which principals and namespaces can currently
+# reach the VM workload and over which ports. It evaluates the AuthorizationPolicies
+# and PeerAuthentications that select the VM, and the Sidecar resources that hide
+# the VM service from other namespaces. The report reflects the applied
+# configuration only, it does not send traffic.
+
+set -e
+
+# Shared configuration variables
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_VERSION="${VM_VERSION:-v1.0}"
+ROOT_NAMESPACE="istio-system"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+BLUE='\033[0;34m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+print_section() {
+    echo ""
+    echo -e "${BLUE}== $1 ==${NC}"
+}
+
+# Labels of the VM workload, used to evaluate workload selectors
+VM_LABELS="{\"app\": \"$VM_APP\", \"version\": \"$VM_VERSION\", \"service.istio.io/canonical-name\": \"$VM_APP\", \"service.istio.io/canonical-revision\": \"$VM_VERSION\"}"
+
+# jq filter keeping the resources whose selector is empty or matches the VM labels
+SELECTS_VM='select((.spec.selector.matchLabels // {}) | to_entries | all(.value == $labels[.key]))'
+
+# Resources of a kind in the root and VM namespaces that apply to the VM
+applicable() {
+    local kind=$1
+    {
+        kubectl get "$kind" -n "$ROOT_NAMESPACE" -o json 2>/dev/null || echo '{"items": []}'
+        kubectl get "$kind" -n "$VM_NAMESPACE" -o json 2>/dev/null || echo '{"items": []}'
+    } | jq -c --argjson labels "$VM_LABELS" ".items[] | $SELECTS_VM"
+}
+
+# Effective mTLS mode: workload policy over namespace policy over mesh-wide policy
+report_peer_authentication() {
+    print_section "Peer authentication (mTLS)"
+
+    local policies=$(applicable peerauthentications)
+    if [ -z "$policies" ]; then
+        echo "  No PeerAuthentication applies: mTLS mode is PERMISSIVE (plain text accepted)"
+        return 0
+    fi
+
+    local mode=$(echo "$policies" | jq -rs --arg ns "$VM_NAMESPACE" '
+        (map(select(.metadata.namespace == $ns and .spec.selector != null)) +
+         map(select(.metadata.namespace == $ns and .spec.selector == null)) +
+         map(select(.metadata.namespace != $ns)))
+        | map(.spec.mtls.mode // empty) | first // "PERMISSIVE"')
+
+    echo "$policies" | jq -r '"  \(.metadata.namespace)/\(.metadata.name): \(.spec.mtls.mode // "UNSET")" +
+        (if .spec.portLevelMtls then " (port overrides: " + ([.spec.portLevelMtls | to_entries[] | "\(.key)=\(.value.mode)"] | join(", ")) + ")" else "" end)'
+    echo "  Effective mode: $mode"
+    if [ "$mode" != "STRICT" ]; then
+        print_warning "Plain text traffic can reach the VM, principal based rules only apply to mTLS traffic"
+    fi
+}
+
+# List the sources and operations of each rule of the policies with the given action
+report_rules() {
+    local policies=$1
+    local action=$2
+
+    echo "$policies" | jq -r --arg action "$action" '
+        select((.spec.action // "ALLOW") == $action) |
+        "  \(.metadata.namespace)/\(.metadata.name):",
+        (if (.spec.rules // []) | length == 0 then
+            (if $action == "ALLOW" then "    (no rules: matches nothing)" else "    (no rules)" end)
+         else
+            (.spec.rules | to_entries[] |
+                "    rule \(.key + 1):",
+                "      from: " + (if (.value.from // []) | length == 0 then "ANY SOURCE" else
+                    ([.value.from[].source | to_entries[] | "\(.key)=\(.value | join(","))"] | join("; ")) end),
+                "      to:   " + (if (.value.to // []) | length == 0 then "ANY PORT/OPERATION" else
+                    ([.value.to[].operation | to_entries[] | "\(.key)=\(.value | join(","))"] | join("; ")) end) +
+                    (if .value.when then " when " + ([.value.when[] | "\(.key) in \(.values // [] | join(","))"] | join("; ")) else "" end))
+         end)'
+}
+
+# Evaluate the AuthorizationPolicies that select the VM
+report_authorization() {
+    print_section "Authorization policies"
+
+    local policies=$(applicable authorizationpolicies)
+    if [ -z "$policies" ]; then
+        echo "  No AuthorizationPolicy applies: every source can reach every VM port"
+        return 0
+    fi
+
+    local action
+    for action in CUSTOM DENY ALLOW AUDIT; do
+        if echo "$policies" | jq -e --arg a "$action" 'select((.spec.action // "ALLOW") == $a)' > /dev/null; then
+            echo "  [$action]"
+            report_rules "$policies" "$action"
+        fi
+    done
+
+    if ! echo "$policies" | jq -e 'select((.spec.action // "ALLOW") == "ALLOW")' > /dev/null; then
+        echo "  No ALLOW policy: every source not denied can reach the VM"
+    elif echo "$policies" | jq -e 'select((.spec.action // "ALLOW") == "ALLOW") | .spec.rules[]? | select((.from // []) | length == 0)' > /dev/null; then
+        print_warning "An ALLOW rule has no 'from': any source matching its operations can reach the VM"
+    fi
+}
+
+# Namespaces whose Sidecar egress configuration does not import the VM service
+report_sidecars() {
+    print_section "Sidecar egress visibility"
+
+    local hidden=$(kubectl get sidecars -A -o json 2>/dev/null | jq -r --arg ns "$VM_NAMESPACE" --arg app "$VM_APP" '
+        .items[] | select(.spec.egress != null) | .metadata.namespace as $sidecar_ns |
+        select([.spec.egress[].hosts[]] | map(
+            . == "*/*" or . == "\($ns)/*" or . == "\($ns)/\($app).\($ns).svc.cluster.local" or
+            (startswith("./") and $sidecar_ns == $ns)) | any | not) |
+        "  \(.metadata.namespace)/\(.metadata.name)"')
+
+    if [ -z "$hidden" ]; then
+        echo "  No Sidecar resource hides $VM_APP.$VM_NAMESPACE from other namespaces"
+    else
+        echo "  These Sidecars do not import $VM_APP.$VM_NAMESPACE, their workloads cannot reach the VM through the mesh:"
+        echo "$hidden"
+    fi
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to build the access report"
+        exit 1
+    fi
+
+    if ! kubectl get namespace "$VM_NAMESPACE" &> /dev/null; then
+        print_error "Namespace $VM_NAMESPACE not found, run: ./setup-istio.sh setup-vm-mesh"
+        exit 1
+    fi
+
+    echo "Access report for $VM_APP ($VM_NAMESPACE), generated $(date -u +%Y-%m-%dT%H:%M:%SZ)"
+    echo "VM labels: app=$VM_APP, version=$VM_VERSION"
+
+    report_peer_authentication
+    report_authorization
+    report_sidecars
+    echo ""
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,218 @@
+#!/bin/bash
+
+# Deployment Artifact Store Script
+# Collects the artifacts produced during a deployment (local state, VM mesh file
+# metadata, applied mesh resources) and stores them in an Azure Blob Storage
+# container under <vm-name>/<timestamp>/ for post-mortem analysis.
+# Secret files (istio-token, root-cert.pem) are only recorded by checksum, secrets
+# in the other files are masked (see redact.sh).
+# It also keeps the deployment state (workspace/configs/*.env) in a container
+# under <resource-group>/ so it can be shared without a database.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+
+# Storage configuration (ARTIFACT_STORAGE_ACCOUNT is required)
+ARTIFACT_STORAGE_ACCOUNT="${ARTIFACT_STORAGE_ACCOUNT:-}"
+ARTIFACT_CONTAINER="${ARTIFACT_CONTAINER:-istio-artifacts}"
+STATE_CONTAINER="${STATE_CONTAINER:-istio-state}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+WORKSPACE_DIR="$(dirname "$SCRIPT_DIR")/workspace"
+CONFIGS_DIR="$WORKSPACE_DIR/configs"
+VM_FILES_DIR="$WORKSPACE_DIR/vm-mesh-setup/vm-files"
+ARTIFACTS_DIR="$WORKSPACE_DIR/artifacts"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 upload | list | download TIMESTAMP | state push|pull|delete"
+    echo ""
+    echo "  upload               Collect the deployment artifacts and upload them"
+    echo "  list                 List the uploaded artifacts of VM_NAME ($VM_NAME)"
+    echo "  download TIMESTAMP   Download one upload into $ARTIFACTS_DIR"
+    echo "  state push           Upload the deployment state of RESOURCE_GROUP ($RESOURCE_GROUP)"
+    echo "  state pull           Download the deployment state into $CONFIGS_DIR"
+    echo "  state delete         Delete the stored deployment state"
+    echo ""
+    echo "Environment:"
+    echo "  ARTIFACT_STORAGE_ACCOUNT   Storage account name (required)"
+    echo "  ARTIFACT_CONTAINER         Blob container for artifacts (default: istio-artifacts)"
+    echo "  STATE_CONTAINER            Blob container for state (default: istio-state)"
+}
+
+# Run az storage commands with the logged-in identity
+storage() {
+    az storage "$@" --account-name "$ARTIFACT_STORAGE_ACCOUNT" --auth-mode login
+}
+
+# Copy the deployment artifacts into a staging directory
+collect_artifacts() {
+    local stage=$1
+
+    mkdir -p "$stage/configs" "$stage/vm-files" "$stage/mesh"
+
+    if [ -d "$CONFIGS_DIR" ]; then
+        cp "$CONFIGS_DIR"/*.env "$stage/configs/" 2>/dev/null || true
+        cp "$CONFIGS_DIR"/*.json "$stage/configs/" 2>/dev/null || true
+        cp "$CONFIGS_DIR"/*.xml "$stage/configs/" 2>/dev/null || true
+    fi
+
+    # VM mesh files: copy the non-secret ones, record every file in a manifest
+    if [ -d "$VM_FILES_DIR" ]; then
+        local file
+        for file in "$VM_FILES_DIR"/*; do
+            [ -f "$file" ] || continue
+            local name=$(basename "$file")
+            echo "$(sha256sum "$file" | awk '{print $1}')  $(wc -c < "$file" | tr -d ' ')  $name" >> "$stage/vm-files/MANIFEST"
+            case $name in
+                istio-token|root-cert.pem) ;;
+                *) cp "$file" "$stage/vm-files/" ;;
+            esac
+        done
+    fi
+
+    # Mesh resources as applied in the cluster
+    if kubectl get namespace "$VM_NAMESPACE" &> /dev/null; then
+        kubectl get workloadgroup,workloadentry,serviceentry,service,endpointslice \
+            -n "$VM_NAMESPACE" -o yaml > "$stage/mesh/resources.yaml" 2>/dev/null || true
+        istioctl analyze -n "$VM_NAMESPACE" > "$stage/mesh/analyze.txt" 2>&1 || true
+    fi
+}
+
+# Collect the artifacts and upload them under <vm-name>/<timestamp>/
+upload_artifacts() {
+    local stamp=$(date -u +%Y%m%dT%H%M%SZ)
+    local stage=$(mktemp -d)
+
+    print_status "Collecting deployment artifacts..."
+    collect_artifacts "$stage"
+    find "$stage" -type f -print0 | xargs -0 -r bash "$SCRIPT_DIR/redact.sh" --in-place
+
+    storage container create --name "$ARTIFACT_CONTAINER" > /dev/null
+
+    print_status "Uploading artifacts to $ARTIFACT_STORAGE_ACCOUNT/$ARTIFACT_CONTAINER/$VM_NAME/$stamp..."
+    if storage blob upload-batch --destination "$ARTIFACT_CONTAINER" \
+        --destination-path "$VM_NAME/$stamp" --source "$stage" --overwrite > /dev/null; then
+        print_status "✓ Artifacts uploaded: $VM_NAME/$stamp"
+    else
+        print_error "Failed to upload artifacts"
+        rm -rf "$stage"
+        exit 1
+    fi
+
+    rm -rf "$stage"
+}
+
+# List the uploaded artifacts of the VM
+list_artifacts() {
+    storage blob list --container-name "$ARTIFACT_CONTAINER" --prefix "$VM_NAME/" \
+        --query "[].{Name:name, Size:properties.contentLength, Modified:properties.lastModified}" -o table
+}
+
+# Download one upload of the VM into the local workspace
+download_artifacts() {
+    local stamp=$1
+
+    if [ -z "$stamp" ]; then
+        print_error "Timestamp is required, see: $0 list"
+        exit 1
+    fi
+
+    mkdir -p "$ARTIFACTS_DIR"
+    storage blob download-batch --source "$ARTIFACT_CONTAINER" --destination "$ARTIFACTS_DIR" \
+        --pattern "$VM_NAME/$stamp/*" > /dev/null
+    print_status "✓ Artifacts downloaded to $ARTIFACTS_DIR/$VM_NAME/$stamp"
+}
+
+# Upload the local deployment state, replacing the stored one
+push_state() {
+    if ! ls "$CONFIGS_DIR"/*.env &> /dev/null; then
+        print_warning "No local deployment state to push"
+        return 0
+    fi
+
+    storage container create --name "$STATE_CONTAINER" > /dev/null
+    storage blob upload-batch --destination "$STATE_CONTAINER" --destination-path "$RESOURCE_GROUP" \
+        --source "$CONFIGS_DIR" --pattern "*.env" --overwrite > /dev/null
+    print_status "✓ Deployment state pushed to $ARTIFACT_STORAGE_ACCOUNT/$STATE_CONTAINER/$RESOURCE_GROUP"
+}
+
+# Download the stored deployment state over the local one
+pull_state() {
+    local stage=$(mktemp -d)
+
+    if ! storage blob download-batch --source "$STATE_CONTAINER" --destination "$stage" \
+        --pattern "$RESOURCE_GROUP/*.env" > /dev/null 2>&1 || ! ls "$stage/$RESOURCE_GROUP"/*.env &> /dev/null; then
+        print_status "No stored deployment state for $RESOURCE_GROUP"
+        rm -rf "$stage"
+        return 0
+    fi
+
+    mkdir -p "$CONFIGS_DIR"
+    cp "$stage/$RESOURCE_GROUP"/*.env "$CONFIGS_DIR/"
+    rm -rf "$stage"
+    print_status "✓ Deployment state pulled from $ARTIFACT_STORAGE_ACCOUNT/$STATE_CONTAINER/$RESOURCE_GROUP"
+}
+
+# Delete the stored deployment state
+delete_state() {
+    storage blob delete-batch --source "$STATE_CONTAINER" --pattern "$RESOURCE_GROUP/*" > /dev/null 2>&1 || true
+    print_status "✓ Stored deployment state of $RESOURCE_GROUP deleted"
+}
+
+# Main function
+main() {
+    if [ -z "$ARTIFACT_STORAGE_ACCOUNT" ]; then
+        print_error "ARTIFACT_STORAGE_ACCOUNT is not set"
+        show_usage
+        exit 1
+    fi
+
+    case $1 in
+        upload)
+            upload_artifacts
+            ;;
+        list)
+            list_artifacts
+            ;;
+        download)
+            download_artifacts "$2"
+            ;;
+        state)
+            case $2 in
+                push) push_state ;;
+                pull) pull_state ;;
+                delete) delete_state ;;
+                *) show_usage; exit 1 ;;
+            esac
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,269 @@
+#!/bin/bash
+
+# VM Auto-Registration Watch Script
+# Follows the WorkloadEntries istiod creates and deletes for the VMs of the
+# WorkloadGroup (auto-registration) and matches them with the VMs of the resource
+# group. It measures how long after the sidecar started each VM got registered and
+# flags running VMs that are not registered after a grace period. Results are written
+# as Prometheus metrics (optionally pushed to a Pushgateway) and as Kubernetes Events
+# of the WorkloadGroup, visible with: kubectl get events -n vm-workloads
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Watch configuration
+AUTOREG_GRACE_SECONDS="${AUTOREG_GRACE_SECONDS:-120}"    # Sidecar uptime before a missing registration is reported
+AUTOREG_CHECK_SECONDS="${AUTOREG_CHECK_SECONDS:-60}"     # Interval of the missing registration check
+PUSHGATEWAY_URL="${PUSHGATEWAY_URL:-}"                   # e.g. http://pushgateway.monitoring:9091
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+METRICS_FILE="$CONFIGS_DIR/autoreg-metrics.prom"
+
+SSH_OPTS=(-o StrictHostKeyChecking=no -o ConnectTimeout=10)
+
+# Per VM state of the watcher
+declare -A REGISTRATIONS DEREGISTRATIONS LATENCY MISSING REPORTED_MISSING
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 watch | check"
+    echo ""
+    echo "  watch   Follow auto-registered WorkloadEntries and report metrics and events until stopped"
+    echo "  check   Report the VMs of RESOURCE_GROUP ($RESOURCE_GROUP) missing a registration, exit 1 if any"
+    echo ""
+    echo "Environment:"
+    echo "  AUTOREG_GRACE_SECONDS   Sidecar uptime before a missing registration is reported (default: 120)"
+    echo "  AUTOREG_CHECK_SECONDS   Interval of the missing registration check in watch mode (default: 60)"
+    echo "  PUSHGATEWAY_URL         Prometheus Pushgateway receiving the metrics (optional)"
+}
+
+# "NAME PRIVATE_IP REACH_IP" of the running VMs of the resource group
+managed_vms() {
+    bash "$SCRIPT_DIR/vm-status.sh" list $RESOURCE_GROUP \
+        | jq -r '.[] | select(.tags["istio-warm-pool"] == null and .powerState == "VM running") | [.name, .privateIps, .publicIps] | @tsv' \
+        | while read -r name private public; do
+            local reach=$public
+            if [ "$VM_PUBLIC_IP" = false ] || [ -z "$public" ]; then
+                reach=$private
+            fi
+            echo "$name ${private%%,*} ${reach%%,*}"
+        done
+}
+
+# Epoch seconds when the sidecar of the VM last started, empty when it is not running
+sidecar_started_at() {
+    ssh -n "${SSH_OPTS[@]}" azureuser@$1 \
+        'systemctl is-active --quiet istio && date -d "$(systemctl show -p ActiveEnterTimestamp --value istio)" +%s' 2>/dev/null || true
+}
+
+# Record a Kubernetes Event on the WorkloadGroup
+emit_event() {
+    local type=$1
+    local reason=$2
+    local message=$3
+    local now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+
+    kubectl create -f - > /dev/null <<EOF || print_warning "Could not record event $reason"
+apiVersion: v1
+kind: Event
+metadata:
+  generateName: $VM_APP-autoreg-
+  namespace: $VM_NAMESPACE
+involvedObject:
+  apiVersion: networking.istio.io/v1
+  kind: WorkloadGroup
+  name: $VM_APP
+  namespace: $VM_NAMESPACE
+type: $type
+reason: $reason
+message: "$message"
+source:
+  component: istio-vm-autoreg-watch
+firstTimestamp: "$now"
+lastTimestamp: "$now"
+count: 1
+EOF
+}
+
+# Write the metrics in the Prometheus text format and push them when configured
+write_metrics() {
+    local vm
+    {
+        echo "# HELP istio_vm_autoregistrations_total WorkloadEntries auto-registered by istiod for the VM."
+        echo "# TYPE istio_vm_autoregistrations_total counter"
+        for vm in "${!REGISTRATIONS[@]}"; do
+            echo "istio_vm_autoregistrations_total{vm=\"$vm\"} ${REGISTRATIONS[$vm]}"
+        done
+        echo "# HELP istio_vm_autoderegistrations_total Auto-registered WorkloadEntries of the VM deleted by istiod."
+        echo "# TYPE istio_vm_autoderegistrations_total counter"
+        for vm in "${!DEREGISTRATIONS[@]}"; do
+            echo "istio_vm_autoderegistrations_total{vm=\"$vm\"} ${DEREGISTRATIONS[$vm]}"
+        done
+        echo "# HELP istio_vm_autoregistration_latency_seconds Seconds from sidecar start to the last registration."
+        echo "# TYPE istio_vm_autoregistration_latency_seconds gauge"
+        for vm in "${!LATENCY[@]}"; do
+            echo "istio_vm_autoregistration_latency_seconds{vm=\"$vm\"} ${LATENCY[$vm]}"
+        done
+        echo "# HELP istio_vm_autoregistration_missing 1 when the sidecar runs but the VM is not registered."
+        echo "# TYPE istio_vm_autoregistration_missing gauge"
+        for vm in "${!MISSING[@]}"; do
+            echo "istio_vm_autoregistration_missing{vm=\"$vm\"} ${MISSING[$vm]}"
+        done
+    } > "$METRICS_FILE.tmp"
+    mv "$METRICS_FILE.tmp" "$METRICS_FILE"
+
+    if [ -n "$PUSHGATEWAY_URL" ]; then
+        curl -s -f --max-time 10 --data-binary @"$METRICS_FILE" \
+            "${PUSHGATEWAY_URL%/}/metrics/job/istio_vm_autoregistration/resource_group/$RESOURCE_GROUP" > /dev/null \
+            || print_warning "Could not push metrics to $PUSHGATEWAY_URL"
+    fi
+}
+
+# Handle one watch event of an auto-registered WorkloadEntry
+handle_event() {
+    local event=$1
+    local type=$(echo "$event" | jq -r '.type')
+    local name=$(echo "$event" | jq -r '.object.metadata.name')
+    local address=$(echo "$event" | jq -r '.object.spec.address')
+    local created=$(echo "$event" | jq -r '.object.metadata.creationTimestamp | fromdateiso8601')
+
+    local vm private reach
+    read -r vm private reach < <(managed_vms | awk -v ip="$address" '$2 == ip') || true
+    if [ -z "$vm" ]; then
+        print_warning "$type $name ($address): not a VM of $RESOURCE_GROUP"
+        return 0
+    fi
+
+    case $type in
+        ADDED)
+            REGISTRATIONS[$vm]=$(( ${REGISTRATIONS[$vm]:-0} + 1 ))
+            MISSING[$vm]=0
+            REPORTED_MISSING[$vm]=""
+            local started=$(sidecar_started_at "$reach")
+            if [ -n "$started" ]; then
+                LATENCY[$vm]=$(( created > started ? created - started : 0 ))
+            fi
+            print_status "$vm registered as $name${started:+ ${LATENCY[$vm]}s after the sidecar started}"
+            emit_event Normal AutoRegistered "$vm registered as WorkloadEntry $name${started:+ in ${LATENCY[$vm]}s}"
+            ;;
+        DELETED)
+            DEREGISTRATIONS[$vm]=$(( ${DEREGISTRATIONS[$vm]:-0} + 1 ))
+            print_warning "$vm deregistered: WorkloadEntry $name deleted"
+            emit_event Normal AutoDeregistered "WorkloadEntry $name of $vm deleted"
+            ;;
+        *)
+            return 0
+            ;;
+    esac
+    write_metrics
+}
+
+# Report running sidecars without an auto-registered WorkloadEntry; returns 1 when any is missing
+check_missing() {
+    local addresses=$(kubectl get workloadentry -n $VM_NAMESPACE -o json \
+        | jq -r '.items[] | select(.metadata.annotations["istio.io/autoRegistrationGroup"] != null) | .spec.address')
+    local now=$(date +%s)
+    local missing=0 vm private reach started
+
+    while read -r vm private reach; do
+        [ -n "$vm" ] || continue
+        if echo "$addresses" | grep -qx "$private"; then
+            MISSING[$vm]=0
+            continue
+        fi
+
+        started=$(sidecar_started_at "$reach")
+        if [ -z "$started" ] || [ $((now - started)) -lt "$AUTOREG_GRACE_SECONDS" ]; then
+            MISSING[$vm]=0
+            continue
+        fi
+
+        MISSING[$vm]=1
+        missing=1
+        print_error "$vm ($private): sidecar running for $((now - started))s but no auto-registered WorkloadEntry"
+        if [ -z "${REPORTED_MISSING[$vm]}" ]; then
+            emit_event Warning AutoRegistrationMissing "$vm ($private) not registered $((now - started))s after the sidecar started"
+            REPORTED_MISSING[$vm]=1
+        fi
+    done < <(managed_vms)
+
+    write_metrics
+    return $missing
+}
+
+# Follow the auto-registered WorkloadEntries, checking for missing registrations periodically
+watch_registrations() {
+    print_status "Watching auto-registered WorkloadEntries in $VM_NAMESPACE (metrics: $METRICS_FILE)"
+    check_missing || true
+    local next_check=$((SECONDS + AUTOREG_CHECK_SECONDS))
+    local event rc
+
+    while true; do
+        rc=0
+        read -r -t 5 event || rc=$?
+        if [ $rc -eq 0 ]; then
+            handle_event "$event"
+        elif [ $rc -le 128 ]; then
+            print_error "WorkloadEntry watch ended, restart the watcher"
+            exit 1
+        fi
+
+        if [ $SECONDS -ge $next_check ]; then
+            check_missing || true
+            next_check=$((SECONDS + AUTOREG_CHECK_SECONDS))
+        fi
+    done < <(kubectl get workloadentry -n $VM_NAMESPACE --watch-only --output-watch-events -o json \
+        | jq -c --unbuffered 'select(.object.metadata.annotations["istio.io/autoRegistrationGroup"] != null)')
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to watch auto-registrations"
+        exit 1
+    fi
+    mkdir -p "$CONFIGS_DIR"
+
+    case $1 in
+        watch)
+            watch_registrations
+            ;;
+        check)
+            if check_missing; then
+                print_status "✓ Every running VM sidecar is registered"
+            else
+                exit 1
+            fi
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,147 @@
+#!/bin/bash
+
+# Consul Catalog Sync Script
+# Mirrors the VM service registration into an external Consul catalog so that
+# workloads not yet migrated to the mesh can still discover the VM service.
+# It is invoked by vm-mesh-integration.sh when the WorkloadEntry is created and by
+# setup-istio.sh when the VM is cleaned up. Requires CONSUL_HTTP_ADDR to be set.
+
+set -e
+
+# Shared configuration variables
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_VERSION="${VM_VERSION:-v1.0}"
+
+# Consul configuration (CONSUL_HTTP_TOKEN is optional)
+CONSUL_HTTP_ADDR="${CONSUL_HTTP_ADDR:-}"
+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN:-}"
+CONSUL_DATACENTER="${CONSUL_DATACENTER:-}"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 register VM_IP | deregister"
+    echo ""
+    echo "Environment:"
+    echo "  CONSUL_HTTP_ADDR     Consul HTTP API address, e.g. http://consul.example.com:8500 (required)"
+    echo "  CONSUL_HTTP_TOKEN    ACL token used for catalog writes (optional)"
+    echo "  CONSUL_DATACENTER    Consul datacenter (optional, defaults to the agent datacenter)"
+}
+
+# Call the Consul catalog API
+consul_put() {
+    local path=$1
+    local payload=$2
+    local headers=(-H "Content-Type: application/json")
+
+    if [ -n "$CONSUL_HTTP_TOKEN" ]; then
+        headers+=(-H "X-Consul-Token: $CONSUL_HTTP_TOKEN")
+    fi
+
+    curl -s -f --max-time 15 -X PUT "${headers[@]}" -d "$payload" "${CONSUL_HTTP_ADDR%/}$path" > /dev/null
+}
+
+# Register the VM node and its service in the Consul catalog
+register_service() {
+    local vm_ip=$1
+
+    if [ -z "$vm_ip" ]; then
+        print_error "VM IP is required to register the service in Consul"
+        exit 1
+    fi
+
+    print_status "Registering $VM_APP ($vm_ip) in Consul catalog at $CONSUL_HTTP_ADDR..."
+
+    local payload=$(cat <<EOF
+{
+  "Datacenter": "$CONSUL_DATACENTER",
+  "Node": "$VM_NAME",
+  "Address": "$vm_ip",
+  "NodeMeta": {
+    "azure-resource": "vm-instance",
+    "istio-namespace": "$VM_NAMESPACE"
+  },
+  "Service": {
+    "ID": "$VM_APP-$VM_NAME",
+    "Service": "$VM_APP",
+    "Address": "$vm_ip",
+    "Port": 8080,
+    "Tags": ["istio-mesh", "version-$VM_VERSION"],
+    "Meta": {
+      "istio-host": "$VM_APP.$VM_NAMESPACE.svc.cluster.local"
+    }
+  },
+  "Check": {
+    "Node": "$VM_NAME",
+    "CheckID": "service:$VM_APP-$VM_NAME",
+    "Name": "Istio mesh registration",
+    "Status": "passing",
+    "ServiceID": "$VM_APP-$VM_NAME"
+  }
+}
+EOF
+)
+
+    if consul_put "/v1/catalog/register" "$payload"; then
+        print_status "✓ $VM_APP registered in Consul as node $VM_NAME"
+    else
+        print_error "Failed to register $VM_APP in Consul"
+        exit 1
+    fi
+}
+
+# Remove the VM node (and its services) from the Consul catalog
+deregister_service() {
+    print_status "Deregistering $VM_NAME from Consul catalog at $CONSUL_HTTP_ADDR..."
+
+    local payload="{\"Datacenter\": \"$CONSUL_DATACENTER\", \"Node\": \"$VM_NAME\"}"
+
+    if consul_put "/v1/catalog/deregister" "$payload"; then
+        print_status "✓ $VM_NAME deregistered from Consul"
+    else
+        print_warning "Failed to deregister $VM_NAME from Consul, it may have already been removed"
+    fi
+}
+
+# Main function
+main() {
+    if [ -z "$CONSUL_HTTP_ADDR" ]; then
+        print_error "CONSUL_HTTP_ADDR is not set"
+        show_usage
+        exit 1
+    fi
+
+    case $1 in
+        register)
+            register_service "$2"
+            ;;
+        deregister)
+            deregister_service
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,243 @@
+#!/bin/bash
+
+# Debug Access Script
+# Opens a port of a VM (SSH by default) to a single source address for a limited time,
+# with an inbound NSG rule that names its owner and expiry in its description. The rule
+# goes to the NSG of the VM NIC and, when the subnet of the VM is locked down by
+# egress-lockdown.sh, to the egress NSG of the subnet too, which filters inbound as well. A
+# detached timer removes the rule when it expires; "sweep" removes the expired rules
+# the timer missed (machine shut down, timer killed) and runs before every other action.
+# Openings and closings are appended to an audit log.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+
+# Debug access configuration
+DEBUG_ACCESS_MINUTES="${DEBUG_ACCESS_MINUTES:-60}"
+DEBUG_ACCESS_SOURCE="${DEBUG_ACCESS_SOURCE:-}"     # CIDR or address, empty: public address of the caller
+DEBUG_ACCESS_PORT="${DEBUG_ACCESS_PORT:-22}"
+
+RULE_PREFIX="Debug-Access"
+DESCRIPTION_PREFIX="istio-debug-access"
+# Evaluated before the Allow-* rules of the VM (1001+) and any Deny rule after them
+FIRST_PRIORITY=900
+LAST_PRIORITY=999
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+AUDIT_LOG="$(dirname "$SCRIPT_DIR")/workspace/configs/debug-access-audit.log"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 open VM_NAME | close VM_NAME [RULE] | list | sweep"
+    echo ""
+    echo "  open VM_NAME          Allow DEBUG_ACCESS_PORT from DEBUG_ACCESS_SOURCE for DEBUG_ACCESS_MINUTES"
+    echo "  close VM_NAME [RULE]  Remove the debug access rules of the VM now (all, or RULE)"
+    echo "  list                  Show the debug access rules of the VMs of VM_RESOURCE_GROUP"
+    echo "  sweep                 Remove the expired debug access rules"
+    echo ""
+    echo "Environment:"
+    echo "  DEBUG_ACCESS_MINUTES  Lifetime of the rule (default: 60)"
+    echo "  DEBUG_ACCESS_SOURCE   Allowed source CIDR (default: public address of this machine)"
+    echo "  DEBUG_ACCESS_PORT     Opened port (default: 22)"
+}
+
+# Append an audit record: TIME|ACTION|VM|RULE|SOURCE|PORT|EXPIRES|USER
+audit() {
+    mkdir -p "$(dirname "$AUDIT_LOG")"
+    echo "$(date -u +%Y-%m-%dT%H:%M:%SZ)|$1|$2|$3|$4|$5|$6|$(current_user)" >> "$AUDIT_LOG"
+}
+
+current_user() {
+    az account show --query user.name -o tsv 2>/dev/null || whoami
+}
+
+# NSG of the VM NIC, or the first NSG of the resource group
+vm_nsg() {
+    local nic=$(az vm show --resource-group $VM_RESOURCE_GROUP --name "$1" --query 'networkProfile.networkInterfaces[0].id' -o tsv)
+    local nsg=$(az network nic show --ids "$nic" --query 'networkSecurityGroup.id' -o tsv | awk -F/ '{print $NF}')
+    if [ -z "$nsg" ]; then
+        nsg=$(az network nsg list --resource-group $VM_RESOURCE_GROUP --query "[0].name" -o tsv)
+    fi
+    echo "$nsg"
+}
+
+# "RG|NSG" of the egress NSG of the subnet of the VM (scripts/egress-lockdown.sh), nothing
+# when the subnet is not locked down
+subnet_egress_nsg() {
+    local nic=$(az vm show --resource-group $VM_RESOURCE_GROUP --name "$1" --query 'networkProfile.networkInterfaces[0].id' -o tsv)
+    local subnet_id=$(az network nic show --ids "$nic" --query 'ipConfigurations[0].subnet.id' -o tsv)
+    local nsg_id=$(az network vnet subnet show --ids "$subnet_id" --query 'networkSecurityGroup.id' -o tsv 2>/dev/null)
+    if [[ "$nsg_id" == *-egress-nsg ]]; then
+        echo "$nsg_id" | awk -F/ '{print $5 "|" $NF}'
+    fi
+}
+
+# "RG|NSG|RULE|SOURCE|PORT|EXPIRES|DESCRIPTION" lines of the debug access rules of the
+# resource groups of the deployment, where the VMs and their subnets are
+debug_rules() {
+    local rg
+    for rg in $({ echo "$VM_RESOURCE_GROUP"; echo "$RESOURCE_GROUP"; \
+                  az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv 2>/dev/null; } | sort -u); do
+        az network nsg list --resource-group $rg -o json | jq -r --arg rg "$rg" --arg prefix "$DESCRIPTION_PREFIX" '
+            .[] | .name as $nsg | .securityRules[] | select((.description // "") | startswith($prefix)) |
+            [$rg, $nsg, .name, (.sourceAddressPrefix // (.sourceAddressPrefixes | join(","))), .destinationPortRange,
+             (.description | capture("expires=(?<e>[0-9]+)").e), .description] | join("|")'
+    done
+}
+
+open_access() {
+    local name=$1
+    local nsg=$(vm_nsg "$name")
+    if [ -z "$nsg" ]; then
+        print_error "No NSG found for VM $name"
+        exit 1
+    fi
+
+    local source=$DEBUG_ACCESS_SOURCE
+    if [ -z "$source" ]; then
+        source=$(curl -s --max-time 10 https://api.ipify.org)
+        if [ -z "$source" ]; then
+            print_error "Could not find the public address of this machine, set the source explicitly"
+            exit 1
+        fi
+    fi
+    if [ "$source" = "*" ] || [ "$source" = "0.0.0.0/0" ] || [ "$source" = "Internet" ]; then
+        print_error "Debug access is for a single source, not $source"
+        exit 1
+    fi
+
+    # "RG|NSG" lines of the NSGs the traffic goes through, the rule gets the same priority in all
+    local nsgs=$({ echo "$VM_RESOURCE_GROUP|$nsg"; subnet_egress_nsg "$name"; } | sort -u)
+    local names=$(echo "$nsgs" | cut -d'|' -f2 | paste -sd, | sed 's/,/, /g')
+    local used=$(while IFS='|' read -r rg nsg; do
+            az network nsg rule list --resource-group $rg --nsg-name "$nsg" --query "[].priority" -o tsv
+        done <<< "$nsgs")
+    local priority=$FIRST_PRIORITY
+    while echo "$used" | grep -qx "$priority"; do
+        priority=$((priority + 1))
+        if [ $priority -gt $LAST_PRIORITY ]; then
+            print_error "No free NSG priority between $FIRST_PRIORITY and $LAST_PRIORITY in $names"
+            exit 1
+        fi
+    done
+
+    local expires=$(($(date +%s) + DEBUG_ACCESS_MINUTES * 60))
+    local rule="$RULE_PREFIX-$DEBUG_ACCESS_PORT-$priority"
+    local rg
+    while IFS='|' read -r rg nsg; do
+        az network nsg rule create --resource-group $rg --nsg-name "$nsg" --name "$rule" --priority $priority \
+            --direction Inbound --access Allow --protocol Tcp --source-address-prefixes "$source" \
+            --destination-port-ranges "$DEBUG_ACCESS_PORT" --destination-address-prefixes '*' \
+            --description "$DESCRIPTION_PREFIX vm=$name by=$(current_user) expires=$expires" > /dev/null
+
+        # Detached timer removing the rule at expiry, sweep catches it if the timer does not survive
+        nohup bash "${BASH_SOURCE[0]}" expire "$rg" "$nsg" "$rule" $((expires - $(date +%s))) > /dev/null 2>&1 &
+    done <<< "$nsgs"
+    audit open "$name" "$rule" "$source" "$DEBUG_ACCESS_PORT" "$expires"
+
+    print_status "✓ Port $DEBUG_ACCESS_PORT of $name open to $source until $(date -d @$expires '+%Y-%m-%d %H:%M %Z') (rule $rule in $names)"
+}
+
+# Delete one rule and record it; REASON is closed or expired
+delete_rule() {
+    local rg=$1 nsg=$2 rule=$3 reason=$4
+    local details
+    # Already removed, e.g. closed before its timer expired
+    details=$(az network nsg rule show --resource-group $rg --nsg-name "$nsg" --name "$rule" \
+        --query "[description, sourceAddressPrefix]" -o tsv 2>/dev/null) || return 0
+    local description source
+    IFS=$'\t' read -r description source <<< "$details"
+    local vm=$(echo "$description" | sed -n 's/.*vm=\([^ ]*\).*/\1/p')
+
+    az network nsg rule delete --resource-group $rg --nsg-name "$nsg" --name "$rule"
+    audit "$reason" "$vm" "$rule" "$source" "" ""
+    print_status "✓ Debug access rule $rule of $vm removed from $nsg ($reason)"
+}
+
+close_access() {
+    local name=$1 only=$2
+    local rg nsg rule source port expires description
+    while IFS='|' read -r rg nsg rule source port expires description; do
+        if [[ "$description" == *"vm=$name "* ]] && { [ -z "$only" ] || [ "$only" = "$rule" ]; }; then
+            delete_rule "$rg" "$nsg" "$rule" closed
+        fi
+    done < <(debug_rules)
+}
+
+sweep_expired() {
+    local now=$(date +%s)
+    local rg nsg rule source port expires description
+    while IFS='|' read -r rg nsg rule source port expires description; do
+        if [ -n "$expires" ] && [ "$expires" -le "$now" ]; then
+            delete_rule "$rg" "$nsg" "$rule" expired
+        fi
+    done < <(debug_rules)
+}
+
+list_access() {
+    local now=$(date +%s)
+    local rg nsg rule source port expires description
+    while IFS='|' read -r rg nsg rule source port expires description; do
+        echo "  $(echo "$description" | sed -n 's/.*vm=\([^ ]*\).*/\1/p'): port $port from $source," \
+            "$(echo "$description" | sed -n 's/.*by=\([^ ]*\).*/by \1/p'), $(( (expires - now) / 60 )) minutes left ($rule in $nsg)"
+    done < <(debug_rules)
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to manage debug access"
+        exit 1
+    fi
+
+    case $1 in
+        open)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            sweep_expired
+            open_access "$2"
+            ;;
+        close)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            close_access "$2" "$3"
+            ;;
+        list)
+            sweep_expired
+            list_access
+            ;;
+        sweep)
+            sweep_expired
+            ;;
+        expire)
+            # Timer started by open: RG NSG RULE SECONDS
+            sleep "$5"
+            delete_rule "$2" "$3" "$4" expired
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -8,6 +8,7 @@ set -e
 # Shared configuration variables
 VM_NAMESPACE="vm-workloads"
 VM_APP="vm-web-service"
+TRUST_DOMAIN="${TRUST_DOMAIN:-cluster.local}"
 
 # Configuration variables
 VM_SERVICE_NAME=$VM_APP
@@ -388,13 +389,13 @@ spec:
   rules:
   - from:
     - source:
-        principals: ["cluster.local/ns/mesh-test/sa/sleep"]
+        principals: ["$TRUST_DOMAIN/ns/mesh-test/sa/sleep"]
     - source:
-        principals: ["cluster.local/ns/mesh-test/sa/httpbin"]
+        principals: ["$TRUST_DOMAIN/ns/mesh-test/sa/httpbin"]
     - source:
-        principals: ["cluster.local/ns/vm-workloads/sa/vm-workload"]
+        principals: ["$TRUST_DOMAIN/ns/vm-workloads/sa/vm-workload"]
     - source:
-        principals: ["cluster.local/ns/helloworld/sa/default"]
+        principals: ["$TRUST_DOMAIN/ns/helloworld/sa/default"]
     - source:
         namespaces: ["istio-system"]
   - to:
@@ -0,0 +1,125 @@
+#!/bin/bash
+
+# Deployment Metadata Script
+# Adds the labels and annotations of the deployment to the Kubernetes manifests it
+# applies, as a filter (stdin to stdout). Every object of a multi-document manifest gets
+# them in its top-level metadata, in the existing labels/annotations block or a new one.
+# Keys the manifest sets itself keep their value. The lists come from the environment,
+# one KEY=VALUE per line.
+
+set -e
+
+# Metadata configuration
+DEPLOYMENT_LABEL_SPECS="${DEPLOYMENT_LABEL_SPECS:-}"
+DEPLOYMENT_ANNOTATION_SPECS="${DEPLOYMENT_ANNOTATION_SPECS:-}"
+
+show_usage() {
+    echo "Usage: $0 < MANIFEST"
+    echo ""
+    echo "Copies the manifest on stdin to stdout with the deployment labels and annotations added."
+    echo ""
+    echo "Environment:"
+    echo "  DEPLOYMENT_LABEL_SPECS        Labels, one KEY=VALUE per line"
+    echo "  DEPLOYMENT_ANNOTATION_SPECS   Annotations, one KEY=VALUE per line"
+}
+
+# The awk program; top-level metadata starts at "metadata:" in the first column, its
+# children are indented by two spaces and their entries by four
+METADATA_AWK='
+function load(specs, section,   n, i, lines, key) {
+    n = split(specs, lines, "\n")
+    for (i = 1; i <= n; i++) {
+        if (index(lines[i], "=") == 0) {
+            continue
+        }
+        key = substr(lines[i], 1, index(lines[i], "=") - 1)
+        keys[section, ++count[section]] = key
+        values[section, key] = substr(lines[i], index(lines[i], "=") + 1)
+    }
+}
+
+function quote(s) {
+    gsub(/\\/, "\\\\", s)
+    gsub(/"/, "\\\"", s)
+    return "\"" s "\""
+}
+
+function emit(section,   i, key) {
+    for (i = 1; i <= count[section]; i++) {
+        key = keys[section, i]
+        if (!((section, key) in seen)) {
+            print "    " quote(key) ": " quote(values[section, key])
+        }
+    }
+}
+
+function close_section() {
+    if (current != "") {
+        emit(current)
+    }
+    current = ""
+}
+
+function close_metadata() {
+    close_section()
+    if (!("labels" in present) && count["labels"] > 0) {
+        print "  labels:"
+        emit("labels")
+    }
+    if (!("annotations" in present) && count["annotations"] > 0) {
+        print "  annotations:"
+        emit("annotations")
+    }
+    in_metadata = 0
+    delete present
+    delete seen
+}
+
+BEGIN {
+    load(ENVIRON["DEPLOYMENT_LABEL_SPECS"], "labels")
+    load(ENVIRON["DEPLOYMENT_ANNOTATION_SPECS"], "annotations")
+}
+
+in_metadata {
+    if ($0 ~ /^---/ || $0 ~ /^[^ #]/) {
+        close_metadata()
+    } else if ($0 ~ /^  [^ #]/) {
+        close_section()
+        if ($0 ~ /^  (labels|annotations):[ \t]*$/) {
+            current = $1
+            sub(/:$/, "", current)
+            present[current] = 1
+        }
+    } else if (current != "" && $0 ~ /^    [^ #]/) {
+        key = $1
+        sub(/:.*$/, "", key)
+        gsub(/^["\047]|["\047]$/, "", key)
+        seen[current, key] = 1
+    }
+}
+
+/^metadata:[ \t]*$/ {
+    in_metadata = 1
+    current = ""
+}
+
+{ print }
+
+END {
+    if (in_metadata) {
+        close_metadata()
+    }
+}
+'
+
+# Main function
+main() {
+    if [ "$1" = "-h" ] || [ "$1" = "--help" ]; then
+        show_usage
+        exit 0
+    fi
+    awk "$METADATA_AWK"
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,83 @@
+#!/bin/bash
+
+# Deployment Progress Script
+# Estimates how far the in-flight deployment recorded in deployment-status.env is, from the
+# durations of the phases completed before (phase-history.log). Each phase of the command is
+# estimated by the median of its past runs in the same region and VM size, or of all its
+# runs when that region and size have none yet, so the estimate recalibrates as deployments
+# of each kind complete. Prints one JSON document, null when no deployment is running.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="${CONFIGS_DIR:-$(dirname "$SCRIPT_DIR")/workspace/configs}"
+
+# Colors for output
+RED='\033[0;31m'
+NC='\033[0m' # No Color
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+# {phase, status, command, vm, phases, percent, elapsed_seconds, eta_seconds, calibration,
+# estimates: [{phase, state, seconds, samples, basis}]}. Without history for a remaining
+# phase the percent and ETA are null
+progress_json() {
+    local status='{}'
+    if [ -f "$CONFIGS_DIR/deployment-status.env" ]; then
+        status=$(jq -Rn '[inputs | select(contains("=")) | capture("^(?<key>[^=]+)=(?<value>.*)$")] | from_entries' \
+            < "$CONFIGS_DIR/deployment-status.env")
+    fi
+
+    cat "$CONFIGS_DIR/phase-history.posted.log" "$CONFIGS_DIR/phase-history.log" 2>/dev/null \
+        | jq -Rn --argjson status "$status" --argjson now "$(date +%s)" '
+        def median: sort | .[length / 2 | floor];
+
+        if $status.LAST_PHASE_STATUS != "running" or ($status.DEPLOYMENT_PHASES // "") == "" then null else
+        [inputs | split("|") | select(.[3] == "completed") |
+            {phase: .[0], seconds: ((.[2] | tonumber) - (.[1] | tonumber)), location: .[5], size: .[6]}] as $history |
+        ($status.DEPLOYMENT_PHASES | split(",")) as $plan |
+        ($plan | index($status.LAST_PHASE)) as $current |
+        ($now - ($status.PHASE_STARTED | tonumber)) as $in_phase |
+
+        [$plan | to_entries[] | .value as $phase |
+            [$history[] | select(.phase == $phase)] as $runs |
+            [$runs[] | select(.location == $status.DEPLOYMENT_LOCATION and .size == $status.DEPLOYMENT_VM_SIZE)] as $local |
+            (if ($local | length) > 0 then {runs: $local, basis: "region"} else {runs: $runs, basis: "all"} end) as $sample |
+            {phase: $phase,
+             state: (if $current == null or .key > $current then "pending" elif .key == $current then "running" else "done" end),
+             seconds: (if ($sample.runs | length) == 0 then null else ([$sample.runs[].seconds] | median) end),
+             samples: ($sample.runs | length), basis: $sample.basis}] as $estimates |
+
+        ($estimates | all(.seconds != null)) as $known |
+        ([$estimates[] | select(.state == "running") | .seconds][0] // 0) as $phase_estimate |
+        ([$estimates[].seconds // 0] | add) as $total |
+        {phase: $status.LAST_PHASE, status: $status.LAST_PHASE_STATUS, command: $status.DEPLOYMENT_COMMAND,
+         vm: $status.DEPLOYMENT_VM, phases: $plan,
+         elapsed_seconds: ($now - ($status.DEPLOYMENT_STARTED | tonumber)),
+         eta_seconds: (if $known then
+             ([$phase_estimate - $in_phase, 0] | max) + ([$estimates[] | select(.state == "pending") | .seconds] | add // 0)
+             else null end),
+         percent: (if $known and $total > 0 then
+             (([$estimates[] | select(.state == "done") | .seconds] | add // 0) + ([$in_phase, $phase_estimate] | min))
+                 * 100 / $total | floor | [., 99] | min
+             else null end),
+         calibration: {location: $status.DEPLOYMENT_LOCATION, vm_size: $status.DEPLOYMENT_VM_SIZE,
+             region_specific: ($estimates | all(.basis == "region"))},
+         estimates: $estimates}
+        end'
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to estimate the deployment progress"
+        exit 1
+    fi
+
+    progress_json
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,178 @@
+#!/bin/bash
+
+# Public DNS Records Script
+# Creates, updates and deletes the public A records of the exposed services of a
+# deployment (ingress gateway, VM). Every record is marked as owned by the deployment
+# so that records created by others are never overwritten and teardown can find all
+# of them. Providers implement <provider>_get, <provider>_upsert, <provider>_delete
+# and <provider>_list; Azure DNS is the only one so far.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+
+# DNS configuration
+DNS_PROVIDER="${DNS_PROVIDER:-azure}"
+DNS_ZONE="${DNS_ZONE:-}"
+DNS_ZONE_RESOURCE_GROUP="${DNS_ZONE_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+DNS_TTL="${DNS_TTL:-300}"
+
+# Ownership marker stored with every record
+OWNER_KEY="istio-deployment"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 upsert NAME IP | delete NAME | delete-all | list"
+    echo ""
+    echo "  upsert NAME IP   Point NAME.DNS_ZONE to IP"
+    echo "  delete NAME      Delete NAME.DNS_ZONE when owned by the deployment"
+    echo "  delete-all       Delete every record owned by the deployment"
+    echo "  list             List the records owned by the deployment"
+    echo ""
+    echo "Environment:"
+    echo "  DNS_ZONE                  Public DNS zone, e.g. apps.example.com (required)"
+    echo "  DNS_ZONE_RESOURCE_GROUP   Resource group of the zone (default: RESOURCE_GROUP)"
+    echo "  DNS_PROVIDER              DNS provider (default: azure)"
+    echo "  DNS_TTL                   Record TTL in seconds (default: 300)"
+}
+
+# --- Azure DNS ---
+
+azure_dns() {
+    az network dns record-set a "$@" --resource-group "$DNS_ZONE_RESOURCE_GROUP" --zone-name "$DNS_ZONE"
+}
+
+# Print "OWNER|IP" of a record, nothing when it does not exist
+azure_get() {
+    azure_dns show --name "$1" -o json 2>/dev/null \
+        | jq -r --arg key "$OWNER_KEY" '"\(.metadata[$key] // "")|\((.ARecords // .arecords)[0].ipv4Address // "")"'
+}
+
+azure_upsert() {
+    local name=$1
+    local ip=$2
+    local current=$(azure_get "$name")
+
+    if [ -z "$current" ]; then
+        azure_dns create --name "$name" --ttl "$DNS_TTL" --metadata "$OWNER_KEY=$RESOURCE_GROUP" > /dev/null
+    elif [ -n "${current#*|}" ]; then
+        azure_dns remove-record --record-set-name "$name" --ipv4-address "${current#*|}" --keep-empty-record-set > /dev/null
+    fi
+    azure_dns add-record --record-set-name "$name" --ipv4-address "$ip" > /dev/null
+}
+
+azure_delete() {
+    azure_dns delete --name "$1" --yes
+}
+
+# Print "NAME IP" of the records owned by the deployment
+azure_list() {
+    azure_dns list -o json | jq -r --arg key "$OWNER_KEY" --arg owner "$RESOURCE_GROUP" \
+        '.[] | select(.metadata[$key]? == $owner) | "\(.name) \((.ARecords // .arecords)[0].ipv4Address // "")"'
+}
+
+# --- Commands ---
+
+provider() {
+    local fn="${DNS_PROVIDER}_$1"
+    shift
+    "$fn" "$@"
+}
+
+upsert_record() {
+    local name=$1
+    local ip=$2
+    local current=$(provider get "$name")
+    local owner="${current%%|*}"
+
+    if [ -n "$current" ] && [ "$owner" != "$RESOURCE_GROUP" ]; then
+        print_error "$name.$DNS_ZONE exists and is not owned by $RESOURCE_GROUP (owner: ${owner:-none}), not changing it"
+        return 1
+    fi
+    if [ "${current#*|}" = "$ip" ]; then
+        print_status "✓ $name.$DNS_ZONE already points to $ip"
+        return 0
+    fi
+
+    provider upsert "$name" "$ip"
+    print_status "✓ $name.$DNS_ZONE -> $ip"
+}
+
+delete_record() {
+    local name=$1
+    local current=$(provider get "$name")
+
+    if [ -z "$current" ]; then
+        return 0
+    fi
+    if [ "${current%%|*}" != "$RESOURCE_GROUP" ]; then
+        print_warning "$name.$DNS_ZONE is not owned by $RESOURCE_GROUP, keeping it"
+        return 0
+    fi
+
+    provider delete "$name"
+    print_status "✓ $name.$DNS_ZONE deleted"
+}
+
+# Main function
+main() {
+    if [ -z "$DNS_ZONE" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to manage DNS records"
+        exit 1
+    fi
+    if ! declare -F "${DNS_PROVIDER}_upsert" > /dev/null; then
+        print_error "Unknown DNS provider: $DNS_PROVIDER (valid: azure)"
+        exit 1
+    fi
+
+    case $1 in
+        upsert)
+            [ -n "$3" ] || { show_usage; exit 1; }
+            upsert_record "$2" "$3"
+            ;;
+        delete)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            delete_record "$2"
+            ;;
+        delete-all)
+            local name ip
+            provider list | while read -r name ip; do
+                delete_record "$name"
+            done
+            ;;
+        list)
+            provider list | while read -r name ip; do
+                echo "$name.$DNS_ZONE $ip"
+            done
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,398 @@
+#!/bin/bash
+
+# Egress Lockdown Script
+# Restricts the outbound traffic of the VM subnets to what the mesh needs ("mesh-only"
+# profile). The allowed destinations are discovered on every run, so re-running apply
+# follows endpoint changes (new gateway address, registry data endpoints):
+#   Egress-Mesh      istiod and the east-west gateway (15012, 15017, 15021, 15443)
+#   Egress-ACR       login and data endpoints of the container registries (443), with
+#                    Egress-ACR-Storage for the storage of registries without data endpoints
+#   Egress-Storage   blob endpoints of the storage accounts, e.g. a package mirror (443)
+#   Egress-AzureAD   Entra ID, for the managed identity and AAD SSH login (443)
+#   Egress-Extra     EGRESS_ALLOW CIDRs (80, 443), and Egress-Extra-<n> per service tag
+#   Egress-Deny-Internet   everything else to the Internet
+# A rule takes several address prefixes or a single service tag, so every service tag
+# gets a rule of its own, at the priorities following the one of its group.
+# The rules live in a subnet NSG. The VM network, its peerings, Azure DNS and IMDS stay
+# reachable. Only subnets of VNets in the resource group of the VM (created by the
+# setup) are locked down. open and close add and remove Maintenance-Internet, which lets
+# the package downloads of patch and upgrade-sidecars through while they run.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+LOCATION="${LOCATION:-eastus}"
+
+# Egress configuration
+EGRESS_ACRS="${EGRESS_ACRS:-}"                           # Container registry names
+EGRESS_STORAGE_ACCOUNTS="${EGRESS_STORAGE_ACCOUNTS:-}"   # Storage account names
+EGRESS_ALLOW="${EGRESS_ALLOW:-}"                         # Extra CIDRs or service tags, comma separated
+
+PROFILE_TAG="istio-egress-profile"
+FIRST_PRIORITY=3000
+MAINTENANCE_PRIORITY=3990
+DENY_PRIORITY=4000
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 endpoints | plan [VM...] | apply [VM...] | remove [VM...] | open [VM...] | close [VM...]"
+    echo ""
+    echo "  endpoints        Print the discovered destinations as JSON"
+    echo "  plan [VM...]     Show the rule changes of the locked down subnets and the subnets of the VMs"
+    echo "  apply [VM...]    Lock down the subnets of the VMs and refresh the locked down subnets"
+    echo "  remove [VM...]   Remove the lockdown of the subnets of the VMs (default: all)"
+    echo "  open [VM...]     Allow HTTP/HTTPS to the Internet from the locked down subnets of the VMs (default: all)"
+    echo "  close [VM...]    Remove that opening"
+    echo ""
+    echo "Environment:"
+    echo "  EGRESS_ACRS               Container registries the VMs pull from"
+    echo "  EGRESS_STORAGE_ACCOUNTS   Storage accounts the VMs download from"
+    echo "  EGRESS_ALLOW              Extra destinations, CIDRs or service tags"
+}
+
+# IPv4 addresses of a host name, as /32 prefixes
+resolve_host() {
+    getent ahostsv4 "$1" 2>/dev/null | awk '{print $1 "/32"}' | sort -u
+}
+
+# East-west gateway address, which is also istiod unless it is exposed with a Private Endpoint
+gateway_address() {
+    kubectl get svc istio-eastwestgateway -n istio-system -o jsonpath='{.status.loadBalancer.ingress[0].ip}' 2>/dev/null
+}
+
+# Private Endpoint addresses of istiod in the VM resource groups
+istiod_private_addresses() {
+    local rg
+    for rg in $(vm_resource_groups); do
+        az network private-endpoint list --resource-group "$rg" \
+            --query "[?ends_with(name, '-istiod-pe')].customDnsConfigs[].ipAddresses[]" -o tsv 2>/dev/null
+    done | sed 's|$|/32|' | sort -u
+}
+
+acr_destinations() {
+    local acr
+    for acr in $EGRESS_ACRS; do
+        local endpoints=$(az acr show-endpoints --name "$acr" --query "[loginServer, dataEndpoints[].endpoint][]" -o tsv 2>/dev/null)
+        if [ -z "$endpoints" ]; then
+            print_warning "Container registry $acr not found"
+            continue
+        fi
+        local host
+        for host in $endpoints; do
+            resolve_host "$host"
+        done
+        if [ "$(echo "$endpoints" | wc -l)" -eq 1 ]; then
+            # Layers come from the storage of the registry, only known as a region
+            local region=$(az acr show --name "$acr" --query location -o tsv 2>/dev/null)
+            region=${region:-$LOCATION}
+            print_warning "Registry $acr has no dedicated data endpoints (az acr update --data-endpoint-enabled), allowing Storage.$region"
+            echo "Storage.$region"
+        fi
+    done | sort -u
+}
+
+storage_destinations() {
+    local account
+    for account in $EGRESS_STORAGE_ACCOUNTS; do
+        local blob=$(az storage account show --name "$account" --query primaryEndpoints.blob -o tsv 2>/dev/null)
+        if [ -z "$blob" ]; then
+            print_warning "Storage account $account not found"
+            continue
+        fi
+        blob=${blob#https://}
+        resolve_host "${blob%/}"
+    done | sort -u
+}
+
+# Discovered destinations as JSON
+endpoints() {
+    local gateway=$(gateway_address)
+    jq -n --arg gateway "$gateway" --arg istiod "$(istiod_private_addresses)" \
+        --arg acr "$(acr_destinations)" --arg storage "$(storage_destinations)" --arg extra "${EGRESS_ALLOW//,/ }" '
+        def list: split("\n") | map(split(" ")[]) | map(select(. != ""));
+        {mesh: ((if $gateway != "" then ["\($gateway)/32"] else [] end) + ($istiod | list) | unique),
+         acr: ($acr | list), storage: ($storage | list), azuread: ["AzureActiveDirectory"], extra: ($extra | list)}'
+}
+
+# "NAME|PRIORITY|ACCESS|PORTS|DESTINATIONS" lines of the profile, without the rules that have
+# nothing to allow. The service tags of a group with a tag suffix get their own rules,
+# named GROUP-SUFFIX (GROUP-SUFFIX-<n> when there are several) or GROUP-<n> without suffix
+desired_rules() {
+    echo "$ENDPOINTS" | jq -r --argjson first $FIRST_PRIORITY --argjson deny $DENY_PRIORITY '
+        def prefix: test("^[0-9a-fA-F.:]+(/[0-9]+)?$");
+        ([["Egress-Mesh", .mesh, "15012 15017 15021 15443", null], ["Egress-ACR", .acr, "443", "Storage"],
+          ["Egress-Storage", .storage, "443", null], ["Egress-AzureAD", .azuread, "443", null], ["Egress-Extra", .extra, "80 443", ""]]
+         | to_entries[] | ($first + .key * 10) as $priority | .value as [$name, $destinations, $ports, $suffix]
+         | if $suffix == null then
+               select($destinations | length > 0) | "\($name)|\($priority)|Allow|\($ports)|\($destinations | sort | join(" "))"
+           else
+               ($destinations | map(select(prefix)) | sort) as $prefixes
+               | ($destinations | map(select(prefix | not)) | sort) as $tags
+               | (select($prefixes | length > 0) | "\($name)|\($priority)|Allow|\($ports)|\($prefixes | join(" "))"),
+                 ($tags | to_entries[]
+                     | (if $suffix == "" then "\($name)-\(.key + 1)"
+                        elif ($tags | length) > 1 then "\($name)-\($suffix)-\(.key + 1)"
+                        else "\($name)-\($suffix)" end) as $rule
+                     | "\($rule)|\($priority + 1 + .key)|Allow|\($ports)|\(.value)")
+           end),
+        "Egress-Deny-Internet|\($deny)|Deny|*|Internet"'
+}
+
+# Same lines for the rules of an NSG
+current_rules() {
+    az network nsg rule list --resource-group "$1" --nsg-name "$2" -o json | jq -r '
+        .[] | select(.direction == "Outbound" and (.name | startswith("Egress-"))) |
+        ([.destinationAddressPrefix // empty] + (.destinationAddressPrefixes // []) | map(select(. != "")) | sort | join(" ")) as $dest |
+        ([.destinationPortRange // empty] + (.destinationPortRanges // []) | map(select(. != "")) | join(" ")) as $ports |
+        "\(.name)|\(.priority)|\(.access)|\($ports)|\($dest)"'
+}
+
+# "RG|VNET|SUBNET" of the subnet of a VM
+vm_subnet() {
+    local nic=$(az vm show --resource-group $VM_RESOURCE_GROUP --name "$1" --query 'networkProfile.networkInterfaces[0].id' -o tsv)
+    local subnet_id=$(az network nic show --ids "$nic" --query 'ipConfigurations[0].subnet.id' -o tsv)
+    echo "$subnet_id" | awk -F/ '{print $5 "|" $(NF-2) "|" $NF}'
+}
+
+# Resource groups holding the VMs of the deployment
+vm_resource_groups() {
+    { echo "$RESOURCE_GROUP"; echo "$VM_RESOURCE_GROUP"; \
+      az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv 2>/dev/null; } | sort -u
+}
+
+# "RG|VNET|SUBNET" of the subnets of the given VMs
+vm_subnets() {
+    local vm
+    for vm in "$@"; do
+        vm_subnet "$vm"
+    done
+}
+
+# "RG|VNET|SUBNET" of the subnets already locked down
+locked_subnets() {
+    local rg
+    for rg in $(vm_resource_groups); do
+        az network nsg list --resource-group "$rg" --query "[?tags.\"$PROFILE_TAG\"].subnets[].id" -o tsv 2>/dev/null \
+            | awk -F/ '{print $5 "|" $(NF-2) "|" $NF}'
+    done
+}
+
+# NSG of the subnet, created and associated when the subnet has none and CREATE is true
+subnet_nsg() {
+    local rg=$1 vnet=$2 subnet=$3 create=$4
+    local nsg=$(az network vnet subnet show --resource-group "$rg" --vnet-name "$vnet" --name "$subnet" \
+        --query 'networkSecurityGroup.id' -o tsv | awk -F/ '{print $NF}')
+    if [ -z "$nsg" ] && [ "$create" = true ]; then
+        nsg="$subnet-egress-nsg"
+        az network nsg create --resource-group "$rg" --name "$nsg" --location $LOCATION > /dev/null
+        subnet_inbound_rules "$rg" "$nsg"
+        az network vnet subnet update --resource-group "$rg" --vnet-name "$vnet" --name "$subnet" \
+            --network-security-group "$nsg" > /dev/null
+        print_status "NSG $nsg created for subnet $vnet/$subnet" >&2
+    elif [ "$create" = true ] && [ "$nsg" = "$subnet-egress-nsg" ]; then
+        subnet_inbound_rules "$rg" "$nsg"
+    fi
+    echo "$nsg"
+}
+
+# Inbound rules of a subnet NSG created for the lockdown. A NIC without NSG of its own is
+# only filtered by them, so they allow the VM network and the NSG rule sources of the VMs
+# (scripts/nsg-sources.sh), not the Internet. VirtualNetwork is a service tag, which a
+# rule cannot mix with other prefixes, so it has a rule of its own
+subnet_inbound_rules() {
+    local rg=$1 nsg=$2
+    local ssh_sources mesh_sources
+    ssh_sources=$(bash "$SCRIPT_DIR/nsg-sources.sh" resolve ssh) || exit 1
+    mesh_sources=$(bash "$SCRIPT_DIR/nsg-sources.sh" resolve mesh) || exit 1
+    mesh_sources=$(echo $mesh_sources | tr ' ' '\n' | grep -vx VirtualNetwork || true)
+    if [ -n "$mesh_sources" ]; then
+        az network nsg rule create --resource-group "$rg" --nsg-name "$nsg" --name Allow-Inbound-Mesh --priority 4000 \
+            --direction Inbound --access Allow --protocol '*' --source-address-prefixes $mesh_sources \
+            --destination-address-prefixes '*' --destination-port-ranges '*' > /dev/null
+    else
+        az network nsg rule delete --resource-group "$rg" --nsg-name "$nsg" --name Allow-Inbound-Mesh &> /dev/null || true
+    fi
+    az network nsg rule create --resource-group "$rg" --nsg-name "$nsg" --name Allow-Inbound-VNet --priority 4020 \
+        --direction Inbound --access Allow --protocol '*' --source-address-prefixes VirtualNetwork \
+        --destination-address-prefixes '*' --destination-port-ranges '*' > /dev/null
+    az network nsg rule create --resource-group "$rg" --nsg-name "$nsg" --name Allow-Inbound-SSH --priority 4010 \
+        --direction Inbound --access Allow --protocol Tcp --source-address-prefixes $ssh_sources \
+        --destination-address-prefixes '*' --destination-port-ranges 22 > /dev/null
+    # Created by older versions
+    az network nsg rule delete --resource-group "$rg" --nsg-name "$nsg" --name Allow-Inbound-All &> /dev/null || true
+}
+
+# Allow HTTP/HTTPS to the Internet from a locked down subnet, above the deny rule
+open_subnet() {
+    local rg=$1 vnet=$2 subnet=$3
+    local nsg=$(subnet_nsg "$rg" "$vnet" "$subnet" false)
+    [ -n "$nsg" ] || return 0
+    az network nsg rule create --resource-group "$rg" --nsg-name "$nsg" --name Maintenance-Internet \
+        --priority $MAINTENANCE_PRIORITY --direction Outbound --access Allow --protocol Tcp \
+        --source-address-prefixes VirtualNetwork --source-port-ranges '*' \
+        --destination-address-prefixes Internet --destination-port-ranges 80 443 \
+        --description "$PROFILE_TAG maintenance, opened $(date -u +%Y-%m-%dT%H:%M:%SZ)" > /dev/null
+    print_status "✓ $vnet/$subnet open to the Internet (HTTP/HTTPS) for the maintenance"
+}
+
+close_subnet() {
+    local rg=$1 vnet=$2 subnet=$3
+    local nsg=$(subnet_nsg "$rg" "$vnet" "$subnet" false)
+    [ -n "$nsg" ] || return 0
+    if az network nsg rule show --resource-group "$rg" --nsg-name "$nsg" --name Maintenance-Internet &> /dev/null; then
+        az network nsg rule delete --resource-group "$rg" --nsg-name "$nsg" --name Maintenance-Internet
+        print_status "✓ $vnet/$subnet locked down again"
+    fi
+}
+
+# Bring the rules of one subnet to the profile, or print the changes when APPLY is false
+lockdown_subnet() {
+    local rg=$1 vnet=$2 subnet=$3 apply=$4
+    if ! vm_resource_groups | grep -qx "$rg"; then
+        print_warning "Subnet $vnet/$subnet is in $rg, not created by the setup, skipping"
+        return 0
+    fi
+
+    local nsg
+    nsg=$(subnet_nsg "$rg" "$vnet" "$subnet" "$apply")
+    local current=""
+    if [ -n "$nsg" ]; then
+        current=$(current_rules "$rg" "$nsg")
+    fi
+    local desired=$(desired_rules)
+
+    local name priority access ports destinations changed=0
+    while IFS='|' read -r name priority access ports destinations; do
+        if echo "$current" | grep -qxF "$name|$priority|$access|$ports|$destinations"; then
+            continue
+        fi
+        changed=1
+        if [ "$apply" != true ]; then
+            echo "  ~ $vnet/$subnet $name: $access $ports to $destinations"
+            continue
+        fi
+        az network nsg rule create --resource-group "$rg" --nsg-name "$nsg" --name "$name" --priority $priority \
+            --direction Outbound --access $access --protocol $([ "$access" = Deny ] && echo '*' || echo Tcp) \
+            --source-address-prefixes VirtualNetwork --source-port-ranges '*' \
+            --destination-address-prefixes $destinations --destination-port-ranges $ports \
+            --description "$PROFILE_TAG mesh-only" > /dev/null
+        print_status "✓ $vnet/$subnet $name: $access $ports to $destinations"
+    done <<< "$desired"
+
+    # Rules of destinations that went away
+    while IFS='|' read -r name priority access ports destinations; do
+        [ -n "$name" ] || continue
+        if ! echo "$desired" | grep -q "^$name|"; then
+            changed=1
+            if [ "$apply" = true ]; then
+                az network nsg rule delete --resource-group "$rg" --nsg-name "$nsg" --name "$name"
+                print_status "✓ $vnet/$subnet $name removed"
+            else
+                echo "  - $vnet/$subnet $name"
+            fi
+        fi
+    done <<< "$current"
+
+    if [ "$apply" = true ]; then
+        az network nsg update --resource-group "$rg" --name "$nsg" --set "tags.$PROFILE_TAG=mesh-only" > /dev/null
+    elif [ $changed -eq 0 ]; then
+        echo "  = $vnet/$subnet up to date"
+    fi
+}
+
+remove_lockdown() {
+    local rg=$1 vnet=$2 subnet=$3
+    local nsg=$(subnet_nsg "$rg" "$vnet" "$subnet" false)
+    [ -n "$nsg" ] || return 0
+
+    local name rest
+    while IFS='|' read -r name rest; do
+        [ -n "$name" ] || continue
+        az network nsg rule delete --resource-group "$rg" --nsg-name "$nsg" --name "$name"
+    done < <(current_rules "$rg" "$nsg")
+    az network nsg update --resource-group "$rg" --name "$nsg" --remove "tags.$PROFILE_TAG" > /dev/null
+    print_status "✓ Egress lockdown removed from $vnet/$subnet"
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required for the egress lockdown"
+        exit 1
+    fi
+
+    local action=$1
+    shift || true
+    case $action in
+        endpoints)
+            endpoints
+            ;;
+        open|close)
+            # Only the subnets that are locked down, of the VMs or all of them
+            local subnets=$(locked_subnets | sort -u)
+            if [ $# -gt 0 ]; then
+                subnets=$(comm -12 <(echo "$subnets") <(vm_subnets "$@" | sort -u))
+            fi
+            local rg vnet subnet
+            while IFS='|' read -r rg vnet subnet; do
+                [ -n "$subnet" ] || continue
+                ${action}_subnet "$rg" "$vnet" "$subnet"
+            done <<< "$subnets"
+            ;;
+        plan|apply|remove)
+            local subnets
+            if [ "$action" = remove ] && [ $# -gt 0 ]; then
+                subnets=$(vm_subnets "$@")
+            else
+                subnets=$({ vm_subnets "$@"; locked_subnets; } | sort -u)
+            fi
+            if [ -z "$subnets" ]; then
+                print_status "No locked down subnet"
+                return 0
+            fi
+            if [ "$action" != remove ]; then
+                ENDPOINTS=$(endpoints)
+                if [ "$(echo "$ENDPOINTS" | jq '.mesh | length')" -eq 0 ]; then
+                    print_error "East-west gateway address not found, the VMs would lose the mesh"
+                    exit 1
+                fi
+            fi
+            local rg vnet subnet
+            while IFS='|' read -r rg vnet subnet; do
+                case $action in
+                    plan) lockdown_subnet "$rg" "$vnet" "$subnet" false ;;
+                    apply) lockdown_subnet "$rg" "$vnet" "$subnet" true ;;
+                    remove) remove_lockdown "$rg" "$vnet" "$subnet" ;;
+                esac
+            done <<< "$subnets"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,89 @@
+#!/bin/bash
+
+# Fleet Plan Script
+# Compares a declarative fleet spec (JSON) with the VMs of the resource group
+# managed by the fleet (tag istio-fleet=managed, or FLEET_TAG_VALUE) and prints the
+# plan needed to converge, one action per line:
+#   create|NAME|SIZE|TAGS|INTEGRATION_MODE|MESH_MODE
+#   resize|NAME|CURRENT_SIZE|SIZE
+#   retag|NAME|TAGS
+#   delete|NAME
+# TAGS are space separated key=value pairs, merged into the other tags of the VM. VMs with
+# "count" N are named NAME-1..NAME-N.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+FLEET_TAG="istio-fleet"
+# Owner of the VMs: fleet apply (managed) or the operator mode (operator) never touch
+# each other's VMs
+FLEET_TAG_VALUE="${FLEET_TAG_VALUE:-managed}"
+
+# Colors for output
+RED='\033[0;31m'
+NC='\033[0m' # No Color
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+# Expand the spec into one desired VM per line: NAME|SIZE|TAGS|INTEGRATION_MODE|MESH_MODE
+desired_vms() {
+    jq -r --arg tag "$FLEET_TAG" --arg owner "$FLEET_TAG_VALUE" '
+        .vms[] | . as $vm |
+        (if (.count // 1) > 1 then [range(1; .count + 1) | "\($vm.name)-\(.)"] else [.name] end)[] |
+        [., ($vm.size // "Standard_B2s"),
+         ((($vm.tags // {}) + {($tag): $owner}) | to_entries | map("\(.key)=\(.value)") | join(" ")),
+         ($vm.mesh.integration_mode // "istio"), ($vm.mesh.mesh_mode // "sidecar")] | join("|")' "$1"
+}
+
+# Main function
+main() {
+    local spec=$1
+
+    if [ ! -f "$spec" ]; then
+        print_error "Fleet spec not found: $spec"
+        exit 1
+    fi
+
+    if ! jq -e '.vms | type == "array"' "$spec" > /dev/null 2>&1; then
+        print_error "Invalid fleet spec, expected {\"vms\": [...]}: $spec"
+        exit 1
+    fi
+
+    local current=$(az vm list --resource-group $RESOURCE_GROUP \
+        --query "[?tags.\"$FLEET_TAG\"=='$FLEET_TAG_VALUE'].{name: name, size: hardwareProfile.vmSize, tags: tags}" -o json)
+
+    local name size tags integration_mode mesh_mode
+    while IFS='|' read -r name size tags integration_mode mesh_mode; do
+        local vm=$(echo "$current" | jq -c --arg n "$name" '.[] | select(.name == $n)')
+        if [ -z "$vm" ]; then
+            echo "create|$name|$size|$tags|$integration_mode|$mesh_mode"
+            continue
+        fi
+
+        local current_size=$(echo "$vm" | jq -r '.size')
+        if [ "$current_size" != "$size" ]; then
+            echo "resize|$name|$current_size|$size"
+        fi
+
+        # Only the tags of the spec: setup adds its own (deployment labels, group) to the VMs
+        local changed_tags=$(echo "$vm" | jq -r --arg tags "$tags" '(.tags // {}) as $current |
+            [$tags | split(" ")[] | select(contains("=")) | capture("^(?<key>[^=]+)=(?<value>.*)$")
+                | select($current[.key] != .value)] | length')
+        if [ "$changed_tags" -gt 0 ]; then
+            echo "retag|$name|$tags"
+        fi
+    done < <(desired_vms "$spec")
+
+    local desired_names=$(desired_vms "$spec" | cut -d'|' -f1)
+    echo "$current" | jq -r '.[].name' | while read -r name; do
+        if ! echo "$desired_names" | grep -qx "$name"; then
+            echo "delete|$name"
+        fi
+    done
+}
+
+# Run main function
+main "$@"
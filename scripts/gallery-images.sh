@@ -0,0 +1,268 @@
+#!/bin/bash
+
+# Gallery Images Script
+# Manages the versions of the Azure Compute Gallery image definition the VMs are created
+# from (GALLERY_IMAGE): lists them with the VMs and scale sets that use them, assigns
+# release channels (the version tag istio-channel, e.g. stable or canary, held by one
+# version at a time) and prunes old versions. Pruning keeps the IMAGE_KEEP newest
+# versions, the versions holding a channel and every version a VM or scale set of the
+# subscription still uses. "build" bakes a new version: a temporary VM created from
+# IMAGE_BASE gets the sidecar package and the bake spec of the warm pool, is generalized
+# and captured into the definition, then its resource group is deleted.
+
+set -e
+
+# Image configuration
+GALLERY_IMAGE="${GALLERY_IMAGE:-}"
+IMAGE_KEEP="${IMAGE_KEEP:-5}"
+IMAGE_BASE="${IMAGE_BASE:-Ubuntu2204}"
+
+# Build VM configuration
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+LOCATION="${LOCATION:-westus}"
+VM_SIZE="${VM_SIZE:-Standard_B2s}"
+BAKE_SPEC="${BAKE_SPEC:-}"
+
+CHANNEL_TAG="istio-channel"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1" >&2
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 list | tag VERSION CHANNEL | untag VERSION | resolve CHANNEL | prune [apply] | build VERSION [CHANNEL]"
+    echo ""
+    echo "  list                  Show the versions with their channel and the VMs using them"
+    echo "  tag VERSION CHANNEL   Move CHANNEL (e.g. stable, canary) to VERSION"
+    echo "  untag VERSION         Remove the channel of VERSION"
+    echo "  resolve CHANNEL       Print the ID of the version holding CHANNEL"
+    echo "  prune [apply]         Show the versions retention would delete, delete them with apply"
+    echo "  build VERSION [CH]    Bake IMAGE_BASE with the sidecar into VERSION, and move CH to it"
+    echo ""
+    echo "Environment:"
+    echo "  GALLERY_IMAGE   Image definition ID: .../galleries/GALLERY/images/DEFINITION (required)"
+    echo "  IMAGE_KEEP      Newest versions always kept by prune (default: 5)"
+    echo "  IMAGE_BASE      Image the build VM is created from (default: Ubuntu2204)"
+    echo "  BAKE_SPEC       Provisioners run on the build VM after the sidecar package (default: none)"
+}
+
+# az sig arguments of the image definition
+sig_args() {
+    local gallery_rg=$(echo "$GALLERY_IMAGE" | awk -F/ '{print $5}')
+    local gallery=$(echo "$GALLERY_IMAGE" | awk -F/ '{print $(NF-2)}')
+    local image=$(echo "$GALLERY_IMAGE" | awk -F/ '{print $NF}')
+    echo "--resource-group $gallery_rg --gallery-name $gallery --gallery-image-definition $image"
+}
+
+# Versions of the image definition, newest first, as [{name, id, published, channel, exclude_from_latest, state}]
+image_versions() {
+    az sig image-version list $(sig_args) -o json | jq -c --arg tag "$CHANNEL_TAG" '
+        [.[] | {name, id, published: (.publishingProfile.publishedDate // ""),
+                channel: (.tags[$tag] // ""), exclude_from_latest: (.publishingProfile.excludeFromLatest // false),
+                state: .provisioningState}] | sort_by(.published) | reverse'
+}
+
+# Versions of the definition used by the VMs and scale sets of the subscription, as
+# {version: [resource names]}. A VM created from the definition records the exact version
+used_versions() {
+    {
+        az vm list --query "[].{name: name, id: storageProfile.imageReference.id, version: storageProfile.imageReference.exactVersion}" -o json
+        az vmss list --query "[].{name: name, id: virtualMachineProfile.storageProfile.imageReference.id, version: null}" -o json
+    } | jq -s -c --arg definition "$GALLERY_IMAGE" '
+        ($definition | ascii_downcase) as $prefix |
+        [add[] | select(.id != null and (.id | ascii_downcase | startswith($prefix)))
+            | {name, version: (if (.id | test("/versions/"; "i")) then (.id | split("/") | last) else .version end)}
+            | select(.version != null)]
+        | group_by(.version) | map({key: .[0].version, value: map(.name)}) | from_entries'
+}
+
+# Versions with their users and whether retention deletes them
+versions_json() {
+    local versions=$(image_versions)
+    local used=$(used_versions)
+    jq -c --argjson used "$used" --argjson keep "$IMAGE_KEEP" '
+        to_entries | map(.value + {used_by: ($used[.value.name] // []),
+            prune: (.key >= $keep and .value.channel == "" and ($used[.value.name] // [] | length) == 0)})' <<< "$versions"
+}
+
+list_versions() {
+    local versions=$(versions_json)
+    printf "%-14s %-22s %-10s %-10s %s\n" "VERSION" "PUBLISHED" "CHANNEL" "STATE" "USED BY"
+    jq -r '.[] | [.name, (.published | .[0:19]), (if .channel == "" then "-" else .channel end), .state,
+                  (if (.used_by | length) == 0 then "-" else (.used_by | join(",")) end)] | @tsv' <<< "$versions" \
+        | while IFS=$'\t' read -r name published channel state used; do
+            printf "%-14s %-22s %-10s %-10s %s\n" "$name" "$published" "$channel" "$state" "$used"
+        done
+}
+
+# Move a channel to a version: the versions holding it lose it first
+tag_version() {
+    local version=$1
+    local channel=$2
+    if [ -z "$version" ] || [ -z "$channel" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! az sig image-version show $(sig_args) --gallery-image-version "$version" &> /dev/null; then
+        print_error "Version $version not found in ${GALLERY_IMAGE##*/}"
+        exit 1
+    fi
+
+    local holder
+    for holder in $(image_versions | jq -r --arg channel "$channel" '.[] | select(.channel == $channel) | .name'); do
+        if [ "$holder" != "$version" ]; then
+            az sig image-version update $(sig_args) --gallery-image-version "$holder" --remove "tags.$CHANNEL_TAG" > /dev/null
+            print_status "$channel removed from $holder"
+        fi
+    done
+    az sig image-version update $(sig_args) --gallery-image-version "$version" --set "tags.$CHANNEL_TAG=$channel" > /dev/null
+    print_status "✓ $version is now $channel"
+}
+
+untag_version() {
+    if [ -z "$1" ]; then
+        show_usage
+        exit 1
+    fi
+    az sig image-version update $(sig_args) --gallery-image-version "$1" --remove "tags.$CHANNEL_TAG" > /dev/null
+    print_status "✓ $1 has no channel"
+}
+
+# ID of the version holding a channel, for --vm-image
+resolve_channel() {
+    local id=$(image_versions | jq -r --arg channel "$1" '[.[] | select(.channel == $channel)][0].id // empty')
+    if [ -z "$id" ]; then
+        print_error "No version of ${GALLERY_IMAGE##*/} holds channel $1, set it with: tag VERSION $1"
+        exit 1
+    fi
+    echo "$id"
+}
+
+prune_versions() {
+    local versions=$(versions_json)
+    local candidates=$(jq -r '.[] | select(.prune) | .name' <<< "$versions")
+    if [ -z "$candidates" ]; then
+        print_status "✓ Nothing to prune: $(jq 'length' <<< "$versions") version(s), $IMAGE_KEEP newest kept, channels and versions in use kept"
+        return 0
+    fi
+
+    local version
+    for version in $candidates; do
+        if [ "$1" = "apply" ]; then
+            print_status "Deleting version $version..."
+            az sig image-version delete $(sig_args) --gallery-image-version "$version"
+        else
+            print_status "Would delete version $version"
+        fi
+    done
+    if [ "$1" = "apply" ]; then
+        print_status "✓ $(echo "$candidates" | wc -l | tr -d ' ') version(s) deleted"
+    else
+        print_status "Run 'prune apply' to delete these $(echo "$candidates" | wc -l | tr -d ' ') version(s)"
+    fi
+}
+
+# Bake a new version: build VM in its own resource group, deprovisioned, generalized and
+# captured. A failed build keeps the resource group for inspection
+build_version() {
+    local version=$1
+    local channel=$2
+    if [[ ! "$version" =~ ^[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+        print_error "Version must be MAJOR.MINOR.PATCH, e.g. 1.0.0"
+        exit 1
+    fi
+    if az sig image-version show $(sig_args) --gallery-image-version "$version" &> /dev/null; then
+        print_error "Version $version already exists in ${GALLERY_IMAGE##*/}"
+        exit 1
+    fi
+    if [ "$(az resource show --ids "$GALLERY_IMAGE" --query properties.osState -o tsv 2>/dev/null)" != "Generalized" ]; then
+        print_error "${GALLERY_IMAGE##*/} must be a generalized image definition to build versions into it"
+        exit 1
+    fi
+
+    local build_rg="$RESOURCE_GROUP-image-$(echo "$version" | tr . -)"
+    local name="image-build"
+    print_status "Building version $version of ${GALLERY_IMAGE##*/} from $IMAGE_BASE in $build_rg..."
+    az group create --name "$build_rg" --location $LOCATION --tags istio-deployment=$RESOURCE_GROUP > /dev/null
+
+    if ! RESOURCE_GROUP=$build_rg LOCATION=$LOCATION VM_SIZE=$VM_SIZE VM_IMAGE=$IMAGE_BASE BAKE_SPEC=$BAKE_SPEC \
+            bash "$SCRIPT_DIR/warm-pool.sh" bake "$name" >&2; then
+        print_error "Build failed, $build_rg is kept for inspection: az group delete --name $build_rg"
+        exit 1
+    fi
+
+    print_status "Generalizing $name..."
+    local vm_ip=$(az vm show -d -g "$build_rg" -n "$name" --query publicIps -o tsv)
+    ssh -o StrictHostKeyChecking=no azureuser@$vm_ip "sudo waagent -deprovision+user -force" > /dev/null 2>&1 || true
+    az vm deallocate --resource-group "$build_rg" --name "$name"
+    az vm generalize --resource-group "$build_rg" --name "$name"
+
+    print_status "Capturing $name into version $version..."
+    if ! az sig image-version create $(sig_args) --gallery-image-version "$version" \
+            --virtual-machine "$(az vm show -g "$build_rg" -n "$name" --query id -o tsv)" > /dev/null; then
+        print_error "Capture failed, $build_rg is kept for inspection: az group delete --name $build_rg"
+        exit 1
+    fi
+
+    az group delete --name "$build_rg" --yes --no-wait
+    print_status "✓ Version $version built, $build_rg is being deleted"
+    if [ -n "$channel" ]; then
+        tag_version "$version" "$channel"
+    fi
+}
+
+# Main function
+main() {
+    if [[ "$GALLERY_IMAGE" != */galleries/*/images/* ]] || [[ "$GALLERY_IMAGE" == */versions/* ]]; then
+        print_error "GALLERY_IMAGE must be an image definition ID: .../galleries/GALLERY/images/DEFINITION"
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to manage gallery images"
+        exit 1
+    fi
+
+    case $1 in
+        list)
+            list_versions
+            ;;
+        tag)
+            tag_version "$2" "$3"
+            ;;
+        untag)
+            untag_version "$2"
+            ;;
+        resolve)
+            resolve_channel "$2"
+            ;;
+        prune)
+            prune_versions "$2"
+            ;;
+        build)
+            build_version "$2" "$3"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
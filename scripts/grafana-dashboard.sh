@@ -0,0 +1,211 @@
+#!/bin/bash
+
+# Grafana Dashboard Provisioning Script
+# Creates or updates, through the Grafana HTTP API, a dashboard per environment
+# (resource group) with the VM sidecar metrics scraped by Prometheus, and posts
+# the recorded deployment phases as annotations so their durations are visible,
+# and the reconciliation passes that found drift (scripts/mesh-reconcile.sh).
+# "annotate" only posts the annotations.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+
+# Grafana configuration: without GRAFANA_URL the Grafana addon is port-forwarded
+GRAFANA_URL="${GRAFANA_URL:-}"
+GRAFANA_API_TOKEN="${GRAFANA_API_TOKEN:-}"
+GRAFANA_LOCAL_PORT="${GRAFANA_LOCAL_PORT:-13000}"
+GRAFANA_FOLDER_UID="istio-vms"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+# Call the Grafana HTTP API
+grafana_api() {
+    local method=$1
+    local path=$2
+    local payload=$3
+    local headers=(-H "Content-Type: application/json")
+
+    if [ -n "$GRAFANA_API_TOKEN" ]; then
+        headers+=(-H "Authorization: Bearer $GRAFANA_API_TOKEN")
+    fi
+
+    curl -s -f --max-time 15 -X "$method" "${headers[@]}" ${payload:+-d "$payload"} "${GRAFANA_URL%/}$path"
+}
+
+# Port-forward the Grafana addon when no GRAFANA_URL is given
+connect_grafana() {
+    if [ -n "$GRAFANA_URL" ]; then
+        return 0
+    fi
+
+    if ! kubectl get svc grafana -n istio-system &> /dev/null; then
+        print_warning "Grafana addon not found in istio-system, skipping dashboard provisioning"
+        exit 0
+    fi
+
+    kubectl port-forward -n istio-system svc/grafana "$GRAFANA_LOCAL_PORT:3000" &> /dev/null &
+    PORT_FORWARD_PID=$!
+    trap 'kill $PORT_FORWARD_PID 2>/dev/null || true' EXIT
+    GRAFANA_URL="http://localhost:$GRAFANA_LOCAL_PORT"
+
+    local i
+    for i in {1..15}; do
+        if grafana_api GET /api/health > /dev/null 2>&1; then
+            return 0
+        fi
+        sleep 1
+    done
+
+    print_error "Grafana is not reachable at $GRAFANA_URL"
+    exit 1
+}
+
+# Grafana timeseries panel with a single PromQL query
+panel() {
+    local id=$1
+    local title=$2
+    local unit=$3
+    local expr=$4
+    local x=$(( (id - 1) % 2 * 12 ))
+    local y=$(( (id - 1) / 2 * 8 ))
+
+    cat <<EOF
+{
+  "id": $id,
+  "type": "timeseries",
+  "title": "$title",
+  "datasource": {"type": "prometheus", "uid": "\${datasource}"},
+  "gridPos": {"h": 8, "w": 12, "x": $x, "y": $y},
+  "fieldConfig": {"defaults": {"unit": "$unit"}, "overrides": []},
+  "targets": [{"refId": "A", "expr": "$expr", "legendFormat": "{{instance}}"}]
+}
+EOF
+}
+
+# Create or update the dashboard of the environment
+provision_dashboard() {
+    local selector="job=\\\"kubernetes-service-endpoints\\\", namespace=\\\"$VM_NAMESPACE\\\", instance=~\\\"\$instance\\\""
+    local uid="istio-vms-$(printf '%s' "$RESOURCE_GROUP" | tr -c 'a-zA-Z0-9-' '-' | cut -c1-30)"
+
+    grafana_api POST /api/folders "{\"uid\": \"$GRAFANA_FOLDER_UID\", \"title\": \"Istio VMs\"}" > /dev/null 2>&1 || true
+
+    local payload=$(cat <<EOF
+{
+  "folderUid": "$GRAFANA_FOLDER_UID",
+  "overwrite": true,
+  "message": "Provisioned by istio-azure-setup",
+  "dashboard": {
+    "uid": "$uid",
+    "title": "Istio VMs ($RESOURCE_GROUP)",
+    "tags": ["istio", "vm", "$RESOURCE_GROUP"],
+    "timezone": "browser",
+    "refresh": "30s",
+    "time": {"from": "now-6h", "to": "now"},
+    "templating": {"list": [
+      {"name": "datasource", "type": "datasource", "query": "prometheus"},
+      {"name": "instance", "type": "query", "datasource": {"type": "prometheus", "uid": "\${datasource}"},
+       "query": "label_values(up{job=\"kubernetes-service-endpoints\", namespace=\"$VM_NAMESPACE\"}, instance)",
+       "includeAll": true, "multi": true, "refresh": 2}
+    ]},
+    "annotations": {"list": [
+      {"name": "Deployments", "enable": true, "iconColor": "blue",
+       "datasource": {"type": "grafana", "uid": "-- Grafana --"},
+       "target": {"type": "tags", "tags": ["istio-vm-deploy", "$RESOURCE_GROUP"], "matchAny": false}},
+      {"name": "Reconciliation drift", "enable": true, "iconColor": "orange",
+       "datasource": {"type": "grafana", "uid": "-- Grafana --"},
+       "target": {"type": "tags", "tags": ["istio-vm-drift", "$RESOURCE_GROUP"], "matchAny": false}}
+    ]},
+    "panels": [
+      $(panel 1 "Sidecar up" "none" "up{$selector}"),
+      $(panel 2 "Inbound requests" "reqps" "sum by (instance) (rate(istio_requests_total{reporter=\\\"destination\\\", $selector}[5m]))"),
+      $(panel 3 "Inbound P99 latency" "ms" "histogram_quantile(0.99, sum by (le, instance) (rate(istio_request_duration_milliseconds_bucket{reporter=\\\"destination\\\", $selector}[5m])))"),
+      $(panel 4 "Inbound 5xx ratio" "percentunit" "sum by (instance) (rate(istio_requests_total{reporter=\\\"destination\\\", response_code=~\\\"5..\\\", $selector}[5m])) / sum by (instance) (rate(istio_requests_total{reporter=\\\"destination\\\", $selector}[5m]))"),
+      $(panel 5 "Sidecar memory" "bytes" "envoy_server_memory_allocated{$selector}"),
+      $(panel 6 "Sidecar CPU" "percentunit" "rate(istio_agent_process_cpu_seconds_total{$selector}[5m])")
+    ]
+  }
+}
+EOF
+)
+
+    if grafana_api POST /api/dashboards/db "$payload" > /dev/null; then
+        print_status "✓ Dashboard 'Istio VMs ($RESOURCE_GROUP)' provisioned: ${GRAFANA_URL%/}/d/$uid"
+    else
+        print_error "Failed to provision the Grafana dashboard"
+        exit 1
+    fi
+}
+
+# Post the recorded deployment phases as region annotations, each phase only once
+post_phase_annotations() {
+    local history="$CONFIGS_DIR/phase-history.log"
+    if [ ! -s "$history" ]; then
+        return 0
+    fi
+
+    local phase started ended status vm posted=0
+    while IFS='|' read -r phase started ended status vm _; do
+        local payload="{\"time\": $((started * 1000)), \"timeEnd\": $((ended * 1000)), \"tags\": [\"istio-vm-deploy\", \"$RESOURCE_GROUP\", \"$phase\", \"$status\"], \"text\": \"$vm: $phase $status in $((ended - started))s\"}"
+        if grafana_api POST /api/annotations "$payload" > /dev/null; then
+            posted=$((posted + 1))
+        fi
+    done < "$history"
+
+    cat "$history" >> "$CONFIGS_DIR/phase-history.posted.log"
+    rm -f "$history"
+    print_status "✓ $posted deployment phase annotation(s) posted"
+}
+
+# Post the last reconciliation pass as an annotation when it found drift, each pass only once
+post_drift_annotation() {
+    local drift="$CONFIGS_DIR/mesh-drift.json"
+    local posted="$CONFIGS_DIR/mesh-drift.posted"
+    if [ ! -s "$drift" ] || ! command -v jq &> /dev/null || [ "$(jq -r '.drift' "$drift")" = 0 ] \
+        || [ "$(jq -r '.checked' "$drift")" = "$(cat "$posted" 2>/dev/null)" ]; then
+        return 0
+    fi
+
+    local payload=$(jq -c --arg rg "$RESOURCE_GROUP" '{time: (.checked | fromdateiso8601 * 1000),
+        tags: (["istio-vm-drift", $rg] + ([.mismatches[].type] | unique)),
+        text: ("\(.drift) mismatch(es): " + ([.mismatches | group_by(.type)[] | "\(length) \(.[0].type)"] | join(", "))
+            + "; " + ([.mismatches | group_by(.action)[] | "\(length) \(.[0].action)"] | join(", ")))}' "$drift")
+    if grafana_api POST /api/annotations "$payload" > /dev/null; then
+        jq -r '.checked' "$drift" > "$posted"
+        print_status "✓ Reconciliation drift annotation posted"
+    fi
+}
+
+# Main function
+main() {
+    connect_grafana
+    if [ "$1" != "annotate" ]; then
+        provision_dashboard
+    fi
+    post_phase_annotations
+    post_drift_annotation
+}
+
+# Run main function
+main "$@"
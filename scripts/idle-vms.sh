@@ -0,0 +1,241 @@
+#!/bin/bash
+
+# Idle VMs Script
+# Finds the VMs of the deployment that served no mesh traffic for IDLE_MINUTES, from the
+# istio_requests_total metrics Prometheus scrapes from their sidecars, and deallocates
+# the ones that opted in with the tag istio-idle=deallocate. A deallocated VM is drained
+# from the mesh first and tagged istio-idle=deallocated. "wake" starts it again and puts
+# it back in the mesh once healthy, for the given VMs or for each VM name received on
+# the wake queue, so a client or an alert can bring a VM back on demand.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+
+# Idle configuration
+IDLE_MINUTES="${IDLE_MINUTES:-60}"
+PROMETHEUS_URL="${PROMETHEUS_URL:-}"                # Without it the Prometheus addon is port-forwarded
+PROMETHEUS_LOCAL_PORT="${PROMETHEUS_LOCAL_PORT:-19090}"
+EVENTS_STORAGE_ACCOUNT="${EVENTS_STORAGE_ACCOUNT:-}"
+WAKE_QUEUE="${WAKE_QUEUE:-istio-vm-wake}"
+
+IDLE_TAG="istio-idle"
+POOL_TAG="istio-warm-pool"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 report | apply | wake [VM_NAME...] | wake-watch"
+    echo ""
+    echo "  report       Show the requests each running VM served in the last IDLE_MINUTES"
+    echo "  apply        Drain and deallocate the idle VMs tagged $IDLE_TAG=deallocate"
+    echo "  wake [VM]    Start the given VMs, or every VM deallocated by apply, and undrain them"
+    echo "  wake-watch   Wake each VM whose name is sent to the wake queue, until stopped"
+    echo ""
+    echo "Environment:"
+    echo "  IDLE_MINUTES             Minutes without requests for a VM to be idle (default: 60)"
+    echo "  PROMETHEUS_URL           Prometheus scraping the VM sidecars (default: port-forward of the addon)"
+    echo "  EVENTS_STORAGE_ACCOUNT   Storage account of the wake queue (wake-watch)"
+    echo "  WAKE_QUEUE               Wake queue name (default: istio-vm-wake)"
+}
+
+# Port-forward the Prometheus addon when no PROMETHEUS_URL is given
+connect_prometheus() {
+    if [ -n "$PROMETHEUS_URL" ]; then
+        return 0
+    fi
+
+    if ! kubectl get svc prometheus -n istio-system &> /dev/null; then
+        print_error "Prometheus addon not found in istio-system, install it or set PROMETHEUS_URL"
+        exit 1
+    fi
+
+    kubectl port-forward -n istio-system svc/prometheus "$PROMETHEUS_LOCAL_PORT:9090" &> /dev/null &
+    PORT_FORWARD_PID=$!
+    trap 'kill $PORT_FORWARD_PID 2>/dev/null || true' EXIT
+    PROMETHEUS_URL="http://localhost:$PROMETHEUS_LOCAL_PORT"
+
+    local i
+    for i in {1..15}; do
+        if curl -s -f --max-time 5 "$PROMETHEUS_URL/-/ready" > /dev/null 2>&1; then
+            return 0
+        fi
+        sleep 1
+    done
+
+    print_error "Prometheus is not reachable at $PROMETHEUS_URL"
+    exit 1
+}
+
+# Instant query, the result as {address: value} with the port of the instance removed
+prometheus_by_address() {
+    curl -s -f --max-time 30 "${PROMETHEUS_URL%/}/api/v1/query" --data-urlencode "query=$1" \
+        | jq -c '[.data.result[] | {key: (.metric.instance | sub(":[0-9]+$"; "")), value: (.value[1] | tonumber)}] | from_entries'
+}
+
+# VMs of the deployment: RESOURCE_GROUP and the resource groups of its VMs
+deployment_vms() {
+    local rgs=$({ echo "$RESOURCE_GROUP"; az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv 2>/dev/null; })
+    RESOURCE_GROUP=$RESOURCE_GROUP bash "$SCRIPT_DIR/vm-status.sh" list $rgs
+}
+
+# Running VMs as [{name, resourceGroup, policy, requests, status}]. Every VM is a target of
+# the metrics Service of its application through an EndpointSlice of its own, so several
+# VMs of one application are judged one by one. A VM Prometheus did not scrape
+# IDLE_MINUTES ago has not been up long enough to be judged, its status is unknown
+idle_json() {
+    local selector="job=\"kubernetes-service-endpoints\", namespace=\"$VM_NAMESPACE\""
+    local scraped requests
+    scraped=$(prometheus_by_address "up{$selector} offset ${IDLE_MINUTES}m")
+    requests=$(prometheus_by_address "sum by (instance) (increase(istio_requests_total{reporter=\"destination\", $selector}[${IDLE_MINUTES}m]))")
+
+    deployment_vms | jq -c --argjson scraped "$scraped" --argjson requests "$requests" \
+        --arg idle_tag "$IDLE_TAG" --arg pool_tag "$POOL_TAG" '
+        [.[] | select(.powerState == "VM running" and .tags[$pool_tag] == null)
+            | ((.privateIps | split(",")) + (.publicIps | split(",")) | map(select(. != ""))) as $addresses
+            | ([$addresses[] | $requests[.] // empty] | add) as $count
+            | {name, resourceGroup, policy: (.tags[$idle_tag] // ""), requests: ($count // 0),
+               status: (if ([$addresses[] | $scraped[.] // empty] | length) == 0 then "unknown"
+                        elif ($count // 0) < 1 then "idle" else "active" end)}]'
+}
+
+# Table of the running VMs and their traffic
+show_idle() {
+    printf "%-30s %-26s %-12s %-10s %s\n" "VM" "RESOURCE GROUP" "REQUESTS" "STATUS" "POLICY"
+    jq -r '.[] | [.name, .resourceGroup, (.requests | floor | tostring), .status, (if .policy == "" then "-" else .policy end)] | @tsv' <<< "$1" \
+        | while IFS=$'\t' read -r name rg count status policy; do
+            printf "%-30s %-26s %-12s %-10s %s\n" "$name" "$rg" "$count" "$status" "$policy"
+        done
+}
+
+# Run a power action of patch-vm.sh on a VM of another resource group
+power() {
+    RESOURCE_GROUP=$3 bash "$SCRIPT_DIR/patch-vm.sh" "$1" "$2"
+}
+
+# Drain and deallocate the idle VMs that opted in
+apply_idle() {
+    local report=$1
+    local name rg deallocated=0
+    while IFS=$'\t' read -r name rg; do
+        print_status "$name served no requests in ${IDLE_MINUTES}m, deallocating it"
+        if power deallocate "$name" "$rg"; then
+            az vm update --resource-group $rg --name "$name" --set "tags.$IDLE_TAG=deallocated" > /dev/null \
+                || print_warning "Could not tag $name with $IDLE_TAG=deallocated, wake will need its name"
+            deallocated=$((deallocated + 1))
+        else
+            print_warning "Could not deallocate $name"
+        fi
+    done < <(jq -r '.[] | select(.status == "idle" and .policy == "deallocate") | [.name, .resourceGroup] | @tsv' <<< "$report")
+    print_status "✓ $deallocated idle VM(s) deallocated"
+}
+
+# Start a VM and put it back in the mesh, restoring its opt-in tag
+wake_vm() {
+    local name=$1
+    local rg=$(deployment_vms | jq -r --arg name "$name" '.[] | select(.name == $name) | .resourceGroup' | head -1)
+    if [ -z "$rg" ]; then
+        print_warning "VM $name is not a VM of $RESOURCE_GROUP, not woken"
+        return 0
+    fi
+
+    print_status "Waking $name..."
+    power start "$name" "$rg" || return 1
+    if [ "$(az vm show --resource-group $rg --name "$name" --query "tags.\"$IDLE_TAG\"" -o tsv 2>/dev/null)" = "deallocated" ]; then
+        az vm update --resource-group $rg --name "$name" --set "tags.$IDLE_TAG=deallocate" > /dev/null \
+            || print_warning "Could not tag $name with $IDLE_TAG=deallocate"
+    fi
+}
+
+# Wake the VMs named in the messages of the wake queue, removing them once handled
+watch_wake_queue() {
+    if [ -z "$EVENTS_STORAGE_ACCOUNT" ]; then
+        print_error "The wake queue needs a Storage account: EVENTS_STORAGE_ACCOUNT (--events-storage)"
+        exit 1
+    fi
+    az storage queue create --name "$WAKE_QUEUE" --account-name "$EVENTS_STORAGE_ACCOUNT" --auth-mode login > /dev/null
+    print_status "Waiting for VM names on queue $WAKE_QUEUE of $EVENTS_STORAGE_ACCOUNT (Ctrl+C to stop)"
+
+    local messages id receipt name
+    while true; do
+        messages=$(az storage message get --queue-name "$WAKE_QUEUE" --num-messages 32 --visibility-timeout 600 \
+            --account-name "$EVENTS_STORAGE_ACCOUNT" --auth-mode login -o json 2>/dev/null || echo '[]')
+        # The messages are read on their own descriptor, waking a VM runs ssh
+        while IFS='|' read -r -u 3 id receipt name; do
+            [ -n "$id" ] || continue
+            # A failed wake is retried when the message becomes visible again
+            if wake_vm "$name"; then
+                az storage message delete --queue-name "$WAKE_QUEUE" --id "$id" --pop-receipt "$receipt" \
+                    --account-name "$EVENTS_STORAGE_ACCOUNT" --auth-mode login > /dev/null
+            fi
+        done 3< <(jq -r '.[] | "\(.id)|\(.popReceipt)|\(.content | gsub("\\s"; ""))"' <<< "$messages")
+        sleep 5
+    done
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to find idle VMs"
+        exit 1
+    fi
+
+    local report name
+    case $1 in
+        report)
+            connect_prometheus
+            show_idle "$(idle_json)"
+            ;;
+        apply)
+            connect_prometheus
+            report=$(idle_json)
+            show_idle "$report"
+            echo ""
+            apply_idle "$report"
+            ;;
+        wake)
+            shift
+            local vms=("$@")
+            if [ ${#vms[@]} -eq 0 ]; then
+                vms=($(deployment_vms | jq -r --arg idle_tag "$IDLE_TAG" '.[] | select(.tags[$idle_tag] == "deallocated") | .name'))
+            fi
+            if [ ${#vms[@]} -eq 0 ]; then
+                print_status "No VM deallocated by the idle policy"
+                return 0
+            fi
+            for name in "${vms[@]}"; do
+                wake_vm "$name"
+            done
+            ;;
+        wake-watch)
+            watch_wake_queue
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,102 @@
+#!/bin/bash
+
+# VM Image Drift Script
+# Compares the image version each VM was created from with the latest version of
+# the same image: the marketplace image (publisher:offer:sku) or the Azure Compute
+# Gallery image definition. VMs behind the latest version are reported as drifted.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+LOCATION="${LOCATION:-westus}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+DRIFT_FILE="$CONFIGS_DIR/image-drift.env"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+# Latest version of the image a VM was created from
+latest_image_version() {
+    local image_ref=$1
+    local image_id=$(echo "$image_ref" | jq -r '.id // empty')
+
+    if [ -n "$image_id" ]; then
+        # Gallery image: .../galleries/G/images/D[/versions/V]
+        local definition="${image_id%/versions/*}"
+        local gallery=$(echo "$definition" | awk -F/ '{print $(NF-2)}')
+        local gallery_rg=$(echo "$definition" | awk -F/ '{print $5}')
+        local image=$(echo "$definition" | awk -F/ '{print $NF}')
+        az sig image-version list --resource-group "$gallery_rg" --gallery-name "$gallery" \
+            --gallery-image-definition "$image" \
+            --query "[?publishingProfile.excludeFromLatest!=\`true\`] | sort_by(@, &publishingProfile.publishedDate)[-1].name" -o tsv 2>/dev/null
+    else
+        local urn=$(echo "$image_ref" | jq -r '"\(.publisher):\(.offer):\(.sku):latest"')
+        az vm image show --location "$LOCATION" --urn "$urn" --query name -o tsv 2>/dev/null
+    fi
+}
+
+# Report the current and latest image version of every VM, drifted VMs go to DRIFT_FILE
+check_drift() {
+    local vms=$(az vm list --resource-group $RESOURCE_GROUP \
+        --query "[?tags.\"istio-warm-pool\"==null].{name: name, image: storageProfile.imageReference}" -o json)
+    local drifted=()
+
+    printf "%-30s %-24s %-24s %s\n" "VM" "CURRENT" "LATEST" "STATUS"
+    local name image_ref current latest status
+    while read -r name; do
+        image_ref=$(echo "$vms" | jq -c --arg n "$name" '.[] | select(.name == $n) | .image')
+        current=$(echo "$image_ref" | jq -r '.exactVersion // (.id // "" | split("/versions/")[1]) // "unknown"')
+        latest=$(latest_image_version "$image_ref")
+
+        if [ -z "$latest" ] || [ "$current" = "unknown" ]; then
+            status="unknown"
+        elif [ "$(printf '%s\n%s\n' "$current" "$latest" | sort -V | tail -1)" != "$current" ]; then
+            status="drifted"
+            drifted+=("$name")
+        else
+            status="current"
+        fi
+        printf "%-30s %-24s %-24s %s\n" "$name" "$current" "${latest:-unknown}" "$status"
+    done < <(echo "$vms" | jq -r '.[].name')
+
+    mkdir -p "$CONFIGS_DIR"
+    echo "DRIFTED_VMS=\"${drifted[*]}\"" > "$DRIFT_FILE"
+    echo "DRIFT_CHECKED=$(date -u +%Y-%m-%dT%H:%M:%SZ)" >> "$DRIFT_FILE"
+
+    if [ ${#drifted[@]} -gt 0 ]; then
+        print_warning "${#drifted[@]} VM(s) behind the latest image: ${drifted[*]}"
+        return 2
+    fi
+    print_status "✓ All VMs run the latest image version"
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to check image drift"
+        exit 1
+    fi
+
+    check_drift
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,59 @@
+#!/bin/bash
+
+# JUnit Report Script
+# Converts a JSON report of setup-istio.sh to JUnit XML on stdout, so CI pipelines can
+# publish it as test results. Two reports are understood:
+#   verification   {suite, vm, finished, checks: [{name, type, result, detail, seconds}]}
+#   deployment     {command, vm, finished, steps: [{name, type, result, seconds}]}
+# A check or step is a test case; "failed" and "timed_out" results are failures.
+
+set -e
+
+# Colors for output
+RED='\033[0;31m'
+NC='\033[0m' # No Color
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 REPORT"
+    echo ""
+    echo "Prints the JUnit XML of the verification or deployment JSON report REPORT."
+}
+
+# Main function
+main() {
+    if [ -z "$1" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to convert reports"
+        exit 1
+    fi
+    if [ ! -f "$1" ]; then
+        print_error "Report not found: $1"
+        exit 1
+    fi
+
+    jq -r '
+        def esc: tostring | @html;
+        def failed: .result == "failed" or .result == "timed_out";
+        (.checks // .steps // []) as $cases |
+        (if .suite then "verification-\(.suite)" else "deployment-\(.command)" end) as $name |
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>",
+        "<testsuites>",
+        "  <testsuite name=\"\($name | esc)\" tests=\"\($cases | length)\" failures=\"\([$cases[] | select(failed)] | length)\" time=\"\([$cases[].seconds // 0] | add // 0)\" timestamp=\"\(.finished // "" | esc)\">",
+        "    <properties><property name=\"vm\" value=\"\(.vm | esc)\"/></properties>",
+        ($cases[] |
+            "    <testcase classname=\"\($name | esc).\(.type | esc)\" name=\"\(.name | esc)\" time=\"\(.seconds // 0)\"" +
+            (if failed then ">\n      <failure message=\"\(.result | esc)\">\(.detail // "" | esc)</failure>\n    </testcase>"
+             else "/>" end)),
+        "  </testsuite>",
+        "</testsuites>"' "$1"
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,194 @@
+#!/bin/bash
+
+# VM Service Load Test Script
+# Runs a short Fortio load test through the mesh against the VM service, to check the
+# capacity of newly onboarded VMs before production traffic is shifted to them. The
+# requests go from a Fortio client with a sidecar in the mesh-test namespace (created
+# on first use) to the Service of the VM application, so they take the same mTLS path
+# as in-cluster clients and spread across every endpoint of the service. The requests and
+# errors of each endpoint, from the Envoy stats of the client sidecar, show the share of
+# the VM. The result (QPS, latency percentiles, error rate, endpoints) is printed as JSON
+# and gated on thresholds.
+
+set -e
+
+# Shared configuration variables
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_IP="${VM_IP:-}"
+
+# Load test configuration
+LOADTEST_QPS="${LOADTEST_QPS:-50}"
+LOADTEST_DURATION="${LOADTEST_DURATION:-30}"            # Seconds
+LOADTEST_CONNECTIONS="${LOADTEST_CONNECTIONS:-8}"
+LOADTEST_PORT="${LOADTEST_PORT:-8080}"
+LOADTEST_PATH="${LOADTEST_PATH:-/}"
+LOADTEST_MAX_ERROR_RATE="${LOADTEST_MAX_ERROR_RATE:-0.01}"
+LOADTEST_MAX_P99_MS="${LOADTEST_MAX_P99_MS:-0}"          # 0: no latency limit
+
+CLIENT_NAMESPACE="mesh-test"
+FORTIO_IMAGE="fortio/fortio:1.66.5"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1" >&2
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 [run]"
+    echo ""
+    echo "Load tests $VM_APP.$VM_NAMESPACE through the mesh and prints the result as JSON,"
+    echo "exit code 1 when the error rate or the P99 latency is above its limit."
+    echo ""
+    echo "Environment:"
+    echo "  VM_IP                     Address of the VM, which must be registered in the mesh"
+    echo "  LOADTEST_QPS              Requests per second, 0 for as fast as possible (default: 50)"
+    echo "  LOADTEST_DURATION         Seconds (default: 30)"
+    echo "  LOADTEST_CONNECTIONS      Parallel connections (default: 8)"
+    echo "  LOADTEST_PORT / _PATH     Port and path of the requests (default: 8080 /)"
+    echo "  LOADTEST_MAX_ERROR_RATE   Share of non 2xx responses allowed (default: 0.01)"
+    echo "  LOADTEST_MAX_P99_MS       P99 latency allowed in ms (default: 0, no limit)"
+}
+
+# The VM must be an endpoint of the service, or the test says nothing about it
+check_vm_registered() {
+    if [ -z "$VM_IP" ]; then
+        return 0
+    fi
+    local entries=$(kubectl get workloadentry -n $VM_NAMESPACE -o json 2>/dev/null | jq -r --arg ip "$VM_IP" \
+        '[.items[] | select(.spec.address == $ip) | .metadata.name] | join(" ")')
+    if [ -z "$entries" ]; then
+        print_error "VM $VM_NAME ($VM_IP) has no WorkloadEntry in $VM_NAMESPACE, it is not in the mesh"
+        exit 1
+    fi
+    print_status "✓ VM $VM_NAME registered as $entries"
+}
+
+# Fortio client with a sidecar, kept between runs like the sleep pod
+deploy_fortio() {
+    if kubectl get deployment fortio -n $CLIENT_NAMESPACE &> /dev/null; then
+        return 0
+    fi
+    if ! kubectl get namespace $CLIENT_NAMESPACE &> /dev/null; then
+        print_error "Namespace $CLIENT_NAMESPACE not found, please execute: ./setup-istio.sh deploy-mesh-test"
+        exit 1
+    fi
+
+    print_status "Deploying the Fortio load test client in $CLIENT_NAMESPACE..."
+    kubectl apply -f - > /dev/null <<EOF
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: fortio
+  namespace: $CLIENT_NAMESPACE
+  labels:
+    app: fortio
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: fortio
+  template:
+    metadata:
+      labels:
+        app: fortio
+    spec:
+      containers:
+      - name: fortio
+        image: $FORTIO_IMAGE
+        args: ["server"]
+        resources:
+          requests:
+            cpu: 500m
+            memory: 128Mi
+EOF
+    kubectl rollout status deployment/fortio -n $CLIENT_NAMESPACE --timeout=180s > /dev/null
+}
+
+# Requests and errors so far of each endpoint of the VM service, as seen by the sidecar of
+# the Fortio client: {"ADDRESS:PORT": {requests, errors}}
+endpoint_stats() {
+    kubectl exec deployment/fortio -n $CLIENT_NAMESPACE -c istio-proxy -- pilot-agent request GET clusters 2>/dev/null \
+        | awk -F'::' -v cluster="outbound|$LOADTEST_PORT||$VM_APP.$VM_NAMESPACE.svc.cluster.local" \
+            '$1 == cluster && ($3 == "rq_total" || $3 == "rq_error") { print $2, $3, $4 }' \
+        | jq -R -s '[split("\n")[] | select(. != "") | split(" ")]
+            | reduce .[] as [$address, $stat, $value] ({}; .[$address][if $stat == "rq_total" then "requests" else "errors" end] = ($value | tonumber))'
+}
+
+# Run the load test, print the summary as JSON; returns 1 when a limit is exceeded
+run_load_test() {
+    local url="http://$VM_APP.$VM_NAMESPACE:$LOADTEST_PORT$LOADTEST_PATH"
+    print_status "Load testing $url: ${LOADTEST_QPS} QPS, $LOADTEST_CONNECTIONS connections, ${LOADTEST_DURATION}s..."
+
+    local before=$(endpoint_stats)
+    local result
+    if ! result=$(kubectl exec deployment/fortio -n $CLIENT_NAMESPACE -c fortio -- fortio load -quiet \
+        -qps "$LOADTEST_QPS" -c "$LOADTEST_CONNECTIONS" -t "${LOADTEST_DURATION}s" -p "50,90,95,99" -json - "$url" 2>/dev/null); then
+        print_error "Fortio could not run the load test against $url"
+        exit 1
+    fi
+    local endpoints=$(jq -n --argjson before "$before" --argjson after "$(endpoint_stats)" '$after
+        | with_entries(.value = {requests: ((.value.requests // 0) - ($before[.key].requests // 0)),
+                                 errors: ((.value.errors // 0) - ($before[.key].errors // 0))})
+        | with_entries(select(.value.requests > 0))')
+
+    echo "$result" | jq --arg vm "$VM_NAME" --arg vm_ip "$VM_IP" --arg url "$url" --argjson endpoints "$endpoints" \
+        --argjson max_error_rate "$LOADTEST_MAX_ERROR_RATE" --argjson max_p99_ms "$LOADTEST_MAX_P99_MS" '
+        (.DurationHistogram.Count) as $requests |
+        ([.RetCodes | to_entries[] | select(.key | test("^2")) | .value] | add // 0) as $ok |
+        (if $requests > 0 then ($requests - $ok) / $requests else 1 end) as $error_rate |
+        ([.DurationHistogram.Percentiles[] | {key: "p\(.Percentile)", value: (.Value * 1000 * 100 | round / 100)}] | from_entries) as $latency |
+        {vm: $vm, url: $url, started: .StartTime, requested_qps: .RequestedQPS, actual_qps: (.ActualQPS * 100 | round / 100),
+         connections: .NumThreads, requests: $requests, status_codes: .RetCodes,
+         error_rate: ($error_rate * 10000 | round / 10000), latency_ms: ($latency + {avg: (.DurationHistogram.Avg * 1000 * 100 | round / 100),
+         max: (.DurationHistogram.Max * 1000 * 100 | round / 100)}),
+         endpoints: $endpoints,
+         vm_requests: (if $vm_ip == "" then null else ([$endpoints | to_entries[] | select(.key | startswith($vm_ip + ":")) | .value.requests] | add // 0) end),
+         limits: {error_rate: $max_error_rate, p99_ms: (if $max_p99_ms > 0 then $max_p99_ms else null end)},
+         passed: ($error_rate <= $max_error_rate and ($max_p99_ms == 0 or $latency.p99 <= $max_p99_ms))}'
+}
+
+# Main function
+main() {
+    if [ -n "$1" ] && [ "$1" != "run" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to summarize the load test"
+        exit 1
+    fi
+
+    check_vm_registered
+    deploy_fortio
+
+    local summary
+    summary=$(run_load_test)
+    echo "$summary"
+
+    if [ "$(echo "$summary" | jq -r .passed)" != true ]; then
+        print_error "Load test above its limits: error rate $(echo "$summary" | jq -r .error_rate) (max $LOADTEST_MAX_ERROR_RATE), P99 $(echo "$summary" | jq -r .latency_ms.p99)ms (max ${LOADTEST_MAX_P99_MS}ms)"
+        exit 1
+    fi
+    if [ "$(echo "$summary" | jq -r .vm_requests)" = 0 ]; then
+        print_warning "VM $VM_NAME ($VM_IP) served none of the requests, they went to $(echo "$summary" | jq -r '.endpoints | keys | join(", ")')"
+    fi
+    print_status "✅ $(echo "$summary" | jq -r '"\(.requests) requests at \(.actual_qps) QPS, P50 \(.latency_ms.p50)ms, P99 \(.latency_ms.p99)ms, error rate \(.error_rate)"')"
+}
+
+# Run main function
+main "$@"
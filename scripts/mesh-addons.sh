@@ -0,0 +1,148 @@
+#!/bin/bash
+
+# Mesh Add-ons Script
+# Installs, removes and reports the Istio telemetry add-ons of the cluster: the sample
+# manifests shipped in samples/addons of the Istio release downloaded to the workspace
+# (Prometheus, Grafana, Kiali, Jaeger and Loki), deployed in istio-system.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+ISTIO_DIR="${ISTIO_DIR:-$(dirname "$SCRIPT_DIR")/workspace/istio-installation}"
+ADDONS_DIR="$ISTIO_DIR/samples/addons"
+
+# Add-ons installed when none is named, and how long to wait for each to be available
+DEFAULT_ADDONS="prometheus grafana kiali jaeger loki"
+ADDON_TIMEOUT="${ADDON_TIMEOUT:-180s}"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 install|uninstall|status [ADDON...]"
+    echo ""
+    echo "  install     Apply the sample manifests of the add-ons and wait for them to be available"
+    echo "  uninstall   Delete the resources of the add-ons"
+    echo "  status      Show the version and readiness of the add-ons"
+    echo ""
+    echo "Add-ons: $DEFAULT_ADDONS (default: all)"
+    echo ""
+    echo "Environment:"
+    echo "  ISTIO_DIR       Istio release with samples/addons (default: workspace/istio-installation)"
+    echo "  ADDON_TIMEOUT   Wait for each add-on to be available (default: 180s)"
+}
+
+# Workload running the add-on, Loki is the only StatefulSet
+addon_workload() {
+    if [ "$1" = "loki" ]; then
+        echo "statefulset/loki"
+    else
+        echo "deployment/$1"
+    fi
+}
+
+# Reject names without a sample manifest before anything is changed
+check_addons() {
+    local addon
+    for addon in "$@"; do
+        if [[ " $DEFAULT_ADDONS " != *" $addon "* ]]; then
+            print_error "Unknown add-on: $addon (valid: $DEFAULT_ADDONS)"
+            exit 1
+        fi
+        if [ ! -f "$ADDONS_DIR/$addon.yaml" ]; then
+            print_error "Manifest not found: $ADDONS_DIR/$addon.yaml, run ./setup-istio.sh setup to download Istio"
+            exit 1
+        fi
+    done
+}
+
+install_addons() {
+    local addon
+    for addon in "$@"; do
+        print_status "Installing addon: $addon"
+        kubectl apply -f "$ADDONS_DIR/$addon.yaml" > /dev/null || print_warning "Failed to install $addon addon"
+    done
+
+    # Waiting one at a time keeps a slow add-on from hiding the state of the others
+    print_status "Waiting for addon deployments to be ready..."
+    for addon in "$@"; do
+        if [ "$addon" = "loki" ]; then
+            kubectl rollout status statefulset/loki -n istio-system --timeout=$ADDON_TIMEOUT > /dev/null || print_warning "Loki not ready within timeout"
+        elif kubectl get deployment $addon -n istio-system &> /dev/null; then
+            kubectl wait --for=condition=available --timeout=$ADDON_TIMEOUT deployment/$addon -n istio-system > /dev/null || print_warning "${addon^} not ready within timeout"
+        fi
+    done
+    print_status "✓ Istio addons installed: $*"
+}
+
+uninstall_addons() {
+    local addon
+    for addon in "$@"; do
+        print_status "Removing addon: $addon"
+        kubectl delete -f "$ADDONS_DIR/$addon.yaml" --ignore-not-found > /dev/null || print_warning "Failed to remove $addon addon"
+    done
+    print_status "✓ Istio addons removed: $*"
+}
+
+# One line per add-on: NAME IMAGE READY
+addon_status() {
+    local addon workload image ready desired
+    printf "%-12s %-50s %s\n" "ADDON" "IMAGE" "READY"
+    for addon in "$@"; do
+        workload=$(addon_workload $addon)
+        if ! kubectl get $workload -n istio-system &> /dev/null; then
+            printf "%-12s %-50s %s\n" "$addon" "-" "not installed"
+            continue
+        fi
+        image=$(kubectl get $workload -n istio-system -o jsonpath='{.spec.template.spec.containers[0].image}')
+        ready=$(kubectl get $workload -n istio-system -o jsonpath='{.status.readyReplicas}')
+        desired=$(kubectl get $workload -n istio-system -o jsonpath='{.spec.replicas}')
+        printf "%-12s %-50s %s\n" "$addon" "$image" "${ready:-0}/${desired:-1}"
+    done
+}
+
+# Main function
+main() {
+    local action=$1
+    shift || true
+    local addons=("$@")
+    if [ ${#addons[@]} -eq 0 ]; then
+        addons=($DEFAULT_ADDONS)
+    fi
+
+    case $action in
+        install)
+            check_addons "${addons[@]}"
+            install_addons "${addons[@]}"
+            ;;
+        uninstall)
+            check_addons "${addons[@]}"
+            uninstall_addons "${addons[@]}"
+            ;;
+        status)
+            addon_status "${addons[@]}"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
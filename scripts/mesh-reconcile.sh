@@ -0,0 +1,260 @@
+#!/bin/bash
+
+# Mesh Reconcile Script
+# Cross-references the three places a VM of the deployment is recorded: Azure (the VMs
+# of RESOURCE_GROUP and of the resource groups of its VMs), the cluster (WorkloadEntries,
+# and the EndpointSlices of the endpointslice integration mode) and the workspace (VMs
+# drained on purpose by patch or group drain). Lists the mismatches with the command
+# that resolves each one; nothing is changed. The fix and watch actions also act on the
+# drift, like a controller: a running VM tagged as a mesh workload (RECONCILE_TAG) without
+# registration gets it recreated, and a registration whose VM is gone is flagged with an
+# annotation for review, never deleted. Each pass saves its drift report for drift.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+
+# Reconciler: the tag of the VMs whose registration is recreated (the mesh integration sets
+# it on every VM that joins the mesh) and the seconds between two passes of watch
+RECONCILE_TAG="${RECONCILE_TAG:-istio-mesh=joined}"
+RECONCILE_INTERVAL="${RECONCILE_INTERVAL:-300}"
+
+# Refresh the rules of the locked down VM subnets at each watch pass (scripts/egress-lockdown.sh,
+# with the egress settings of the deployment in the environment)
+EGRESS_REFRESH="${EGRESS_REFRESH:-false}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+DRIFT_FILE="$CONFIGS_DIR/mesh-drift.json"
+
+POOL_TAG="istio-warm-pool"
+ORPHAN_ANNOTATION="azure.drift/orphaned-since"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 show | report | check | fix | watch | drift"
+    echo ""
+    echo "  show     Print the mismatches between Azure, the cluster and the workspace with their fix"
+    echo "  report   Print the same as JSON"
+    echo "  check    Print the mismatches and exit 1 if any"
+    echo "  fix      Recreate the missing registrations of the mesh VMs, flag the orphaned ones"
+    echo "  watch    Run fix every RECONCILE_INTERVAL seconds until stopped"
+    echo "  drift    Print the drift report of the last fix or watch pass (JSON)"
+    echo ""
+    echo "Environment:"
+    echo "  RECONCILE_TAG        Tag of the mesh VMs whose registration is recreated (default: istio-mesh=joined)"
+    echo "  RECONCILE_INTERVAL   Seconds between two watch passes (default: 300)"
+}
+
+# VMs of the deployment as [{name, resourceGroup, powerState, addresses, pool, mesh}], mesh
+# when the VM has RECONCILE_TAG
+azure_vms() {
+    local rgs=$({ echo "$RESOURCE_GROUP"; az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv 2>/dev/null; })
+    RESOURCE_GROUP=$RESOURCE_GROUP bash "$SCRIPT_DIR/vm-status.sh" list $rgs \
+        | jq -c --arg pool_tag "$POOL_TAG" --arg key "${RECONCILE_TAG%%=*}" --arg value "${RECONCILE_TAG#*=}" \
+            '[.[] | {name, resourceGroup, powerState,
+            addresses: ((.privateIps | split(",")) + (.publicIps | split(",")) | map(select(. != ""))),
+            pool: (.tags[$pool_tag] != null), mesh: (.tags[$key] == $value)}]'
+}
+
+# Mesh registrations of VM addresses as [{kind, namespace, name, address, vm}]. vm is the
+# azure.vm label of the registration, or the hostname of an endpoint; WorkloadEntries
+# registered before they were labeled only have their address
+mesh_registrations() {
+    local entries slices
+    entries=$(kubectl get workloadentry -A -o json | jq -c '[.items[] | {kind: "WorkloadEntry",
+        namespace: .metadata.namespace, name: .metadata.name, address: .spec.address,
+        vm: (.metadata.labels["azure.vm"] // "")}]')
+    slices=$(kubectl get endpointslice -A -l endpointslice.kubernetes.io/managed-by=istio-azure-setup -o json 2>/dev/null \
+        | jq -c '[.items[] | . as $slice | .endpoints[] | .hostname as $host | .addresses[] | {kind: "EndpointSlice",
+            namespace: $slice.metadata.namespace, name: $slice.metadata.name, address: .,
+            vm: ($slice.metadata.labels["azure.vm"] // $host // "")}]' || echo '[]')
+    jq -c -n --argjson entries "$entries" --argjson slices "${slices:-[]}" '$entries + $slices'
+}
+
+# VMs with a drain backup in the workspace
+drained_vms() {
+    local file
+    for file in "$CONFIGS_DIR"/drained-*.json; do
+        [ -f "$file" ] || continue
+        file=$(basename "$file" .json)
+        echo "${file#drained-}"
+    done | jq -R -s -c 'split("\n") | map(select(. != ""))'
+}
+
+# The reconciliation document: counts of each source and the mismatches with their fix
+reconcile_json() {
+    local vms=$(azure_vms)
+    local registrations=$(mesh_registrations)
+    local drained=$(drained_vms)
+
+    jq -n --argjson vms "$vms" --argjson registrations "$registrations" --argjson drained "$drained" '
+        ($vms | map({key: .name, value: .}) | from_entries) as $by_name |
+        ([$vms[].addresses[]]) as $addresses |
+        {
+            sources: {azure: ($vms | length), mesh: ($registrations | length), drained: ($drained | length)},
+            mismatches: (
+                [$vms[] | select(.powerState == "VM running" and (.pool | not) and (.name as $n | $drained | index($n) | not))
+                    | . as $vm | select([$registrations[].address] | any(. as $a | $vm.addresses | index($a)) | not)
+                    | {type: "vm_not_registered", vm: .name, resource_group: .resourceGroup, mesh_workload: .mesh,
+                       detail: "\(.name) is running with no WorkloadEntry or endpoint for \(.addresses | join(", "))",
+                       fix: "./setup-istio.sh onboard \(.name)"}]
+                + [$registrations[] | select(.vm == "" and (.address as $a | $addresses | index($a) | not))
+                    | {type: "registration_without_vm", vm: null, resource_group: null,
+                       kind, namespace, name,
+                       detail: "\(.kind) \(.namespace)/\(.name) points at \(.address), no VM has this address",
+                       fix: "kubectl delete \(.kind | ascii_downcase) \(.name) -n \(.namespace)"}]
+                + [$registrations[] | select(.vm != "" and $by_name[.vm] == null)
+                    | {type: "registration_without_vm", vm: .vm, resource_group: null,
+                       kind, namespace, name,
+                       detail: "\(.kind) \(.namespace)/\(.name) belongs to \(.vm), which no longer exists",
+                       fix: "./setup-istio.sh cleanup vm --vm-name \(.vm)"}]
+                + [$registrations[] | select(.vm != "" and $by_name[.vm] != null) | . as $r
+                    | select($by_name[$r.vm].addresses | index($r.address) | not)
+                    | {type: "address_drift", vm: .vm, resource_group: $by_name[.vm].resourceGroup,
+                       detail: "\(.kind) \(.namespace)/\(.name) has \(.address), \(.vm) has \($by_name[.vm].addresses | join(", "))",
+                       fix: "./setup-istio.sh mesh-update --vm-name \(.vm)"}]
+                + [$drained[] | select($by_name[.] == null)
+                    | {type: "drained_vm_missing", vm: ., resource_group: null,
+                       detail: "drain backup of \(.), which no longer exists",
+                       fix: "rm workspace/configs/drained-\(.).json"}]
+                | unique_by(.type, .detail))
+        }'
+}
+
+# Table of the mismatches
+show_reconcile() {
+    local report=$1
+    jq -r '.sources | "Azure VMs: \(.azure), mesh registrations: \(.mesh), drained VMs: \(.drained)"' <<< "$report"
+    if [ "$(jq '.mismatches | length' <<< "$report")" -eq 0 ]; then
+        print_status "✓ Azure, the cluster and the workspace agree"
+        return 0
+    fi
+    echo ""
+    jq -r '.mismatches[] | [.type, .detail, .fix] | @tsv' <<< "$report" \
+        | while IFS=$'\t' read -r type detail fix; do
+            print_warning "$type: $detail"
+            echo "    fix: $fix"
+        done
+}
+
+# One reconciliation pass: recreate the registration of each mesh VM that has none, flag
+# each orphaned registration (the annotation keeps the time it was first seen), then save
+# the drift report with the action taken on each mismatch to DRIFT_FILE
+reconcile_pass() {
+    local report=$(reconcile_json)
+    local actions='[]'
+    local item type vm rg kind namespace name action
+    mkdir -p "$CONFIGS_DIR"
+
+    # The mismatches are read on their own descriptor, the register action runs ssh
+    while read -r -u 3 item; do
+        [ -n "$item" ] || continue
+        type=$(jq -r '.type' <<< "$item")
+        action="reported"
+        if [ "$type" = "vm_not_registered" ] && [ "$(jq -r '.mesh_workload' <<< "$item")" = "true" ]; then
+            vm=$(jq -r '.vm' <<< "$item")
+            rg=$(jq -r '.resource_group' <<< "$item")
+            print_status "Recreating the mesh registration of $vm..."
+            if VM_NAME=$vm VM_RESOURCE_GROUP=$rg bash "$SCRIPT_DIR/vm-mesh-integration.sh" register > "$CONFIGS_DIR/reconcile-$vm.log" 2>&1; then
+                action="recreated"
+                print_status "✓ $vm registered again"
+            else
+                action="recreate_failed"
+                print_error "Could not register $vm again, see $CONFIGS_DIR/reconcile-$vm.log"
+            fi
+        elif [ "$type" = "registration_without_vm" ]; then
+            kind=$(jq -r '.kind | ascii_downcase' <<< "$item")
+            namespace=$(jq -r '.namespace' <<< "$item")
+            name=$(jq -r '.name' <<< "$item")
+            # Without --overwrite, an entry flagged before keeps its first time
+            kubectl annotate $kind $name -n $namespace "$ORPHAN_ANNOTATION=$(date -u +%Y-%m-%dT%H:%M:%SZ)" &> /dev/null || true
+            action="flagged"
+            print_warning "$(jq -r '.detail' <<< "$item"), flagged with $ORPHAN_ANNOTATION"
+        fi
+        actions=$(jq -c --argjson item "$item" --arg action "$action" '. + [$item + {action: $action}]' <<< "$actions")
+    done 3< <(jq -c '.mismatches[]' <<< "$report")
+
+    jq --argjson actions "$actions" --arg checked "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+        '{checked: $checked, sources, drift: ($actions | length), mismatches: $actions}' <<< "$report" > "$DRIFT_FILE"
+    print_status "Drift: $(jq '.drift' "$DRIFT_FILE") mismatch(es), $(jq '[.mismatches[] | select(.action == "recreated")] | length' "$DRIFT_FILE") registration(s) recreated"
+}
+
+# Reconcile until stopped. A failed pass, e.g. an expired login, is retried at the next one
+watch_reconcile() {
+    print_status "Reconciling $RESOURCE_GROUP every ${RECONCILE_INTERVAL}s (mesh VMs tagged $RECONCILE_TAG)"
+    while true; do
+        ( reconcile_pass ) || print_error "Reconciliation pass failed"
+        if [ "$EGRESS_REFRESH" = true ]; then
+            bash "$SCRIPT_DIR/egress-lockdown.sh" apply > /dev/null || print_warning "Could not refresh the egress lockdown rules"
+        fi
+        # Drift found by the pass shows on the Grafana dashboard of the environment
+        RESOURCE_GROUP=$RESOURCE_GROUP bash "$SCRIPT_DIR/grafana-dashboard.sh" annotate > /dev/null \
+            || print_warning "Could not post the drift annotation to Grafana"
+        sleep "$RECONCILE_INTERVAL"
+    done
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to reconcile the inventory"
+        exit 1
+    fi
+
+    local report
+    case $1 in
+        show|"")
+            report=$(reconcile_json)
+            show_reconcile "$report"
+            ;;
+        report)
+            reconcile_json
+            ;;
+        check)
+            report=$(reconcile_json)
+            show_reconcile "$report"
+            if [ "$(jq '.mismatches | length' <<< "$report")" -gt 0 ]; then
+                exit 1
+            fi
+            ;;
+        fix)
+            reconcile_pass
+            ;;
+        watch)
+            watch_reconcile
+            ;;
+        drift)
+            if [ ! -f "$DRIFT_FILE" ]; then
+                print_error "No drift report yet, run: $0 fix"
+                exit 1
+            fi
+            cat "$DRIFT_FILE"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,186 @@
+#!/bin/bash
+
+# Mesh Versions Script
+# Reports the Istio versions running in the mesh: istiod (every revision), the gateways
+# of istio-system and the sidecar of every VM, from istioctl proxy-status, next to the
+# Istio release these scripts install (the istioctl of the workspace). Istio supports
+# data planes up to one minor version behind their control plane, a proxy further
+# behind, or ahead of its istiod, is flagged with the command that fixes it.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+ISTIO_DIR="${ISTIO_DIR:-$(dirname "$SCRIPT_DIR")/workspace/istio-installation}"
+
+# Minor versions a data plane may lag its control plane
+MAX_MINOR_SKEW="${MAX_MINOR_SKEW:-1}"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 show | report | check"
+    echo ""
+    echo "  show     Print the istiod, gateway and VM sidecar versions with upgrade recommendations"
+    echo "  report   Print the same as JSON"
+    echo "  check    Print the skewed components and exit 1 if any"
+    echo ""
+    echo "Environment:"
+    echo "  MAX_MINOR_SKEW   Minor versions a proxy may lag its istiod (default: 1)"
+}
+
+# Version of the Istio release of the workspace, the one setup and upgrades install
+manager_version() {
+    if [ -x "$ISTIO_DIR/bin/istioctl" ]; then
+        "$ISTIO_DIR/bin/istioctl" version --remote=false --short 2>/dev/null | head -1
+    fi
+}
+
+# istiod pods as [{name, revision, version}], the version is the tag of their image
+istiod_pods() {
+    kubectl get pods -n istio-system -l app=istiod -o json | jq -c '[.items[] | {
+        name: .metadata.name,
+        revision: (.metadata.labels["istio.io/rev"] // "default"),
+        version: (.spec.containers[0].image | split(":") | last | sub("-.*$"; ""))}]'
+}
+
+# Proxies of istioctl proxy-status as [{name, namespace, istiod, version}]. Empty cells
+# shift the middle columns, VERSION is always the last one and ISTIOD, when listed, the
+# one before
+proxies() {
+    istioctl proxy-status 2>/dev/null | awk '
+        NR == 1 { with_istiod = ($(NF - 1) == "ISTIOD"); next }
+        { print $1 "\t" (with_istiod ? $(NF - 1) : "") "\t" $NF }' \
+        | jq -Rn '[inputs | split("\t") | {
+            name: (.[0] | split(".")[0]),
+            namespace: (.[0] | split(".")[1:] | join(".")),
+            istiod: .[1],
+            version: (.[2] | sub("-.*$"; ""))}]'
+}
+
+# Names of the VMs of the deployment: RESOURCE_GROUP and the resource groups of its VMs.
+# Azure uses the VM name as host name, which names the proxy of its sidecar
+vm_names() {
+    az vm list --query "[].{name: name, rg: resourceGroup, deployment: tags.\"istio-deployment\"}" -o json 2>/dev/null \
+        | jq -c --arg rg "$RESOURCE_GROUP" '[.[] | select((.rg | ascii_downcase) == ($rg | ascii_downcase) or .deployment == $rg) | .name]' \
+        || echo '[]'
+}
+
+# The versions document: manager, istiod revisions, gateways and VMs with their skew
+versions_json() {
+    local pods=$(istiod_pods)
+    local proxies=$(proxies)
+    local vms=$(vm_names)
+
+    jq -n --arg manager "$(manager_version)" --argjson pods "$pods" --argjson proxies "$proxies" \
+        --argjson vms "${vms:-[]}" --argjson max_skew "$MAX_MINOR_SKEW" '
+        def minor: split(".") | (.[1] // "0") | tonumber? // 0;
+        ([$pods[].version] | max_by(minor)) as $newest |
+        ($pods | map({key: .name, value: .version}) | from_entries) as $istiod_versions |
+        def assess($kind):
+            ($istiod_versions[.istiod] // $newest) as $control |
+            . + {kind: $kind, control_plane: $control,
+                 status: (if .version == "" or $control == null then "unknown"
+                          else (($control | minor) - (.version | minor)) as $skew |
+                              if $skew < 0 then "ahead" elif $skew > $max_skew then "skewed" else "ok" end
+                          end)};
+        {
+            manager: {version: $manager, supported: (if $manager == "" then null else "\($manager | split(".")[0]).\(($manager | minor) - $max_skew) - \($manager | split(".")[0:2] | join("."))" end)},
+            istiod: [$pods[] | . + {status: (if $manager == "" then "unknown"
+                                              elif ($manager | minor) - (.version | minor) > $max_skew then "skewed"
+                                              else "ok" end)}],
+            gateways: [$proxies[] | select(.namespace == "istio-system" and (.name | test("gateway"))) | assess("gateway")],
+            vms: [$proxies[] | select(.name as $n | $vms | index($n)) | assess("vm")]
+        }'
+}
+
+# Upgrade command for every component out of the supported skew
+recommendations() {
+    jq -r '
+        (.istiod[] | select(.status == "skewed") |
+            "istiod \(.name) (\(.version)) is behind the release of these scripts: workspace/istio-installation/bin/istioctl upgrade moves it to \($ENV.MANAGER)"),
+        (.gateways[] | select(.status == "skewed") |
+            "Gateway \(.name) (\(.version)) lags istiod \(.control_plane): kubectl rollout restart deployment/\(.name | sub("-[a-z0-9]+-[a-z0-9]+$"; "")) -n istio-system"),
+        (.vms[] | select(.status == "skewed") |
+            "VM \(.name) (\(.version)) lags istiod \(.control_plane): ./setup-istio.sh upgrade-sidecars \(.control_plane)"),
+        ((.gateways + .vms)[] | select(.status == "ahead") |
+            "\(if .kind == "vm" then "VM" else "Gateway" end) \(.name) (\(.version)) is newer than istiod \(.control_plane): upgrade the control plane first")' \
+        <<< "$1"
+}
+
+# Table of the components and the recommendations
+show_versions() {
+    local report=$1
+    local manager=$(jq -r '.manager.version // ""' <<< "$report")
+    echo "Manager (workspace istioctl): ${manager:-not downloaded}$(jq -r '.manager.supported // empty | ", supported istiod \(.)"' <<< "$report")"
+    echo ""
+    printf "%-10s %-52s %-12s %-12s %s\n" "KIND" "NAME" "VERSION" "ISTIOD" "STATUS"
+    jq -r '(.istiod[] | ["istiod", "\(.name) (\(.revision))", .version, "-", .status]),
+           ((.gateways + .vms)[] | [.kind, "\(.name).\(.namespace)", .version, .control_plane, .status]) | map(. // "-") | @tsv' <<< "$report" \
+        | while IFS=$'\t' read -r kind name version control status; do
+            printf "%-10s %-52s %-12s %-12s %s\n" "$kind" "$name" "$version" "$control" "$status"
+        done
+
+    local advice=$(MANAGER=$manager recommendations "$report")
+    if [ -n "$advice" ]; then
+        echo ""
+        echo "$advice" | while read -r line; do
+            print_warning "$line"
+        done
+    fi
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to report the mesh versions"
+        exit 1
+    fi
+
+    local report
+    case $1 in
+        show|"")
+            report=$(versions_json)
+            show_versions "$report"
+            ;;
+        report)
+            versions_json
+            ;;
+        check)
+            report=$(versions_json)
+            local skewed=$(jq '[.istiod[], .gateways[], .vms[] | select(.status == "skewed" or .status == "ahead")] | length' <<< "$report")
+            if [ "$skewed" -gt 0 ]; then
+                MANAGER=$(jq -r '.manager.version' <<< "$report") recommendations "$report" | while read -r line; do
+                    print_error "$line"
+                done
+                exit 1
+            fi
+            print_status "✓ Every component is within $MAX_MINOR_SKEW minor version(s) of its control plane"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,230 @@
+#!/bin/bash
+
+# Migration Manifests Script
+# Generates the Kubernetes Deployment and Service equivalent to the VM workload, from
+# its WorkloadGroup (labels, ports, readiness probe, service account), so the workload
+# can move off the VM with traffic-shift.sh. The pods keep the app label and service
+# account of the VM, so the Service and the AuthorizationPolicies cover them, and get
+# their own version label for the k8s subset. Without MIGRATION_IMAGE the sample
+# application source is copied from the VM into a ConfigMap run by a Python image.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Migration configuration
+MIGRATION_IMAGE="${MIGRATION_IMAGE:-}"         # Container image of the workload, empty: sample app from the VM
+MIGRATION_REPLICAS="${MIGRATION_REPLICAS:-2}"
+SAMPLE_APP_IMAGE="python:3.10-slim"
+SAMPLE_APP_PATH="/home/azureuser/vm-service/app.py"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+MIGRATION_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs/migration"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 generate|apply VERSION"
+    echo ""
+    echo "  generate VERSION   Write the Deployment and Service of VM_APP ($VM_APP) with version=VERSION"
+    echo "  apply VERSION      Generate and apply them, requires a traffic shift in progress"
+    echo ""
+    echo "Environment:"
+    echo "  MIGRATION_IMAGE      Container image of the workload (default: the sample app of the VM)"
+    echo "  MIGRATION_REPLICAS   Replicas of the Deployment (default: 2)"
+}
+
+# Render a JSON object as YAML map entries with string values at the given indentation
+render_map() {
+    jq -r --arg pad "$(printf '%*s' "$2" '')" 'to_entries[] | "\($pad)\(.key): \(.value | tostring | @json)"' <<< "$1"
+}
+
+# Application ports of the WorkloadGroup: the sidecar ports (15000-15099) come with the pod sidecar
+app_ports() {
+    jq -c '.spec.template.ports // {} | with_entries(select(.value < 15000 or .value > 15099))' <<< "$1"
+}
+
+# ConfigMap with the sample application source read from the VM
+sample_app_configmap() {
+    local query="publicIps"
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        query="privateIps"
+    fi
+    local ip=$(az vm show -d -g $VM_RESOURCE_GROUP -n $VM_NAME --query $query -o tsv | tr ',' '\n' | grep -v ':' | head -1)
+
+    local source
+    if ! source=$(ssh -o StrictHostKeyChecking=no -o ConnectTimeout=10 azureuser@$ip "cat $SAMPLE_APP_PATH"); then
+        print_error "Could not read $SAMPLE_APP_PATH from $VM_NAME, set MIGRATION_IMAGE instead" >&2
+        exit 1
+    fi
+
+    cat <<EOF
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: $VM_APP-source
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+data:
+  app.py: |
+$(echo "$source" | sed 's/^/    /')
+---
+EOF
+}
+
+# Print the manifests of the workload with the given version
+generate_manifests() {
+    local version=$1
+    local group
+
+    if ! group=$(kubectl get workloadgroup $VM_APP -n $VM_NAMESPACE -o json 2>/dev/null); then
+        print_error "WorkloadGroup $VM_APP not found in $VM_NAMESPACE" >&2
+        exit 1
+    fi
+
+    local labels=$(jq -c --arg v "$version" '.spec.metadata.labels // {} | del(.["azure.group"]) |
+        .version = $v | .["service.istio.io/canonical-revision"] = $v' <<< "$group")
+    local ports=$(app_ports "$group")
+    local probe=$(jq -c '.spec.probe.httpGet // empty' <<< "$group")
+    local service_account=$(jq -r '.spec.template.serviceAccount // "default"' <<< "$group")
+
+    local image=$MIGRATION_IMAGE
+    if [ -z "$image" ]; then
+        image=$SAMPLE_APP_IMAGE
+        sample_app_configmap
+    fi
+
+    cat <<EOF
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: $VM_APP-$version
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+    version: "$version"
+    azure.resource: vm-migration
+spec:
+  replicas: $MIGRATION_REPLICAS
+  selector:
+    matchLabels:
+      app: $VM_APP
+      version: "$version"
+  template:
+    metadata:
+      labels:
+$(render_map "$labels" 8)
+    spec:
+      serviceAccountName: $service_account
+      containers:
+      - name: $VM_APP
+        image: $image
+EOF
+    if [ -z "$MIGRATION_IMAGE" ]; then
+        cat <<EOF
+        command: ["sh", "-c", "pip install --no-cache-dir flask && exec python /app/app.py"]
+        volumeMounts:
+        - name: source
+          mountPath: /app
+EOF
+    fi
+    if [ "$ports" != "{}" ]; then
+        echo "        ports:"
+        jq -r 'to_entries[] | "        - name: \(.key)\n          containerPort: \(.value)"' <<< "$ports"
+    fi
+    if [ -n "$probe" ]; then
+        cat <<EOF
+        readinessProbe:
+          httpGet:
+            path: $(jq -r '.path // "/"' <<< "$probe")
+            port: $(jq -r '.port' <<< "$probe")
+          periodSeconds: $(jq -r '.spec.probe.periodSeconds // 5' <<< "$group")
+          initialDelaySeconds: $(jq -r '.spec.probe.initialDelaySeconds // 1' <<< "$group")
+EOF
+    fi
+    if [ -z "$MIGRATION_IMAGE" ]; then
+        cat <<EOF
+      volumes:
+      - name: source
+        configMap:
+          name: $VM_APP-source
+EOF
+    fi
+
+    # Same Service as the VM one, so the manifests also work once the VM resources are gone
+    cat <<EOF
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: $VM_APP
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+spec:
+  selector:
+    app: $VM_APP
+  ports:
+$(jq -r 'to_entries[] | "  - name: \(.key)\n    port: \(.value)\n    targetPort: \(.value)\n    protocol: TCP"' <<< "$ports")
+  type: ClusterIP
+EOF
+}
+
+# Main function
+main() {
+    local action=$1
+    local version=$2
+
+    if [ -z "$version" ] || { [ "$action" != "generate" ] && [ "$action" != "apply" ]; }; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to generate the migration manifests"
+        exit 1
+    fi
+
+    # The pods join the Service right away, only safe once the traffic shift controls the split
+    if [ "$action" = "apply" ] && \
+        [ "$(kubectl get destinationrule $VM_APP -n $VM_NAMESPACE -o jsonpath='{.metadata.labels.azure\.traffic-shift}' 2>/dev/null)" != "active" ]; then
+        print_error "No traffic shift in progress for $VM_APP, the pods would get traffic right away"
+        print_error "Run first: ./setup-istio.sh traffic-shift start $version"
+        exit 1
+    fi
+
+    mkdir -p "$MIGRATION_DIR"
+    local file="$MIGRATION_DIR/$VM_APP-$version.yaml"
+    generate_manifests "$version" > "$file"
+    print_status "✓ Manifests of $VM_APP version $version written to $file"
+
+    if [ "$action" = "apply" ]; then
+        kubectl apply -f "$file"
+        print_status "✓ Deployment $VM_APP-$version applied, shift traffic with: ./setup-istio.sh traffic-shift step WEIGHT"
+    fi
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,458 @@
+#!/bin/bash
+
+# VM Network Check Script
+# Pre-flight checks of the VM network path to the mesh, run before the VM joins it.
+# The effective routes of the VM NIC (system routes merged with the route tables of
+# hub-spoke networks) must send Internet bound traffic to the expected next hop, and
+# Azure Network Watcher must see istiod and the east-west gateway reachable from the VM.
+# Before the VM is created, the address space, subnet and static private IP it asks for
+# are checked against each other and against the networks of the cluster, and the route
+# table and NSG of an existing subnet must let it reach istiod and the east-west gateway.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+VM_NAME="${VM_NAME:-istio-vm}"
+CLUSTER_NAME="${CLUSTER_NAME:-istio-aks-cluster}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Addresses of the VM network, same values as setup-istio.sh --vnet-prefix, --subnet-prefix
+# and --private-ip, and the networks they must not overlap
+VM_VNET_PREFIX="${VM_VNET_PREFIX:-10.0.0.0/16}"
+VM_SUBNET_PREFIX="${VM_SUBNET_PREFIX:-10.0.0.0/24}"
+VM_PRIVATE_IP="${VM_PRIVATE_IP:-}"
+VM_VNET_NAME="${VM_VNET_NAME:-${VM_NAME}VNET}"
+VM_SUBNET_NAME="${VM_SUBNET_NAME:-${VM_NAME}Subnet}"
+VM_CLUSTER_DNS="${VM_CLUSTER_DNS:-hosts}"
+VM_DNS_RESOLVER_SUBNET_PREFIX="${VM_DNS_RESOLVER_SUBNET_PREFIX:-10.0.1.0/28}"
+AKS_SERVICE_CIDR="${AKS_SERVICE_CIDR:-10.0.0.0/16}"
+
+# Expected outbound path, same values as setup-istio.sh --outbound-type / --firewall-ip
+VM_OUTBOUND_TYPE="${VM_OUTBOUND_TYPE:-}"
+VM_FIREWALL_IP="${VM_FIREWALL_IP:-}"
+
+# Mesh addresses the VM must reach (set by setup-istio.sh from the east-west gateway)
+ISTIOD_ADDRESS="${ISTIOD_ADDRESS:-}"
+GATEWAY_ADDRESS="${GATEWAY_ADDRESS:-}"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 routes | connectivity | addresses | subnet"
+    echo ""
+    echo "  routes         Validate the effective routes of the VM NIC"
+    echo "  connectivity   Check with Network Watcher that ISTIOD_ADDRESS:15012 and GATEWAY_ADDRESS:15443 are reachable"
+    echo "  addresses      Validate the VNet and subnet prefixes and the static private IP of a new VM"
+    echo "  subnet         Check that the subnet of a new VM can reach ISTIOD_ADDRESS:15012 and GATEWAY_ADDRESS:15443"
+}
+
+# IPv4 address as a 32-bit integer
+ip_to_int() {
+    local a b c d
+    IFS=. read -r a b c d <<< "$1"
+    echo $(( (a << 24) + (b << 16) + (c << 8) + d ))
+}
+
+valid_ip() {
+    [[ "$1" =~ ^([0-9]{1,3})\.([0-9]{1,3})\.([0-9]{1,3})\.([0-9]{1,3})$ ]] || return 1
+    local octet
+    for octet in "${BASH_REMATCH[@]:1}"; do
+        [ "$octet" -le 255 ] || return 1
+    done
+}
+
+# A network address with a prefix length from /8 to /29, the range Azure accepts
+valid_cidr() {
+    [[ "$1" == */* ]] && valid_ip "${1%/*}" && [[ "${1#*/}" =~ ^[0-9]+$ ]] || return 1
+    [ "${1#*/}" -ge 8 ] && [ "${1#*/}" -le 29 ] || return 1
+    local range=($(cidr_range "$1"))
+    [ "$(ip_to_int "${1%/*}")" -eq "${range[0]}" ]
+}
+
+# First and last address of a CIDR, as integers
+cidr_range() {
+    local size=$(( 1 << (32 - ${1#*/}) ))
+    local first=$(( $(ip_to_int "${1%/*}") / size * size ))
+    echo "$first $(( first + size - 1 ))"
+}
+
+cidr_contains() {
+    local outer=($(cidr_range "$1")) inner=($(cidr_range "$2"))
+    [ "${inner[0]}" -ge "${outer[0]}" ] && [ "${inner[1]}" -le "${outer[1]}" ]
+}
+
+cidrs_overlap() {
+    local a=($(cidr_range "$1")) b=($(cidr_range "$2"))
+    [ "${a[0]}" -le "${b[1]}" ] && [ "${b[0]}" -le "${a[1]}" ]
+}
+
+# Address spaces of the VNets of the AKS node resource group
+cluster_address_spaces() {
+    local node_rg=$(az aks show --resource-group $RESOURCE_GROUP --name $CLUSTER_NAME --query nodeResourceGroup -o tsv 2>/dev/null)
+    if [ -n "$node_rg" ]; then
+        az network vnet list --resource-group "$node_rg" --query '[].addressSpace.addressPrefixes[]' -o tsv 2>/dev/null
+    fi
+}
+
+# Validate the addresses a new VM asks for. The VM network must not overlap the cluster
+# when the VM is reached on its private IP (--no-public-ip), over peering or VPN
+check_addresses() {
+    local failed=0
+    local prefix
+    for prefix in "$VM_VNET_PREFIX" "$VM_SUBNET_PREFIX"; do
+        if ! valid_cidr "$prefix"; then
+            print_error "$prefix is not an IPv4 network address with a prefix length from /8 to /29"
+            return 1
+        fi
+    done
+    if ! cidr_contains "$VM_VNET_PREFIX" "$VM_SUBNET_PREFIX"; then
+        print_error "Subnet $VM_SUBNET_PREFIX is outside the VNet address space $VM_VNET_PREFIX"
+        return 1
+    fi
+
+    if [ -n "$VM_PRIVATE_IP" ] && ! valid_ip "$VM_PRIVATE_IP"; then
+        print_error "$VM_PRIVATE_IP is not an IPv4 address"
+        failed=1
+    elif [ -n "$VM_PRIVATE_IP" ]; then
+        local subnet=($(cidr_range "$VM_SUBNET_PREFIX"))
+        local ip=$(ip_to_int "$VM_PRIVATE_IP")
+        if [ "$ip" -lt "${subnet[0]}" ] || [ "$ip" -gt "${subnet[1]}" ]; then
+            print_error "Private IP $VM_PRIVATE_IP is outside the subnet $VM_SUBNET_PREFIX"
+            failed=1
+        elif [ "$ip" -lt $(( subnet[0] + 4 )) ] || [ "$ip" -eq "${subnet[1]}" ]; then
+            # Network address, gateway, Azure DNS (2) and broadcast
+            print_error "Private IP $VM_PRIVATE_IP is reserved by Azure, use an address from the 5th to the last but one of $VM_SUBNET_PREFIX"
+            failed=1
+        elif az network vnet show --resource-group $VM_RESOURCE_GROUP --name "$VM_VNET_NAME" &> /dev/null \
+            && [ "$(az network vnet check-ip-address --resource-group $VM_RESOURCE_GROUP --name "$VM_VNET_NAME" \
+                --ip-address "$VM_PRIVATE_IP" --query available -o tsv 2>/dev/null)" = "false" ]; then
+            print_error "Private IP $VM_PRIVATE_IP is already in use in $VM_VNET_NAME"
+            failed=1
+        fi
+    fi
+
+    if [ "$VM_CLUSTER_DNS" = "resolver" ]; then
+        if ! valid_cidr "$VM_DNS_RESOLVER_SUBNET_PREFIX" || ! cidr_contains "$VM_VNET_PREFIX" "$VM_DNS_RESOLVER_SUBNET_PREFIX"; then
+            print_error "DNS resolver subnet $VM_DNS_RESOLVER_SUBNET_PREFIX must be a network inside the VNet address space $VM_VNET_PREFIX"
+            failed=1
+        elif cidrs_overlap "$VM_SUBNET_PREFIX" "$VM_DNS_RESOLVER_SUBNET_PREFIX"; then
+            print_error "DNS resolver subnet $VM_DNS_RESOLVER_SUBNET_PREFIX overlaps the VM subnet $VM_SUBNET_PREFIX"
+            failed=1
+        fi
+    fi
+
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        local space
+        for space in $(cluster_address_spaces); do
+            if cidrs_overlap "$VM_VNET_PREFIX" "$space"; then
+                print_error "VNet address space $VM_VNET_PREFIX overlaps the cluster network $space, they cannot be peered"
+                failed=1
+            fi
+        done
+        if cidrs_overlap "$VM_VNET_PREFIX" "$AKS_SERVICE_CIDR"; then
+            print_warning "VNet address space $VM_VNET_PREFIX overlaps the service CIDR $AKS_SERVICE_CIDR of the cluster, pods cannot reach VM addresses that are also service IPs"
+        fi
+    fi
+
+    if [ $failed -eq 0 ]; then
+        print_status "✓ VM network $VM_VNET_PREFIX, subnet $VM_SUBNET_PREFIX${VM_PRIVATE_IP:+, private IP $VM_PRIVATE_IP}"
+    fi
+    return $failed
+}
+
+# Validate the default route of the VM NIC against the configured outbound path
+check_routes() {
+    local nic_id=$(az vm show --resource-group $VM_RESOURCE_GROUP --name $VM_NAME --query 'networkProfile.networkInterfaces[0].id' -o tsv)
+    print_status "Reading effective routes of ${nic_id##*/}..."
+
+    local routes
+    if ! routes=$(az network nic show-effective-route-table --ids "$nic_id" -o json 2>/dev/null); then
+        print_error "Could not read the effective routes, is the VM running?"
+        return 1
+    fi
+
+    echo "$routes" | jq -r '.value[] | select(.source == "User" and .state == "Active") |
+        "  user route \(.addressPrefix | join(",")) -> \(.nextHopType) \(.nextHopIpAddress | join(","))"'
+
+    local default_route=$(echo "$routes" | jq -c '[.value[] | select(.state == "Active" and (.addressPrefix | index("0.0.0.0/0")))] | first // empty')
+    if [ -z "$default_route" ]; then
+        print_error "No active 0.0.0.0/0 route: the VM cannot reach istiod, the east-west gateway or package repositories"
+        return 1
+    fi
+
+    local hop_type=$(echo "$default_route" | jq -r '.nextHopType')
+    local hop_ip=$(echo "$default_route" | jq -r '.nextHopIpAddress | join(",")')
+    print_status "Default route: $hop_type${hop_ip:+ $hop_ip} ($(echo "$default_route" | jq -r '.source'))"
+
+    case $hop_type in
+        None)
+            print_error "The default route drops Internet bound traffic"
+            return 1
+            ;;
+        VirtualAppliance)
+            if [ -n "$VM_FIREWALL_IP" ] && [ "$hop_ip" != "$VM_FIREWALL_IP" ]; then
+                print_error "The default route goes to $hop_ip, expected the firewall $VM_FIREWALL_IP"
+                return 1
+            fi
+            ;;
+        *)
+            if [ "$VM_OUTBOUND_TYPE" = "firewall" ]; then
+                print_error "The default route goes to $hop_type, expected the firewall (VirtualAppliance)"
+                return 1
+            fi
+            ;;
+    esac
+
+    print_status "✓ Effective routes match the outbound configuration"
+}
+
+# Explain a Network Watcher issue type
+issue_hint() {
+    case $1 in
+        NetworkSecurityRule) echo "an NSG rule denies the traffic" ;;
+        UserDefinedRoute) echo "a route table sends the traffic to a next hop that drops it" ;;
+        GuestFirewall) echo "the VM firewall (iptables/ufw) blocks the traffic" ;;
+        DnsResolution) echo "the destination name does not resolve" ;;
+        PortThrottled|SocketBind) echo "the VM ran out of ports" ;;
+        CPU|Memory) echo "the VM is overloaded" ;;
+        *) echo "see the Network Watcher documentation for $1" ;;
+    esac
+}
+
+# Test one destination from the VM, or from the VM ID given as 4th argument, with Network
+# Watcher and diagnose the failure
+test_connectivity() {
+    local name=$1
+    local address=$2
+    local port=$3
+    local source=${4:-$VM_NAME}
+
+    local result
+    if ! result=$(az network watcher test-connectivity --resource-group $VM_RESOURCE_GROUP --source-resource "$source" \
+        --dest-address "$address" --dest-port "$port" --protocol Tcp -o json 2>/dev/null); then
+        print_error "Network Watcher connectivity check to $name ($address:$port) could not run"
+        return 1
+    fi
+
+    if [ "$(echo "$result" | jq -r '.connectionStatus')" = "Reachable" ]; then
+        print_status "✓ $name ($address:$port) reachable, average latency $(echo "$result" | jq -r '.avgLatencyInMs // "?"')ms"
+        return 0
+    fi
+
+    print_error "$name ($address:$port) is not reachable from ${source##*/}"
+    local hop type issue
+    while IFS='|' read -r hop type issue; do
+        echo "  at $hop: $type, $(issue_hint "$type")${issue:+ ($issue)}"
+    done < <(echo "$result" | jq -r '.hops[] | .address as $hop | .issues[]? |
+        "\($hop // "unknown hop")|\(.type)|\([.context[]? | to_entries[] | "\(.key)=\(.value)"] | join(", "))"')
+    return 1
+}
+
+# Check from the VM that istiod and the east-west gateway are reachable
+check_connectivity() {
+    if ! az vm extension show --resource-group $VM_RESOURCE_GROUP --vm-name $VM_NAME --name NetworkWatcherAgentLinux &> /dev/null; then
+        print_status "Installing the Network Watcher agent on $VM_NAME..."
+        az vm extension set --resource-group $VM_RESOURCE_GROUP --vm-name $VM_NAME \
+            --publisher Microsoft.Azure.NetworkWatcher --name NetworkWatcherAgentLinux > /dev/null
+    fi
+
+    local failed=0
+    if [ -n "$ISTIOD_ADDRESS" ]; then
+        test_connectivity istiod "$ISTIOD_ADDRESS" 15012 || failed=1
+    else
+        print_warning "No istiod address for the VM yet, skipping the istiod check"
+    fi
+    if [ -n "$GATEWAY_ADDRESS" ]; then
+        test_connectivity "east-west gateway" "$GATEWAY_ADDRESS" 15443 || failed=1
+    else
+        print_warning "No east-west gateway address, skipping the gateway check"
+    fi
+    return $failed
+}
+
+# RFC 1918 address
+private_ip() {
+    local ip=$(ip_to_int "$1") range
+    for range in 10.0.0.0/8 172.16.0.0/12 192.168.0.0/16; do
+        local bounds=($(cidr_range "$range"))
+        [ "$ip" -ge "${bounds[0]}" ] && [ "$ip" -le "${bounds[1]}" ] && return 0
+    done
+    return 1
+}
+
+# An address prefix of an NSG rule or route matches the address. Of the service tags,
+# Internet and VirtualNetwork are told apart by the address being private, others never match
+prefix_matches() {
+    local prefix=$1
+    local address=$2
+    case $prefix in
+        '*'|0.0.0.0/0) return 0 ;;
+        Internet) ! private_ip "$address" ;;
+        VirtualNetwork) private_ip "$address" ;;
+        */*)
+            valid_ip "${prefix%/*}" || return 1
+            local range=($(cidr_range "$prefix")) ip=$(ip_to_int "$address")
+            [ "$ip" -ge "${range[0]}" ] && [ "$ip" -le "${range[1]}" ]
+            ;;
+        *) [ "$prefix" = "$address" ] ;;
+    esac
+}
+
+# A port range of an NSG rule ("*", "15012" or "15000-15100") contains the port
+port_matches() {
+    case $1 in
+        '*') return 0 ;;
+        *-*) [ "$2" -ge "${1%-*}" ] && [ "$2" -le "${1#*-}" ] ;;
+        *) [ "$1" = "$2" ] ;;
+    esac
+}
+
+# Diagnose the route and the outbound NSG rule the subnet applies to one destination
+check_subnet_destination() {
+    local name=$1
+    local address=$2
+    local port=$3
+    local subnet=$4
+
+    # Longest user route prefix matching the address, system routes apply otherwise
+    local route_table=$(echo "$subnet" | jq -r '.routeTable.id // empty')
+    if [ -n "$route_table" ]; then
+        local best="" best_length=-1 route_name prefix hop_type
+        while IFS='|' read -r route_name prefix hop_type; do
+            if [[ "$prefix" == */* ]] && prefix_matches "$prefix" "$address" && [ "${prefix#*/}" -gt "$best_length" ]; then
+                best="$route_name|$prefix|$hop_type"
+                best_length=${prefix#*/}
+            fi
+        done < <(az network route-table show --ids "$route_table" -o json | jq -r '.routes[] | "\(.name)|\(.addressPrefix)|\(.nextHopType)"')
+        if [ "${best##*|}" = "None" ]; then
+            IFS='|' read -r route_name prefix hop_type <<< "$best"
+            print_error "$name ($address:$port) is not reachable from $VM_SUBNET_NAME"
+            echo "  at ${route_table##*/}: UserDefinedRoute, $(issue_hint UserDefinedRoute) (RouteName=$route_name, AddressPrefix=$prefix)"
+            return 1
+        fi
+    fi
+
+    # First outbound rule of the subnet NSG, by priority, matching TCP to the address and port
+    local nsg=$(echo "$subnet" | jq -r '.networkSecurityGroup.id // empty')
+    if [ -z "$nsg" ]; then
+        print_status "✓ $name ($address:$port) reachable from $VM_SUBNET_NAME, no NSG on the subnet"
+        return 0
+    fi
+    local rule_name access ports prefixes
+    while IFS='|' read -r rule_name access ports prefixes; do
+        local port_match=false prefix_match=false item port_list prefix_list
+        IFS=, read -ra port_list <<< "$ports"
+        IFS=, read -ra prefix_list <<< "$prefixes"
+        for item in "${port_list[@]}"; do
+            port_matches "$item" "$port" && port_match=true
+        done
+        for item in "${prefix_list[@]}"; do
+            prefix_matches "$item" "$address" && prefix_match=true
+        done
+        if [ "$port_match" = true ] && [ "$prefix_match" = true ]; then
+            if [ "$access" = "Allow" ]; then
+                print_status "✓ $name ($address:$port) reachable from $VM_SUBNET_NAME, allowed by ${nsg##*/}/$rule_name"
+                return 0
+            fi
+            print_error "$name ($address:$port) is not reachable from $VM_SUBNET_NAME"
+            echo "  at ${nsg##*/}: NetworkSecurityRule, $(issue_hint NetworkSecurityRule) (RuleName=$rule_name)"
+            return 1
+        fi
+    done < <(az network nsg show --ids "$nsg" -o json | jq -r '(.securityRules + .defaultSecurityRules)
+        | map(select(.direction == "Outbound" and (.protocol == "*" or .protocol == "Tcp"))) | sort_by(.priority)[]
+        | "\(.name)|\(.access)|\([.destinationPortRange // empty] + (.destinationPortRanges // []) | join(","))|\([.destinationAddressPrefix // empty] + (.destinationAddressPrefixes // []) | join(","))"')
+    print_warning "No outbound rule of ${nsg##*/} decides for $name ($address:$port), check its service tag rules"
+}
+
+# Before the VM is created, check that its subnet can reach istiod and the east-west gateway.
+# Network Watcher tests from a running VM of the subnet that has its agent, otherwise the
+# route table and NSG of the subnet are evaluated. A subnet az vm create makes has neither
+check_subnet() {
+    local subnet
+    if ! subnet=$(az network vnet subnet show --resource-group $VM_RESOURCE_GROUP --vnet-name "$VM_VNET_NAME" \
+        --name "$VM_SUBNET_NAME" -o json 2>/dev/null); then
+        print_status "✓ Subnet $VM_SUBNET_NAME is created with the VM, without route table or NSG"
+        return 0
+    fi
+
+    local probe="" nic vm_id
+    for nic in $(echo "$subnet" | jq -r '.ipConfigurations[]?.id | split("/ipConfigurations/")[0]' | sort -u); do
+        vm_id=$(az network nic show --ids "$nic" --query 'virtualMachine.id' -o tsv 2>/dev/null)
+        if [ -n "$vm_id" ] && [ "${vm_id##*/}" != "$VM_NAME" ] \
+            && [ "$(az vm get-instance-view --ids "$vm_id" --query "instanceView.statuses[?starts_with(code, 'PowerState/')].code | [0]" -o tsv 2>/dev/null)" = "PowerState/running" ] \
+            && az vm extension show --ids "$vm_id/extensions/NetworkWatcherAgentLinux" &> /dev/null; then
+            probe=$vm_id
+            break
+        fi
+    done
+    if [ -n "$probe" ]; then
+        print_status "Testing from ${probe##*/}, a VM of subnet $VM_SUBNET_NAME, with Network Watcher..."
+    else
+        print_status "Evaluating the route table and NSG of subnet $VM_SUBNET_NAME..."
+    fi
+
+    local failed=0 name address port
+    for name in istiod "east-west gateway"; do
+        if [ "$name" = istiod ]; then
+            address=$ISTIOD_ADDRESS port=15012
+        else
+            address=$GATEWAY_ADDRESS port=15443
+        fi
+        if [ -z "$address" ]; then
+            print_warning "No $name address yet, skipping the $name check"
+        elif [ -n "$probe" ]; then
+            test_connectivity "$name" "$address" $port "$probe" || failed=1
+        else
+            check_subnet_destination "$name" "$address" $port "$subnet" || failed=1
+        fi
+    done
+    return $failed
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required for the network checks"
+        exit 1
+    fi
+
+    case $1 in
+        routes)
+            check_routes
+            ;;
+        connectivity)
+            check_connectivity
+            ;;
+        addresses)
+            check_addresses
+            ;;
+        subnet)
+            check_subnet
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
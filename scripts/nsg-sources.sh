@@ -0,0 +1,237 @@
+#!/bin/bash
+
+# NSG Sources Script
+# Resolves the source prefixes of the inbound NSG rules of the VMs and tightens the
+# rules of existing NSGs that still allow them from anywhere. Two kinds of rules:
+#   ssh    Allow-SSH and the default-allow-ssh rule of az vm create: management access
+#   mesh   Allow-VMWeb8080, Allow-HTTPS443, Allow-IstioMesh, Allow-VMServices: traffic
+#          from the cluster
+# A source is a comma separated list of CIDRs or service tags, or one of the keywords
+# "caller" (public address of this machine) and "cluster" (outbound addresses of the
+# AKS cluster). Empty picks per VM exposure: caller/cluster for VMs with a public IP,
+# VirtualNetwork (the VM network and its peerings) for private VMs. plan and apply look
+# up the exposure of each NSG from the NICs behind it, so a deployment can mix both.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+CLUSTER_NAME="${CLUSTER_NAME:-istio-aks}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Source configuration
+SSH_SOURCE="${SSH_SOURCE:-}"
+MESH_SOURCE="${MESH_SOURCE:-}"
+
+SSH_RULES="Allow-SSH default-allow-ssh"
+MESH_RULES="Allow-VMWeb8080 Allow-HTTPS443 Allow-IstioMesh Allow-VMServices"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 resolve ssh|mesh | plan | apply | apply-nsg RESOURCE_GROUP NSG"
+    echo ""
+    echo "  resolve ssh|mesh      Print the source prefixes of the rules of that kind"
+    echo "  plan                  Show the rules of the managed NSGs whose sources would change"
+    echo "  apply                 Change them"
+    echo "  apply-nsg RG NSG      Change the rules of one NSG"
+    echo ""
+    echo "Environment:"
+    echo "  SSH_SOURCE    Sources of the SSH rules: CIDRs/service tags, caller, or empty (automatic)"
+    echo "  MESH_SOURCE   Sources of the mesh rules: CIDRs/service tags, cluster, or empty (automatic)"
+}
+
+# Public address of this machine
+caller_prefix() {
+    local ip=$(curl -s --max-time 10 https://api.ipify.org)
+    if [ -z "$ip" ]; then
+        print_error "Could not find the public address of this machine"
+        exit 1
+    fi
+    echo "$ip/32"
+}
+
+# Outbound public addresses of the AKS cluster load balancer
+cluster_prefixes() {
+    local ids=$(az aks show --resource-group $RESOURCE_GROUP --name $CLUSTER_NAME \
+        --query "networkProfile.loadBalancerProfile.effectiveOutboundIPs[].id" -o tsv 2>/dev/null)
+    if [ -z "$ids" ]; then
+        print_error "No outbound address found for cluster $CLUSTER_NAME, set the mesh source explicitly"
+        exit 1
+    fi
+    local id
+    for id in $ids; do
+        echo "$(az network public-ip show --ids "$id" --query ipAddress -o tsv)/32"
+    done
+}
+
+# Space separated source prefixes of a rule kind
+resolve() {
+    local kind=$1
+    local value
+    case $kind in
+        ssh) value=$SSH_SOURCE ;;
+        mesh) value=$MESH_SOURCE ;;
+        *) show_usage; exit 1 ;;
+    esac
+
+    if [ -z "$value" ]; then
+        if [ "$VM_PUBLIC_IP" = false ]; then
+            value="VirtualNetwork"
+        elif [ "$kind" = "ssh" ]; then
+            value="caller"
+        else
+            value="cluster"
+        fi
+    fi
+
+    local source prefixes=""
+    for source in ${value//,/ }; do
+        case $source in
+            caller) prefixes+=" $(caller_prefix)" ;;
+            cluster) prefixes+=" $(cluster_prefixes)" ;;
+            *) prefixes+=" $source" ;;
+        esac
+    done
+    echo $prefixes | tr ' ' '\n' | sort -u | tr '\n' ' ' | sed 's/ $//'
+}
+
+# true when a NIC behind the NSG, directly or through a subnet, has a public IP. An NSG
+# without NIC keeps the exposure of the command line
+nsg_public() {
+    local rg=$1 nsg=$2
+    local nics=$(az network nsg show --resource-group "$rg" --name "$nsg" -o json 2>/dev/null | jq -r '.networkInterfaces[]?.id')
+    local subnet
+    for subnet in $(az network nsg show --resource-group "$rg" --name "$nsg" --query "subnets[].id" -o tsv 2>/dev/null); do
+        nics+=$'\n'$(az network vnet subnet show --ids "$subnet" --query "ipConfigurations[].id" -o tsv 2>/dev/null \
+            | sed 's|/ipConfigurations/.*||')
+    done
+    nics=$(echo "$nics" | grep -i '/networkInterfaces/' | sort -u)
+    if [ -z "$nics" ]; then
+        echo "$VM_PUBLIC_IP"
+        return 0
+    fi
+    local public_ips=$(az network nic show --ids $nics -o json 2>/dev/null \
+        | jq -r '[.] | flatten | [.[].ipConfigurations[].publicIPAddress.id // empty] | length')
+    if [ "${public_ips:-0}" -gt 0 ]; then
+        echo true
+    else
+        echo false
+    fi
+}
+
+# Resolve the sources of an NSG for its exposure, each exposure once
+resolve_for_nsg() {
+    local public=$(nsg_public "$1" "$2")
+    if [ "$public" = false ]; then
+        if [ -z "$PRIVATE_SSH_PREFIXES" ]; then
+            PRIVATE_SSH_PREFIXES=$(VM_PUBLIC_IP=false resolve ssh)
+            PRIVATE_MESH_PREFIXES=$(VM_PUBLIC_IP=false resolve mesh)
+        fi
+        SSH_PREFIXES=$PRIVATE_SSH_PREFIXES MESH_PREFIXES=$PRIVATE_MESH_PREFIXES NSG_EXPOSURE=private
+    else
+        if [ -z "$PUBLIC_SSH_PREFIXES" ]; then
+            PUBLIC_SSH_PREFIXES=$(VM_PUBLIC_IP=true resolve ssh)
+            PUBLIC_MESH_PREFIXES=$(VM_PUBLIC_IP=true resolve mesh)
+        fi
+        SSH_PREFIXES=$PUBLIC_SSH_PREFIXES MESH_PREFIXES=$PUBLIC_MESH_PREFIXES NSG_EXPOSURE=public
+    fi
+}
+
+# "RULE|CURRENT|DESIRED" lines of the rules of one NSG whose sources differ from the resolved ones
+nsg_changes() {
+    local rg=$1 nsg=$2
+    az network nsg rule list --resource-group "$rg" --nsg-name "$nsg" -o json | jq -r \
+        --arg ssh_rules "$SSH_RULES" --arg mesh_rules "$MESH_RULES" --arg ssh "$SSH_PREFIXES" --arg mesh "$MESH_PREFIXES" '
+        .[] | select(.direction == "Inbound" and .access == "Allow") |
+        (if (.name | IN($ssh_rules | split(" ")[])) then $ssh
+         elif (.name | IN($mesh_rules | split(" ")[])) then $mesh else empty end) as $desired |
+        ([.sourceAddressPrefix // empty] + (.sourceAddressPrefixes // []) | map(select(. != "")) | sort | join(" ")) as $current |
+        # A single address may come back with or without /32
+        def normalize: split(" ") | map(sub("/32$"; "")) | sort;
+        select(($current | normalize) != ($desired | normalize)) |
+        "\(.name)|\($current)|\($desired)"'
+}
+
+# Resource groups holding the VM NSGs: RESOURCE_GROUP and the resource groups of its VMs
+managed_resource_groups() {
+    echo "$RESOURCE_GROUP"
+    az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv
+}
+
+# Print or apply the changes of one NSG, with the sources of the VMs behind it
+harden_nsg() {
+    local rg=$1 nsg=$2 apply=$3
+    local rule current desired
+    resolve_for_nsg "$rg" "$nsg"
+    while IFS='|' read -r rule current desired; do
+        [ -n "$rule" ] || continue
+        if [ "$apply" = true ]; then
+            az network nsg rule update --resource-group "$rg" --nsg-name "$nsg" --name "$rule" \
+                --source-address-prefixes $desired > /dev/null
+            print_status "✓ $rg/$nsg $rule: from $desired"
+        else
+            echo "  ~ $rg/$nsg ($NSG_EXPOSURE) $rule: ${current:-none} -> $desired"
+        fi
+    done < <(nsg_changes "$rg" "$nsg")
+}
+
+harden_all() {
+    local apply=$1
+    local rg nsg
+    for rg in $(managed_resource_groups); do
+        for nsg in $(az network nsg list --resource-group "$rg" --query "[].name" -o tsv 2>/dev/null); do
+            harden_nsg "$rg" "$nsg" "$apply"
+        done
+    done
+}
+
+# Main function
+main() {
+    if [ "$1" = "resolve" ]; then
+        resolve "$2"
+        return 0
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to compare NSG rules"
+        exit 1
+    fi
+
+    case $1 in
+        plan)
+            harden_all false
+            [ -z "$PUBLIC_SSH_PREFIXES" ] || echo "Public VMs: SSH from $PUBLIC_SSH_PREFIXES, mesh from $PUBLIC_MESH_PREFIXES"
+            [ -z "$PRIVATE_SSH_PREFIXES" ] || echo "Private VMs: SSH from $PRIVATE_SSH_PREFIXES, mesh from $PRIVATE_MESH_PREFIXES"
+            ;;
+        apply)
+            harden_all true
+            ;;
+        apply-nsg)
+            [ -n "$3" ] || { show_usage; exit 1; }
+            harden_nsg "$2" "$3" true
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,330 @@
+#!/bin/bash
+
+# VM OS Patch Script
+# Applies OS updates to mesh VMs one at a time: the VM is drained from the mesh
+# (its WorkloadEntries are removed, or its EndpointSlice endpoints marked not ready),
+# updated, rebooted, and traffic is re-enabled only after the sidecar and the
+# application are healthy again. A failing VM stays drained and stops the rollout.
+# "drain" and "undrain" only take VMs out of the mesh endpoints and put them back.
+# The power actions drain a VM before it stops and put it back once it is healthy again.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+INTEGRATION_MODE="${INTEGRATION_MODE:-istio}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Patch configuration
+DRAIN_SECONDS="${DRAIN_SECONDS:-30}"        # Wait for in-flight requests after draining
+REBOOT_TIMEOUT="${REBOOT_TIMEOUT:-300}"     # Seconds to wait for SSH after the reboot
+REBOOT="${REBOOT:-always}"                  # always or required (only when /var/run/reboot-required exists)
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+
+SSH_OPTS=(-o StrictHostKeyChecking=no -o ConnectTimeout=10)
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 VM_NAME... | --all | drain VM_NAME... | undrain VM_NAME... | POWER_ACTION VM_NAME..."
+    echo ""
+    echo "  VM_NAME...           Patch the given VMs, one at a time"
+    echo "  --all                Patch every VM of RESOURCE_GROUP ($RESOURCE_GROUP) except warm pool VMs"
+    echo "  drain VM_NAME...     Only drain the given VMs from the mesh"
+    echo "  undrain VM_NAME...   Put drained VMs back in the mesh"
+    echo ""
+    echo "Power actions, each followed by the resulting power state:"
+    echo "  start                Start the VMs, undrain them once the sidecar and application are healthy"
+    echo "  stop                 Drain and power off the VMs (compute is still billed)"
+    echo "  deallocate           Drain and deallocate the VMs (compute is released)"
+    echo "  restart              Drain, restart, then undrain the VMs once healthy"
+    echo "  power-state          Only print the power state"
+}
+
+# IP used to reach the VM, same selection as vm-mesh-integration.sh
+vm_ip() {
+    local query="publicIps"
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        query="privateIps"
+    fi
+    az vm show -d -g $RESOURCE_GROUP -n "$1" --query $query -o tsv 2>/dev/null | tr ',' '\n' | grep -v ':' | head -1
+}
+
+# Remove the VM from the mesh endpoints, keeping what is needed to restore it
+drain_vm() {
+    local name=$1
+    local ip=$2
+    local backup="$CONFIGS_DIR/drained-$name.json"
+
+    print_status "Draining $name ($ip) from the mesh..."
+
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        kubectl get endpointslice -n $VM_NAMESPACE -l kubernetes.io/service-name=$VM_APP -o json \
+            | jq --arg ip "$ip" '.items[] | select(any(.endpoints[]; .addresses | index($ip)))' > "$backup"
+        jq -r '.metadata.name' "$backup" | while read -r slice; do
+            kubectl get endpointslice "$slice" -n $VM_NAMESPACE -o json \
+                | jq --arg ip "$ip" '(.endpoints[] | select(.addresses | index($ip)) | .conditions.ready) = false' \
+                | kubectl apply -f - > /dev/null
+        done
+    else
+        kubectl get workloadentry -n $VM_NAMESPACE -o json \
+            | jq --arg ip "$ip" '{apiVersion: "v1", kind: "List", items: [.items[] | select(.spec.address == $ip)
+                | del(.metadata.resourceVersion, .metadata.uid, .metadata.creationTimestamp, .metadata.generation, .metadata.managedFields, .status)]}' > "$backup"
+        jq -r '.items[].metadata.name' "$backup" | while read -r entry; do
+            kubectl delete workloadentry "$entry" -n $VM_NAMESPACE > /dev/null
+        done
+    fi
+
+    print_status "Waiting ${DRAIN_SECONDS}s for in-flight requests..."
+    sleep "$DRAIN_SECONDS"
+}
+
+# Put the VM back in the mesh endpoints
+undrain_vm() {
+    local name=$1
+    local ip=$2
+    local backup="$CONFIGS_DIR/drained-$name.json"
+
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        jq -r '.metadata.name' "$backup" | while read -r slice; do
+            kubectl get endpointslice "$slice" -n $VM_NAMESPACE -o json \
+                | jq --arg ip "$ip" '(.endpoints[] | select(.addresses | index($ip)) | .conditions.ready) = true' \
+                | kubectl apply -f - > /dev/null
+        done
+    elif [ "$(jq '.items | length' "$backup")" -gt 0 ]; then
+        kubectl apply -f "$backup" > /dev/null
+    fi
+
+    rm -f "$backup"
+    print_status "✓ $name is receiving mesh traffic again"
+}
+
+# Apply OS updates and reboot when configured
+update_vm() {
+    local name=$1
+    local ip=$2
+
+    print_status "Applying OS updates on $name..."
+    if ! ssh "${SSH_OPTS[@]}" azureuser@$ip "sudo apt-get update -q && \
+        sudo DEBIAN_FRONTEND=noninteractive apt-get -y -q -o Dpkg::Options::=--force-confold upgrade" > /dev/null; then
+        print_error "OS update failed on $name"
+        return 1
+    fi
+
+    if [ "$REBOOT" = "required" ] && ! ssh "${SSH_OPTS[@]}" azureuser@$ip "test -f /var/run/reboot-required"; then
+        print_status "No reboot required on $name"
+        return 0
+    fi
+
+    print_status "Rebooting $name..."
+    ssh "${SSH_OPTS[@]}" azureuser@$ip "sudo systemctl reboot" || true
+    sleep 20
+
+    local deadline=$((SECONDS + REBOOT_TIMEOUT))
+    until ssh "${SSH_OPTS[@]}" azureuser@$ip "true" &> /dev/null; do
+        if [ $SECONDS -ge $deadline ]; then
+            print_error "$name is not reachable ${REBOOT_TIMEOUT}s after the reboot"
+            return 1
+        fi
+        sleep 10
+    done
+}
+
+# Check the sidecar and the application after the update
+verify_vm() {
+    local name=$1
+    local ip=$2
+    local i
+
+    print_status "Verifying sidecar and application health on $name..."
+    for i in {1..30}; do
+        if ssh "${SSH_OPTS[@]}" azureuser@$ip "systemctl is-active --quiet istio && \
+            curl -sf --max-time 5 http://localhost:15021/healthz/ready > /dev/null && \
+            curl -sf --max-time 5 http://localhost:8080/health > /dev/null" &> /dev/null; then
+            print_status "✓ Sidecar and application are healthy on $name"
+            return 0
+        fi
+        sleep 5
+    done
+
+    print_error "Sidecar or application not healthy on $name after the update"
+    return 1
+}
+
+# Power state of a VM as Azure displays it, e.g. "VM running"
+power_state() {
+    az vm get-instance-view --resource-group $RESOURCE_GROUP --name "$1" \
+        --query "instanceView.statuses[?starts_with(code, 'PowerState/')].displayStatus | [0]" -o tsv 2>/dev/null
+}
+
+# Start, stop, deallocate or restart one VM, keeping it out of the mesh endpoints while it
+# is down. A VM drained before a restart stays drained, start puts back any drained VM
+power_vm() {
+    local action=$1
+    local name=$2
+    local ip=$(vm_ip "$name")
+    local backup="$CONFIGS_DIR/drained-$name.json"
+    local was_drained=false
+
+    if [ -f "$backup" ]; then
+        was_drained=true
+    elif [ -n "$ip" ] && [[ "$action" =~ ^(stop|deallocate|restart)$ ]]; then
+        drain_vm "$name" "$ip"
+    fi
+
+    case $action in
+        start)
+            print_status "Starting $name..."
+            az vm start --resource-group $RESOURCE_GROUP --name "$name" > /dev/null
+            ;;
+        stop)
+            print_status "Powering off $name..."
+            az vm stop --resource-group $RESOURCE_GROUP --name "$name" > /dev/null
+            ;;
+        deallocate)
+            print_status "Deallocating $name..."
+            az vm deallocate --resource-group $RESOURCE_GROUP --name "$name" > /dev/null
+            ;;
+        restart)
+            print_status "Restarting $name..."
+            az vm restart --resource-group $RESOURCE_GROUP --name "$name" > /dev/null
+            ;;
+    esac
+
+    if [ -f "$backup" ] && { [ "$action" = "start" ] || { [ "$action" = "restart" ] && [ "$was_drained" = false ]; }; }; then
+        ip=$(vm_ip "$name")
+        if ! jq -e --arg ip "$ip" '[.. | objects | (.address // empty), (.addresses // [])[]] | length == 0 or index($ip) != null' "$backup" > /dev/null; then
+            # Restoring the entries would point the mesh at an address the VM lost with its deallocation
+            print_warning "$name came back with address ${ip:-none}, left drained: ./setup-istio.sh mesh-update --vm-name $name"
+        elif verify_vm "$name" "$ip"; then
+            undrain_vm "$name" "$ip"
+        else
+            print_error "$name left drained, restore data: $backup"
+            return 1
+        fi
+    fi
+
+    printf "%-30s %s\n" "$name" "$(power_state "$name")"
+}
+
+# Drain, update, reboot, verify and re-enable one VM
+patch_vm() {
+    local name=$1
+    local ip=$(vm_ip "$name")
+
+    if [ -z "$ip" ]; then
+        print_error "Could not get the IP address of VM $name"
+        return 1
+    fi
+
+    print_status "=== Patching $name ==="
+    drain_vm "$name" "$ip"
+
+    if update_vm "$name" "$ip" && verify_vm "$name" "$ip"; then
+        undrain_vm "$name" "$ip"
+        return 0
+    fi
+
+    print_error "$name left drained, restore data: $CONFIGS_DIR/drained-$name.json"
+    return 1
+}
+
+# Main function
+main() {
+    local vms=()
+    local action=""
+
+    case $1 in
+        "")
+            show_usage
+            exit 1
+            ;;
+        --all)
+            vms=($(az vm list --resource-group $RESOURCE_GROUP --query "[?tags.\"istio-warm-pool\"==null].name" -o tsv))
+            ;;
+        drain|undrain|start|stop|deallocate|restart|power-state)
+            action=$1
+            shift
+            vms=("$@")
+            ;;
+        *)
+            vms=("$@")
+            ;;
+    esac
+
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to drain VMs"
+        exit 1
+    fi
+
+    mkdir -p "$CONFIGS_DIR"
+
+    if [ -n "$action" ] && [ "$action" != "drain" ] && [ "$action" != "undrain" ]; then
+        local name
+        for name in "${vms[@]}"; do
+            if ! az vm show --resource-group $RESOURCE_GROUP --name "$name" &> /dev/null; then
+                print_error "VM $name not found in $RESOURCE_GROUP"
+                exit 1
+            fi
+            power_vm "$action" "$name"
+        done
+        return 0
+    fi
+
+    if [ -n "$action" ]; then
+        local name ip
+        for name in "${vms[@]}"; do
+            ip=$(vm_ip "$name")
+            if [ -z "$ip" ]; then
+                print_error "Could not get the IP address of VM $name"
+                exit 1
+            fi
+            if [ "$action" = "drain" ] && [ -f "$CONFIGS_DIR/drained-$name.json" ]; then
+                print_warning "$name is already drained"
+            elif [ "$action" = "drain" ]; then
+                drain_vm "$name" "$ip"
+            elif [ -f "$CONFIGS_DIR/drained-$name.json" ]; then
+                undrain_vm "$name" "$ip"
+            else
+                print_warning "$name is not drained"
+            fi
+        done
+        return 0
+    fi
+
+    print_status "Patching ${#vms[@]} VM(s) one at a time: ${vms[*]}"
+
+    local name patched=0
+    for name in "${vms[@]}"; do
+        if ! patch_vm "$name"; then
+            print_error "Rollout stopped after $patched of ${#vms[@]} VM(s)"
+            exit 1
+        fi
+        patched=$((patched + 1))
+    done
+
+    print_status "✅ $patched VM(s) patched"
+}
+
+# Run main function
+main "$@"
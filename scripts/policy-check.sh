@@ -0,0 +1,114 @@
+#!/bin/bash
+
+# Deployment Policy Check Script
+# Evaluates a deployment request (JSON input built by setup-istio.sh) against
+# organization policies written in Rego, using the OPA CLI. Policies are loaded
+# from a local file or directory, or from a git repository (URL[#REF]).
+# Every message in data.istio_azure.deployment.deny blocks the deployment.
+
+set -e
+
+# Policy configuration
+POLICY_SOURCE="${POLICY_SOURCE:-}"
+POLICY_QUERY="${POLICY_QUERY:-data.istio_azure.deployment.deny}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+POLICIES_DIR="$(dirname "$SCRIPT_DIR")/workspace/policies"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 INPUT_JSON"
+    echo ""
+    echo "Environment:"
+    echo "  POLICY_SOURCE   Rego file, directory or git repository URL[#REF] (required)"
+    echo "  POLICY_QUERY    Query returning the deny messages (default: data.istio_azure.deployment.deny)"
+}
+
+# Resolve the policy source to a local path, cloning git repositories into the workspace
+resolve_policies() {
+    case $POLICY_SOURCE in
+        https://*|git@*|*.git|*.git#*)
+            local url="${POLICY_SOURCE%%#*}"
+            local ref=""
+            if [[ "$POLICY_SOURCE" == *#* ]]; then
+                ref="${POLICY_SOURCE#*#}"
+            fi
+
+            rm -rf "$POLICIES_DIR"
+            mkdir -p "$(dirname "$POLICIES_DIR")"
+            if ! git clone -q --depth 1 ${ref:+--branch "$ref"} "$url" "$POLICIES_DIR" >&2; then
+                print_error "Failed to clone policy repository: $url" >&2
+                exit 1
+            fi
+            rm -rf "$POLICIES_DIR/.git"
+            echo "$POLICIES_DIR"
+            ;;
+        *)
+            if [ ! -e "$POLICY_SOURCE" ]; then
+                print_error "Policy source not found: $POLICY_SOURCE" >&2
+                exit 1
+            fi
+            echo "$POLICY_SOURCE"
+            ;;
+    esac
+}
+
+# Main function
+main() {
+    local input=$1
+
+    if [ -z "$POLICY_SOURCE" ] || [ ! -f "$input" ]; then
+        show_usage
+        exit 1
+    fi
+
+    if ! command -v opa &> /dev/null || ! command -v jq &> /dev/null; then
+        print_error "The OPA CLI and jq are required for policy checks: https://www.openpolicyagent.org/docs/latest/#running-opa"
+        exit 1
+    fi
+
+    local policies
+    policies=$(resolve_policies) || exit 1
+    print_status "Evaluating deployment policies from $POLICY_SOURCE..."
+
+    local violations
+    if ! violations=$(opa eval --format raw --data "$policies" --input "$input" "$POLICY_QUERY" 2>&1); then
+        print_error "Policy evaluation failed: $violations"
+        exit 1
+    fi
+
+    # An undefined query (e.g. wrong package name) returns nothing, treat it as an error
+    if [ -z "$violations" ]; then
+        print_error "Policy query $POLICY_QUERY is undefined in $POLICY_SOURCE"
+        exit 1
+    fi
+
+    if [ "$(echo "$violations" | jq 'length')" -eq 0 ]; then
+        print_status "✓ Deployment request complies with the policies"
+        return 0
+    fi
+
+    print_error "Deployment request denied by policy:"
+    echo "$violations" | jq -r '.[] | "  - \(.)"'
+    exit 1
+}
+
+# Run main function
+main "$@"
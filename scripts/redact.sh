@@ -0,0 +1,115 @@
+#!/bin/bash
+
+# Secret Redaction Script
+# Masks secrets in text, as a filter (stdin to stdout, line by line so that it can sit
+# in front of a terminal) or in files. Secrets are found two ways:
+#   by name    the values of the variables listed in REDACT_VARS, read from the
+#              environment, become [REDACTED:NAME]
+#   by shape   service account tokens and other JWTs, bearer tokens, SSH public key
+#              bodies, private key blocks, SAS signatures, storage account keys and
+#              password or client secret arguments, plus the extended regular
+#              expressions (awk syntax) of REDACT_PATTERNS_FILE, one per line, # for comments
+
+set -e
+
+# Redaction configuration
+REDACT_VARS="${REDACT_VARS:-}"
+REDACT_PATTERNS_FILE="${REDACT_PATTERNS_FILE:-}"
+
+# Values shorter than this are not masked, they would match ordinary words
+MIN_VALUE_LENGTH=6
+
+show_usage() {
+    echo "Usage: $0 [--in-place FILE...]"
+    echo ""
+    echo "Copies stdin to stdout with the secrets masked, or masks them in the FILEs."
+    echo ""
+    echo "Environment:"
+    echo "  REDACT_VARS            Names of the variables whose values are secrets"
+    echo "  REDACT_PATTERNS_FILE   Extra extended regular expressions of secrets"
+}
+
+# The awk program; values and patterns come from the environment
+REDACT_AWK='
+BEGIN {
+    n = split(ENVIRON["REDACT_VARS"], names, " ")
+    for (i = 1; i <= n; i++) {
+        if (length(ENVIRON[names[i]]) >= ENVIRON["MIN_VALUE_LENGTH"]) {
+            values[++nvalues] = ENVIRON[names[i]]
+            labels[nvalues] = names[i]
+        }
+    }
+    file = ENVIRON["REDACT_PATTERNS_FILE"]
+    if (file != "") {
+        while ((getline line < file) > 0) {
+            if (line != "" && line !~ /^#/) {
+                patterns[++npatterns] = line
+            }
+        }
+    }
+}
+# Literal replacement, values may hold regular expression characters
+function mask_value(s, value, label,    out, i) {
+    out = ""
+    while ((i = index(s, value)) > 0) {
+        out = out substr(s, 1, i - 1) "[REDACTED:" label "]"
+        s = substr(s, i + length(value))
+    }
+    return out s
+}
+/-----BEGIN [A-Z ]*PRIVATE KEY-----/ { in_key = 1; print "[REDACTED:private-key]"; fflush(); next }
+in_key { if ($0 ~ /-----END [A-Z ]*PRIVATE KEY-----/) in_key = 0; next }
+{
+    for (i = 1; i <= nvalues; i++) {
+        $0 = mask_value($0, values[i], labels[i])
+    }
+    gsub(/eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+/, "[REDACTED:jwt]")
+    gsub(/[Bb]earer [A-Za-z0-9._~+\/=-]+/, "Bearer [REDACTED]")
+    gsub(/(ssh-rsa|ssh-ed25519|ssh-dss|ecdsa-sha2-nistp[0-9]+) AAAA[A-Za-z0-9+\/=]+/, "[REDACTED:ssh-key]")
+    gsub(/sig=[A-Za-z0-9%+\/=]+/, "sig=[REDACTED]")
+    gsub(/AccountKey=[A-Za-z0-9+\/=]+/, "AccountKey=[REDACTED]")
+    gsub(/--password[ =][^ ]+/, "--password [REDACTED]")
+    gsub(/--client-secret[ =][^ ]+/, "--client-secret [REDACTED]")
+    for (i = 1; i <= npatterns; i++) {
+        gsub(patterns[i], "[REDACTED]")
+    }
+    print
+    fflush()
+}'
+
+redact_stream() {
+    MIN_VALUE_LENGTH=$MIN_VALUE_LENGTH awk "$REDACT_AWK"
+}
+
+redact_files() {
+    local file tmp
+    for file in "$@"; do
+        [ -f "$file" ] || continue
+        # Binary files are left alone
+        grep -Iq . "$file" 2>/dev/null || continue
+        tmp=$(mktemp)
+        redact_stream < "$file" > "$tmp"
+        cat "$tmp" > "$file"
+        rm -f "$tmp"
+    done
+}
+
+# Main function
+main() {
+    case $1 in
+        "")
+            redact_stream
+            ;;
+        --in-place)
+            shift
+            redact_files "$@"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
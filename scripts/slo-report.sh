@@ -0,0 +1,206 @@
+#!/bin/bash
+
+# Deployment SLO Report Script
+# Computes service level indicators of the VM deployments from the local history:
+# deployment success rate, time from the start of a deployment to the VM joining the
+# mesh (P50/P95) and validation pass rate (policy, network pre-flight, mesh tests).
+# Each indicator is reported over the SLO window and the 6h and 1h windows, with the
+# burn rate of its error budget. "check" fails when a burn rate is above its alert
+# threshold: the 1h window catches fast burns, the 6h window slow ones.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+
+# Objectives
+SLO_WINDOW_DAYS="${SLO_WINDOW_DAYS:-28}"
+SLO_DEPLOY_SUCCESS_TARGET="${SLO_DEPLOY_SUCCESS_TARGET:-0.95}"
+SLO_MESH_READY_SECONDS="${SLO_MESH_READY_SECONDS:-1200}"         # Deployments ready within this time...
+SLO_MESH_READY_TARGET="${SLO_MESH_READY_TARGET:-0.95}"           # ...make up this share of the successful ones
+SLO_VALIDATION_TARGET="${SLO_VALIDATION_TARGET:-0.90}"
+
+# Alerting
+SLO_FAST_BURN="${SLO_FAST_BURN:-14.4}"       # Burn rate threshold of the 1h window
+SLO_SLOW_BURN="${SLO_SLOW_BURN:-6}"          # Burn rate threshold of the 6h window
+SLO_WEBHOOK_URL="${SLO_WEBHOOK_URL:-}"       # Receives the firing alerts as JSON (optional)
+PUSHGATEWAY_URL="${PUSHGATEWAY_URL:-}"       # e.g. http://pushgateway.monitoring:9091
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+METRICS_FILE="$CONFIGS_DIR/slo-metrics.prom"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 report | metrics | check"
+    echo ""
+    echo "  report    Print the indicators, burn rates and firing alerts as JSON"
+    echo "  metrics   Write them to $METRICS_FILE in the Prometheus text format"
+    echo "  check     Print the firing alerts, send them to SLO_WEBHOOK_URL and exit 1 if any"
+    echo ""
+    echo "Environment:"
+    echo "  SLO_WINDOW_DAYS             SLO window in days (default: 28)"
+    echo "  SLO_DEPLOY_SUCCESS_TARGET   Share of successful deployments (default: 0.95)"
+    echo "  SLO_MESH_READY_SECONDS      Time to mesh ready objective (default: 1200)"
+    echo "  SLO_MESH_READY_TARGET       Share of deployments ready within it (default: 0.95)"
+    echo "  SLO_VALIDATION_TARGET       Share of passed validations (default: 0.90)"
+    echo "  SLO_FAST_BURN               Alert threshold of the 1h burn rate (default: 14.4)"
+    echo "  SLO_SLOW_BURN               Alert threshold of the 6h burn rate (default: 6)"
+    echo "  SLO_WEBHOOK_URL             Webhook receiving the firing alerts (optional)"
+    echo "  PUSHGATEWAY_URL             Prometheus Pushgateway receiving the metrics (optional)"
+}
+
+# The SLO report: indicators per window, burn rates and firing alerts
+slo_json() {
+    jq -n \
+        --rawfile deployments <(cat "$CONFIGS_DIR/deployment-history.log" 2>/dev/null) \
+        --rawfile validations <(cat "$CONFIGS_DIR/validation-history.log" 2>/dev/null) \
+        --rawfile phases <(cat "$CONFIGS_DIR/phase-history.posted.log" "$CONFIGS_DIR/phase-history.log" 2>/dev/null) \
+        --argjson now "$(date +%s)" \
+        --argjson days "$SLO_WINDOW_DAYS" \
+        --argjson targets "{\"deployment_success\": $SLO_DEPLOY_SUCCESS_TARGET, \"mesh_ready\": $SLO_MESH_READY_TARGET, \"validation\": $SLO_VALIDATION_TARGET}" \
+        --argjson ready_seconds "$SLO_MESH_READY_SECONDS" \
+        --argjson thresholds "{\"1h\": $SLO_FAST_BURN, \"6h\": $SLO_SLOW_BURN}" '
+        def rows: split("\n") | map(select(length > 0) | split("|"));
+        def ratio($good; $all): if $all == 0 then null else $good / $all end;
+        def pct($p): if length == 0 then null else sort | .[(length - 1) * $p | floor] end;
+        def round2: if . == null then null else . * 100 | round / 100 end;
+
+        ($phases | rows | map(select(.[0] == "mesh_integration" and .[3] == "completed") |
+            {vm: .[4], ended: (.[2] | tonumber)})) as $ready |
+        ($deployments | rows | map({command: .[0], vm: .[1], started: (.[2] | tonumber), ended: (.[3] | tonumber),
+            ok: (.[4] == "success")}) |
+            map(. as $d | .ready_seconds = ([$ready[] | select(.vm == $d.vm and .ended >= $d.started and .ended <= $d.ended) |
+                .ended - $d.started] | min))) as $d |
+        ($validations | rows | map({check: .[0], vm: .[1], time: (.[2] | tonumber), ok: (.[3] == "passed")})) as $v |
+
+        def indicators($seconds):
+            ($d | map(select(.ended > $now - $seconds))) as $dw |
+            ($dw | map(.ready_seconds | select(. != null))) as $times |
+            ($v | map(select(.time > $now - $seconds))) as $vw |
+            {deployments: ($dw | length),
+             deployment_success_rate: ratio($dw | map(select(.ok)) | length; $dw | length),
+             time_to_mesh_ready_seconds: {p50: ($times | pct(0.5)), p95: ($times | pct(0.95))},
+             mesh_ready_within_objective: ratio($times | map(select(. <= $ready_seconds)) | length; $times | length),
+             validations: ($vw | length),
+             validation_pass_rate: ratio($vw | map(select(.ok)) | length; $vw | length)};
+
+        def burn($rate; $target): if $rate == null then 0 else ((1 - $rate) / (1 - $target)) | round2 end;
+
+        {"\($days)d": indicators($days * 86400), "6h": indicators(21600), "1h": indicators(3600)} as $windows |
+        ($windows | with_entries(.value = {
+            deployment_success: burn(.value.deployment_success_rate; $targets.deployment_success),
+            mesh_ready: burn(.value.mesh_ready_within_objective; $targets.mesh_ready),
+            validation: burn(.value.validation_pass_rate; $targets.validation)})) as $burn |
+
+        {generated: (now | todate), window_days: $days, targets: ($targets + {mesh_ready_seconds: $ready_seconds}),
+         windows: ($windows | map_values(.deployment_success_rate |= round2 | .mesh_ready_within_objective |= round2 |
+             .validation_pass_rate |= round2)),
+         burn_rates: $burn,
+         alerts: [$thresholds | to_entries[] | .key as $w | .value as $limit |
+             $burn[$w] | to_entries[] | select(.value > $limit) |
+             {slo: .key, window: $w, burn_rate: .value, threshold: $limit}]}'
+}
+
+# Write the report in the Prometheus text format and push it when configured
+write_metrics() {
+    local report=$1
+
+    echo "$report" | jq -r '
+        def metric($name; $type; $help; $samples):
+            "# HELP \($name) \($help)", "# TYPE \($name) \($type)",
+            ($samples[] | select(.value != null) | "\($name){\(.labels | to_entries | map("\(.key)=\"\(.value)\"") | join(","))} \(.value)");
+        (.windows | to_entries) as $w |
+        metric("istio_vm_slo_deployments"; "gauge"; "Deployments finished in the window.";
+            [$w[] | {labels: {window: .key}, value: .value.deployments}]),
+        metric("istio_vm_slo_deployment_success_ratio"; "gauge"; "Share of successful deployments in the window.";
+            [$w[] | {labels: {window: .key}, value: .value.deployment_success_rate}]),
+        metric("istio_vm_slo_time_to_mesh_ready_seconds"; "gauge"; "Seconds from deployment start to the VM in the mesh.";
+            [$w[] | .key as $k | .value.time_to_mesh_ready_seconds | to_entries[] |
+                {labels: {window: $k, quantile: (if .key == "p50" then "0.5" else "0.95" end)}, value: .value}]),
+        metric("istio_vm_slo_validation_pass_ratio"; "gauge"; "Share of passed deployment validations in the window.";
+            [$w[] | {labels: {window: .key}, value: .value.validation_pass_rate}]),
+        metric("istio_vm_slo_burn_rate"; "gauge"; "Error budget burn rate of the SLO in the window.";
+            [.burn_rates | to_entries[] | .key as $k | .value | to_entries[] | {labels: {slo: .key, window: $k}, value: .value}]),
+        metric("istio_vm_slo_target"; "gauge"; "Objective of the SLO.";
+            [.targets | to_entries[] | select(.key != "mesh_ready_seconds") | {labels: {slo: .key}, value: .value}])
+    ' > "$METRICS_FILE.tmp"
+    mv "$METRICS_FILE.tmp" "$METRICS_FILE"
+    print_status "✓ SLO metrics written to $METRICS_FILE"
+
+    if [ -n "$PUSHGATEWAY_URL" ]; then
+        curl -s -f --max-time 10 --data-binary @"$METRICS_FILE" \
+            "${PUSHGATEWAY_URL%/}/metrics/job/istio_vm_slo/resource_group/$RESOURCE_GROUP" > /dev/null \
+            || print_warning "Could not push metrics to $PUSHGATEWAY_URL"
+    fi
+}
+
+# Report the firing alerts; returns 1 when there is any
+check_alerts() {
+    local report=$1
+    local alerts=$(echo "$report" | jq -c '.alerts')
+
+    if [ "$alerts" = "[]" ]; then
+        print_status "✓ Error budget burn rates within thresholds"
+        return 0
+    fi
+
+    echo "$alerts" | jq -r '.[] | "\(.slo) burns its error budget \(.burn_rate)x over \(.window) (threshold \(.threshold)x)"' \
+        | while IFS= read -r line; do print_error "$line"; done
+
+    if [ -n "$SLO_WEBHOOK_URL" ]; then
+        echo "$report" | jq -c --arg rg "$RESOURCE_GROUP" '{event: "SLOBurnRateExceeded", resource_group: $rg,
+            time: .generated, alerts, windows}' \
+            | curl -s -f --max-time 10 -H "Content-Type: application/json" --data-binary @- "$SLO_WEBHOOK_URL" > /dev/null \
+            || print_warning "Could not notify $SLO_WEBHOOK_URL"
+    fi
+    return 1
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to compute the SLO report"
+        exit 1
+    fi
+
+    local report
+    case $1 in
+        report)
+            slo_json
+            ;;
+        metrics)
+            mkdir -p "$CONFIGS_DIR"
+            report=$(slo_json)
+            write_metrics "$report"
+            ;;
+        check)
+            report=$(slo_json)
+            check_alerts "$report"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
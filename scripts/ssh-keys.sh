@@ -0,0 +1,225 @@
+#!/bin/bash
+
+# SSH Keys Script
+# Builds the set of public keys allowed to log in to the VMs as azureuser: the local key
+# the scripts connect with (~/.ssh/id_rsa.pub, created like az --generate-ssh-keys
+# when missing), the keys given with --ssh-key and the organization break-glass key.
+# Every key is checked before it reaches a VM: OpenSSH public key format, no DSA and
+# a minimum RSA size. "rotate" replaces authorized_keys on running VMs with the set
+# through the VM agent (az vm run-command), so it also works when SSH access is lost.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+
+# Key configuration
+VM_SSH_KEY_FILES="${VM_SSH_KEY_FILES:-}"        # Public key files, space separated, one or more keys each
+BREAK_GLASS_SSH_KEY="${BREAK_GLASS_SSH_KEY:-}"  # Public key file or key line of the break-glass key
+SSH_MIN_RSA_BITS="${SSH_MIN_RSA_BITS:-2048}"
+
+LOCAL_SSH_KEY="$HOME/.ssh/id_rsa.pub"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 validate | describe | export DIR | rotate VM_NAME... | rotate --all"
+    echo ""
+    echo "  validate        Check every key of the set, exit 1 if any is rejected"
+    echo "  describe        Print the type, size and fingerprint of every key as JSON"
+    echo "  export DIR      Write every key to DIR/key-N.pub, for az vm create --ssh-key-values"
+    echo "  rotate VM...    Replace authorized_keys of azureuser on the VMs with the set"
+    echo "  rotate --all    Same for every VM of RESOURCE_GROUP ($RESOURCE_GROUP) except warm pool VMs"
+    echo ""
+    echo "Environment:"
+    echo "  VM_SSH_KEY_FILES      Public key files added to the local key, space separated"
+    echo "  BREAK_GLASS_SSH_KEY   Break-glass public key, file or key line (optional)"
+    echo "  SSH_MIN_RSA_BITS      Minimum size of RSA keys (default: 2048)"
+}
+
+# "SOURCE|KEY" lines of the key set, without duplicates
+key_set() {
+    if [ ! -f "$LOCAL_SSH_KEY" ]; then
+        ssh-keygen -q -t rsa -b 4096 -N "" -f "${LOCAL_SSH_KEY%.pub}" >&2
+    fi
+
+    local file line
+    {
+        for file in "$LOCAL_SSH_KEY" $VM_SSH_KEY_FILES; do
+            if [ ! -f "$file" ]; then
+                echo "$file|"
+                continue
+            fi
+            grep -v -e '^[[:space:]]*$' -e '^[[:space:]]*#' "$file" | while IFS= read -r line; do
+                echo "$file|$line"
+            done
+        done
+        if [ -f "$BREAK_GLASS_SSH_KEY" ]; then
+            grep -v -e '^[[:space:]]*$' -e '^[[:space:]]*#' "$BREAK_GLASS_SSH_KEY" | head -1 | sed 's/^/break-glass|/'
+        elif [[ "$BREAK_GLASS_SSH_KEY" == *" "* ]]; then
+            echo "break-glass|$BREAK_GLASS_SSH_KEY"
+        elif [ -n "$BREAK_GLASS_SSH_KEY" ]; then
+            echo "$BREAK_GLASS_SSH_KEY|"
+        fi
+    } | awk '{ split(substr($0, index($0, "|") + 1), key, " ") } !seen[key[1] " " key[2]]++'
+}
+
+# Print "BITS FINGERPRINT TYPE" of a key line, or the reason it is rejected and return 1
+check_key() {
+    local key=$1
+    local bits fingerprint type
+
+    if [ -z "$key" ]; then
+        echo "file not found"
+        return 1
+    fi
+    if [[ "$key" == -----BEGIN* ]]; then
+        echo "private key, give the .pub file"
+        return 1
+    fi
+    if ! read -r bits fingerprint type < <(echo "$key" | ssh-keygen -l -f - 2>/dev/null | awk '{print $1, $2, $NF}'); then
+        echo "not an OpenSSH public key"
+        return 1
+    fi
+
+    type=$(echo "$type" | tr -d '()')
+    if [ "$type" = "DSA" ]; then
+        echo "DSA keys are not allowed"
+        return 1
+    fi
+    if [ "$type" = "RSA" ] && [ "$bits" -lt "$SSH_MIN_RSA_BITS" ]; then
+        echo "RSA key of $bits bits, the minimum is $SSH_MIN_RSA_BITS"
+        return 1
+    fi
+    echo "$bits $fingerprint $type"
+}
+
+# Check every key of the set; returns 1 when any is rejected
+validate_keys() {
+    local source key result rejected=0
+    while IFS='|' read -r source key; do
+        if result=$(check_key "$key"); then
+            print_status "✓ $source: $result"
+        else
+            print_error "$source: $result"
+            rejected=1
+        fi
+    done < <(key_set)
+    return $rejected
+}
+
+# JSON array with the source, type, size and fingerprint of every key
+describe_keys() {
+    local source key bits fingerprint type
+    while IFS='|' read -r source key; do
+        bits="" fingerprint="" type=""
+        read -r bits fingerprint type < <(check_key "$key") || true
+        jq -cn --arg source "$source" --arg type "$type" --arg bits "$bits" --arg fingerprint "$fingerprint" \
+            '{source: $source, type: $type, bits: ($bits | tonumber? // 0), fingerprint: $fingerprint}'
+    done < <(key_set) | jq -s -c '.'
+}
+
+# Write one file per key, az vm create reads a single key per file
+export_keys() {
+    local dir=$1
+    local n=0 source key
+
+    rm -rf "$dir"
+    mkdir -p "$dir"
+    while IFS='|' read -r source key; do
+        n=$((n + 1))
+        echo "$key" > "$dir/key-$n.pub"
+    done < <(key_set)
+}
+
+# Replace authorized_keys of azureuser on one VM, keeping the previous file as authorized_keys.bak
+rotate_vm() {
+    local name=$1
+    local content=$(key_set | cut -d'|' -f2- | base64 | tr -d '\n')
+
+    local power=$(az vm show -d -g $VM_RESOURCE_GROUP -n "$name" --query powerState -o tsv 2>/dev/null)
+    if [ "$power" != "VM running" ]; then
+        print_warning "$name is not running (${power:-not found}), skipped"
+        return 1
+    fi
+
+    local output=$(az vm run-command invoke -g $VM_RESOURCE_GROUP -n "$name" --command-id RunShellScript \
+        --query 'value[0].message' -o tsv --scripts "set -e
+dir=/home/azureuser/.ssh
+install -d -m 700 -o azureuser -g azureuser \$dir
+echo $content | base64 -d > \$dir/authorized_keys.new
+chown azureuser:azureuser \$dir/authorized_keys.new && chmod 600 \$dir/authorized_keys.new
+[ ! -f \$dir/authorized_keys ] || cp -p \$dir/authorized_keys \$dir/authorized_keys.bak
+mv \$dir/authorized_keys.new \$dir/authorized_keys
+echo KEYS-ROTATED \$(grep -c . \$dir/authorized_keys)" 2>&1)
+
+    if [[ "$output" != *KEYS-ROTATED* ]]; then
+        print_error "$name: authorized_keys not rotated: $output"
+        return 1
+    fi
+    print_status "✓ $name: authorized_keys replaced ($(echo "$output" | sed -n 's/.*KEYS-ROTATED \([0-9]*\).*/\1/p') keys)"
+}
+
+# Main function
+main() {
+    if ! command -v ssh-keygen &> /dev/null || ! command -v jq &> /dev/null; then
+        print_error "ssh-keygen and jq are required to manage SSH keys"
+        exit 1
+    fi
+
+    case $1 in
+        validate)
+            validate_keys
+            ;;
+        describe)
+            describe_keys
+            ;;
+        export)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            validate_keys || exit 1
+            export_keys "$2"
+            ;;
+        rotate)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            if ! validate_keys; then
+                print_error "Not rotating: fix the rejected keys first"
+                exit 1
+            fi
+            shift
+            local vms=("$@")
+            if [ "$1" = "--all" ]; then
+                VM_RESOURCE_GROUP=$RESOURCE_GROUP
+                vms=($(az vm list --resource-group $RESOURCE_GROUP --query "[?tags.\"istio-warm-pool\"==null].name" -o tsv))
+            fi
+            local name failed=0
+            for name in "${vms[@]}"; do
+                rotate_vm "$name" || failed=1
+            done
+            exit $failed
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
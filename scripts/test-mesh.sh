@@ -13,6 +13,7 @@ VM_APP="vm-web-service"
 # Configuration variables
 VM_SERVICE_NAME=$VM_APP
 TEST_TIMEOUT=30
+INTEGRATION_MODE="${INTEGRATION_MODE:-istio}"
 
 # Array to track failed tests
 FAILED_TESTS=()
@@ -189,6 +190,22 @@ test_vm_namespace() {
         print_test_result "FAIL" "VM service '$VM_SERVICE_NAME' not found"
     fi
     
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        # Test EndpointSlice mirrors the VM IP
+        ((total++))
+        local vm_addresses=$(kubectl get endpointslice -n "$VM_NAMESPACE" -l kubernetes.io/service-name="$VM_SERVICE_NAME" -o jsonpath='{.items[*].endpoints[*].addresses[*]}' 2>/dev/null || echo "")
+        if [ -n "$vm_addresses" ]; then
+            print_test_result "PASS" "EndpointSlice exists for VM service ($vm_addresses)"
+            ((passed++))
+        else
+            print_test_result "FAIL" "No EndpointSlice found for VM service"
+        fi
+
+        echo ""
+        print_status "VM Namespace Tests: $passed/$total passed"
+        return $((total - passed))
+    fi
+    
     # Test WorkloadEntry exists
     ((total++))
     local workload_entries=$(kubectl get workloadentry -n "$VM_NAMESPACE" --no-headers 2>/dev/null | wc -l)
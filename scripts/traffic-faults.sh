@@ -0,0 +1,275 @@
+#!/bin/bash
+
+# Traffic Faults Script
+# Injects delays and aborts into the traffic of a service, and mirrors its traffic to another
+# service, to test how the clients and the VM workload cope: e.g. mirror the requests of an
+# in-cluster service to the VM service before moving traffic to it, or the other way around.
+# Each change mutates the HTTP routes of the VirtualService of the service (one is created
+# for a service without it) and keeps the previous values and an expiry in its annotations.
+# A detached timer reverts it at expiry; "sweep" reverts the ones whose timer did not
+# survive and runs before every other action. The VirtualService is labeled
+# azure.traffic-fault=active meanwhile, so setup-vm-mesh leaves its routes alone.
+
+set -e
+
+# Shared configuration variables
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+FIELD_MANAGER="${FIELD_MANAGER:-istio-azure-setup}"
+
+# Fault configuration
+FAULT_SERVICE="${FAULT_SERVICE:-$VM_APP}"      # NAME (in VM_NAMESPACE) or NAME.NAMESPACE
+FAULT_MINUTES="${FAULT_MINUTES:-15}"
+FAULT_DELAY="${FAULT_DELAY:-5s}"
+FAULT_STATUS="${FAULT_STATUS:-503}"
+
+FAULT_LABEL="azure.traffic-fault"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 delay PERCENT | abort PERCENT | mirror SERVICE [PERCENT] | status | clear | sweep"
+    echo ""
+    echo "  delay PERCENT            Delay PERCENT of the requests to FAULT_SERVICE by FAULT_DELAY"
+    echo "  abort PERCENT            Fail PERCENT of the requests to FAULT_SERVICE with FAULT_STATUS"
+    echo "  mirror SERVICE [PERCENT] Copy PERCENT (default: 100) of the requests to FAULT_SERVICE to SERVICE"
+    echo "  status                   Show the faults and mirrors in place and when they are reverted"
+    echo "  clear                    Revert the faults and mirrors of FAULT_SERVICE now"
+    echo "  sweep                    Revert the expired faults and mirrors"
+    echo ""
+    echo "Environment:"
+    echo "  FAULT_SERVICE   Service whose traffic is changed, NAME or NAME.NAMESPACE (default: VM_APP)"
+    echo "  FAULT_MINUTES   Time before the change is reverted (default: 15)"
+    echo "  FAULT_DELAY     Delay of the delayed requests (default: 5s)"
+    echo "  FAULT_STATUS    HTTP status of the aborted requests (default: 503)"
+}
+
+current_user() {
+    az account show --query user.name -o tsv 2>/dev/null || whoami
+}
+
+# FQDN of a service given as NAME (in VM_NAMESPACE), NAME.NAMESPACE or FQDN
+service_host() {
+    case $1 in
+        *.svc.cluster.local) echo "$1" ;;
+        *.*) echo "$1.svc.cluster.local" ;;
+        *) echo "$1.$VM_NAMESPACE.svc.cluster.local" ;;
+    esac
+}
+
+# Name and namespace of FAULT_SERVICE
+fault_target() {
+    local namespace=$(echo "$FAULT_SERVICE" | cut -s -d. -f2)
+    echo "${FAULT_SERVICE%%.*} ${namespace:-$VM_NAMESPACE}"
+}
+
+# A percentage of requests, decimals allowed as in the Istio percentage
+valid_percent() {
+    [[ "$1" =~ ^[0-9]+(\.[0-9]+)?$ ]] && awk -v p="$1" 'BEGIN { exit !(p > 0 && p <= 100) }'
+}
+
+# Create a VirtualService with the plain route of a service that has none, so its routes can
+# be mutated. It is marked as created here and deleted when the change is reverted
+create_virtualservice() {
+    local name=$1 namespace=$2
+    if ! kubectl get service $name -n $namespace &> /dev/null; then
+        print_error "Service $name not found in $namespace"
+        exit 1
+    fi
+    kubectl apply --server-side --field-manager=$FIELD_MANAGER -f - > /dev/null <<EOF
+apiVersion: networking.istio.io/v1
+kind: VirtualService
+metadata:
+  name: $name
+  namespace: $namespace
+  annotations:
+    $FAULT_LABEL/created: "true"
+spec:
+  hosts:
+  - $name.$namespace.svc.cluster.local
+  http:
+  - route:
+    - destination:
+        host: $name.$namespace.svc.cluster.local
+EOF
+    print_status "VirtualService $name.$namespace created for the change"
+}
+
+# Apply the jq FILTER to every HTTP route of the VirtualService of FAULT_SERVICE and (re)arm
+# the revert timer. The routes before the first change are kept to be restored
+mutate_routes() {
+    local filter=$1 description=$2
+    local name namespace
+    read -r name namespace <<< "$(fault_target)"
+
+    local vs
+    if ! vs=$(kubectl get virtualservice $name -n $namespace -o json 2>/dev/null); then
+        create_virtualservice $name $namespace
+        vs=$(kubectl get virtualservice $name -n $namespace -o json)
+    fi
+    if [ "$(jq '.spec.http // [] | length' <<< "$vs")" -eq 0 ]; then
+        print_error "VirtualService $name.$namespace has no HTTP route, faults and mirroring need an HTTP service"
+        exit 1
+    fi
+
+    local expires=$(($(date +%s) + FAULT_MINUTES * 60))
+    local patch=$(jq -c --arg prefix "$FAULT_LABEL" --arg expires "$expires" --arg by "$(current_user)" "
+        {metadata: {labels: {(\$prefix): \"active\"}, annotations: {
+            \"\(\$prefix)/original\": (.metadata.annotations[\"\(\$prefix)/original\"] // ([.spec.http[] | {fault, mirror, mirrorPercentage}] | tojson)),
+            \"\(\$prefix)/expires\": \$expires, \"\(\$prefix)/by\": \$by}},
+         spec: {http: [.spec.http[] | $filter]}}" <<< "$vs")
+    kubectl patch virtualservice $name -n $namespace --type merge -p "$patch" --field-manager=$FIELD_MANAGER > /dev/null
+
+    # Detached timer reverting the change at expiry, sweep catches it if the timer does not survive
+    VM_NAMESPACE=$VM_NAMESPACE FIELD_MANAGER=$FIELD_MANAGER \
+        nohup bash "${BASH_SOURCE[0]}" expire $namespace $name $((FAULT_MINUTES * 60)) > /dev/null 2>&1 &
+
+    print_status "✓ $name.$namespace: $description until $(date -d @$expires '+%Y-%m-%d %H:%M %Z')"
+}
+
+# Restore the routes of a VirtualService as they were before the first change, or delete it
+# when it was created for the change; REASON is cleared or expired
+revert_routes() {
+    local namespace=$1 name=$2 reason=$3
+    local vs
+    vs=$(kubectl get virtualservice $name -n $namespace -o json 2>/dev/null) || return 0
+    # Already reverted, e.g. cleared before its timer expired
+    if [ "$(jq -r --arg prefix "$FAULT_LABEL" '.metadata.labels[$prefix] // ""' <<< "$vs")" != "active" ]; then
+        return 0
+    fi
+
+    if [ "$(jq -r --arg prefix "$FAULT_LABEL" '.metadata.annotations["\($prefix)/created"] // ""' <<< "$vs")" = "true" ]; then
+        kubectl delete virtualservice $name -n $namespace > /dev/null
+    else
+        local patch=$(jq -c --arg prefix "$FAULT_LABEL" '
+            (.metadata.annotations["\($prefix)/original"] | fromjson) as $original |
+            {metadata: {labels: {($prefix): null}, annotations: {"\($prefix)/original": null, "\($prefix)/expires": null, "\($prefix)/by": null}},
+             spec: {http: [.spec.http | to_entries[] | .value + ($original[.key] // {}) | with_entries(select(.value != null))]}}' <<< "$vs")
+        kubectl patch virtualservice $name -n $namespace --type merge -p "$patch" --field-manager=$FIELD_MANAGER > /dev/null
+    fi
+    print_status "✓ Faults and mirrors of $name.$namespace reverted ($reason)"
+}
+
+# "NAMESPACE NAME EXPIRES" lines of the VirtualServices with a change in place
+active_changes() {
+    kubectl get virtualservice -A -l "$FAULT_LABEL=active" -o json 2>/dev/null | jq -r --arg prefix "$FAULT_LABEL" \
+        '.items[] | "\(.metadata.namespace) \(.metadata.name) \(.metadata.annotations["\($prefix)/expires"] // 0)"'
+}
+
+sweep_expired() {
+    local now=$(date +%s)
+    local namespace name expires
+    while read -r namespace name expires; do
+        if [ -n "$name" ] && [ "$expires" -le "$now" ]; then
+            revert_routes $namespace $name expired
+        fi
+    done < <(active_changes)
+}
+
+show_changes() {
+    local changes=$(kubectl get virtualservice -A -l "$FAULT_LABEL=active" -o json 2>/dev/null || echo '{"items": []}')
+    if [ "$(jq '.items | length' <<< "$changes")" -eq 0 ]; then
+        print_status "No fault or mirror in place"
+        return 0
+    fi
+    jq -r --arg prefix "$FAULT_LABEL" --argjson now "$(date +%s)" '.items[] |
+        "\(.metadata.name).\(.metadata.namespace), by \(.metadata.annotations["\($prefix)/by"]), \((((.metadata.annotations["\($prefix)/expires"] | tonumber) - $now) / 60 | floor)) minutes left",
+        (.spec.http[] | [
+            (.fault.delay // empty | "  delay \(.fixedDelay) on \(.percentage.value)%"),
+            (.fault.abort // empty | "  abort \(.httpStatus) on \(.percentage.value)%"),
+            (.mirror // empty | "  mirror to \(.host)")
+        ] | .[])' <<< "$changes"
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to inject faults"
+        exit 1
+    fi
+
+    case $1 in
+        delay|abort)
+            if ! valid_percent "$2"; then
+                print_error "Percentage of the requests between 0 and 100 expected: ${2:-none}"
+                exit 1
+            fi
+            if [ "$1" = "delay" ] && ! [[ "$FAULT_DELAY" =~ ^[0-9]+(ms|s|m)$ ]]; then
+                print_error "Delay must be a duration like 500ms or 5s: $FAULT_DELAY"
+                exit 1
+            fi
+            if [ "$1" = "abort" ] && { ! [[ "$FAULT_STATUS" =~ ^[0-9]+$ ]] || [ "$FAULT_STATUS" -lt 200 ] || [ "$FAULT_STATUS" -gt 599 ]; }; then
+                print_error "Abort status must be an HTTP status between 200 and 599: $FAULT_STATUS"
+                exit 1
+            fi
+            sweep_expired
+            if [ "$1" = "delay" ]; then
+                mutate_routes ".fault = ((.fault // {}) + {delay: {percentage: {value: $2}, fixedDelay: \"$FAULT_DELAY\"}})" \
+                    "$2% of the requests delayed by $FAULT_DELAY"
+            else
+                mutate_routes ".fault = ((.fault // {}) + {abort: {percentage: {value: $2}, httpStatus: $FAULT_STATUS}})" \
+                    "$2% of the requests aborted with $FAULT_STATUS"
+            fi
+            ;;
+        mirror)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            local percent=${3:-100}
+            if ! valid_percent "$percent"; then
+                print_error "Percentage of the requests between 0 and 100 expected: $percent"
+                exit 1
+            fi
+            local host=$(service_host "$2")
+            if [ "$host" = "$(service_host "$FAULT_SERVICE")" ]; then
+                print_error "A service cannot mirror its traffic to itself"
+                exit 1
+            fi
+            sweep_expired
+            mutate_routes ".mirror = {host: \"$host\"} | .mirrorPercentage = {value: $percent}" \
+                "$percent% of the requests mirrored to $host"
+            ;;
+        status)
+            sweep_expired
+            show_changes
+            ;;
+        clear)
+            local name namespace
+            read -r name namespace <<< "$(fault_target)"
+            revert_routes $namespace $name cleared
+            ;;
+        sweep)
+            sweep_expired
+            ;;
+        expire)
+            # Timer started by a change: NAMESPACE NAME SECONDS. A later change of the same
+            # service moved the expiry, its own timer reverts it
+            sleep "$4"
+            local expires=$(kubectl get virtualservice $3 -n $2 -o jsonpath="{.metadata.annotations.${FAULT_LABEL//./\\.}/expires}" 2>/dev/null)
+            if [ -n "$expires" ] && [ "$expires" -le "$(date +%s)" ]; then
+                revert_routes $2 $3 expired
+            fi
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
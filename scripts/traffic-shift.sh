@@ -0,0 +1,171 @@
+#!/bin/bash
+
+# Traffic Shift Script
+# Moves the traffic of the VM service to an in-cluster Deployment serving the same host,
+# the classic VM to Kubernetes migration. The Deployment runs in the VM namespace with the
+# label app=VM_APP and its own version label, so the Service selects both. The
+# DestinationRule of the service gets the subsets "vm" and "k8s" (by version label) and
+# the VirtualService splits the traffic between them with weights stepped on request.
+# The resources are labeled azure.traffic-shift=active while a shift is in progress, so
+# setup-vm-mesh keeps the split instead of resetting the routes.
+
+set -e
+
+# Shared configuration variables
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+FIELD_MANAGER="${FIELD_MANAGER:-istio-azure-setup}"
+
+SHIFT_LABEL="azure.traffic-shift"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 start VERSION | step WEIGHT | status | stop"
+    echo ""
+    echo "  start VERSION   Add the subsets vm and k8s (pods labeled version=VERSION), all traffic to the VM"
+    echo "  step WEIGHT     Send WEIGHT percent (0-100) of the traffic to the Deployment, the rest to the VM"
+    echo "  status          Show the current split and the endpoints of each subset"
+    echo "  stop            Remove the subsets and the split, the Service balances over all endpoints again"
+}
+
+# Version label of the VM workload, from its WorkloadGroup
+vm_version() {
+    kubectl get workloadgroup $VM_APP -n $VM_NAMESPACE -o jsonpath='{.spec.metadata.labels.version}' 2>/dev/null
+}
+
+# Fail unless a shift was started for the service
+require_active_shift() {
+    if [ "$(kubectl get destinationrule $VM_APP -n $VM_NAMESPACE -o jsonpath="{.metadata.labels.${SHIFT_LABEL//./\\.}}" 2>/dev/null)" != "active" ]; then
+        print_error "No traffic shift in progress for $VM_APP.$VM_NAMESPACE, run: $0 start VERSION"
+        exit 1
+    fi
+}
+
+# Add the vm and k8s subsets to the DestinationRule and route all traffic to the VM
+start_shift() {
+    local version=$1
+    local vm_version=$(vm_version)
+
+    if [ -z "$vm_version" ]; then
+        print_error "WorkloadGroup $VM_APP not found in $VM_NAMESPACE, is the VM in the mesh?"
+        exit 1
+    fi
+    if [ "$version" = "$vm_version" ]; then
+        print_error "The Deployment needs a version label different from the VM ($vm_version)"
+        exit 1
+    fi
+    if [ -z "$(kubectl get pods -n $VM_NAMESPACE -l app=$VM_APP,version=$version -o name 2>/dev/null)" ]; then
+        print_warning "No pod labeled app=$VM_APP,version=$version in $VM_NAMESPACE yet, the k8s subset is empty"
+    fi
+
+    local subsets=$(jq -cn --arg vm "$vm_version" --arg k8s "$version" \
+        '{spec: {subsets: [{name: "vm", labels: {version: $vm}}, {name: "k8s", labels: {version: $k8s}}]}}')
+    kubectl patch destinationrule $VM_APP -n $VM_NAMESPACE --type merge -p "$subsets" --field-manager=$FIELD_MANAGER > /dev/null
+    kubectl label virtualservice,destinationrule $VM_APP -n $VM_NAMESPACE "$SHIFT_LABEL=active" --overwrite --field-manager=$FIELD_MANAGER > /dev/null
+
+    set_weight 0
+    print_status "✓ Subsets vm (version=$vm_version) and k8s (version=$version) created for $VM_APP.$VM_NAMESPACE"
+}
+
+# Split the traffic: WEIGHT percent to the k8s subset, the rest to the vm subset
+set_weight() {
+    local weight=$1
+
+    if ! [[ "$weight" =~ ^[0-9]+$ ]] || [ "$weight" -gt 100 ]; then
+        print_error "Weight must be a percentage between 0 and 100: $weight"
+        exit 1
+    fi
+
+    local patch=$(kubectl get virtualservice $VM_APP -n $VM_NAMESPACE -o json | jq -c --argjson weight "$weight" '
+        .spec.http[0].route[0].destination as $destination |
+        [{op: "replace", path: "/spec/http/0/route", value: [
+            {destination: ($destination + {subset: "vm"}), weight: (100 - $weight)},
+            {destination: ($destination + {subset: "k8s"}), weight: $weight}]}]')
+    kubectl patch virtualservice $VM_APP -n $VM_NAMESPACE --type json -p "$patch" --field-manager=$FIELD_MANAGER > /dev/null
+
+    print_status "✓ $VM_APP.$VM_NAMESPACE: $((100 - weight))% VM, $weight% Kubernetes"
+}
+
+# Print the split and the endpoints behind each subset
+show_shift() {
+    require_active_shift
+
+    kubectl get virtualservice $VM_APP -n $VM_NAMESPACE -o json \
+        | jq -r '.spec.http[0].route[] | "  \(.destination.subset // "all"): \(.weight // 100)%"'
+
+    local dr=$(kubectl get destinationrule $VM_APP -n $VM_NAMESPACE -o json)
+    local subset version
+    for subset in vm k8s; do
+        version=$(echo "$dr" | jq -r --arg s $subset '.spec.subsets[] | select(.name == $s) | .labels.version')
+        if [ "$subset" = "vm" ]; then
+            echo "  vm endpoints (version=$version): $(kubectl get workloadentry -n $VM_NAMESPACE -o json \
+                | jq --arg v "$version" --arg app "$VM_APP" '[.items[] | select(.spec.labels.app == $app and .spec.labels.version == $v)] | length')"
+        else
+            echo "  k8s endpoints (version=$version): $(kubectl get pods -n $VM_NAMESPACE -l app=$VM_APP,version=$version \
+                --field-selector status.phase=Running -o name | wc -l | tr -d ' ')"
+        fi
+    done
+}
+
+# Remove the subsets and the split, restoring the single route of the service
+stop_shift() {
+    require_active_shift
+
+    local patch=$(kubectl get virtualservice $VM_APP -n $VM_NAMESPACE -o json | jq -c '
+        [{op: "replace", path: "/spec/http/0/route", value: [{destination: (.spec.http[0].route[0].destination | del(.subset))}]}]')
+    kubectl patch virtualservice $VM_APP -n $VM_NAMESPACE --type json -p "$patch" --field-manager=$FIELD_MANAGER > /dev/null
+    kubectl patch destinationrule $VM_APP -n $VM_NAMESPACE --type json -p '[{"op": "remove", "path": "/spec/subsets"}]' --field-manager=$FIELD_MANAGER > /dev/null
+    kubectl label virtualservice,destinationrule $VM_APP -n $VM_NAMESPACE "$SHIFT_LABEL-" --field-manager=$FIELD_MANAGER > /dev/null
+
+    print_status "✓ Traffic shift of $VM_APP.$VM_NAMESPACE stopped"
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to shift traffic"
+        exit 1
+    fi
+
+    case $1 in
+        start)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            start_shift "$2"
+            ;;
+        step)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            require_active_shift
+            set_weight "$2"
+            ;;
+        status)
+            show_shift
+            ;;
+        stop)
+            stop_shift
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
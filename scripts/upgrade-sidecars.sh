@@ -0,0 +1,241 @@
+#!/bin/bash
+
+# Fleet Sidecar Upgrade Script
+# Rolls a new istio-sidecar package across the mesh VMs in waves. Each VM is
+# upgraded, restarted and health checked; after every wave the upgraded VMs must
+# stay healthy for WAVE_SOAK_SECONDS. The rollout pauses when failures exceed
+# MAX_FAILURES and resumes where it stopped when the same command is run again.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# Upgrade configuration
+TARGET_VERSION="${TARGET_VERSION:-}"            # Sidecar version to install, e.g. 1.27.1
+BATCH_SIZE="${BATCH_SIZE:-1}"                   # VMs per wave
+MAX_FAILURES="${MAX_FAILURES:-0}"               # Failed VMs tolerated before pausing
+WAVE_SOAK_SECONDS="${WAVE_SOAK_SECONDS:-60}"    # Health gate duration after each wave
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+PROGRESS_FILE="$CONFIGS_DIR/sidecar-upgrade.log"
+
+SSH_OPTS=(-o StrictHostKeyChecking=no -o ConnectTimeout=10)
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: TARGET_VERSION=X.Y.Z $0 upgrade | status"
+    echo ""
+    echo "  upgrade   Upgrade the sidecar of every VM of RESOURCE_GROUP ($RESOURCE_GROUP), in waves"
+    echo "  status    Show the per-VM progress of the last rollout"
+    echo ""
+    echo "Environment:"
+    echo "  TARGET_VERSION      Istio sidecar version to install (required for upgrade)"
+    echo "  BATCH_SIZE          VMs per wave (default: 1)"
+    echo "  MAX_FAILURES        Failed VMs tolerated before the rollout pauses (default: 0)"
+    echo "  WAVE_SOAK_SECONDS   Seconds upgraded VMs must stay healthy after each wave (default: 60)"
+}
+
+# IP used to reach the VM, same selection as vm-mesh-integration.sh
+vm_ip() {
+    local query="publicIps"
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        query="privateIps"
+    fi
+    az vm show -d -g $RESOURCE_GROUP -n "$1" --query $query -o tsv 2>/dev/null | tr ',' '\n' | grep -v ':' | head -1
+}
+
+# Record the progress of a VM
+record_progress() {
+    echo "$1|$TARGET_VERSION|$2|$(date -u +%Y-%m-%dT%H:%M:%SZ)" >> "$PROGRESS_FILE"
+}
+
+# Last recorded status of a VM for the target version
+last_status() {
+    grep "^$1|$TARGET_VERSION|" "$PROGRESS_FILE" 2>/dev/null | tail -1 | cut -d'|' -f3
+}
+
+# Sidecar and application readiness on the VM
+vm_healthy() {
+    ssh "${SSH_OPTS[@]}" azureuser@$1 "systemctl is-active --quiet istio && \
+        curl -sf --max-time 5 http://localhost:15021/healthz/ready > /dev/null" &> /dev/null
+}
+
+# Refuse sidecars newer than the control plane, istiod must be upgraded first
+check_version_skew() {
+    local image=$(kubectl get deployment istiod -n istio-system -o jsonpath='{.spec.template.spec.containers[0].image}' 2>/dev/null)
+    local control_plane="${image##*:}"
+
+    if [ -z "$control_plane" ]; then
+        print_warning "Could not get the istiod version, skipping version skew check"
+        return 0
+    fi
+
+    print_status "Control plane version: $control_plane, target sidecar version: $TARGET_VERSION"
+    if [ "$(printf '%s\n%s\n' "${control_plane%%-*}" "$TARGET_VERSION" | sort -V | tail -1)" != "${control_plane%%-*}" ]; then
+        print_error "Sidecar $TARGET_VERSION is newer than the control plane $control_plane, upgrade istiod first"
+        exit 1
+    fi
+}
+
+# Install the target sidecar package on one VM and wait until it is ready
+upgrade_vm() {
+    local name=$1
+    local ip=$(vm_ip "$name")
+
+    if [ -z "$ip" ]; then
+        print_error "[$name] Could not get the VM IP address"
+        return 1
+    fi
+
+    record_progress "$name" "upgrading"
+    print_status "[$name] Installing istio-sidecar $TARGET_VERSION..."
+    if ! ssh "${SSH_OPTS[@]}" azureuser@$ip "wget -q --timeout=30 --tries=3 -O /tmp/istio-sidecar.deb \
+        https://storage.googleapis.com/istio-release/releases/${TARGET_VERSION}/deb/istio-sidecar.deb && \
+        sudo dpkg -i /tmp/istio-sidecar.deb > /dev/null && rm -f /tmp/istio-sidecar.deb && \
+        sudo systemctl daemon-reload && sudo systemctl restart istio"; then
+        print_error "[$name] Package installation failed"
+        return 1
+    fi
+
+    local i
+    for i in {1..24}; do
+        if vm_healthy "$ip"; then
+            print_status "[$name] ✓ Sidecar $TARGET_VERSION ready"
+            return 0
+        fi
+        sleep 5
+    done
+
+    print_error "[$name] Sidecar not ready after the upgrade"
+    return 1
+}
+
+# Check that the VMs of the wave stay healthy for the soak period
+soak_wave() {
+    local deadline=$((SECONDS + WAVE_SOAK_SECONDS))
+    local name
+
+    print_status "Health gate: watching the wave for ${WAVE_SOAK_SECONDS}s..."
+    while [ $SECONDS -lt $deadline ]; do
+        for name in "$@"; do
+            if ! vm_healthy "$(vm_ip "$name")"; then
+                print_error "[$name] Became unhealthy during the health gate"
+                record_progress "$name" "failed"
+                return 1
+            fi
+        done
+        sleep 10
+    done
+}
+
+# Upgrade all VMs in waves of BATCH_SIZE
+run_upgrade() {
+    if [ -z "$TARGET_VERSION" ]; then
+        show_usage
+        exit 1
+    fi
+
+    check_version_skew
+
+    local vms=($(az vm list --resource-group $RESOURCE_GROUP --query "[?tags.\"istio-warm-pool\"==null].name" -o tsv))
+    local pending=() name
+    for name in "${vms[@]}"; do
+        if [ "$(last_status "$name")" = "upgraded" ]; then
+            print_status "[$name] Already on $TARGET_VERSION, skipping"
+        else
+            pending+=("$name")
+        fi
+    done
+
+    print_status "Upgrading ${#pending[@]} of ${#vms[@]} VM(s) to $TARGET_VERSION in waves of $BATCH_SIZE"
+
+    local failures=0 wave=1 start
+    for ((start = 0; start < ${#pending[@]}; start += BATCH_SIZE)); do
+        local batch=("${pending[@]:start:BATCH_SIZE}")
+        local upgraded=()
+        print_status "=== Wave $wave: ${batch[*]} ==="
+
+        for name in "${batch[@]}"; do
+            if upgrade_vm "$name"; then
+                upgraded+=("$name")
+            else
+                record_progress "$name" "failed"
+                failures=$((failures + 1))
+            fi
+        done
+
+        if [ ${#upgraded[@]} -gt 0 ]; then
+            if soak_wave "${upgraded[@]}"; then
+                for name in "${upgraded[@]}"; do
+                    record_progress "$name" "upgraded"
+                done
+            else
+                failures=$((failures + 1))
+            fi
+        fi
+
+        if [ $failures -gt "$MAX_FAILURES" ]; then
+            print_error "Rollout paused after wave $wave: $failures failure(s), $MAX_FAILURES tolerated"
+            print_status "Fix the failed VMs and run the upgrade again to resume"
+            exit 1
+        fi
+        wave=$((wave + 1))
+    done
+
+    print_status "✅ Sidecar rollout to $TARGET_VERSION finished ($failures failure(s))"
+}
+
+# Show the last recorded status of every VM
+show_progress() {
+    if [ ! -s "$PROGRESS_FILE" ]; then
+        print_status "No sidecar rollout recorded"
+        return 0
+    fi
+
+    printf "%-30s %-12s %-10s %s\n" "VM" "VERSION" "STATUS" "UPDATED"
+    awk -F'|' '{ last[$1] = $0 } END { for (vm in last) print last[vm] }' "$PROGRESS_FILE" | sort \
+        | while IFS='|' read -r name version status updated; do
+            printf "%-30s %-12s %-10s %s\n" "$name" "$version" "$status" "$updated"
+        done
+}
+
+# Main function
+main() {
+    mkdir -p "$CONFIGS_DIR"
+
+    case $1 in
+        upgrade)
+            run_upgrade
+            ;;
+        status)
+            show_progress
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
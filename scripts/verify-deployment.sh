@@ -0,0 +1,216 @@
+#!/bin/bash
+
+# Deployment Verification Script
+# Runs a named suite of post-deployment checks against the VM workload. Suites are
+# registered in a JSON file (see examples/verification-suites.json) as lists of checks:
+#   http      request from the mesh-test sleep pod, expects a status code
+#   mtls      same request, then checks the client sidecar negotiated TLS with the VM
+#   latency   N requests from the sleep pod, the P95 must stay within a budget
+#   dns       a name resolves, in the cluster or on the VM
+# Results are printed and written as a JSON report; any failed check fails the run.
+
+set -e
+
+# Shared configuration variables
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_IP="${VM_IP:-}"
+
+# Verification configuration
+VERIFICATION_SUITES="${VERIFICATION_SUITES:-}"    # JSON file of the suites
+CLIENT_NAMESPACE="mesh-test"
+CLIENT="deployment/sleep"
+
+SSH_OPTS=(-o StrictHostKeyChecking=no -o ConnectTimeout=10)
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 list | check SUITE | run SUITE [REPORT]"
+    echo ""
+    echo "  list                 List the suites and their checks"
+    echo "  check SUITE          Exit 1 when SUITE is not registered or has an unknown check type"
+    echo "  run SUITE [REPORT]   Run the checks of SUITE, write the JSON report to REPORT"
+    echo ""
+    echo "Environment:"
+    echo "  VERIFICATION_SUITES  JSON file of the suites (required)"
+    echo "  VM_IP                Address of the VM, for dns checks run on the VM"
+}
+
+# Run a command in the client pod of the mesh-test namespace
+client() {
+    kubectl exec $CLIENT -n $CLIENT_NAMESPACE -c sleep -- "$@"
+}
+
+# Cluster local name of a host given as SERVICE.NAMESPACE
+fqdn() {
+    case $1 in
+        *.*.*) echo "$1" ;;
+        *) echo "$1.svc.cluster.local" ;;
+    esac
+}
+
+# URL of the check, the VM service by default
+check_url() {
+    jq -r --arg host "$VM_APP.$VM_NAMESPACE" '"http://\(.host // $host):\(.port // 8080)\(.path // "/")"' <<< "$1"
+}
+
+check_http() {
+    local url=$(check_url "$1")
+    local expect=$(jq -r '.expect // 200' <<< "$1")
+    local code=$(client curl -s -o /dev/null -w '%{http_code}' --max-time 10 "$url" 2>/dev/null || true)
+
+    echo "$url returned ${code:-no response}, expected $expect"
+    [ "$code" = "$expect" ]
+}
+
+check_mtls() {
+    local host=$(jq -r --arg host "$VM_APP.$VM_NAMESPACE" '.host // $host' <<< "$1")
+    local port=$(jq -r '.port // 8080' <<< "$1")
+
+    client curl -s -o /dev/null --max-time 10 "http://$host:$port/" &> /dev/null || true
+    local handshakes=$(kubectl exec $CLIENT -n $CLIENT_NAMESPACE -c istio-proxy -- pilot-agent request GET stats 2>/dev/null \
+        | grep -F "cluster.outbound|$port||$(fqdn "$host").ssl.handshake:" | awk '{print $2}')
+
+    echo "${handshakes:-0} TLS handshakes from the sidecar to $host:$port"
+    [ "${handshakes:-0}" -gt 0 ]
+}
+
+check_latency() {
+    local url=$(check_url "$1")
+    local requests=$(jq -r '.requests // 20' <<< "$1")
+    local budget=$(jq -r '.p95_ms // 500' <<< "$1")
+
+    local p95=$(client sh -c "for i in \$(seq $requests); do curl -s -o /dev/null -w '%{time_total}\n' --max-time 10 '$url'; done" 2>/dev/null \
+        | awk '{ print int($1 * 1000) }' | sort -n | awk '{ t[NR] = $1 } END { if (NR) print t[int((NR - 1) * 0.95) + 1] }')
+
+    echo "P95 of $requests requests to $url: ${p95:-unknown}ms, budget ${budget}ms"
+    [ -n "$p95" ] && [ "$p95" -le "$budget" ]
+}
+
+check_dns() {
+    local host=$(jq -r --arg host "$VM_APP.$VM_NAMESPACE.svc.cluster.local" '.host // $host' <<< "$1")
+    local from=$(jq -r '.from // "cluster"' <<< "$1")
+    local address
+
+    if [ "$from" = "vm" ]; then
+        address=$(ssh "${SSH_OPTS[@]}" azureuser@$VM_IP "getent hosts $host" 2>/dev/null | awk '{print $1; exit}')
+    else
+        address=$(client nslookup "$host" 2>/dev/null | awk '/^Address/ { a = $NF } END { print a }')
+    fi
+
+    echo "$host resolves to ${address:-nothing} from the $from"
+    [ -n "$address" ]
+}
+
+# Checks of the suite, one JSON object per line
+suite_checks() {
+    jq -c --arg suite "$1" '.suites[$suite][]?' "$VERIFICATION_SUITES"
+}
+
+list_suites() {
+    jq -r '.suites | to_entries[] | "\(.key):", (.value[] | "  \(.type)\t\(.name // "")")' "$VERIFICATION_SUITES"
+}
+
+# Exit 1 when the suite cannot run
+check_suite() {
+    local suite=$1
+    if [ "$(jq --arg suite "$suite" '.suites[$suite] | length' "$VERIFICATION_SUITES")" -eq 0 ]; then
+        print_error "Verification suite '$suite' not found in $VERIFICATION_SUITES"
+        exit 1
+    fi
+    local unknown=$(suite_checks "$suite" | jq -r 'select(.type | IN("http", "mtls", "latency", "dns") | not) | .type' | sort -u)
+    if [ -n "$unknown" ]; then
+        print_error "Unknown check type in suite '$suite': $unknown (valid: http, mtls, latency, dns)"
+        exit 1
+    fi
+}
+
+run_suite() {
+    local suite=$1
+    local report=$2
+    check_suite "$suite"
+    print_status "Running verification suite '$suite' on $VM_NAME..."
+
+    local check type name detail result start failed=0 results=()
+    while IFS= read -r check; do
+        type=$(jq -r '.type' <<< "$check")
+        name=$(jq -r --arg type "$type" '.name // $type' <<< "$check")
+        start=$SECONDS
+        if detail=$(check_$type "$check"); then
+            result="passed"
+            print_status "✓ $name: $detail"
+        else
+            result="failed"
+            failed=$((failed + 1))
+            print_error "✗ $name: $detail"
+        fi
+        results+=("$(jq -cn --arg name "$name" --arg type "$type" --arg result "$result" --arg detail "$detail" \
+            --argjson seconds $((SECONDS - start)) '{name: $name, type: $type, result: $result, detail: $detail, seconds: $seconds}')")
+    done < <(suite_checks "$suite")
+
+    if [ -n "$report" ]; then
+        printf '%s\n' "${results[@]}" | jq -s --arg suite "$suite" --arg vm "$VM_NAME" --argjson failed $failed \
+            '{suite: $suite, vm: $vm, finished: (now | todate), result: (if $failed == 0 then "passed" else "failed" end), checks: .}' > "$report"
+    fi
+
+    if [ $failed -gt 0 ]; then
+        print_error "Verification suite '$suite': $failed of ${#results[@]} checks failed"
+        return 1
+    fi
+    print_status "✅ Verification suite '$suite' passed (${#results[@]} checks)"
+}
+
+# Main function
+main() {
+    if [ -z "$VERIFICATION_SUITES" ] || [ -z "$1" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to run verification suites"
+        exit 1
+    fi
+    if [ ! -f "$VERIFICATION_SUITES" ]; then
+        print_error "Verification suites file not found: $VERIFICATION_SUITES"
+        exit 1
+    fi
+
+    case $1 in
+        list)
+            list_suites
+            ;;
+        check)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            check_suite "$2"
+            ;;
+        run)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            run_suite "$2" "$3"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,199 @@
+#!/bin/bash
+
+# VM Lifecycle Events Script
+# Subscribes the managed resource groups (RESOURCE_GROUP and the resource groups of
+# its VMs) to Azure Event Grid and delivers the VM write and delete events to a Storage
+# queue, so the onboarding watcher reacts within seconds instead of its next poll.
+# "receive" waits for events and prints them as "ACTION VM_NAME RESOURCE_GROUP" lines,
+# removing them from the queue. Event Grid delivers at least once: an event whose id was
+# already received, or older than EVENTS_MAX_AGE, is removed without being printed.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+
+# Events configuration (EVENTS_STORAGE_ACCOUNT is required)
+EVENTS_STORAGE_ACCOUNT="${EVENTS_STORAGE_ACCOUNT:-}"
+EVENTS_QUEUE="${EVENTS_QUEUE:-istio-vm-events}"
+EVENTS_MAX_AGE="${EVENTS_MAX_AGE:-3600}"
+EVENTS_SEEN_FILE="${EVENTS_SEEN_FILE:-}"
+
+# Event ids kept in EVENTS_SEEN_FILE
+SEEN_EVENTS_KEPT=1000
+
+EVENT_SUBSCRIPTION="istio-vm-lifecycle"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 create | delete | status | receive [SECONDS]"
+    echo ""
+    echo "  create            Create the queue and the Event Grid subscriptions of the managed resource groups"
+    echo "  delete            Delete the subscriptions and the queue"
+    echo "  status            Show the subscriptions and the number of queued events"
+    echo "  receive [SECONDS] Wait up to SECONDS (default: 60) for events, print and remove them"
+    echo ""
+    echo "Environment:"
+    echo "  EVENTS_STORAGE_ACCOUNT   Existing Storage account of the queue (required)"
+    echo "  EVENTS_QUEUE             Queue name (default: istio-vm-events)"
+    echo "  EVENTS_MAX_AGE           Seconds after which an event is dropped as stale (default: 3600)"
+    echo "  EVENTS_SEEN_FILE         File remembering the received event ids across runs (default: none)"
+}
+
+# Run az storage commands on the queue account with the logged-in identity
+storage() {
+    az storage "$@" --account-name "$EVENTS_STORAGE_ACCOUNT" --auth-mode login
+}
+
+# RESOURCE_GROUP and the resource groups created for its VMs
+managed_resource_groups() {
+    echo "$RESOURCE_GROUP"
+    az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv
+}
+
+create_subscriptions() {
+    local account_id
+    if ! account_id=$(az storage account show --name "$EVENTS_STORAGE_ACCOUNT" --query id -o tsv 2>/dev/null); then
+        print_error "Storage account $EVENTS_STORAGE_ACCOUNT not found"
+        exit 1
+    fi
+
+    az provider register --namespace Microsoft.EventGrid > /dev/null
+    storage queue create --name "$EVENTS_QUEUE" > /dev/null
+    print_status "✓ Queue $EVENTS_QUEUE in $EVENTS_STORAGE_ACCOUNT"
+
+    local rg
+    for rg in $(managed_resource_groups); do
+        az eventgrid event-subscription create \
+            --name "$EVENT_SUBSCRIPTION" \
+            --source-resource-id "$(az group show --name $rg --query id -o tsv)" \
+            --endpoint-type storagequeue \
+            --endpoint "$account_id/queueServices/default/queues/$EVENTS_QUEUE" \
+            --included-event-types Microsoft.Resources.ResourceWriteSuccess Microsoft.Resources.ResourceDeleteSuccess \
+            --advanced-filter data.operationName StringIn \
+                Microsoft.Compute/virtualMachines/write Microsoft.Compute/virtualMachines/delete > /dev/null
+        print_status "✓ VM events of $rg delivered to $EVENTS_QUEUE"
+    done
+}
+
+delete_subscriptions() {
+    local rg
+    for rg in $(managed_resource_groups); do
+        if az eventgrid event-subscription delete --name "$EVENT_SUBSCRIPTION" \
+            --source-resource-id "$(az group show --name $rg --query id -o tsv)" &> /dev/null; then
+            print_status "✓ Event subscription of $rg deleted"
+        fi
+    done
+    storage queue delete --name "$EVENTS_QUEUE" > /dev/null
+    print_status "✓ Queue $EVENTS_QUEUE deleted"
+}
+
+show_subscriptions() {
+    local rg state
+    for rg in $(managed_resource_groups); do
+        state=$(az eventgrid event-subscription show --name "$EVENT_SUBSCRIPTION" \
+            --source-resource-id "$(az group show --name $rg --query id -o tsv)" \
+            --query provisioningState -o tsv 2>/dev/null || echo "not subscribed")
+        echo "  $rg: $state"
+    done
+    echo "  Queued events: $(storage queue metadata show --name "$EVENTS_QUEUE" --query approximateMessageCount -o tsv 2>/dev/null || echo unknown)"
+}
+
+# Print the VM events of the queue as "ACTION VM_NAME RESOURCE_GROUP", waiting up to SECONDS for the first ones
+receive_events() {
+    local deadline=$((SECONDS + ${1:-60}))
+    local messages
+
+    while true; do
+        messages=$(storage message get --queue-name "$EVENTS_QUEUE" --num-messages 32 --visibility-timeout 60 -o json 2>/dev/null || echo '[]')
+        if [ "$(echo "$messages" | jq 'length')" -gt 0 ]; then
+            break
+        fi
+        if [ $SECONDS -ge $deadline ]; then
+            return 0
+        fi
+        sleep 5
+    done
+
+    local seen=${EVENTS_SEEN_FILE:-$(mktemp)}
+    touch "$seen"
+
+    local id receipt content event event_id age
+    while IFS='|' read -r id receipt content; do
+        # Event Grid base64 encodes the events it writes to queues
+        event=$content
+        if [[ "$content" != "{"* ]]; then
+            event=$(echo "$content" | base64 -d 2>/dev/null || true)
+        fi
+        event_id=$(echo "$event" | jq -r '.id // empty' 2>/dev/null || true)
+        age=$(echo "$event" | jq -r 'now - (.eventTime // "" | sub("\\.[0-9]+"; "") | fromdateiso8601? // now) | floor' 2>/dev/null || echo 0)
+        if [ -n "$event_id" ] && grep -qxF "$event_id" "$seen"; then
+            print_warning "Skipped event $event_id, already received" >&2
+        elif [ "${age:-0}" -gt "$EVENTS_MAX_AGE" ]; then
+            print_warning "Skipped event ${event_id:-$id}, ${age}s old" >&2
+        else
+            echo "$event" | jq -r '(.data.operationName | if endswith("/delete") then "delete" else "write" end) + " " +
+                (.subject | split("/") | "\(.[-1]) \(.[4])")' 2>/dev/null || print_warning "Skipped unreadable event $id" >&2
+            if [ -n "$event_id" ]; then
+                echo "$event_id" >> "$seen"
+            fi
+        fi
+        storage message delete --queue-name "$EVENTS_QUEUE" --id "$id" --pop-receipt "$receipt" > /dev/null
+    done < <(echo "$messages" | jq -r '.[] | "\(.id)|\(.popReceipt)|\(.content)"')
+
+    tail -n $SEEN_EVENTS_KEPT "$seen" > "$seen.tmp" && mv "$seen.tmp" "$seen"
+    if [ -z "$EVENTS_SEEN_FILE" ]; then
+        rm -f "$seen"
+    fi
+}
+
+# Main function
+main() {
+    if [ -z "$EVENTS_STORAGE_ACCOUNT" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to handle VM events"
+        exit 1
+    fi
+
+    case $1 in
+        create)
+            create_subscriptions
+            ;;
+        delete)
+            delete_subscriptions
+            ;;
+        status)
+            show_subscriptions
+            ;;
+        receive)
+            receive_events "$2"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
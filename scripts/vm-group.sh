@@ -0,0 +1,154 @@
+#!/bin/bash
+
+# VM Group Script
+# A group is an application deployed on several VMs, e.g. ratings-v1 on 3 VMs. Its VMs
+# carry the tag istio-group=NAME (copied to the Istio resources as the label azure.group)
+# and are named NAME-1..NAME-N. Lists the members of a group and reports their Azure
+# and mesh state; scaling, draining and deleting are done by setup-istio.sh group.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+INTEGRATION_MODE="${INTEGRATION_MODE:-istio}"
+
+GROUP_TAG="istio-group"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 members NAME | status NAME | check NAME"
+    echo ""
+    echo "  members NAME   Print the VMs of the group, one per line in index order"
+    echo "  status NAME    Show the power state, address and mesh registration of every VM of the group"
+    echo "  check NAME     Count the mesh registrations and metrics endpoints of every VM of the group,"
+    echo "                 fail when a VM has none or a VM removed from the group left some behind"
+}
+
+# VMs tagged with the group, in index order
+group_members() {
+    az vm list --resource-group $RESOURCE_GROUP --query "[?tags.\"$GROUP_TAG\"=='$1'].name" -o tsv | sort -V
+}
+
+# One line per VM of the group: NAME POWER PRIVATE_IP MESH
+group_status() {
+    local group=$1
+    local vms=$(bash "$SCRIPT_DIR/vm-status.sh" list $RESOURCE_GROUP | jq -c --arg tag "$GROUP_TAG" --arg group "$group" \
+        '[.[] | select(.tags[$tag] == $group) | {name, power: .powerState, ips: .privateIps, public: .publicIps}]')
+
+    if [ "$(echo "$vms" | jq 'length')" -eq 0 ]; then
+        print_warning "Group $group has no VMs in $RESOURCE_GROUP"
+        return 0
+    fi
+
+    # Addresses with a WorkloadEntry, or a ready endpoint of a mirrored EndpointSlice
+    local registered
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        registered=$(kubectl get endpointslice -n $VM_NAMESPACE -l endpointslice.kubernetes.io/managed-by=istio-azure-setup -o json 2>/dev/null \
+            | jq -c '[.items[].endpoints[] | select(.conditions.ready != false) | .addresses[]]' || echo '[]')
+    else
+        registered=$(kubectl get workloadentry -n $VM_NAMESPACE -o json 2>/dev/null | jq -c '[.items[].spec.address]' || echo '[]')
+    fi
+
+    printf "%-30s %-16s %-16s %s\n" "VM" "POWER" "PRIVATE IP" "MESH"
+    local name power private public mesh
+    while IFS='|' read -r name power private public; do
+        if [ -f "$CONFIGS_DIR/drained-$name.json" ]; then
+            mesh="drained"
+        elif echo "$registered" | jq -e --arg private "${private%%,*}" --arg public "${public%%,*}" \
+            'index($private) != null or ($public != "" and index($public) != null)' > /dev/null; then
+            mesh="registered"
+        else
+            mesh="not registered"
+        fi
+        printf "%-30s %-16s %-16s %s\n" "$name" "${power#VM }" "${private%%,*}" "$mesh"
+    done < <(echo "$vms" | jq -r 'sort_by(.name | capture("-(?<n>[0-9]+)$").n // "0" | tonumber) | .[] | "\(.name)|\(.power)|\(.ips)|\(.public // "")"')
+}
+
+# Registrations labeled with a VM of the group: one line per VM with its instance
+# registrations (WorkloadEntries, or EndpointSlices in endpointslice mode) and metrics
+# endpoints. Auto-registered WorkloadEntries are created by istiod without the VM label,
+# only their metrics endpoints are counted
+group_check() {
+    local group=$1
+    local members=$(group_members "$group" | jq -Rn '[inputs]')
+    local counts=$(kubectl get workloadentry,endpointslice -n $VM_NAMESPACE -l azure.vm -o json | jq -c \
+        --argjson members "$members" --arg group "$group" '
+        [.items[] | {vm: .metadata.labels["azure.vm"], resource: .metadata.labels["azure.resource"]}
+            | select(.vm as $vm | ($members | index($vm)) != null or ($vm | test("^\($group)-[0-9]+$")))]
+        | group_by(.vm) | map({key: .[0].vm, value: {
+            instances: map(select(.resource == "vm-instance" or .resource == "vm-endpoint")) | length,
+            metrics: map(select(.resource == "vm-metrics")) | length}}) | from_entries')
+
+    printf "%-30s %-10s %-10s %s\n" "VM" "INSTANCES" "METRICS" "CHECK"
+    local failed=0 name instances metrics check
+    while read -r name instances metrics check; do
+        [ "$check" = "ok" ] || failed=$((failed + 1))
+        printf "%-30s %-10s %-10s %s\n" "$name" "$instances" "$metrics" "$check"
+    done < <(jq -r --argjson counts "$counts" --arg mode "$INTEGRATION_MODE" '
+        ([$counts[] | .metrics] | any(. > 0)) as $scraped
+        | (.[] | . as $vm | ($counts[$vm] // {instances: 0, metrics: 0}) as $c
+            | [$vm, $c.instances, $c.metrics,
+               (if $mode != "autoregister" and $c.instances == 0 then "no-registration"
+                elif $scraped and $c.metrics == 0 then "no-metrics-endpoint" else "ok" end)]),
+          ($counts | keys[] | select(. as $vm | $members | index($vm) | not)
+            | [., $counts[.].instances, $counts[.].metrics, "removed-vm-leftover"])
+        | @tsv' --argjson members "$members" <<< "$members")
+
+    if [ $failed -gt 0 ]; then
+        print_error "$failed VM(s) of group $group with mismatched mesh registrations"
+        return 1
+    fi
+    print_status "✓ Mesh registrations of group $group match its $(jq 'length' <<< "$members") VM(s)"
+}
+
+# Main function
+main() {
+    if [ -z "$2" ]; then
+        show_usage
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to manage VM groups"
+        exit 1
+    fi
+
+    case $1 in
+        members)
+            group_members "$2"
+            ;;
+        status)
+            group_status "$2"
+            ;;
+        check)
+            group_check "$2"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,196 @@
+#!/bin/bash
+
+# VM Identity Script
+# Gives a VM a managed identity (system-assigned, or a user-assigned identity created
+# when missing) and the role assignments its workload needs, e.g. AcrPull on a registry
+# or Key Vault Secrets User on a vault. Assignments made here carry a description
+# naming the VM, so "release" removes exactly those when the VM goes away, together
+# with the user-assigned identity if it was created for the VM.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+
+# Identity configuration
+VM_IDENTITY="${VM_IDENTITY:-}"                      # system, user (VM_NAME-identity), identity name or resource ID
+VM_ROLE_ASSIGNMENTS="${VM_ROLE_ASSIGNMENTS:-}"      # ROLE:SCOPE entries separated by ";"
+
+OWNER_PREFIX="istio-azure-setup:"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 assign VM_NAME | release VM_NAME | validate"
+    echo ""
+    echo "  assign VM_NAME    Give the VM its identity and create the role assignments"
+    echo "  release VM_NAME   Remove the role assignments made for the VM and the identity created for it"
+    echo "  validate          Resolve the scopes of the role assignments without changing anything"
+    echo ""
+    echo "Environment:"
+    echo "  VM_IDENTITY           system, user, or the name or resource ID of a user-assigned identity"
+    echo "  VM_ROLE_ASSIGNMENTS   ROLE:SCOPE entries separated by ';', SCOPE is a resource ID or"
+    echo "                        acr/NAME, keyvault/NAME, storage/NAME or rg/NAME"
+}
+
+# Resource ID of a scope given as ID or TYPE/NAME
+resolve_scope() {
+    local scope=$1
+    local type
+
+    case $scope in
+        /subscriptions/*) echo "$scope"; return 0 ;;
+        rg/*) az group show --name "${scope#rg/}" --query id -o tsv 2>/dev/null; return 0 ;;
+        acr/*) type="Microsoft.ContainerRegistry/registries" ;;
+        keyvault/*) type="Microsoft.KeyVault/vaults" ;;
+        storage/*) type="Microsoft.Storage/storageAccounts" ;;
+        *) return 0 ;;
+    esac
+    az resource list --name "${scope#*/}" --resource-type "$type" --query "[0].id" -o tsv 2>/dev/null
+}
+
+# "ROLE|SCOPE_ID" lines of the requested assignments; returns 1 when a scope cannot be resolved
+resolved_assignments() {
+    local entry role id failed=0
+    while IFS= read -r entry; do
+        [ -n "$entry" ] || continue
+        role="${entry%%:*}"
+        id=$(resolve_scope "${entry#*:}")
+        if [ "$role" = "$entry" ] || [ -z "$id" ]; then
+            print_error "Role assignment '$entry': scope not found (expected ROLE:SCOPE)" >&2
+            failed=1
+            continue
+        fi
+        echo "$role|$id"
+    done < <(echo "$VM_ROLE_ASSIGNMENTS" | tr ';' '\n')
+    return $failed
+}
+
+# Name of the user-assigned identity, empty for a system-assigned one
+user_identity_name() {
+    case $VM_IDENTITY in
+        system|"") ;;
+        user) echo "$1-identity" ;;
+        *) echo "${VM_IDENTITY##*/}" ;;
+    esac
+}
+
+# Attach the identity to the VM and print the principal ID the roles are assigned to
+attach_identity() {
+    local name=$1
+    local identity=$(user_identity_name "$name")
+
+    if [ -z "$identity" ]; then
+        az vm identity assign --resource-group $VM_RESOURCE_GROUP --name "$name" --query systemAssignedIdentity -o tsv
+        return 0
+    fi
+
+    local id=$VM_IDENTITY
+    if [[ "$VM_IDENTITY" != /subscriptions/* ]]; then
+        if ! id=$(az identity show --resource-group $VM_RESOURCE_GROUP --name "$identity" --query id -o tsv 2>/dev/null); then
+            id=$(az identity create --resource-group $VM_RESOURCE_GROUP --name "$identity" \
+                --tags istio-vm=$name --query id -o tsv)
+            print_status "User-assigned identity $identity created" >&2
+        fi
+    fi
+    az vm identity assign --resource-group $VM_RESOURCE_GROUP --name "$name" --identities "$id" > /dev/null
+    az identity show --ids "$id" --query principalId -o tsv
+}
+
+assign_roles() {
+    local name=$1
+    local assignments
+    if ! assignments=$(resolved_assignments); then
+        exit 1
+    fi
+
+    local principal=$(attach_identity "$name")
+    print_status "✓ VM $name identity: ${VM_IDENTITY:-system} (principal $principal)"
+
+    local role scope
+    while IFS='|' read -r role scope; do
+        [ -n "$role" ] || continue
+        # A new identity takes a moment to replicate in Azure AD, retry until it is found
+        local attempt
+        for attempt in 1 2 3 4 5 6; do
+            if az role assignment create --assignee-object-id "$principal" --assignee-principal-type ServicePrincipal \
+                --role "$role" --scope "$scope" --description "$OWNER_PREFIX$name" > /dev/null 2>&1; then
+                break
+            fi
+            if [ $attempt -eq 6 ]; then
+                print_error "Could not assign $role on $scope to $name"
+                exit 1
+            fi
+            sleep 10
+        done
+        print_status "✓ $role on $scope"
+    done <<< "$assignments"
+}
+
+# Principal IDs of the identities of the VM
+vm_principals() {
+    az vm show --resource-group $VM_RESOURCE_GROUP --name "$1" \
+        --query "[identity.principalId, identity.userAssignedIdentities.*.principalId][] | [?@ != null]" -o tsv 2>/dev/null
+}
+
+release_roles() {
+    local name=$1
+    local principal id
+
+    for principal in $(vm_principals "$name"); do
+        for id in $(az role assignment list --assignee "$principal" --all \
+            --query "[?description=='$OWNER_PREFIX$name'].id" -o tsv 2>/dev/null); do
+            az role assignment delete --ids "$id"
+            print_status "✓ Role assignment ${id##*/} of $name removed"
+        done
+    done
+
+    # Identities created for the VM, only used by it
+    local identity
+    for identity in $(az identity list --resource-group $VM_RESOURCE_GROUP --query "[?tags.\"istio-vm\"=='$name'].id" -o tsv 2>/dev/null); do
+        az vm identity remove --resource-group $VM_RESOURCE_GROUP --name "$name" --identities "$identity" > /dev/null 2>&1 || true
+        az identity delete --ids "$identity"
+        print_status "✓ User-assigned identity ${identity##*/} deleted"
+    done
+}
+
+# Main function
+main() {
+    case $1 in
+        assign)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            assign_roles "$2"
+            ;;
+        release)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            release_roles "$2"
+            ;;
+        validate)
+            resolved_assignments > /dev/null
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,171 @@
+#!/bin/bash
+
+# VM Info Script
+# Prints one JSON document joining the Azure and mesh state of a VM: VM details, SSH
+# access mode, deployment phases and verification, WorkloadEntries, Service/ServiceEntry,
+# sidecar health, workload certificate expiry and an estimated monthly cost, so dashboards
+# and scripts can get everything about a VM in a single call.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+CONFIGS_DIR="$(dirname "$SCRIPT_DIR")/workspace/configs"
+
+SSH_OPTS=(-o StrictHostKeyChecking=no -o ConnectTimeout=10)
+
+# Azure Retail Prices API, public and unauthenticated
+PRICES_API="https://prices.azure.com/api/retail/prices"
+HOURS_PER_MONTH=730
+
+# Colors for output
+RED='\033[0;31m'
+NC='\033[0m' # No Color
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+# Azure view of the VM
+vm_json() {
+    az vm show -d --resource-group $VM_RESOURCE_GROUP --name $VM_NAME -o json | jq '{
+        name, resourceGroup, location, size: .hardwareProfile.vmSize, powerState,
+        publicIps, privateIps, fqdns, tags,
+        image: (.storageProfile.imageReference | {publisher, offer, sku, version: (.exactVersion // .version), id})}'
+}
+
+# How people log in to the VM: SSH keys of azureuser and/or Azure AD SSH login with its role assignments
+access_json() {
+    local vm=$(az vm show --resource-group $VM_RESOURCE_GROUP --name $VM_NAME -o json)
+    local extension=$(az vm extension list --resource-group $VM_RESOURCE_GROUP --vm-name $VM_NAME \
+        --query "[?name=='AADSSHLoginForLinux'] | [0].provisioningState" -o tsv 2>/dev/null)
+    local logins=$(az role assignment list --scope "$(echo "$vm" | jq -r .id)" --include-inherited \
+        --query "[?roleDefinitionName=='Virtual Machine Administrator Login' || roleDefinitionName=='Virtual Machine User Login'].{principal: principalName, type: principalType, role: roleDefinitionName}" \
+        -o json 2>/dev/null || echo '[]')
+
+    echo "$vm" | jq --arg extension "$extension" --argjson logins "$logins" '
+        (.osProfile.linuxConfiguration.ssh.publicKeys // [] | length) as $keys |
+        {mode: ([if $keys > 0 then "ssh-key" else empty end, if $extension == "Succeeded" then "aad" else empty end] | join("+")),
+         ssh_keys: $keys, password_login: (.osProfile.linuxConfiguration.disablePasswordAuthentication == false),
+         aad_extension: (if $extension == "" then null else $extension end), aad_logins: $logins}'
+}
+
+# Last deployment status, progress of a running deployment, the recorded phases and the last
+# verification of the VM
+deployment_json() {
+    local status='{}'
+    if [ -f "$CONFIGS_DIR/deployment-status.env" ]; then
+        status=$(jq -Rn '[inputs | select(contains("=")) | capture("^(?<key>[^=]+)=(?<value>.*)$")] | from_entries' \
+            < "$CONFIGS_DIR/deployment-status.env")
+    fi
+    local verification=$(jq -c '{suite, finished, result, failed: [.checks[] | select(.result == "failed") | .name]}' \
+        "$CONFIGS_DIR/verification-$VM_NAME.json" 2>/dev/null || echo null)
+    local progress=$(CONFIGS_DIR=$CONFIGS_DIR bash "$SCRIPT_DIR/deployment-progress.sh" 2>/dev/null || echo null)
+
+    cat "$CONFIGS_DIR/phase-history.posted.log" "$CONFIGS_DIR/phase-history.log" 2>/dev/null \
+        | jq -Rn --arg vm "$VM_NAME" --argjson status "$status" --argjson verification "$verification" \
+            --argjson progress "${progress:-null}" '{
+            last_phase: $status.LAST_PHASE, last_phase_status: $status.LAST_PHASE_STATUS, updated: $status.LAST_PHASE_UPDATED,
+            progress: (if $progress.vm == $vm then $progress else null end),
+            verification: $verification,
+            phases: [inputs | split("|") | select(.[4] == $vm) |
+                {phase: .[0], status: .[3], started: (.[1] | tonumber | todate), seconds: ((.[2] | tonumber) - (.[1] | tonumber))}]}'
+}
+
+# WorkloadEntries of the VM address and the Service/ServiceEntry of its application
+mesh_json() {
+    local ip=$1
+    local entries=$(kubectl get workloadentry -n $VM_NAMESPACE -o json 2>/dev/null || echo '{"items": []}')
+    local service=$(kubectl get service $VM_APP -n $VM_NAMESPACE -o json 2>/dev/null || echo null)
+    local service_entry=$(kubectl get serviceentry $VM_APP -n $VM_NAMESPACE -o json 2>/dev/null || echo null)
+
+    jq -n --arg ip "$ip" --argjson entries "$entries" --argjson service "$service" --argjson se "$service_entry" '{
+        workload_entries: [$entries.items[] | select(.spec.address == $ip) |
+            {name: .metadata.name, labels: .spec.labels, network: .spec.network, serviceAccount: .spec.serviceAccount,
+             health: ([.status.conditions[]? | select(.type == "Healthy") | .status] | first)}],
+        service: (if $service == null then null else
+            {name: $service.metadata.name, type: $service.spec.type, clusterIP: $service.spec.clusterIP,
+             ports: [$service.spec.ports[] | {name, port, targetPort}]} end),
+        service_entry: (if $se == null then null else
+            {name: $se.metadata.name, hosts: $se.spec.hosts, resolution: $se.spec.resolution, location: $se.spec.location} end)}'
+}
+
+# Sidecar readiness and workload certificate validity, read on the VM
+sidecar_json() {
+    local ip=$1
+    local remote
+
+    remote=$(ssh "${SSH_OPTS[@]}" azureuser@$ip '
+        echo "active=$(systemctl is-active istio 2>/dev/null)"
+        echo "ready=$(curl -s -o /dev/null -w "%{http_code}" --max-time 5 http://localhost:15021/healthz/ready)"
+        echo "version=$(dpkg-query -W -f="\${Version}" istio-sidecar 2>/dev/null)"
+        echo "certs=$(curl -s --max-time 5 http://localhost:15000/certs | tr -d "\n")"' 2>/dev/null) || remote=""
+
+    if [ -z "$remote" ]; then
+        echo '{"reachable": false}'
+        return 0
+    fi
+
+    local certs=$(echo "$remote" | sed -n 's/^certs=//p')
+    jq -n --arg active "$(echo "$remote" | sed -n 's/^active=//p')" \
+        --arg ready "$(echo "$remote" | sed -n 's/^ready=//p')" \
+        --arg version "$(echo "$remote" | sed -n 's/^version=//p')" \
+        --argjson certs "$(echo "${certs:-null}" | jq -c . 2>/dev/null || echo null)" '{
+        reachable: true, service: $active, ready: ($ready == "200"), version: $version,
+        workload_cert: ([$certs.certificates[]?.cert_chain[]? | select(.subject_alt_names != null)] | first |
+            if . == null then null else {serial: .serial_number, valid_from, expiration_time, days_until_expiration: (.days_until_expiration | tonumber?)} end)}'
+}
+
+# Estimated monthly pay-as-you-go price of the VM size (Linux, no Spot/Low Priority)
+cost_json() {
+    local location=$1
+    local size=$2
+    local filter="serviceName eq 'Virtual Machines' and armRegionName eq '$location' and armSkuName eq '$size' and priceType eq 'Consumption'"
+
+    local prices=$(curl -s -G --max-time 15 "$PRICES_API" --data-urlencode "\$filter=$filter" 2>/dev/null || true)
+    if [ -z "$prices" ]; then
+        echo null
+        return 0
+    fi
+
+    echo "$prices" | jq --argjson hours $HOURS_PER_MONTH '
+        [.Items[]? | select((.productName | test("Windows") | not) and (.skuName | test("Spot|Low Priority") | not))] | first |
+        if . == null then null else
+            {currency: .currencyCode, hourly: .retailPrice, monthly: ((.retailPrice * $hours * 100 | round) / 100), meter: .meterName}
+        end' 2>/dev/null || echo null
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to build the VM info"
+        exit 1
+    fi
+
+    local vm
+    if ! vm=$(vm_json 2>/dev/null); then
+        print_error "VM $VM_NAME not found in $VM_RESOURCE_GROUP"
+        exit 1
+    fi
+
+    local ip=$(echo "$vm" | jq -r --arg public "$VM_PUBLIC_IP" 'if $public == "false" then .privateIps else .publicIps end |
+        split(",") | map(select(contains(":") | not)) | first // ""')
+
+    jq -n --argjson vm "$vm" \
+        --argjson deployment "$(deployment_json)" \
+        --argjson access "$(access_json 2>/dev/null || echo null)" \
+        --argjson mesh "$(mesh_json "$ip")" \
+        --argjson sidecar "$(sidecar_json "$ip")" \
+        --argjson cost "$(cost_json "$(echo "$vm" | jq -r .location)" "$(echo "$vm" | jq -r .size)")" \
+        '{generated: (now | todate), vm: $vm, access: $access, deployment: $deployment, mesh: $mesh, sidecar: $sidecar, cost_estimate: $cost}'
+}
+
+# Run main function
+main "$@"
@@ -6,21 +6,123 @@
 
 set -e
 
-# Shared configuration variables
-RESOURCE_GROUP="istio-playground-rg"
-CLUSTER_NAME="istio-aks-cluster"
-VM_NAME="istio-vm"
-VM_NAMESPACE="vm-workloads"
-VM_APP="vm-web-service"
+# Shared configuration variables (exported by setup-istio.sh when overridden)
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+CLUSTER_NAME="${CLUSTER_NAME:-istio-aks-cluster}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_APP="${VM_APP:-vm-web-service}"
 
 # Get script directory for relative paths
 SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 
 # Use local workspace (can be overridden by environment variable)
-WORK_DIR="$SCRIPT_DIR/../workspace/vm-mesh-setup"
+WORK_DIR="${WORK_DIR:-$SCRIPT_DIR/../workspace/vm-mesh-setup}"
 SERVICE_ACCOUNT="vm-workload"
 VM_VERSION="v1.0"
-VM_NETWORK="vm-network" # Multi-Network
+
+# Mesh the VM joins (setup-istio.sh --mesh): network of its WorkloadEntries, and trust domain
+# and mesh ID the istiod of the cluster must have
+MESH_NAME="${MESH_NAME:-}"
+VM_NETWORK="${VM_NETWORK:-vm-network}" # Multi-Network
+TRUST_DOMAIN="${TRUST_DOMAIN:-cluster.local}"
+MESH_ID="${MESH_ID:-mesh1}"
+
+# Service discovery mode for the VM: "istio" (WorkloadEntry + ServiceEntry), "autoregister"
+# (no static entry: istiod creates the WorkloadEntry from the WorkloadGroup when the VM
+# sidecar connects, and removes it when the sidecar goes away) or "endpointslice"
+# (headless Service + EndpointSlice pointing at the VM IP)
+INTEGRATION_MODE="${INTEGRATION_MODE:-istio}"
+
+# Data plane for the VM: "sidecar" (Envoy on the VM) or "ambient" (no proxy on the VM,
+# L7 policy enforced by a waypoint in the VM namespace; ztunnel is not supported on VMs)
+MESH_MODE="${MESH_MODE:-sidecar}"
+
+# Ports of the VM workload (NAME=PORT[/PROTOCOL], PROTOCOL one of HTTP, HTTP2, GRPC, TCP or
+# TLS, by default from the name prefix), and prefix of the VM tags copied as workload
+# labels: the tag mesh.tier=frontend becomes the label tier=frontend
+VM_WORKLOAD_PORTS="${VM_WORKLOAD_PORTS:-http=8080,metrics=15020,health=15021}"
+MESH_LABEL_TAG_PREFIX="mesh."
+PORT_PROTOCOLS="HTTP|HTTP2|GRPC|TCP|TLS"
+
+# Services hosted by the VM besides VM_APP, ";" separated NAME:PORTS[:LABELS] with PORTS and
+# LABELS as comma separated KEY=VALUE lists, e.g. "orders:http=8081,grpc=9091:tier=backend",
+# the ports taking a protocol like the workload ports
+VM_SERVICE_SPECS="${VM_SERVICE_SPECS:-}"
+
+# Connection pool limits and outlier detection of the DestinationRules of the VM services:
+# "default" (TRAFFIC_POLICY_DEFAULTS), "off" (no limits, only the mTLS mode) or comma
+# separated KEY=VALUE overriding some defaults, e.g. "maxConnections=50,baseEjectionTime=1m"
+TRAFFIC_POLICY="${TRAFFIC_POLICY:-default}"
+TRAFFIC_POLICY_DEFAULTS="maxConnections=100,connectTimeout=10s,maxPendingRequests=64,maxRequests=1024,maxRequestsPerConnection=2,consecutive5xxErrors=3,consecutiveGatewayErrors=3,interval=30s,baseEjectionTime=30s,maxEjectionPercent=50"
+
+# Deployment files installed on the VM by setup-vm-mesh.sh: ";" separated KEY=VALUE variables
+# written to VM_ENV_PATH, and ";" separated LOCAL:REMOTE[:MODE] text files. {vm}, {rg},
+# {vm_rg}, {cluster}, {namespace} and {app} in the values and file contents are replaced
+VM_ENV_SPECS="${VM_ENV_SPECS:-}"
+VM_ENV_PATH="${VM_ENV_PATH:-/etc/default/$VM_APP}"
+VM_FILE_SPECS="${VM_FILE_SPECS:-}"
+
+# Set to false by setup-istio.sh --no-public-ip, the VM is then reached on its private IP
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+
+# How the VM reaches istiod: "public" (east-west gateway LoadBalancer) or "private-link"
+# (internal LoadBalancer + Private Link Service, Private Endpoint in the VM VNet)
+ISTIOD_EXPOSURE="${ISTIOD_EXPOSURE:-public}"
+ISTIOD_PLS_NAME="istiod-pls"
+
+# How the VM resolves *.svc.cluster.local names:
+#   hosts      only the /etc/hosts entries generated by istioctl (istiod)
+#   proxy      the sidecar DNS proxy (ISTIO_META_DNS_CAPTURE), not available in ambient mode
+#   resolver   Azure DNS Private Resolver forwarding cluster.local to kube-dns over Private Link
+#   forwarder  kube-dns over Private Link only, for a conditional forwarder on corporate DNS
+VM_CLUSTER_DNS="${VM_CLUSTER_DNS:-hosts}"
+VM_DNS_RESOLVER_SUBNET_PREFIX="${VM_DNS_RESOLVER_SUBNET_PREFIX:-10.0.1.0/28}"
+KUBE_DNS_PLS_NAME="kube-dns-pls"
+
+# Expose the VM sidecar merged metrics (/stats/prometheus on the status port) to Prometheus
+VM_METRICS_SCRAPE="${VM_METRICS_SCRAPE:-true}"
+
+# Optional proxyConfig overrides merged into the generated mesh.yaml
+PROXY_CONCURRENCY="${PROXY_CONCURRENCY:-}"              # Envoy worker threads, 0 = all cores
+PROXY_HOLD_APPLICATION="${PROXY_HOLD_APPLICATION:-}"    # holdApplicationUntilProxyStarts: true|false
+PROXY_STATUS_PORT="${PROXY_STATUS_PORT:-}"              # pilot-agent status port (default 15020)
+PROXY_METADATA="${PROXY_METADATA:-}"                    # Comma separated KEY=VALUE proxy metadata
+PROXY_BOOTSTRAP_OVERRIDE="${PROXY_BOOTSTRAP_OVERRIDE:-}" # Path to a custom Envoy bootstrap JSON file
+
+# Optional sidecar resource limits applied to the istio systemd unit on the VM
+SIDECAR_CPU_LIMIT="${SIDECAR_CPU_LIMIT:-}"              # CPU cores, e.g. 0.5 or 2
+SIDECAR_MEMORY_LIMIT="${SIDECAR_MEMORY_LIMIT:-}"        # Memory with M or G suffix, e.g. 512M
+SIDECAR_CONCURRENCY="${SIDECAR_CONCURRENCY:-$PROXY_CONCURRENCY}" # Envoy worker threads
+
+# Optional traffic capture settings rendered into cluster.env (default: capture everything)
+CAPTURE_INBOUND_PORTS="${CAPTURE_INBOUND_PORTS:-}"                   # Inbound ports to capture, "*" or comma separated
+CAPTURE_EXCLUDE_INBOUND_PORTS="${CAPTURE_EXCLUDE_INBOUND_PORTS:-}"   # Inbound ports to bypass
+CAPTURE_OUTBOUND_CIDRS="${CAPTURE_OUTBOUND_CIDRS:-}"                 # Outbound CIDRs to capture, "*" or comma separated
+CAPTURE_EXCLUDE_OUTBOUND_CIDRS="${CAPTURE_EXCLUDE_OUTBOUND_CIDRS:-}" # Outbound CIDRs to bypass
+CAPTURE_EXCLUDE_OUTBOUND_PORTS="${CAPTURE_EXCLUDE_OUTBOUND_PORTS:-}" # Outbound ports to bypass
+
+# Server-side dry-run (main "dry-run"): the changes go through the API server admission,
+# Istio validation webhook included, without being persisted. The results are collected
+# in the DRY_RUN_REPORT JSON file instead of stopping at the first error
+DRY_RUN=false
+DRY_RUN_REPORT="${DRY_RUN_REPORT:-}"
+DRY_RUN_RESULTS=()
+# Address of the WorkloadEntries when the VM does not exist yet (TEST-NET-1)
+DRY_RUN_VM_IP="192.0.2.10"
+
+# Resources are created with server-side apply under this field manager. Fields another
+# manager owns are a conflict that fails the apply unless FORCE_CONFLICTS=true; fields of
+# the client-side applies and patches these scripts made before are taken over
+FIELD_MANAGER="${FIELD_MANAGER:-istio-azure-setup}"
+FORCE_CONFLICTS="${FORCE_CONFLICTS:-false}"
+LEGACY_MANAGERS="kubectl-client-side-apply|kubectl-patch|kubectl-create|kubectl-label|before-first-apply"
+
+# Labels and annotations of the deployment added to every applied object, one KEY=VALUE
+# per line (see scripts/deployment-metadata.sh)
+DEPLOYMENT_LABEL_SPECS="${DEPLOYMENT_LABEL_SPECS:-}"
+DEPLOYMENT_ANNOTATION_SPECS="${DEPLOYMENT_ANNOTATION_SPECS:-}"
 
 # Colors for output
 RED='\033[0;31m'
@@ -40,18 +142,986 @@ print_error() {
     echo -e "${RED}[ERROR]${NC} $1"
 }
 
+# kubectl with the changes made by the deployment field manager, applies done server-side,
+# and the changes sent as server-side dry-run in dry-run mode
+kubectl() {
+    case $1 in
+        create|patch|label|annotate)
+            set -- "$@" --field-manager=$FIELD_MANAGER
+            ;;
+    esac
+    if [ "$DRY_RUN" = true ]; then
+        case $1 in
+            apply|create|delete|patch|label|annotate)
+                dry_run_change "$@"
+                return
+                ;;
+            wait)
+                return 0
+                ;;
+        esac
+    elif [ "$1" = "apply" ]; then
+        manifest_args "$@"
+        if ! server_side_apply "${KUBECTL_ARGS[@]}" <<< "$KUBECTL_MANIFEST"; then
+            echo "$KUBECTL_OUTPUT" | grep -q 'conflict with "' \
+                && print_error "Fields of $(manifest_target) are managed by another controller, set FORCE_CONFLICTS=true to take them over"
+            echo "$KUBECTL_OUTPUT" >&2
+            return 1
+        fi
+        echo "$KUBECTL_OUTPUT"
+        return
+    fi
+    command kubectl "$@"
+}
+
+# Split kubectl arguments into KUBECTL_ARGS and the manifest given with -f (file or stdin)
+manifest_args() {
+    KUBECTL_ARGS=()
+    KUBECTL_MANIFEST=""
+    local file=""
+    while [ $# -gt 0 ]; do
+        if [ "$1" = "-f" ]; then
+            file=$2
+            shift 2
+            continue
+        fi
+        KUBECTL_ARGS+=("$1")
+        shift
+    done
+    if [ "$file" = "-" ]; then
+        KUBECTL_MANIFEST=$(cat)
+    elif [ -n "$file" ]; then
+        KUBECTL_MANIFEST=$(cat "$file")
+    fi
+}
+
+# KIND/NAME of the (first) object of KUBECTL_MANIFEST
+manifest_target() {
+    echo "$KUBECTL_MANIFEST" | awk '/^kind:/ { kind = $2 } /^  name:/ && !name { name = $2 } END { print kind "/" name }'
+}
+
+# Server-side apply of the manifest on stdin, output in KUBECTL_OUTPUT. Conflicts with
+# LEGACY_MANAGERS only are forced, as are all conflicts with FORCE_CONFLICTS=true
+server_side_apply() {
+    local manifest=$(bash "$SCRIPT_DIR/deployment-metadata.sh") rc=0
+    KUBECTL_OUTPUT=$(command kubectl "$@" --server-side --field-manager=$FIELD_MANAGER -f - <<< "$manifest" 2>&1) || rc=$?
+    if [ $rc -eq 0 ] || ! echo "$KUBECTL_OUTPUT" | grep -q 'conflict with "'; then
+        return $rc
+    fi
+
+    local foreign=$(echo "$KUBECTL_OUTPUT" | grep -o 'conflict with "[^"]*"' | cut -d'"' -f2 | sort -u | grep -vxE "$LEGACY_MANAGERS" || true)
+    if [ -n "$foreign" ] && [ "$FORCE_CONFLICTS" != true ]; then
+        return $rc
+    fi
+    rc=0
+    KUBECTL_OUTPUT=$(command kubectl "$@" --server-side --field-manager=$FIELD_MANAGER --force-conflicts -f - <<< "$manifest" 2>&1) || rc=$?
+    return $rc
+}
+
+# Delete a resource only when the deployment manages it: the deployment field manager (or
+# the kubectl managers of the applies before server-side apply) owns some of its fields.
+# Resources created by other tools under the same name are kept, returning 1
+delete_owned() {
+    local resource=$1
+    local namespace=$2
+    local managers
+    managers=$(kubectl get $resource -n $namespace -o jsonpath='{.metadata.managedFields[*].manager}' 2>/dev/null) || return 0
+    if ! echo "$managers" | tr ' ' '\n' | grep -qxE "$FIELD_MANAGER|$LEGACY_MANAGERS"; then
+        print_warning "$resource.$namespace is not managed by $FIELD_MANAGER ($managers), keeping it"
+        return 1
+    fi
+    kubectl delete $resource -n $namespace
+}
+
+# Dry-run one change and record its result, always returns 0 so that every change is checked
+dry_run_change() {
+    manifest_args "$@"
+    local args=("${KUBECTL_ARGS[@]}") manifest=$KUBECTL_MANIFEST
+
+    local target="${args[*]:1}" output rc=0 check="server"
+    if [ -n "$manifest" ] && [ "${args[0]}" = "apply" ]; then
+        target=$(manifest_target)
+        server_side_apply "${args[@]}" --dry-run=server <<< "$manifest" || rc=$?
+        output=$KUBECTL_OUTPUT
+    elif [ -n "$manifest" ]; then
+        target=$(manifest_target)
+        output=$(command kubectl "${args[@]}" --dry-run=server -f - <<< "$manifest" 2>&1) || rc=$?
+    fi
+    if [ -n "$manifest" ]; then
+        # Namespaced objects of a namespace created by the same run: validated offline
+        if [ $rc -ne 0 ] && echo "$output" | grep -q 'namespaces ".*" not found'; then
+            check="offline"
+            rc=0
+            if echo "$manifest" | grep -q '^apiVersion: .*istio\.io/'; then
+                output=$(istioctl validate -f - <<< "$manifest" 2>&1) || rc=$?
+            else
+                output=$(command kubectl "${args[@]}" --dry-run=client -f - <<< "$manifest" 2>&1) || rc=$?
+            fi
+        fi
+    else
+        output=$(command kubectl "${args[@]}" --dry-run=server 2>&1) || rc=$?
+    fi
+
+    local result="passed"
+    if [ $rc -ne 0 ]; then
+        result="failed"
+        print_error "✗ ${args[0]} $target: $(echo "$output" | tail -1)"
+    else
+        print_status "✓ ${args[0]} $target ($check dry-run)"
+    fi
+    DRY_RUN_RESULTS+=("$(jq -cn --arg verb "${args[0]}" --arg target "$target" --arg check "$check" --arg result "$result" \
+        --arg message "$([ $rc -ne 0 ] && echo "$output")" '{verb: $verb, target: $target, check: $check, result: $result, message: $message}')")
+    return 0
+}
+
+# Write the dry-run report, returns 1 when a change was rejected
+dry_run_summary() {
+    local failed=$(printf '%s\n' "${DRY_RUN_RESULTS[@]}" | grep -c '"result":"failed"' || true)
+    if [ -n "$DRY_RUN_REPORT" ]; then
+        printf '%s\n' "${DRY_RUN_RESULTS[@]}" | jq -s --arg vm "$VM_NAME" --argjson failed $failed \
+            '{vm: $vm, finished: (now | todate), result: (if $failed == 0 then "passed" else "failed" end), changes: .}' > "$DRY_RUN_REPORT"
+    fi
+    if [ $failed -gt 0 ]; then
+        print_error "$failed of ${#DRY_RUN_RESULTS[@]} mesh changes rejected by the API server"
+        return 1
+    fi
+    print_status "✅ ${#DRY_RUN_RESULTS[@]} mesh changes accepted by the API server"
+}
+
 # Get VM IP using Azure CLI
 get_vm_ip() {
     print_status "Getting VM IP address..."
     
-    VM_IP=$(az vm show -d -g $RESOURCE_GROUP -n $VM_NAME --query publicIps -o tsv 2>/dev/null)
+    # Dual-stack VMs report both addresses comma separated, VMs without public IP use the private IP
+    local ip_query="publicIps"
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        ip_query="privateIps"
+    fi
+    local public_ips=$(az vm show -d -g $VM_RESOURCE_GROUP -n $VM_NAME --query $ip_query -o tsv 2>/dev/null | tr ',' '\n')
+    VM_IP=$(echo "$public_ips" | grep -v ':' | head -1)
+    VM_IPV6=$(echo "$public_ips" | grep ':' | head -1)
     
     if [ -z "$VM_IP" ] || [ "$VM_IP" = "null" ]; then
-        print_error "Could not get VM IP address for VM: $VM_NAME in resource group: $RESOURCE_GROUP"
+        print_error "Could not get VM IP address for VM: $VM_NAME in resource group: $VM_RESOURCE_GROUP"
         exit 1
     fi
     
     print_status "✓ VM IP found: $VM_IP"
+    if [ -n "$VM_IPV6" ]; then
+        print_status "✓ VM IPv6 found: $VM_IPV6"
+    fi
+}
+
+# Validate proxyConfig overrides before anything is created in the cluster
+validate_proxy_config() {
+    if [ -n "$PROXY_CONCURRENCY" ] && ! [[ "$PROXY_CONCURRENCY" =~ ^[0-9]+$ ]]; then
+        print_error "PROXY_CONCURRENCY must be a non-negative integer: $PROXY_CONCURRENCY"
+        exit 1
+    fi
+
+    if [ -n "$PROXY_HOLD_APPLICATION" ] && ! [[ "$PROXY_HOLD_APPLICATION" =~ ^(true|false)$ ]]; then
+        print_error "PROXY_HOLD_APPLICATION must be true or false: $PROXY_HOLD_APPLICATION"
+        exit 1
+    fi
+
+    if [ -n "$PROXY_STATUS_PORT" ]; then
+        if ! [[ "$PROXY_STATUS_PORT" =~ ^[0-9]+$ ]] || [ "$PROXY_STATUS_PORT" -lt 1 ] || [ "$PROXY_STATUS_PORT" -gt 65535 ]; then
+            print_error "PROXY_STATUS_PORT must be a port number between 1 and 65535: $PROXY_STATUS_PORT"
+            exit 1
+        fi
+        # Ports already used by the VM service and the Envoy sidecar
+        case $PROXY_STATUS_PORT in
+            8080|15000|15001|15004|15006|15008|15021|15090)
+                print_error "PROXY_STATUS_PORT $PROXY_STATUS_PORT conflicts with a port used by the VM service or the sidecar"
+                exit 1
+                ;;
+        esac
+    fi
+
+    if [ -n "$PROXY_METADATA" ]; then
+        local entry
+        IFS=',' read -ra entries <<< "$PROXY_METADATA"
+        for entry in "${entries[@]}"; do
+            if ! [[ "$entry" =~ ^[A-Z_][A-Z0-9_]*=.*$ ]]; then
+                print_error "Invalid PROXY_METADATA entry '$entry' (expected KEY=VALUE with an upper case KEY)"
+                exit 1
+            fi
+        done
+    fi
+
+    if [ -n "$PROXY_BOOTSTRAP_OVERRIDE" ]; then
+        if [ ! -s "$PROXY_BOOTSTRAP_OVERRIDE" ]; then
+            print_error "Bootstrap override file not found or empty: $PROXY_BOOTSTRAP_OVERRIDE"
+            exit 1
+        fi
+        if command -v jq &> /dev/null && ! jq empty "$PROXY_BOOTSTRAP_OVERRIDE" &> /dev/null; then
+            print_error "Bootstrap override file is not valid JSON: $PROXY_BOOTSTRAP_OVERRIDE"
+            exit 1
+        fi
+    fi
+}
+
+# Validate the sidecar resource limits
+validate_sidecar_resources() {
+    if [ -n "$SIDECAR_CPU_LIMIT" ] && ! [[ "$SIDECAR_CPU_LIMIT" =~ ^([0-9]+(\.[0-9]+)?|\.[0-9]+)$ ]]; then
+        print_error "SIDECAR_CPU_LIMIT must be a number of cores, e.g. 0.5 or 2: $SIDECAR_CPU_LIMIT"
+        exit 1
+    fi
+
+    if [ -n "$SIDECAR_MEMORY_LIMIT" ] && ! [[ "$SIDECAR_MEMORY_LIMIT" =~ ^[1-9][0-9]*[MG]$ ]]; then
+        print_error "SIDECAR_MEMORY_LIMIT must be a size with M or G suffix, e.g. 512M: $SIDECAR_MEMORY_LIMIT"
+        exit 1
+    fi
+
+    if [ -n "$SIDECAR_CONCURRENCY" ] && ! [[ "$SIDECAR_CONCURRENCY" =~ ^[0-9]+$ ]]; then
+        print_error "SIDECAR_CONCURRENCY must be a non-negative integer: $SIDECAR_CONCURRENCY"
+        exit 1
+    fi
+}
+
+# Memory limit in MB
+sidecar_memory_limit_mb() {
+    local value=${SIDECAR_MEMORY_LIMIT%[MG]}
+    if [[ "$SIDECAR_MEMORY_LIMIT" == *G ]]; then
+        echo $((value * 1024))
+    else
+        echo "$value"
+    fi
+}
+
+# Warn when the VM is too small for the configured sidecar limits
+check_vm_capacity() {
+    if [ -z "$SIDECAR_CPU_LIMIT$SIDECAR_MEMORY_LIMIT$SIDECAR_CONCURRENCY" ]; then
+        return 0
+    fi
+
+    print_status "Checking VM capacity against sidecar resource limits..."
+
+    local vm_size=$(az vm show -g $VM_RESOURCE_GROUP -n $VM_NAME --query hardwareProfile.vmSize -o tsv 2>/dev/null || echo "unknown")
+    local vm_cores=$(ssh -o StrictHostKeyChecking=no azureuser@$VM_IP 'nproc' 2>/dev/null || echo "")
+    local vm_memory_mb=$(ssh -o StrictHostKeyChecking=no azureuser@$VM_IP "awk '/MemTotal/ {print int(\$2 / 1024)}' /proc/meminfo" 2>/dev/null || echo "")
+
+    if [ -z "$vm_cores" ] || [ -z "$vm_memory_mb" ]; then
+        print_warning "Could not read VM capacity, skipping sidecar limits check"
+        return 0
+    fi
+
+    print_status "VM size $vm_size: $vm_cores core(s), ${vm_memory_mb}MB memory"
+
+    # Leave at least half of the VM for the workload itself
+    if [ -n "$SIDECAR_CPU_LIMIT" ] && awk -v limit="$SIDECAR_CPU_LIMIT" -v cores="$vm_cores" 'BEGIN { exit !(limit > cores / 2) }'; then
+        print_warning "Sidecar CPU limit ($SIDECAR_CPU_LIMIT cores) exceeds half of the VM cores ($vm_cores) - consider a larger VM size than $vm_size"
+    fi
+
+    if [ -n "$SIDECAR_MEMORY_LIMIT" ] && [ "$(sidecar_memory_limit_mb)" -gt $((vm_memory_mb / 2)) ]; then
+        print_warning "Sidecar memory limit ($SIDECAR_MEMORY_LIMIT) exceeds half of the VM memory (${vm_memory_mb}MB) - consider a larger VM size than $vm_size"
+    fi
+
+    if [ -n "$SIDECAR_CONCURRENCY" ] && [ "$SIDECAR_CONCURRENCY" -gt "$vm_cores" ]; then
+        print_warning "Sidecar concurrency ($SIDECAR_CONCURRENCY) is higher than the VM cores ($vm_cores)"
+    fi
+}
+
+# Write the sidecar resource settings consumed by setup-vm-mesh.sh on the VM
+generate_sidecar_resources() {
+    if [ -z "$SIDECAR_CPU_LIMIT$SIDECAR_MEMORY_LIMIT$SIDECAR_CONCURRENCY" ]; then
+        return 0
+    fi
+
+    cat > "$WORK_DIR/vm-files/sidecar-resources.env" <<EOF
+SIDECAR_CPU_LIMIT=$SIDECAR_CPU_LIMIT
+SIDECAR_MEMORY_LIMIT=$SIDECAR_MEMORY_LIMIT
+SIDECAR_CONCURRENCY=$SIDECAR_CONCURRENCY
+EOF
+    print_status "✓ Sidecar resource limits generated"
+}
+
+# Replace the deployment placeholders of a value or file content
+render_deployment_template() {
+    local text=$1
+    text="${text//\{vm\}/$VM_NAME}"
+    text="${text//\{rg\}/$RESOURCE_GROUP}"
+    text="${text//\{vm_rg\}/$VM_RESOURCE_GROUP}"
+    text="${text//\{cluster\}/$CLUSTER_NAME}"
+    text="${text//\{namespace\}/$VM_NAMESPACE}"
+    printf '%s' "${text//\{app\}/$VM_APP}"
+}
+
+# Render the environment file and the files of the deployment into vm-files/deployment-files,
+# with the list of what goes where (SOURCE|DESTINATION|MODE) setup-vm-mesh.sh installs
+generate_deployment_files() {
+    local dir="$WORK_DIR/vm-files/deployment-files"
+    rm -rf "$dir"
+    if [ -z "$VM_ENV_SPECS$VM_FILE_SPECS" ]; then
+        return 0
+    fi
+    mkdir -p "$dir"
+
+    local spec key
+    if [ -n "$VM_ENV_SPECS" ]; then
+        IFS=';' read -ra specs <<< "$VM_ENV_SPECS"
+        for spec in "${specs[@]}"; do
+            key="${spec%%=*}"
+            if [[ ! "$key" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]] || [ "$key" = "$spec" ]; then
+                print_error "Invalid VM environment variable, expected KEY=VALUE: $spec"
+                exit 1
+            fi
+            # Quoted for systemd EnvironmentFile and for sourcing from a shell alike
+            printf '%s="%s"\n' "$key" "$(render_deployment_template "${spec#*=}" | sed 's/[\\"]/\\&/g')"
+        done > "$dir/env"
+        echo "env|$VM_ENV_PATH|0644" >> "$dir/manifest"
+    fi
+
+    local index=0 source destination mode content
+    if [ -n "$VM_FILE_SPECS" ]; then
+        IFS=';' read -ra specs <<< "$VM_FILE_SPECS"
+        for spec in "${specs[@]}"; do
+            IFS=':' read -r source destination mode <<< "$spec"
+            mode="${mode:-0644}"
+            if [ ! -f "$source" ]; then
+                print_error "VM file not found: $source"
+                exit 1
+            fi
+            if [[ "$destination" != /* ]] || [[ ! "$mode" =~ ^[0-7]{3,4}$ ]]; then
+                print_error "Invalid VM file, expected LOCAL:/ABSOLUTE/PATH[:MODE]: $spec"
+                exit 1
+            fi
+            index=$((index + 1))
+            # The trailing newlines of the file are kept
+            content=$(cat "$source"; printf x)
+            render_deployment_template "${content%x}" > "$dir/file-$index"
+            echo "file-$index|$destination|$mode" >> "$dir/manifest"
+        done
+    fi
+    print_status "✓ Deployment files rendered: $(wc -l < "$dir/manifest" | tr -d ' ') file(s)"
+}
+
+# Validate the traffic capture settings
+validate_capture_options() {
+    local name
+    for name in CAPTURE_INBOUND_PORTS CAPTURE_EXCLUDE_INBOUND_PORTS CAPTURE_EXCLUDE_OUTBOUND_PORTS; do
+        local value="${!name}"
+        if [ -n "$value" ] && [ "$value" != "*" ] && ! [[ "$value" =~ ^[0-9]+(,[0-9]+)*$ ]]; then
+            print_error "$name must be \"*\" or a comma separated list of ports: $value"
+            exit 1
+        fi
+    done
+
+    for name in CAPTURE_OUTBOUND_CIDRS CAPTURE_EXCLUDE_OUTBOUND_CIDRS; do
+        local value="${!name}"
+        if [ -n "$value" ] && [ "$value" != "*" ] && ! [[ "$value" =~ ^[0-9a-fA-F.:]+/[0-9]+(,[0-9a-fA-F.:]+/[0-9]+)*$ ]]; then
+            print_error "$name must be \"*\" or a comma separated list of CIDRs: $value"
+            exit 1
+        fi
+    done
+}
+
+# A NAME=PORT[/PROTOCOL] list, the protocol in any case
+valid_port_list() {
+    [[ "$1" =~ ^[a-z0-9-]+=[0-9]+(/[A-Za-z0-9]+)?(,[a-z0-9-]+=[0-9]+(/[A-Za-z0-9]+)?)*$ ]] || return 1
+    ! echo "$1" | tr ',' '\n' | sed -n 's#.*/##p' | tr a-z A-Z | grep -qvxE "$PORT_PROTOCOLS"
+}
+
+# Validate the workload ports and the additional service specs before anything is created
+# in the cluster
+validate_vm_services() {
+    if ! valid_port_list "$VM_WORKLOAD_PORTS"; then
+        print_error "Invalid workload ports \"$VM_WORKLOAD_PORTS\", expected NAME=PORT[/PROTOCOL][,...] with PROTOCOL one of ${PORT_PROTOCOLS//|/, }"
+        exit 1
+    fi
+
+    local name ports labels
+    while IFS=: read -r name ports labels; do
+        [ -n "$name" ] || continue
+        if ! [[ "$name" =~ ^[a-z0-9]([-a-z0-9]*[a-z0-9])?$ ]] || ! valid_port_list "$ports"; then
+            print_error "Invalid VM service \"$name:$ports${labels:+:$labels}\", expected NAME:PORTNAME=PORT[/PROTOCOL][,...][:KEY=VALUE,...]"
+            exit 1
+        fi
+        if [ "$name" = "$VM_APP" ]; then
+            print_error "VM service $name is the main application, set its ports with --workload-ports"
+            exit 1
+        fi
+    done < <(echo "$VM_SERVICE_SPECS" | tr ';' '\n')
+}
+
+# Every key of TRAFFIC_POLICY must be one of TRAFFIC_POLICY_DEFAULTS, with a duration
+# (connectTimeout, interval, baseEjectionTime) or an integer value
+validate_traffic_policy() {
+    if [ "$TRAFFIC_POLICY" = "default" ] || [ "$TRAFFIC_POLICY" = "off" ]; then
+        return 0
+    fi
+
+    local entry key value
+    IFS=',' read -ra entries <<< "$TRAFFIC_POLICY"
+    for entry in "${entries[@]}"; do
+        key=${entry%%=*}
+        value=${entry#*=}
+        if [[ "$entry" != *=* ]] || [[ ",$TRAFFIC_POLICY_DEFAULTS" != *",$key="* ]]; then
+            print_error "Invalid traffic policy entry '$entry', expected default, off or KEY=VALUE with KEY one of: $(echo "$TRAFFIC_POLICY_DEFAULTS" | sed 's/=[^,]*//g; s/,/, /g')"
+            exit 1
+        fi
+        case $key in
+            connectTimeout|interval|baseEjectionTime)
+                if ! [[ "$value" =~ ^[0-9]+(ms|s|m|h)$ ]]; then
+                    print_error "Traffic policy $key must be a duration like 10s or 1m: $value"
+                    exit 1
+                fi
+                ;;
+            maxEjectionPercent)
+                if ! [[ "$value" =~ ^[0-9]+$ ]] || [ "$value" -gt 100 ]; then
+                    print_error "Traffic policy maxEjectionPercent must be a percentage between 0 and 100: $value"
+                    exit 1
+                fi
+                ;;
+            *)
+                if ! [[ "$value" =~ ^[0-9]+$ ]]; then
+                    print_error "Traffic policy $key must be a non-negative integer: $value"
+                    exit 1
+                fi
+                ;;
+        esac
+    done
+}
+
+# Set a variable in the generated cluster.env, replacing any value from istioctl
+set_cluster_env() {
+    local key=$1
+    local value=$2
+    local env_file="$WORK_DIR/vm-files/cluster.env"
+
+    sed -i.bak "/^$key=/d" "$env_file" && rm -f "$env_file.bak"
+    echo "$key='$value'" >> "$env_file"
+}
+
+# Render the traffic capture settings into cluster.env
+configure_traffic_capture() {
+    [ -n "$CAPTURE_INBOUND_PORTS" ] && set_cluster_env ISTIO_INBOUND_PORTS "$CAPTURE_INBOUND_PORTS"
+    [ -n "$CAPTURE_EXCLUDE_INBOUND_PORTS" ] && set_cluster_env ISTIO_LOCAL_EXCLUDE_PORTS "$CAPTURE_EXCLUDE_INBOUND_PORTS"
+    [ -n "$CAPTURE_OUTBOUND_CIDRS" ] && set_cluster_env ISTIO_SERVICE_CIDR "$CAPTURE_OUTBOUND_CIDRS"
+    [ -n "$CAPTURE_EXCLUDE_OUTBOUND_CIDRS" ] && set_cluster_env ISTIO_SERVICE_EXCLUDE_CIDR "$CAPTURE_EXCLUDE_OUTBOUND_CIDRS"
+    [ -n "$CAPTURE_EXCLUDE_OUTBOUND_PORTS" ] && set_cluster_env ISTIO_LOCAL_OUTBOUND_PORTS_EXCLUDE "$CAPTURE_EXCLUDE_OUTBOUND_PORTS"
+
+    print_status "✓ Traffic capture: inbound ${CAPTURE_INBOUND_PORTS:-*}, outbound ${CAPTURE_OUTBOUND_CIDRS:-*}"
+}
+
+# Render the proxy.istio.io/config annotation used by istioctl to build mesh.yaml
+render_proxy_config_annotation() {
+    if [ -z "$PROXY_CONCURRENCY$PROXY_HOLD_APPLICATION$PROXY_STATUS_PORT$PROXY_METADATA" ]; then
+        return 0
+    fi
+
+    echo "    annotations:"
+    echo "      proxy.istio.io/config: |"
+    [ -n "$PROXY_CONCURRENCY" ] && echo "        concurrency: $PROXY_CONCURRENCY"
+    [ -n "$PROXY_HOLD_APPLICATION" ] && echo "        holdApplicationUntilProxyStarts: $PROXY_HOLD_APPLICATION"
+    [ -n "$PROXY_STATUS_PORT" ] && echo "        statusPort: $PROXY_STATUS_PORT"
+    if [ -n "$PROXY_METADATA" ]; then
+        echo "        proxyMetadata:"
+        local entry
+        IFS=',' read -ra entries <<< "$PROXY_METADATA"
+        for entry in "${entries[@]}"; do
+            echo "          ${entry%%=*}: \"${entry#*=}\""
+        done
+    fi
+    return 0
+}
+
+# Refuse to join a control plane of another mesh than the selected one: the VM would get
+# certificates of a trust domain its peers do not accept
+verify_mesh_identity() {
+    local mesh_config=$(kubectl get configmap istio -n istio-system -o jsonpath='{.data.mesh}' 2>/dev/null)
+    if [ -z "$mesh_config" ]; then
+        print_warning "No mesh configuration in $CLUSTER_NAME, trust domain and mesh ID not checked"
+        return 0
+    fi
+
+    local trust_domain=$(sed -n 's/^trustDomain: *//p' <<< "$mesh_config" | tr -d '"' | head -1)
+    local mesh_id=$(sed -n 's/^ *meshId: *//p' <<< "$mesh_config" | tr -d '"' | head -1)
+    if [ "${trust_domain:-cluster.local}" != "$TRUST_DOMAIN" ]; then
+        print_error "istiod of $CLUSTER_NAME has trust domain ${trust_domain:-cluster.local}, not $TRUST_DOMAIN${MESH_NAME:+ of mesh $MESH_NAME}"
+        exit 1
+    fi
+    if [ -n "$mesh_id" ] && [ "$mesh_id" != "$MESH_ID" ]; then
+        print_error "istiod of $CLUSTER_NAME has mesh ID $mesh_id, not $MESH_ID${MESH_NAME:+ of mesh $MESH_NAME}"
+        exit 1
+    fi
+    print_status "✓ Mesh ${MESH_NAME:-(default)}: trust domain $TRUST_DOMAIN, mesh ID $MESH_ID, VM network $VM_NETWORK"
+}
+
+# Verify the proxyConfig overrides made it into the generated mesh.yaml
+verify_proxy_config() {
+    local mesh_file="$WORK_DIR/vm-files/mesh.yaml"
+
+    [ -n "$PROXY_CONCURRENCY" ] && ! grep -q "concurrency: $PROXY_CONCURRENCY" "$mesh_file" && \
+        print_warning "concurrency override not found in mesh.yaml"
+    [ -n "$PROXY_HOLD_APPLICATION" ] && ! grep -q "holdApplicationUntilProxyStarts: $PROXY_HOLD_APPLICATION" "$mesh_file" && \
+        print_warning "holdApplicationUntilProxyStarts override not found in mesh.yaml"
+    [ -n "$PROXY_STATUS_PORT" ] && ! grep -q "statusPort: $PROXY_STATUS_PORT" "$mesh_file" && \
+        print_warning "statusPort override not found in mesh.yaml"
+
+    if [ -n "$PROXY_BOOTSTRAP_OVERRIDE" ]; then
+        cp "$PROXY_BOOTSTRAP_OVERRIDE" "$WORK_DIR/vm-files/bootstrap-override.json"
+        echo "ISTIO_BOOTSTRAP_OVERRIDE=/etc/istio/proxy/bootstrap-override.json" >> "$WORK_DIR/vm-files/cluster.env"
+        print_status "✓ Custom Envoy bootstrap override added"
+    fi
+    return 0
+}
+
+# Namespace label enrolling the VM namespace in the selected data plane
+namespace_dataplane_label() {
+    if [ "$MESH_MODE" = "ambient" ]; then
+        echo "istio.io/dataplane-mode: ambient"
+    else
+        echo "istio-injection: enabled"
+    fi
+}
+
+# Expose istiod on an internal LoadBalancer with a Private Link Service and connect
+# a Private Endpoint in the VM subnet to it; sets ISTIOD_PRIVATE_IP
+setup_istiod_private_link() {
+    if [ "$ISTIOD_EXPOSURE" != "private-link" ]; then
+        return 0
+    fi
+
+    print_status "Exposing istiod through Private Link..."
+    local subscription=$(az account show --query id -o tsv)
+    kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: istiod-private-link
+  namespace: istio-system
+  annotations:
+    service.beta.kubernetes.io/azure-load-balancer-internal: "true"
+    service.beta.kubernetes.io/azure-pls-create: "true"
+    service.beta.kubernetes.io/azure-pls-name: "$ISTIOD_PLS_NAME"
+    service.beta.kubernetes.io/azure-pls-visibility: "$subscription"
+    service.beta.kubernetes.io/azure-pls-auto-approval: "$subscription"
+spec:
+  type: LoadBalancer
+  selector:
+    app: istiod
+  ports:
+  - name: grpc-xds
+    port: 15012
+    targetPort: 15012
+  - name: https-webhook
+    port: 15017
+    targetPort: 15017
+EOF
+
+    ISTIOD_PRIVATE_IP=$(connect_private_endpoint $ISTIOD_PLS_NAME istiod "istio-system/istiod-private-link")
+    print_status "✓ Private Endpoint $VM_NAME-istiod-pe connected to $ISTIOD_PLS_NAME, istiod address for the VM: $ISTIOD_PRIVATE_IP"
+}
+
+# Subnet of the VM NIC
+vm_subnet_id() {
+    local nic_id=$(az vm show -g $VM_RESOURCE_GROUP -n $VM_NAME --query 'networkProfile.networkInterfaces[0].id' -o tsv)
+    az network nic show --ids "$nic_id" --query 'ipConfigurations[0].subnet.id' -o tsv
+}
+
+# Wait for the Private Link Service AKS creates for a Service and connect the Private
+# Endpoint $VM_NAME-<name>-pe in the VM subnet to it; prints the endpoint IP
+connect_private_endpoint() {
+    local pls_name=$1
+    local name=$2
+    local service=$3
+
+    local node_rg=$(az aks show --resource-group $RESOURCE_GROUP --name $CLUSTER_NAME --query nodeResourceGroup -o tsv)
+    local pls_id="" i
+    for i in {1..30}; do
+        pls_id=$(az network private-link-service show --resource-group "$node_rg" --name $pls_name --query id -o tsv 2>/dev/null || true)
+        if [ -n "$pls_id" ]; then
+            break
+        fi
+        sleep 10
+    done
+    if [ -z "$pls_id" ]; then
+        print_error "Private Link Service $pls_name not created in $node_rg, check: kubectl describe svc -n ${service/\// }" >&2
+        exit 1
+    fi
+
+    local pe_name="$VM_NAME-$name-pe"
+    if ! az network private-endpoint show --resource-group $VM_RESOURCE_GROUP --name "$pe_name" &> /dev/null; then
+        az network private-endpoint create --resource-group $VM_RESOURCE_GROUP --name "$pe_name" \
+            --subnet "$(vm_subnet_id)" --private-connection-resource-id "$pls_id" --connection-name $name > /dev/null
+    fi
+
+    local pe_nic=$(az network private-endpoint show --resource-group $VM_RESOURCE_GROUP --name "$pe_name" --query 'networkInterfaces[0].id' -o tsv)
+    az network nic show --ids "$pe_nic" --query 'ipConfigurations[0].privateIPAddress' -o tsv
+}
+
+# Expose kube-dns on an internal LoadBalancer with a Private Link Service, reachable from
+# the VM VNet through a Private Endpoint; sets KUBE_DNS_PRIVATE_IP
+setup_kube_dns_private_link() {
+    print_status "Exposing kube-dns through Private Link..."
+    local subscription=$(az account show --query id -o tsv)
+    kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: kube-dns-private-link
+  namespace: kube-system
+  annotations:
+    service.beta.kubernetes.io/azure-load-balancer-internal: "true"
+    service.beta.kubernetes.io/azure-pls-create: "true"
+    service.beta.kubernetes.io/azure-pls-name: "$KUBE_DNS_PLS_NAME"
+    service.beta.kubernetes.io/azure-pls-visibility: "$subscription"
+    service.beta.kubernetes.io/azure-pls-auto-approval: "$subscription"
+spec:
+  type: LoadBalancer
+  selector:
+    k8s-app: kube-dns
+  ports:
+  - name: dns
+    port: 53
+    targetPort: 53
+    protocol: UDP
+  - name: dns-tcp
+    port: 53
+    targetPort: 53
+    protocol: TCP
+EOF
+
+    KUBE_DNS_PRIVATE_IP=$(connect_private_endpoint $KUBE_DNS_PLS_NAME kube-dns "kube-system/kube-dns-private-link")
+    print_status "✓ kube-dns reachable from the VM VNet at $KUBE_DNS_PRIVATE_IP"
+}
+
+# Create (once per VNet) a DNS Private Resolver whose forwarding ruleset sends
+# cluster.local queries to kube-dns; VMs using Azure-provided DNS pick it up
+setup_dns_resolver() {
+    local subnet_id=$(vm_subnet_id)
+    local vnet_id="${subnet_id%/subnets/*}"
+    local vnet_rg=$(echo "$vnet_id" | awk -F/ '{print $5}')
+    local vnet="${vnet_id##*/}"
+    local location=$(az vm show -g $VM_RESOURCE_GROUP -n $VM_NAME --query location -o tsv)
+    local resolver="$vnet-resolver"
+    local ruleset="$vnet-ruleset"
+
+    if ! az extension show --name dns-resolver &> /dev/null; then
+        az extension add --name dns-resolver --only-show-errors
+    fi
+
+    if ! az network vnet subnet show -g "$vnet_rg" --vnet-name "$vnet" -n dns-resolver-outbound &> /dev/null; then
+        print_status "Creating subnet dns-resolver-outbound ($VM_DNS_RESOLVER_SUBNET_PREFIX) in $vnet..."
+        az network vnet subnet create -g "$vnet_rg" --vnet-name "$vnet" -n dns-resolver-outbound \
+            --address-prefixes "$VM_DNS_RESOLVER_SUBNET_PREFIX" --delegations Microsoft.Network/dnsResolvers > /dev/null
+    fi
+
+    if ! az dns-resolver show -g "$vnet_rg" -n "$resolver" &> /dev/null; then
+        print_status "Creating DNS Private Resolver $resolver..."
+        az dns-resolver create -g "$vnet_rg" -n "$resolver" --id "$vnet_id" --location "$location" > /dev/null
+        az dns-resolver outbound-endpoint create -g "$vnet_rg" --dns-resolver-name "$resolver" -n outbound \
+            --id "$vnet_id/subnets/dns-resolver-outbound" --location "$location" > /dev/null
+    fi
+
+    if ! az dns-resolver forwarding-ruleset show -g "$vnet_rg" -n "$ruleset" &> /dev/null; then
+        local outbound_id=$(az dns-resolver outbound-endpoint show -g "$vnet_rg" --dns-resolver-name "$resolver" -n outbound --query id -o tsv)
+        az dns-resolver forwarding-ruleset create -g "$vnet_rg" -n "$ruleset" --location "$location" \
+            --outbound-endpoints "[{id:$outbound_id}]" > /dev/null
+        az dns-resolver vnet-link create -g "$vnet_rg" --ruleset-name "$ruleset" -n "$vnet-link" --id "$vnet_id" > /dev/null
+    fi
+
+    # create also updates the target when the Private Endpoint IP changed
+    az dns-resolver forwarding-rule create -g "$vnet_rg" --ruleset-name "$ruleset" -n cluster-local \
+        --domain-name "cluster.local." --forwarding-rule-state Enabled \
+        --target-dns-servers "[{ip-address:$KUBE_DNS_PRIVATE_IP,port:53}]" > /dev/null
+    print_status "✓ $resolver forwards cluster.local to kube-dns ($KUBE_DNS_PRIVATE_IP) for $vnet"
+}
+
+# Write conditional forwarder examples for corporate DNS servers
+write_forwarder_guidance() {
+    local file="$WORK_DIR/cluster-dns-forwarder.txt"
+    cat > "$file" <<EOF
+Forward the cluster.local zone to kube-dns at $KUBE_DNS_PRIVATE_IP (UDP/TCP 53).
+The DNS servers must reach this Private Endpoint in the VNet of $VM_NAME.
+
+Windows DNS Server:
+  Add-DnsServerConditionalForwarderZone -Name "cluster.local" -MasterServers $KUBE_DNS_PRIVATE_IP
+
+BIND (named.conf):
+  zone "cluster.local" { type forward; forward only; forwarders { $KUBE_DNS_PRIVATE_IP; }; };
+
+Unbound:
+  forward-zone:
+    name: "cluster.local."
+    forward-addr: $KUBE_DNS_PRIVATE_IP
+EOF
+    print_status "Conditional forwarder configuration for corporate DNS:"
+    sed 's/^/  /' "$file"
+}
+
+# Set up the resolution of cluster service names on the VM
+setup_cluster_dns() {
+    case $VM_CLUSTER_DNS in
+        hosts|proxy)
+            return 0
+            ;;
+        resolver)
+            setup_kube_dns_private_link
+            setup_dns_resolver
+            ;;
+        forwarder)
+            setup_kube_dns_private_link
+            write_forwarder_guidance
+            ;;
+    esac
+}
+
+# Enable or disable the sidecar DNS proxy in cluster.env
+configure_dns_capture() {
+    case $VM_CLUSTER_DNS in
+        proxy)
+            set_cluster_env ISTIO_META_DNS_CAPTURE true
+            set_cluster_env ISTIO_META_DNS_AUTO_ALLOCATE true
+            print_status "✓ Cluster names resolved by the sidecar DNS proxy"
+            ;;
+        resolver|forwarder)
+            # The resolvers of the VM answer, the proxy must not intercept port 53
+            set_cluster_env ISTIO_META_DNS_CAPTURE false
+            ;;
+    esac
+}
+
+# Resolve istiod to the Private Endpoint in the generated hosts file (mesh.yaml keeps the service name)
+wire_istiod_private_endpoint() {
+    if [ -z "$ISTIOD_PRIVATE_IP" ]; then
+        return 0
+    fi
+
+    local hosts_file="$WORK_DIR/vm-files/hosts"
+    grep -v 'istiod\.istio-system\.svc' "$hosts_file" 2>/dev/null > "$hosts_file.tmp" || true
+    echo "$ISTIOD_PRIVATE_IP istiod.istio-system.svc" >> "$hosts_file.tmp"
+    mv "$hosts_file.tmp" "$hosts_file"
+    print_status "✓ istiod.istio-system.svc resolves to the Private Endpoint $ISTIOD_PRIVATE_IP"
+}
+
+# KEY=VALUE labels of the VM workload, VM tags named mesh.<label> override the defaults
+# except app, which the Service and ServiceEntry select on. The VM group (tag istio-group)
+# becomes the label azure.group
+workload_labels() {
+    echo "app=$VM_APP"
+    echo "version=$VM_VERSION"
+    echo "service.istio.io/canonical-name=$VM_APP"
+    echo "service.istio.io/canonical-revision=$VM_VERSION"
+    echo "azure.zone=westus"
+    az vm show -g $VM_RESOURCE_GROUP -n $VM_NAME --query tags -o yaml 2>/dev/null \
+        | sed -n -e "s/^${MESH_LABEL_TAG_PREFIX//./\\.}\([^:]*\): *'\{0,1\}\([^']*\)'\{0,1\}$/\1=\2/p" \
+            -e "s/^istio-group: *'\{0,1\}\([^']*\)'\{0,1\}$/azure.group=\1/p" \
+        | grep -v '^app=' || true
+}
+
+# Render KEY=VALUE lines from stdin as YAML map entries at the given indentation, the
+# last value of a key wins
+render_labels() {
+    awk -F= -v pad="$(printf '%*s' "$1" '')" '
+        { key = $1; sub(/^[^=]*=/, ""); if (!(key in value)) order[n++] = key; value[key] = $0 }
+        END { for (i = 0; i < n; i++) printf "%s%s: \"%s\"\n", pad, order[i], value[order[i]] }'
+}
+
+# Render the workload labels as YAML map entries at the given indentation
+render_workload_labels() {
+    workload_labels | render_labels "$1"
+}
+
+# The workload ports as "name port protocol" lines. A port without a protocol gets it from
+# its name prefix: grpc* GRPC, http2* HTTP2, tcp* TCP, tls* and https* TLS, HTTP otherwise
+workload_ports() {
+    echo "$VM_WORKLOAD_PORTS" | tr ',' '\n' | grep -v '^$' | awk -F'[=/]' '{
+        protocol = toupper($3)
+        if (protocol == "") protocol = $1 ~ /^grpc/ ? "GRPC" : $1 ~ /^http2/ ? "HTTP2" : $1 ~ /^tcp/ ? "TCP" : $1 ~ /^(tls|https)/ ? "TLS" : "HTTP"
+        print $1, $2, protocol
+    }'
+}
+
+# Render the workload ports as YAML map entries at the given indentation
+render_workload_ports() {
+    workload_ports | awk -v pad="$(printf '%*s' "$1" '')" '{ printf "%s%s: %s\n", pad, $1, $2 }'
+}
+
+# Ports the Service and ServiceEntry expose: the workload ports but the health port,
+# which only the readiness probe of the WorkloadGroup uses
+service_ports() {
+    workload_ports | grep -v '^health ' || true
+}
+
+# The port the VirtualService routes to and the readiness probe checks, as "name port
+# protocol": the http port, or the first service port when there is none
+main_port() {
+    service_ports | awk '
+        $1 == "http" { print; found = 1; exit }
+        NR == 1 { first = $0 }
+        END { if (!found) print (first != "" ? first : "http 8080 HTTP") }'
+}
+
+# Render the service ports as port list entries of a Service, ServiceEntry or EndpointSlice,
+# with the protocol of each port: appProtocol for Kubernetes, protocol for the ServiceEntry
+render_service_ports() {
+    service_ports | awk -v kind="$1" '{
+        if (kind == "service") printf "  - port: %s\n    targetPort: %s\n    name: %s\n    protocol: TCP\n    appProtocol: %s\n", $2, $2, $1, tolower($3)
+        else if (kind == "serviceentry") printf "  - number: %s\n    name: %s\n    protocol: %s\n", $2, $1, $3
+        else printf "- name: %s\n  port: %s\n  protocol: TCP\n  appProtocol: %s\n", $1, $2, tolower($3)
+    }'
+}
+
+# Render the trafficPolicy of a DestinationRule whose main port has the given protocol: the
+# mTLS mode, then the TRAFFIC_POLICY connection pool and outlier detection. The request
+# limits are HTTP settings, left out for TCP and TLS, and maxRequestsPerConnection would
+# defeat the multiplexing of HTTP2 and GRPC
+render_traffic_policy() {
+    local protocol=$1
+    echo "  trafficPolicy:"
+    echo "    tls:"
+    echo "      mode: $([ "$MESH_MODE" = "ambient" ] && echo DISABLE || echo ISTIO_MUTUAL)"
+    [ "$TRAFFIC_POLICY" != "off" ] || return 0
+
+    local -A policy
+    local entry
+    for entry in ${TRAFFIC_POLICY_DEFAULTS//,/ } $([ "$TRAFFIC_POLICY" = "default" ] || echo "${TRAFFIC_POLICY//,/ }"); do
+        policy[${entry%%=*}]=${entry#*=}
+    done
+    cat <<EOF
+    connectionPool:
+      tcp:
+        maxConnections: ${policy[maxConnections]}
+        connectTimeout: ${policy[connectTimeout]}
+EOF
+    if [ "$protocol" != "TCP" ] && [ "$protocol" != "TLS" ]; then
+        echo "      http:"
+        echo "        http1MaxPendingRequests: ${policy[maxPendingRequests]}"
+        echo "        http2MaxRequests: ${policy[maxRequests]}"
+        [ "$protocol" != "HTTP" ] || echo "        maxRequestsPerConnection: ${policy[maxRequestsPerConnection]}"
+    fi
+    cat <<EOF
+    outlierDetection:
+      consecutive5xxErrors: ${policy[consecutive5xxErrors]}
+      consecutiveGatewayErrors: ${policy[consecutiveGatewayErrors]}
+      interval: ${policy[interval]}
+      baseEjectionTime: ${policy[baseEjectionTime]}
+      maxEjectionPercent: ${policy[maxEjectionPercent]}
+EOF
+}
+
+# Render the readiness probe of the WorkloadGroup on the main port: GET /ready for HTTP, a
+# TCP connection for the other protocols, which an HTTP/1.1 request would not pass
+render_readiness_probe() {
+    local name port protocol
+    read -r name port protocol <<< "$(main_port)"
+    if [ "$protocol" = "HTTP" ]; then
+        printf "    httpGet:\n      port: %s\n      path: /ready\n" "$port"
+    else
+        printf "    tcpSocket:\n      port: %s\n" "$port"
+    fi
+}
+
+# Render the route of the VirtualService to the main port: an HTTP route with retries for
+# HTTP, HTTP2 and GRPC, a TCP route for TCP and TLS
+render_main_route() {
+    local name port protocol
+    read -r name port protocol <<< "$(main_port)"
+    local host="$VM_APP.$VM_NAMESPACE.svc.cluster.local"
+    case $protocol in
+        TCP|TLS)
+            cat <<EOF
+  tcp:
+  - match:
+    - port: $port
+    route:
+    - destination:
+        host: $host
+        port:
+          number: $port
+EOF
+            ;;
+        *)
+            cat <<EOF
+  http:
+  - match:
+    - uri:
+        prefix: /
+    route:
+    - destination:
+        host: $host
+        port:
+          number: $port
+    timeout: 30s
+    retries:
+      attempts: 3
+      perTryTimeout: 10s
+EOF
+            ;;
+    esac
+}
+
+# JSON array of the addresses of the VM: public (or reach) IPv4 and IPv6, and private IPs
+vm_addresses() {
+    (echo "$VM_IP"; echo "$VM_IPV6"; az vm show -d -g $VM_RESOURCE_GROUP -n $VM_NAME --query privateIps -o tsv 2>/dev/null | tr ',' '\n') \
+        | grep -v '^$' | jq -Rn '[inputs]'
+}
+
+# Bring the labels and ports of the VM WorkloadEntries (created here or auto-registered by
+# istiod) and of the WorkloadGroup template in line with the deployment, patching only
+# what differs instead of recreating the entries
+sync_workload_entries() {
+    if ! command -v jq &> /dev/null; then
+        print_warning "jq is not installed, existing WorkloadEntries keep their labels and ports"
+        return 0
+    fi
+
+    local labels=$(render_workload_labels 0 | jq -Rn '[inputs | capture("^(?<key>[^:]+): \"(?<value>.*)\"$")] | from_entries')
+    local ports=$(workload_ports | jq -Rn '[inputs | split(" ") | {key: .[0], value: (.[1] | tonumber)}] | from_entries')
+    local addresses=$(vm_addresses)
+
+    local entries=$(kubectl get workloadentry -n $VM_NAMESPACE -o json | jq -c --argjson addresses "$addresses" \
+        '[.items[] | select(.metadata.labels["azure.resource"] != "vm-service-instance") | select(.spec.address as $a | $addresses | index($a)) | {kind: "workloadentry", name: .metadata.name, labels: (.spec.labels // {}), ports: (.spec.ports // {}), base: "/spec"}]')
+    local group=$(kubectl get workloadgroup $VM_APP -n $VM_NAMESPACE -o json 2>/dev/null | jq -c \
+        '[{kind: "workloadgroup", name: .metadata.name, labels: (.spec.metadata.labels // {}), ports: (.spec.template.ports // {}), base: "/spec/metadata", ports_base: "/spec/template"}]' || echo '[]')
+
+    local item kind name changes patch
+    while read -r item; do
+        kind=$(echo "$item" | jq -r '.kind')
+        name=$(echo "$item" | jq -r '.name')
+        changes=$(echo "$item" | jq -r --argjson labels "$labels" --argjson ports "$ports" '
+            def diff($current; $desired; $what):
+                ($desired | to_entries[] | select($current[.key] != .value) |
+                    if $current[.key] == null then "+ \($what) \(.key)=\(.value)" else "~ \($what) \(.key)=\($current[.key]) -> \(.value)" end),
+                ($current | keys[] | select($desired[.] == null) | "- \($what) \(.)");
+            diff(.labels; $labels; "label"), diff(.ports; $ports; "port")')
+
+        if [ -z "$changes" ]; then
+            print_status "✓ $kind $name labels and ports in sync"
+            continue
+        fi
+
+        print_status "Updating $kind $name:"
+        echo "$changes" | sed 's/^/    /'
+        patch=$(echo "$item" | jq -c --argjson labels "$labels" --argjson ports "$ports" \
+            '[{op: "add", path: "\(.base)/labels", value: $labels}, {op: "add", path: "\(.ports_base // .base)/ports", value: $ports}]')
+        kubectl patch $kind "$name" -n $VM_NAMESPACE --type json -p "$patch" > /dev/null
+    done < <(jq -cn --argjson entries "${entries:-[]}" --argjson group "${group:-[]}" '$group + $entries | .[]')
+}
+
+# Deploy a waypoint for the VM namespace so traffic to the VM gets L7 policy in ambient mode
+setup_waypoint() {
+    if [ "$MESH_MODE" != "ambient" ]; then
+        return 0
+    fi
+
+    if [ "$DRY_RUN" = true ]; then
+        kubectl apply -f - < <(istioctl waypoint generate -n $VM_NAMESPACE)
+        return 0
+    fi
+
+    print_status "Deploying waypoint for namespace $VM_NAMESPACE..."
+    if istioctl waypoint apply -n $VM_NAMESPACE --enroll-namespace --wait; then
+        print_status "✓ Waypoint deployed, $VM_APP traffic is routed through it"
+    else
+        print_error "Failed to deploy waypoint (are the Gateway API CRDs installed?)"
+        exit 1
+    fi
+
+    print_warning "The VM has no mesh data plane in ambient mode: waypoint to VM traffic is plain text,"
+    print_warning "restrict the VM inbound NSG rules to the cluster subnet"
 }
 
 # Create namespace and service account in the cluster with Azure best practices
@@ -65,7 +1135,7 @@ kind: Namespace
 metadata:
   name: $VM_NAMESPACE
   labels:
-    istio-injection: enabled
+    $(namespace_dataplane_label)
     azure.workload.identity/use: "true"
     name: $VM_NAMESPACE
 spec: {}
@@ -90,7 +1160,9 @@ EOF
     kubectl wait --for=condition=Ready serviceaccount/$SERVICE_ACCOUNT -n $VM_NAMESPACE --timeout=30s || true
     
     # Verify ServiceAccount exists before proceeding
-    if ! kubectl get serviceaccount $SERVICE_ACCOUNT -n $VM_NAMESPACE &> /dev/null; then
+    if [ "$DRY_RUN" = true ]; then
+        :
+    elif ! kubectl get serviceaccount $SERVICE_ACCOUNT -n $VM_NAMESPACE &> /dev/null; then
         print_error "ServiceAccount $SERVICE_ACCOUNT not found in namespace $VM_NAMESPACE"
         exit 1
     fi
@@ -108,29 +1180,26 @@ metadata:
     azure.resource: vm-workload
 spec:
   metadata:
+$(render_proxy_config_annotation)
     labels:
-      app: $VM_APP
-      version: $VM_VERSION
-      azure.zone: westus
+$(render_workload_labels 6)
   template:
     serviceAccount: $SERVICE_ACCOUNT
     network: $VM_NETWORK
     ports:
-      http: 8080
-      metrics: 15020
-      health: 15021
+$(render_workload_ports 6)
   probe:
     periodSeconds: 5
     initialDelaySeconds: 1
-    httpGet:
-      port: 8080
-      path: /ready
+$(render_readiness_probe)
 EOF
 
     kubectl apply -f "$WORK_DIR/vm-files/workloadgroup.yaml"
     
     # Verify WorkloadGroup was created successfully
-    if kubectl get workloadgroup $VM_APP -n $VM_NAMESPACE &> /dev/null; then
+    if [ "$DRY_RUN" = true ]; then
+        :
+    elif kubectl get workloadgroup $VM_APP -n $VM_NAMESPACE &> /dev/null; then
         print_status "✓ WorkloadGroup $VM_APP created successfully in namespace $VM_NAMESPACE"
         
         # Validate ServiceAccount reference in WorkloadGroup
@@ -161,11 +1230,11 @@ spec:
   rules:
   - from:
     - source:
-        principals: ["cluster.local/ns/$VM_NAMESPACE/sa/$SERVICE_ACCOUNT"]
+        principals: ["$TRUST_DOMAIN/ns/$VM_NAMESPACE/sa/$SERVICE_ACCOUNT"]
     - source:
-        principals: ["cluster.local/ns/mesh-test/sa/sleep"]
+        principals: ["$TRUST_DOMAIN/ns/mesh-test/sa/sleep"]
     - source:
-        principals: ["cluster.local/ns/helloworld/sa/default"]
+        principals: ["$TRUST_DOMAIN/ns/helloworld/sa/default"]
   - to:
     - operation:
         methods: ["GET", "POST", "PUT", "DELETE"]
@@ -205,11 +1274,11 @@ spec:
   rules:
   - from:
     - source:
-        principals: ["cluster.local/ns/helloworld/sa/default"]
+        principals: ["$TRUST_DOMAIN/ns/helloworld/sa/default"]
     - source:
-        principals: ["cluster.local/ns/mesh-test/sa/sleep"]
+        principals: ["$TRUST_DOMAIN/ns/mesh-test/sa/sleep"]
     - source:
-        principals: ["cluster.local/ns/vm-workloads/sa/vm-workload"]
+        principals: ["$TRUST_DOMAIN/ns/$VM_NAMESPACE/sa/$SERVICE_ACCOUNT"]
     - source:
         namespaces: ["istio-system"]
   - to:
@@ -223,12 +1292,56 @@ EOF
     print_status "✓ Cluster resources configured with Azure optimizations"
 }
 
+# VirtualService of the VM service with timeout settings for Azure
+apply_virtual_service() {
+    kubectl apply -f - <<EOF
+apiVersion: networking.istio.io/v1
+kind: VirtualService
+metadata:
+  name: $VM_APP
+  namespace: $VM_NAMESPACE
+spec:
+  hosts:
+  - $VM_APP.$VM_NAMESPACE.svc.cluster.local
+  gateways:
+  - mesh
+$(render_main_route)
+EOF
+}
+
+# VirtualService and DestinationRule of the VM service
+apply_routing_config() {
+    # Faults and mirrors injected by scripts/traffic-faults.sh are reverted at their expiry,
+    # the routes are applied again by the next run
+    if [ "$(kubectl get virtualservice $VM_APP -n $VM_NAMESPACE -o jsonpath='{.metadata.labels.azure\.traffic-fault}' 2>/dev/null)" = "active" ]; then
+        print_warning "Fault injection on $VM_APP in progress, keeping its VirtualService"
+    else
+        apply_virtual_service
+    fi
+
+    # DestinationRule configuration with Azure-optimized settings, ejecting a flaky VM from
+    # the load balancing pool for a while
+    kubectl apply -f - <<EOF
+apiVersion: networking.istio.io/v1
+kind: DestinationRule
+metadata:
+  name: $VM_APP
+  namespace: $VM_NAMESPACE
+spec:
+  host: $VM_APP.$VM_NAMESPACE.svc.cluster.local
+$(render_traffic_policy "$(main_port | awk '{print $3}')")
+EOF
+}
+
 # Apply VM configuration files with immediate VM IP
 apply_vm_config() {
     print_status "Applying VM configuration..."
 
     # Service configuration
-    kubectl apply -f - <<EOF
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        apply_endpointslice_config
+    else
+        kubectl apply -f - <<EOF
 apiVersion: v1
 kind: Service
 metadata:
@@ -240,101 +1353,84 @@ spec:
   selector:
     app: $VM_APP
   ports:
-  - port: 8080
-    targetPort: 8080
-    name: http
-    protocol: TCP
-  - port: 15020
-    targetPort: 15020
-    name: metrics
-    protocol: TCP
+$(render_service_ports service)
   type: ClusterIP
 EOF
+    fi
 
-    # VirtualService configuration with timeout settings for Azure
-    kubectl apply -f - <<EOF
-apiVersion: networking.istio.io/v1
-kind: VirtualService
-metadata:
-  name: $VM_APP
-  namespace: $VM_NAMESPACE
-spec:
-  hosts:
-  - $VM_APP.$VM_NAMESPACE.svc.cluster.local
-  gateways:
-  - mesh
-  http:
-  - match:
-    - uri:
-        prefix: /
-    route:
-    - destination:
-        host: $VM_APP.$VM_NAMESPACE.svc.cluster.local
-        port:
-          number: 8080
-    timeout: 30s
-    retries:
-      attempts: 3
-      perTryTimeout: 10s
-EOF
+    # Plain Kubernetes discovery, without VirtualService or DestinationRule
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        apply_vm_services
+        print_status "✓ VM configuration files applied (endpointslice mode)"
+        return 0
+    fi
+
+    # A traffic shift in progress (scripts/traffic-shift.sh) owns the routes and subsets
+    if [ "$(kubectl get destinationrule $VM_APP -n $VM_NAMESPACE -o jsonpath='{.metadata.labels.azure\.traffic-shift}' 2>/dev/null)" = "active" ]; then
+        print_warning "Traffic shift of $VM_APP in progress, keeping its VirtualService and DestinationRule"
+    else
+        apply_routing_config
+    fi
 
-    # DestinationRule configuration with Azure-optimized settings
+    # The Service selects the WorkloadEntry istiod registers for the VM sidecar
+    if [ "$INTEGRATION_MODE" = "autoregister" ]; then
+        remove_static_workload_entries
+        sync_workload_entries
+        apply_vm_services
+        print_status "✓ VM configuration files applied (autoregister mode, the VM registers when its sidecar connects)"
+        return 0
+    fi
+    
+    # WorkloadEntry configuration with Azure health checks, one per VM of the application
     kubectl apply -f - <<EOF
 apiVersion: networking.istio.io/v1
-kind: DestinationRule
+kind: WorkloadEntry
 metadata:
-  name: $VM_APP
+  annotations:
+    istio.io/autoRegistrationGroup: $VM_APP
+  name: $VM_APP-$VM_NAME
   namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+    version: $VM_VERSION
+    azure.resource: vm-instance
+    azure.vm: $VM_NAME
 spec:
-  host: $VM_APP.$VM_NAMESPACE.svc.cluster.local
-  trafficPolicy:
-    tls:
-      mode: ISTIO_MUTUAL
-    connectionPool:
-      tcp:
-        maxConnections: 100
-        connectTimeout: 10s
-      http:
-        http1MaxPendingRequests: 64
-        maxRequestsPerConnection: 2
-    outlierDetection:
-      consecutiveErrors: 3
-      interval: 30s
-      baseEjectionTime: 30s
+  address: "$VM_IP"
+  labels:
+$(render_workload_labels 4)
+  serviceAccount: $SERVICE_ACCOUNT
+  network: "$VM_NETWORK"
+  ports:
+$(render_workload_ports 4)
 EOF
-    
-    # WorkloadEntry configuration with Azure health checks
-    # TODO: The WorkloadEntry is created but with a different name, i.e.: vm-web-service-10.0.0.4-vm-network
-    if ! kubectl get workloadentry -n $VM_NAMESPACE $VM_APP-vm &> /dev/null; then
+
+    # Dual-stack VMs get a second WorkloadEntry for the IPv6 address
+    if [ -n "$VM_IPV6" ]; then
         kubectl apply -f - <<EOF
 apiVersion: networking.istio.io/v1
 kind: WorkloadEntry
 metadata:
-  annotations:
-    istio.io/autoRegistrationGroup: $VM_APP
-  name: $VM_APP-vm
+  name: $VM_APP-$VM_NAME-ipv6
   namespace: $VM_NAMESPACE
   labels:
     app: $VM_APP
+    version: $VM_VERSION
     azure.resource: vm-instance
+    azure.vm: $VM_NAME
 spec:
-  address: "$VM_IP"
+  address: "$VM_IPV6"
   labels:
-    app: $VM_APP
-    version: $VM_VERSION
-    azure.zone: westus
+$(render_workload_labels 4)
   serviceAccount: $SERVICE_ACCOUNT
-  network: "vm-network"
+  network: "$VM_NETWORK"
   ports:
-    http: 8080
-    metrics: 15020
-    health: 15021
+$(render_workload_ports 4)
 EOF
-    else 
-      print_status "WorkloadEntry $VM_APP-vm already exists, skipping creation."
     fi
+    remove_shared_registrations
 
-    # ServiceEntry configuration with proper Azure networking
+    # ServiceEntry configuration with proper Azure networking, listing every VM of the application
     kubectl apply -f - <<EOF
 apiVersion: networking.istio.io/v1
 kind: ServiceEntry
@@ -348,23 +1444,385 @@ spec:
   - $VM_APP.$VM_NAMESPACE.svc.cluster.local
   location: MESH_EXTERNAL
   ports:
-  - number: 8080
-    name: http
-    protocol: HTTP
-  - number: 15020
-    name: metrics
-    protocol: HTTP
+$(render_service_ports serviceentry)
   resolution: DNS
   addresses:
-  - "$VM_IP"
+$(app_instance_addresses | sed 's/.*/  - "&"/')
   workloadSelector:
     labels:
       app: $VM_APP
 EOF
 
+    sync_workload_entries
+    apply_vm_services
     print_status "✓ VM configuration files applied"
 }
 
+# Addresses of the VMs registered for the application, this one included: its
+# WorkloadEntries are not persisted in dry-run mode
+app_instance_addresses() {
+    { echo "$VM_IP"; echo "$VM_IPV6"
+      kubectl get workloadentry -n $VM_NAMESPACE -l azure.resource=vm-instance,app=$VM_APP \
+          -o jsonpath='{range .items[*]}{.spec.address}{"\n"}{end}' 2>/dev/null; } | grep -v '^$' | sort -u
+}
+
+# Point the ServiceEntries of the VM applications at the VMs still registered for them,
+# and delete those of applications no VM is registered for anymore
+prune_service_entries() {
+    local namespace name app addresses
+    kubectl get serviceentry -A -l azure.resource=vm-service-entry \
+        -o jsonpath='{range .items[*]}{.metadata.namespace} {.metadata.name} {.spec.workloadSelector.labels.app}{"\n"}{end}' 2>/dev/null \
+        | while read -r namespace name app; do
+            [ -n "$app" ] || continue
+            addresses=$(kubectl get workloadentry -n $namespace -l azure.resource=vm-instance,app=$app \
+                -o jsonpath='{range .items[*]}{.spec.address}{"\n"}{end}' 2>/dev/null | grep -v '^$' | jq -Rn '[inputs] | unique')
+            if [ "$addresses" = "[]" ]; then
+                if delete_owned serviceentry/$name $namespace; then
+                    print_status "✓ ServiceEntry $name.$namespace removed, no VM serves $app anymore"
+                fi
+            elif [ "$(kubectl get serviceentry $name -n $namespace -o json | jq -c '.spec.addresses // [] | unique')" != "$addresses" ]; then
+                kubectl patch serviceentry $name -n $namespace --type merge -p "{\"spec\": {\"addresses\": $addresses}}" > /dev/null
+                print_status "✓ ServiceEntry $name.$namespace addresses: $(jq -r 'join(", ")' <<< "$addresses")"
+            fi
+        done
+}
+
+# Delete the registrations of the VM under the names earlier deployments shared between
+# all VMs of the application ($VM_APP-vm, $VM_APP-vm-ipv6 and $VM_APP-vm-metrics); each
+# VM now has objects named after it
+remove_shared_registrations() {
+    local kind name
+    kubectl get workloadentry,endpointslice -n $VM_NAMESPACE -o json 2>/dev/null | jq -r \
+        --argjson addresses "$(vm_addresses)" --arg app "$VM_APP" '
+        .items[] | select(.metadata.name | IN("\($app)-vm", "\($app)-vm-ipv6", "\($app)-vm-metrics"))
+            | select(((.spec.address // empty), .endpoints[]?.addresses[]?) as $a | $addresses | index($a))
+            | "\(.kind | ascii_downcase) \(.metadata.name)"' | sort -u \
+        | while read -r kind name; do
+            kubectl delete $kind "$name" -n $VM_NAMESPACE
+            print_status "✓ Shared $kind $name of $VM_NAME replaced by one named after the VM"
+        done
+}
+
+# Delete the WorkloadEntries an earlier istio mode deployment created for the VM; the
+# auto-registered entry of the sidecar takes their place
+remove_static_workload_entries() {
+    remove_shared_registrations
+    local name address
+    for name in $VM_APP-$VM_NAME $VM_APP-$VM_NAME-ipv6; do
+        address=$(kubectl get workloadentry $name -n $VM_NAMESPACE -o jsonpath='{.spec.address}' 2>/dev/null || true)
+        if [ -n "$address" ] && jq -e --arg address "$address" 'index($address) != null' <<< "$(vm_addresses)" > /dev/null; then
+            kubectl delete workloadentry $name -n $VM_NAMESPACE
+            print_status "✓ Static WorkloadEntry $name removed, $VM_NAME is auto-registered"
+        fi
+    done
+}
+
+# Mirror the VM into plain Kubernetes service discovery: a headless Service without
+# selector plus an EndpointSlice per VM of the application listing its IP
+apply_endpointslice_config() {
+    print_status "Creating headless Service and EndpointSlice for VM IP $VM_IP..."
+
+    kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: $VM_APP
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+    azure.resource: vm-service
+spec:
+  clusterIP: None
+  ports:
+$(render_service_ports service)
+EOF
+
+    kubectl apply -f - <<EOF
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: $VM_APP-$VM_NAME
+  namespace: $VM_NAMESPACE
+  labels:
+    kubernetes.io/service-name: $VM_APP
+    endpointslice.kubernetes.io/managed-by: istio-azure-setup
+    app: $VM_APP
+    azure.resource: vm-endpoint
+    azure.vm: $VM_NAME
+addressType: IPv4
+ports:
+$(render_service_ports endpointslice)
+endpoints:
+- addresses:
+  - "$VM_IP"
+  hostname: $VM_NAME
+  conditions:
+    ready: true
+EOF
+
+    if [ -n "$VM_IPV6" ]; then
+        kubectl apply -f - <<EOF
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: $VM_APP-$VM_NAME-ipv6
+  namespace: $VM_NAMESPACE
+  labels:
+    kubernetes.io/service-name: $VM_APP
+    endpointslice.kubernetes.io/managed-by: istio-azure-setup
+    app: $VM_APP
+    azure.resource: vm-endpoint
+    azure.vm: $VM_NAME
+addressType: IPv6
+ports:
+$(render_service_ports endpointslice)
+endpoints:
+- addresses:
+  - "$VM_IPV6"
+  hostname: $VM_NAME
+  conditions:
+    ready: true
+EOF
+    fi
+
+    if kubectl get endpointslice $VM_APP-$VM_NAME -n $VM_NAMESPACE &> /dev/null; then
+        print_status "✓ EndpointSlice $VM_APP-$VM_NAME points at $VM_IP"
+    else
+        print_error "Failed to create EndpointSlice $VM_APP-$VM_NAME"
+        exit 1
+    fi
+    remove_shared_registrations
+}
+
+# Register the additional services of the VM: a Service per service and, for every VM
+# address, a WorkloadEntry (or EndpointSlice) with the ports and labels of the service.
+# Instances of services no longer listed for the VM are removed
+apply_vm_services() {
+    local name ports labels wanted=""
+    while IFS=: read -r name ports labels; do
+        [ -n "$name" ] || continue
+        wanted="$wanted $name"
+        print_status "Registering service $name ($ports) of $VM_NAME..."
+
+        if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+            kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: $name
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $name
+    azure.resource: vm-additional-service
+spec:
+  clusterIP: None
+  ports:
+$(VM_WORKLOAD_PORTS=$ports render_service_ports service)
+EOF
+        else
+            kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: $name
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $name
+    azure.resource: vm-additional-service
+spec:
+  selector:
+    app: $name
+  ports:
+$(VM_WORKLOAD_PORTS=$ports render_service_ports service)
+  type: ClusterIP
+EOF
+
+            kubectl apply -f - <<EOF
+apiVersion: networking.istio.io/v1
+kind: DestinationRule
+metadata:
+  name: $name
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $name
+    azure.resource: vm-additional-service
+spec:
+  host: $name.$VM_NAMESPACE.svc.cluster.local
+$(render_traffic_policy "$(VM_WORKLOAD_PORTS=$ports main_port | awk '{print $3}')")
+EOF
+        fi
+
+        local address suffix
+        for address in "$VM_IP" "$VM_IPV6"; do
+            [ -n "$address" ] || continue
+            suffix=$([[ "$address" == *:* ]] && echo "-ipv6" || true)
+
+            if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+                kubectl apply -f - <<EOF
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: $name-$VM_NAME$suffix
+  namespace: $VM_NAMESPACE
+  labels:
+    kubernetes.io/service-name: $name
+    endpointslice.kubernetes.io/managed-by: istio-azure-setup
+    app: $name
+    azure.resource: vm-service-instance
+    azure.vm: $VM_NAME
+addressType: $([ -n "$suffix" ] && echo IPv6 || echo IPv4)
+ports:
+$(VM_WORKLOAD_PORTS=$ports render_service_ports endpointslice)
+endpoints:
+- addresses:
+  - "$address"
+  hostname: $VM_NAME
+  conditions:
+    ready: true
+EOF
+            else
+                kubectl apply -f - <<EOF
+apiVersion: networking.istio.io/v1
+kind: WorkloadEntry
+metadata:
+  name: $name-$VM_NAME$suffix
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $name
+    azure.resource: vm-service-instance
+    azure.vm: $VM_NAME
+spec:
+  address: "$address"
+  labels:
+$({ workload_labels; echo "app=$name"; echo "service.istio.io/canonical-name=$name"; echo "$labels" | tr ',' '\n' | grep '=' | grep -v '^app='; } | render_labels 4)
+  serviceAccount: $SERVICE_ACCOUNT
+  network: "$VM_NETWORK"
+  ports:
+$(VM_WORKLOAD_PORTS=$ports render_workload_ports 4)
+EOF
+            fi
+        done
+    done < <(echo "$VM_SERVICE_SPECS" | tr ';' '\n')
+
+    local kind app
+    kubectl get workloadentry,endpointslice -n $VM_NAMESPACE -l azure.resource=vm-service-instance,azure.vm=$VM_NAME \
+        -o jsonpath='{range .items[*]}{.kind} {.metadata.name} {.metadata.labels.app}{"\n"}{end}' 2>/dev/null \
+        | while read -r kind name app; do
+            if [[ " $wanted " != *" $app "* ]]; then
+                print_status "Service $app is no longer hosted by $VM_NAME, removing $name"
+                kubectl delete "${kind,,}" "$name" -n $VM_NAMESPACE
+            fi
+        done
+    prune_vm_services
+}
+
+# Delete the additional services no VM is registered for anymore
+prune_vm_services() {
+    local namespace name
+    kubectl get service -A -l azure.resource=vm-additional-service \
+        -o jsonpath='{range .items[*]}{.metadata.namespace} {.metadata.name}{"\n"}{end}' 2>/dev/null \
+        | while read -r namespace name; do
+            if [ -z "$(kubectl get workloadentry,endpointslice -n $namespace -l azure.resource=vm-service-instance,app=$name -o name 2>/dev/null)" ]; then
+                delete_owned destinationrule/$name $namespace || true
+                if delete_owned service/$name $namespace; then
+                    print_status "✓ Service $name.$namespace removed, no VM hosts it anymore"
+                fi
+            fi
+        done
+}
+
+# Make the VM sidecar metrics scrapable by Prometheus: a selector-less Service of the
+# application annotated for the addon's kubernetes-service-endpoints job, an EndpointSlice
+# per VM with its IP and, when the Prometheus Operator is installed, a ServiceMonitor for
+# the same Service
+configure_metrics_scraping() {
+    if [ "$VM_METRICS_SCRAPE" != "true" ] || [ "$MESH_MODE" = "ambient" ]; then
+        return 0
+    fi
+
+    local metrics_port="${PROXY_STATUS_PORT:-15020}"
+    print_status "Configuring Prometheus scraping of $VM_IP:$metrics_port/stats/prometheus..."
+
+    kubectl apply -f - <<EOF
+apiVersion: v1
+kind: Service
+metadata:
+  name: $VM_APP-vm-metrics
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+    azure.resource: vm-metrics
+  annotations:
+    prometheus.io/scrape: "true"
+    prometheus.io/port: "$metrics_port"
+    prometheus.io/path: /stats/prometheus
+spec:
+  clusterIP: None
+  ports:
+  - name: http-envoy-prom
+    port: $metrics_port
+    targetPort: $metrics_port
+    protocol: TCP
+---
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: $VM_APP-$VM_NAME-metrics
+  namespace: $VM_NAMESPACE
+  labels:
+    kubernetes.io/service-name: $VM_APP-vm-metrics
+    endpointslice.kubernetes.io/managed-by: istio-azure-setup
+    app: $VM_APP
+    azure.resource: vm-metrics
+    azure.vm: $VM_NAME
+addressType: IPv4
+ports:
+- name: http-envoy-prom
+  port: $metrics_port
+  protocol: TCP
+endpoints:
+- addresses:
+  - "$VM_IP"
+  hostname: $VM_NAME
+  conditions:
+    ready: true
+EOF
+
+    if kubectl get crd servicemonitors.monitoring.coreos.com &> /dev/null; then
+        kubectl apply -f - <<EOF
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: $VM_APP-vm-metrics
+  namespace: $VM_NAMESPACE
+  labels:
+    app: $VM_APP
+spec:
+  selector:
+    matchLabels:
+      azure.resource: vm-metrics
+      app: $VM_APP
+  endpoints:
+  - port: http-envoy-prom
+    path: /stats/prometheus
+    interval: 15s
+EOF
+        print_status "✓ ServiceMonitor $VM_APP-vm-metrics created"
+    fi
+
+    print_status "✓ VM sidecar metrics exposed through Service $VM_APP-vm-metrics"
+}
+
+# Mirror the VM service registration into Consul when CONSUL_HTTP_ADDR is set
+sync_external_registry() {
+    if [ -z "$CONSUL_HTTP_ADDR" ]; then
+        return 0
+    fi
+
+    VM_NAME=$VM_NAME VM_NAMESPACE=$VM_NAMESPACE VM_APP=$VM_APP VM_VERSION=$VM_VERSION \
+        bash "$SCRIPT_DIR/consul-sync.sh" register "$VM_IP"
+}
+
 # Generate comprehensive VM files with Azure optimizations
 generate_vm_files() {
     print_status "Generating comprehensive VM files for Azure deployment..."
@@ -378,11 +1836,18 @@ generate_vm_files() {
 
     istioctl x workload entry configure -f "$WORK_DIR/vm-files/workloadgroup.yaml" -o "$WORK_DIR/vm-files" --clusterID "${CLUSTER_NAME}" --autoregister
     rm -f "$WORK_DIR/vm-files/workloadgroup.yaml"
+    verify_proxy_config
+    generate_sidecar_resources
+    configure_traffic_capture
+    configure_dns_capture
+    wire_istiod_private_endpoint
 
     # Copy scripts if they exist
     print_status "Preparing VM setup script..."
     
     cp "$SCRIPT_DIR/vm-scripts/setup-vm-mesh.sh" "$WORK_DIR/vm-files/"
+    generate_deployment_files
+    echo "MESH_MODE=$MESH_MODE" > "$WORK_DIR/vm-files/mesh-mode.env"
     
     print_status "✓ VM files generated: $WORK_DIR/vm-files/"
     print_status "Files: hosts, root-cert.pem, istio-token, cluster.env, mesh.yaml, setup-vm-mesh.sh"
@@ -417,13 +1882,242 @@ run_vm_setup() {
     fi
 }
 
+# Apply the regenerated files on the VM and restart its sidecar with them
+refresh_vm_sidecar() {
+    print_status "Refreshing the mesh configuration of $VM_NAME..."
+
+    if ssh -o StrictHostKeyChecking=no azureuser@$VM_IP 'bash /tmp/vm-files/setup-vm-mesh.sh update'; then
+        print_status "✓ VM mesh configuration refreshed"
+    else
+        print_error "VM mesh configuration refresh failed, $VM_NAME keeps its previous registration"
+        exit 1
+    fi
+}
+
+# "NAMESPACE APP" of the current registration of the VM, from the WorkloadEntries
+# (or EndpointSlices) listing one of its addresses
+current_registration() {
+    kubectl get workloadentry,endpointslice -A -o json | jq -r --argjson addresses "$(vm_addresses)" '
+        [.items[] | select(.metadata.labels["azure.resource"] != "vm-service-instance")
+            | select(((.spec.address // empty), .endpoints[]?.addresses[]?) as $a | $addresses | index($a))
+            | "\(.metadata.namespace) \(.spec.labels.app // .metadata.labels.app // "")"] | first // empty'
+}
+
+# Remove the VM from the namespace/application it moved away from, and the resources of
+# that application once no other VM is registered for it
+retire_registration() {
+    local namespace=$1
+    local app=$2
+
+    print_status "Removing $VM_NAME from $app.$namespace..."
+    local kind name
+    kubectl get workloadentry,endpointslice -n $namespace -o json | jq -r --argjson addresses "$(vm_addresses)" '
+        .items[] | select(((.spec.address // empty), .endpoints[]?.addresses[]?) as $a | $addresses | index($a))
+            | "\(.kind | ascii_downcase) \(.metadata.name)"' | sort -u \
+        | while read -r kind name; do
+            kubectl delete $kind "$name" -n $namespace
+        done
+
+    if [ -n "$(kubectl get workloadentry,endpointslice -n $namespace -l app=$app -o name 2>/dev/null)" ]; then
+        print_status "✓ Other VMs still serve $app.$namespace, keeping its resources"
+        return 0
+    fi
+
+    local resource
+    for resource in service/$app service/$app-vm-metrics serviceentry/$app-vm virtualservice/$app destinationrule/$app workloadgroup/$app; do
+        delete_owned $resource $namespace || true
+    done
+    if kubectl get crd servicemonitors.monitoring.coreos.com &> /dev/null; then
+        delete_owned servicemonitor/$app-vm-metrics $namespace || true
+    fi
+
+    # The VM policies are named per namespace, a policy still selecting the old app is stale
+    local policy
+    for policy in vm-workload-policy vm-outbound-policy; do
+        if [ "$(kubectl get authorizationpolicy $policy -n $namespace -o jsonpath='{.spec.selector.matchLabels.app}' 2>/dev/null)" = "$app" ]; then
+            delete_owned authorizationpolicy/$policy $namespace || true
+        fi
+    done
+    print_status "✓ Resources of $app.$namespace removed"
+}
+
+# Apply namespace, application, port and label changes to the registration of an onboarded
+# VM without recreating it. Labels and ports are patched in place; a new namespace or
+# application is a new workload identity, so the VM gets regenerated files and a sidecar
+# restart before its previous registration is removed
+update_registration() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to update the mesh registration"
+        exit 1
+    fi
+
+    get_vm_ip
+    local current=$(current_registration)
+    if [ -z "$current" ]; then
+        print_error "$VM_NAME is not registered in the mesh, run setup-vm-mesh first"
+        exit 1
+    fi
+    local old_namespace=${current%% *}
+    local old_app=${current#* }
+    print_status "Current registration: $old_app.$old_namespace, target: $VM_APP.$VM_NAMESPACE"
+
+    mkdir -p "$WORK_DIR/vm-files"
+    setup_cluster_resources
+    apply_vm_config
+    setup_waypoint
+    configure_metrics_scraping
+    sync_external_registry
+
+    if [ "$old_namespace" = "$VM_NAMESPACE" ] && [ "$old_app" = "$VM_APP" ]; then
+        rm -f "$WORK_DIR/vm-files/workloadgroup.yaml"
+        print_status "✅ Mesh registration of $VM_NAME updated in place, the sidecar keeps running"
+        return 0
+    fi
+
+    setup_istiod_private_link
+    setup_cluster_dns
+    generate_vm_files
+    copy_files_to_vm
+    refresh_vm_sidecar
+    retire_registration "$old_namespace" "$old_app"
+    prune_vm_services
+    prune_service_entries
+
+    print_status "✅ $VM_NAME moved from $old_app.$old_namespace to $VM_APP.$VM_NAMESPACE"
+}
+
 # Main function with VM IP support
 main() {
+    # prune: delete the additional services left without VM and point the ServiceEntries
+    # at the remaining VMs, e.g. after a VM was removed
+    if [ "$1" = "prune" ]; then
+        prune_vm_services
+        prune_service_entries
+        return 0
+    fi
+
+    # sync: only update the labels and ports of the existing mesh registration
+    if [ "$1" = "sync" ]; then
+        get_vm_ip
+        sync_workload_entries
+        return 0
+    fi
+
     print_status "Starting VM mesh integration setup..."
+
+    case $INTEGRATION_MODE in
+        istio|endpointslice) ;;
+        autoregister)
+            if [ "$MESH_MODE" = "ambient" ]; then
+                print_error "Auto-registration needs the VM sidecar, use --integration-mode istio or endpointslice in ambient mode"
+                exit 1
+            fi
+            ;;
+        *)
+            print_error "Unknown integration mode: $INTEGRATION_MODE (valid: istio, autoregister, endpointslice)"
+            exit 1
+            ;;
+    esac
+    print_status "Integration mode: $INTEGRATION_MODE"
+
+    if [ "$MESH_MODE" != "sidecar" ] && [ "$MESH_MODE" != "ambient" ]; then
+        print_error "Unknown mesh mode: $MESH_MODE (valid: sidecar, ambient)"
+        exit 1
+    fi
+    print_status "Mesh mode: $MESH_MODE"
+
+    if [ "$ISTIOD_EXPOSURE" != "public" ] && [ "$ISTIOD_EXPOSURE" != "private-link" ]; then
+        print_error "Unknown istiod exposure: $ISTIOD_EXPOSURE (valid: public, private-link)"
+        exit 1
+    fi
+
+    case $VM_CLUSTER_DNS in
+        hosts|resolver|forwarder) ;;
+        proxy)
+            if [ "$MESH_MODE" = "ambient" ]; then
+                print_error "The sidecar DNS proxy is not available in ambient mode, use --vm-cluster-dns resolver or forwarder"
+                exit 1
+            fi
+            ;;
+        *)
+            print_error "Unknown cluster DNS mode: $VM_CLUSTER_DNS (valid: hosts, proxy, resolver, forwarder)"
+            exit 1
+            ;;
+    esac
        
+    validate_proxy_config
+    validate_sidecar_resources
+    validate_capture_options
+    validate_vm_services
+    validate_traffic_policy
+    verify_mesh_identity
+
+    # dry-run: send the cluster resources of the integration to the API server without
+    # persisting them, before the VM is provisioned
+    if [ "$1" = "dry-run" ]; then
+        DRY_RUN=true
+        VM_IP=${VM_IP:-$DRY_RUN_VM_IP}
+        print_status "Dry-run of the mesh resources of $VM_NAME ($VM_IP)..."
+        mkdir -p "$WORK_DIR/vm-files"
+        setup_cluster_resources
+        apply_vm_config
+        setup_waypoint
+        configure_metrics_scraping
+        dry_run_summary
+        return
+    fi
+
+    # update: change namespace, application, ports or labels of an onboarded VM
+    if [ "$1" = "update" ]; then
+        update_registration
+        return 0
+    fi
+
+    # register: recreate the cluster side of the mesh registration of an onboarded VM, e.g.
+    # after its WorkloadEntries were deleted. An auto-registered VM only comes back when
+    # its sidecar connects again, so the sidecar is restarted
+    if [ "$1" = "register" ]; then
+        get_vm_ip
+        apply_vm_config
+        if [ "$INTEGRATION_MODE" = "autoregister" ]; then
+            ssh -n -o StrictHostKeyChecking=no azureuser@$VM_IP 'sudo systemctl restart istio'
+        fi
+        print_status "✓ Mesh registration of $VM_NAME recreated"
+        return 0
+    fi
+
+    # vmss: cluster resources and VM files shared by the instances of a scale set. The
+    # instances register themselves through the WorkloadGroup, so nothing here depends
+    # on their addresses; the files go into their cloud-init
+    if [ "$1" = "vmss" ]; then
+        if [ "$INTEGRATION_MODE" != "autoregister" ] || [ "$MESH_MODE" != "sidecar" ]; then
+            print_error "Scale set instances join the mesh with their sidecar: autoregister integration and sidecar mesh mode only"
+            exit 1
+        fi
+        if [ "$ISTIOD_EXPOSURE" != "public" ] || [ "$VM_CLUSTER_DNS" = "resolver" ] || [ "$VM_CLUSTER_DNS" = "forwarder" ]; then
+            print_error "Private Link istiod and cluster DNS are set up per VM network, scale sets use the public east-west gateway"
+            exit 1
+        fi
+        if [ -n "$VM_SERVICE_SPECS" ]; then
+            print_error "Additional services are registered per VM address, they are not supported on scale sets"
+            exit 1
+        fi
+        print_status "Mesh resources of scale set $VM_NAME..."
+        setup_cluster_resources
+        apply_vm_config
+        generate_vm_files
+        return 0
+    fi
+
     get_vm_ip
+    check_vm_capacity
     setup_cluster_resources
     apply_vm_config
+    setup_waypoint
+    configure_metrics_scraping
+    sync_external_registry
+    setup_istiod_private_link
+    setup_cluster_dns
     generate_vm_files
     copy_files_to_vm
     run_vm_setup
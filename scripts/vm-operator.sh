@@ -0,0 +1,330 @@
+#!/bin/bash
+
+# VM Operator Script
+# Kubernetes side of the operator mode. The VMWorkload custom resource declares desired VMs
+# in the cluster, e.g. synced from a GitOps repository. spec turns the VMWorkloads into a
+# fleet spec, which setup-istio.sh operator run applies like fleet apply; report writes the
+# result back to their status; wait watches the VMWorkloads (the informer of the loop) until
+# one changes or the resync period ends, so a pass also repairs drift nobody declared.
+# A finalizer keeps a deleted VMWorkload until its VMs are gone from Azure, and its status
+# reports the VMs a pass could not delete.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+FIELD_MANAGER="${FIELD_MANAGER:-istio-azure-setup}"
+
+# Seconds between two passes when no VMWorkload changes
+OPERATOR_RESYNC="${OPERATOR_RESYNC:-300}"
+
+CRD_GROUP="mesh.istio-azure-setup.io"
+RESOURCE="vmworkloads.$CRD_GROUP"
+WORKLOAD_TAG="istio-vmworkload"
+FINALIZER="$CRD_GROUP/cleanup"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1" >&2
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 install | uninstall | spec | report EXIT_CODE | wait | status"
+    echo ""
+    echo "  install      Create or update the VMWorkload CustomResourceDefinition"
+    echo "  uninstall    Delete the CustomResourceDefinition, refused while VMWorkloads exist"
+    echo "  spec         Print the fleet spec declared by the VMWorkloads"
+    echo "  report RC    Set the status of the VMWorkloads from the exit code of the last pass, release"
+    echo "               the deleted ones whose VMs are gone"
+    echo "  wait         Return when a VMWorkload changes, or after OPERATOR_RESYNC seconds"
+    echo "  status       List the VMWorkloads with their phase"
+    echo ""
+    echo "Environment:"
+    echo "  OPERATOR_RESYNC   Seconds between two passes without change (default: 300)"
+}
+
+install_crd() {
+    kubectl apply --server-side --field-manager=$FIELD_MANAGER -f - > /dev/null <<EOF
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: $RESOURCE
+spec:
+  group: $CRD_GROUP
+  scope: Namespaced
+  names:
+    kind: VMWorkload
+    listKind: VMWorkloadList
+    plural: vmworkloads
+    singular: vmworkload
+    shortNames:
+    - vmw
+  versions:
+  - name: v1alpha1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Count
+      type: integer
+      jsonPath: .spec.count
+    - name: Size
+      type: string
+      jsonPath: .spec.size
+    - name: Phase
+      type: string
+      jsonPath: .status.phase
+    - name: Age
+      type: date
+      jsonPath: .metadata.creationTimestamp
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              count:
+                type: integer
+                minimum: 1
+                maximum: 50
+                default: 1
+              size:
+                type: string
+                default: Standard_B2s
+              tags:
+                type: object
+                additionalProperties:
+                  type: string
+              mesh:
+                type: object
+                properties:
+                  integrationMode:
+                    type: string
+                    enum: [istio, autoregister, endpointslice]
+                  meshMode:
+                    type: string
+                    enum: [sidecar, ambient]
+          status:
+            type: object
+            properties:
+              phase:
+                type: string
+              message:
+                type: string
+              vms:
+                type: array
+                items:
+                  type: string
+              observedGeneration:
+                type: integer
+              lastReconciled:
+                type: string
+              conditions:
+                type: array
+                items:
+                  type: object
+                  required: [type, status]
+                  properties:
+                    type:
+                      type: string
+                    status:
+                      type: string
+                    reason:
+                      type: string
+                    message:
+                      type: string
+                    lastTransitionTime:
+                      type: string
+EOF
+    kubectl wait --for=condition=Established crd/$RESOURCE --timeout=60s > /dev/null
+    print_status "✓ CustomResourceDefinition $RESOURCE installed"
+}
+
+uninstall_crd() {
+    local count=$(kubectl get $RESOURCE -A -o name 2>/dev/null | wc -l | tr -d ' ')
+    if [ "$count" -gt 0 ]; then
+        # Deleting the CRD deletes the VMWorkloads, and the next pass the VMs with them
+        print_error "$count VMWorkload(s) still declare VMs, delete them first"
+        exit 1
+    fi
+    kubectl delete crd $RESOURCE --ignore-not-found > /dev/null
+    print_status "✓ CustomResourceDefinition $RESOURCE deleted"
+}
+
+# The VMWorkloads, failing when the CRD is not installed
+list_workloads() {
+    if ! kubectl get crd $RESOURCE &> /dev/null; then
+        print_error "The VMWorkload CRD is not installed, run: setup-istio.sh operator install"
+        exit 1
+    fi
+    kubectl get $RESOURCE -A -o json
+}
+
+# Add the cleanup finalizer to the VMWorkloads without it, before any of their VMs exists
+add_finalizers() {
+    local item namespace name patch
+    jq -c --arg finalizer "$FINALIZER" '.items[] | select(.metadata.deletionTimestamp == null)
+        | select((.metadata.finalizers // []) | index($finalizer) | not)
+        | {namespace: .metadata.namespace, name: .metadata.name,
+           patch: {metadata: {finalizers: ((.metadata.finalizers // []) + [$finalizer])}}}' \
+        | while read -r item; do
+            namespace=$(jq -r '.namespace' <<< "$item")
+            name=$(jq -r '.name' <<< "$item")
+            patch=$(jq -c '.patch' <<< "$item")
+            kubectl patch $RESOURCE $name -n $namespace --type merge -p "$patch" --field-manager=$FIELD_MANAGER > /dev/null
+        done
+}
+
+# The fleet spec of the VMWorkloads. Deleted ones are left out, so the pass deletes their
+# VMs. VM names are global to the resource group, so of two VMWorkloads with the same name
+# in different namespaces only the oldest is kept
+workload_spec() {
+    local workloads
+    workloads=$(list_workloads)
+    add_finalizers <<< "$workloads"
+    jq --arg tag "$WORKLOAD_TAG" '{vms: [.items | map(select(.metadata.deletionTimestamp == null))
+        | sort_by(.metadata.creationTimestamp) | unique_by(.metadata.name)[] | {
+        name: .metadata.name, count: (.spec.count // 1), size: .spec.size,
+        tags: ((.spec.tags // {}) + {($tag): "\(.metadata.namespace).\(.metadata.name)"}),
+        mesh: {integration_mode: .spec.mesh.integrationMode, mesh_mode: .spec.mesh.meshMode}}]}' <<< "$workloads"
+}
+
+# A deleted VMWorkload: release it once its VMs are gone, otherwise report them in a
+# CleanupFailed condition, so they are not orphaned silently
+finalize_workload() {
+    local namespace=$1
+    local name=$2
+    local rc=$3
+    local now=$4
+
+    local remaining
+    if ! remaining=$(az vm list --resource-group $RESOURCE_GROUP --query "[?tags.\"$WORKLOAD_TAG\"=='$namespace.$name'].name" -o tsv); then
+        print_warning "Could not list the VMs of $namespace/$name, it is kept until the next pass"
+        return 0
+    fi
+    if [ -z "$remaining" ]; then
+        local finalizers=$(kubectl get $RESOURCE $name -n $namespace -o json \
+            | jq -c --arg finalizer "$FINALIZER" '{metadata: {finalizers: [(.metadata.finalizers // [])[] | select(. != $finalizer)]}}')
+        kubectl patch $RESOURCE $name -n $namespace --type merge -p "$finalizers" --field-manager=$FIELD_MANAGER > /dev/null \
+            && print_status "✓ VMs of $namespace/$name deleted, VMWorkload released"
+        return 0
+    fi
+
+    local patch=$(jq -cn --arg vms "$remaining" --argjson rc "$rc" --arg now "$now" '($vms | split("\n")) as $vms |
+        "\($vms | length) VM(s) still exist: \($vms | join(", ")), the pass exited with code \($rc). Retried at the next pass" as $message |
+        {status: {phase: "Deleting", message: $message, vms: $vms, lastReconciled: $now,
+            conditions: [{type: "CleanupFailed", status: "True", reason: "VMsRemaining", message: $message, lastTransitionTime: $now}]}}')
+    kubectl patch $RESOURCE $name -n $namespace --subresource=status --type merge -p "$patch" \
+        --field-manager=$FIELD_MANAGER > /dev/null || true
+    print_warning "VMWorkload $namespace/$name is deleted but its VMs still exist: $(echo $remaining)"
+}
+
+# Status of every VMWorkload after a pass: Ready or Failed for all of them (a pass applies
+# the whole fleet), Conflict for the ones shadowed by an older VMWorkload of the same name.
+# Deleted VMWorkloads are finalized instead
+report_status() {
+    local rc=$1
+    local now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+    local item namespace name patch
+    local deleted=$(list_workloads | jq -r '.items[] | select(.metadata.deletionTimestamp != null)
+        | "\(.metadata.namespace) \(.metadata.name)"')
+    while read -r -u 3 namespace name; do
+        [ -n "$name" ] && finalize_workload "$namespace" "$name" "$rc" "$now"
+    done 3<<< "$deleted"
+
+    list_workloads | jq -c --argjson rc "$rc" --arg now "$now" '
+        .items | map(select(.metadata.deletionTimestamp == null)) | sort_by(.metadata.creationTimestamp)
+        | [unique_by(.metadata.name)[].metadata.uid] as $kept | .[] |
+        {namespace: .metadata.namespace, name: .metadata.name, status: (
+            if (.metadata.uid | IN($kept[]) | not) then
+                {phase: "Conflict", message: "An older VMWorkload named \(.metadata.name) declares these VMs", vms: []}
+            else
+                (if $rc == 0 then
+                    {phase: "Ready", message: "VMs match the spec and joined the mesh"}
+                else
+                    {phase: "Failed", message: "Reconciliation failed (exit code \($rc)), retried at the next pass"}
+                end)
+                + {vms: (if (.spec.count // 1) > 1 then [range(1; .spec.count + 1) as $i | "\(.metadata.name)-\($i)"] else [.metadata.name] end)}
+            end
+            + {observedGeneration: .metadata.generation, lastReconciled: $now})}' \
+        | while read -r item; do
+            namespace=$(jq -r '.namespace' <<< "$item")
+            name=$(jq -r '.name' <<< "$item")
+            patch=$(jq -c '{status: .status}' <<< "$item")
+            kubectl patch $RESOURCE $name -n $namespace --subresource=status --type merge -p "$patch" \
+                --field-manager=$FIELD_MANAGER > /dev/null || print_warning "Could not update the status of $namespace/$name"
+        done
+}
+
+# Block until a VMWorkload is added, changed or deleted, at most OPERATOR_RESYNC seconds.
+# The watch starts after the status updates of the pass, so they do not wake it up
+wait_for_change() {
+    local fd pid event rc=0
+    local started=$(date +%s)
+    exec {fd}< <(kubectl get $RESOURCE -A --watch-only -o name 2>/dev/null)
+    pid=$!
+    read -r -t "$OPERATOR_RESYNC" -u $fd event || rc=$?
+    if [ $rc -eq 0 ]; then
+        print_status "Changed: $event"
+    elif [ $rc -le 128 ]; then
+        # The watch ended (API server unreachable, CRD deleted): wait out the period anyway
+        print_warning "Watch of the VMWorkloads ended, next pass in at most ${OPERATOR_RESYNC}s"
+        sleep $((OPERATOR_RESYNC - ($(date +%s) - started))) 2>/dev/null || true
+    fi
+    kill $pid 2>/dev/null || true
+    exec {fd}<&-
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required by the operator mode"
+        exit 1
+    fi
+
+    case $1 in
+        install)
+            install_crd
+            ;;
+        uninstall)
+            uninstall_crd
+            ;;
+        spec)
+            workload_spec
+            ;;
+        report)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            report_status "$2"
+            ;;
+        wait)
+            wait_for_change
+            ;;
+        status)
+            list_workloads > /dev/null
+            kubectl get $RESOURCE -A \
+                -o custom-columns='NAMESPACE:.metadata.namespace,NAME:.metadata.name,COUNT:.spec.count,SIZE:.spec.size,PHASE:.status.phase,VMS:.status.vms,MESSAGE:.status.message'
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,77 @@
+#!/bin/bash
+
+# VM IMDS Bootstrap Script (to be run on the VM)
+# Custom data of the scale sets created with --vmss-bootstrap user-data. Reads the instance
+# metadata from IMDS: its name, resource group, location and tags go to an environment file
+# the services of the VM can load, and the user data (the mesh files and setup-vm-mesh.sh
+# rendered by setup-istio.sh) is run. It installs itself as istio-vm-bootstrap, so the
+# current user data of the scale set model can be applied again later: "update" refreshes
+# the mesh configuration and restarts the sidecar.
+set -e
+
+IMDS_URL="http://169.254.169.254/metadata/instance/compute?api-version=2021-01-01"
+ENV_FILE="/etc/default/istio-vm-imds"
+INSTALL_PATH="/usr/local/bin/istio-vm-bootstrap"
+
+print_status() {
+    echo -e "\033[0;32m[INFO]\033[0m $1"
+}
+
+print_error() {
+    echo -e "\033[0;31m[ERROR]\033[0m $1"
+}
+
+# Instance metadata, IMDS can take a few seconds to answer after boot
+fetch_metadata() {
+    local i
+    for i in $(seq 1 30); do
+        if curl -s -f --max-time 5 -H "Metadata: true" "$IMDS_URL"; then
+            return 0
+        fi
+        sleep 2
+    done
+    print_error "IMDS did not answer at $IMDS_URL"
+    return 1
+}
+
+# Environment file of the instance: AZURE_* for the VM, TAG_* for each tag (upper case,
+# other characters than letters and digits as _)
+write_environment() {
+    python3 -c '
+import json, re, sys
+compute = json.load(sys.stdin)
+def line(key, value):
+    return "%s=\"%s\"" % (key, str(value).replace("\\", "\\\\").replace("\"", "\\\""))
+print(line("AZURE_VM_NAME", compute.get("name", "")))
+print(line("AZURE_RESOURCE_GROUP", compute.get("resourceGroupName", "")))
+print(line("AZURE_LOCATION", compute.get("location", "")))
+print(line("AZURE_VMSS_NAME", compute.get("vmScaleSetName", "")))
+for tag in compute.get("tagsList", []):
+    print(line("TAG_" + re.sub("[^A-Z0-9]", "_", tag["name"].upper()), tag["value"]))
+' | sudo tee "$ENV_FILE" > /dev/null
+    print_status "Instance metadata written to $ENV_FILE"
+}
+
+main() {
+    local metadata
+    metadata=$(fetch_metadata)
+
+    if [ "$0" != "$INSTALL_PATH" ] && [ -f "$0" ]; then
+        sudo install -m 0755 "$0" "$INSTALL_PATH"
+    fi
+    write_environment <<< "$metadata"
+
+    local user_data
+    user_data=$(python3 -c 'import json, sys; print(json.load(sys.stdin).get("userData", ""))' <<< "$metadata")
+    if [ -z "$user_data" ]; then
+        print_error "The instance has no user data, nothing to set up"
+        exit 1
+    fi
+
+    print_status "Running the user data${1:+ ($1)}..."
+    base64 -d <<< "$user_data" > /tmp/istio-vm-user-data.sh
+    bash /tmp/istio-vm-user-data.sh "$@"
+}
+
+# Run main function
+main "$@"
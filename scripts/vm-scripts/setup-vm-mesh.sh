@@ -9,6 +9,12 @@ WORK_DIR="/home/azureuser/istio-vm-setup"
 # Shared configuration variables
 VM_NAME="istio-vm"
 
+# Data plane selected by vm-mesh-integration.sh (sidecar or ambient)
+MESH_MODE="sidecar"
+if [ -f "/tmp/vm-files/mesh-mode.env" ]; then
+    source /tmp/vm-files/mesh-mode.env
+fi
+
 print_status() {
     echo -e "\033[0;32m[INFO]\033[0m $1"
 }
@@ -103,8 +109,12 @@ install_istio_certificates() {
         exit 1
     fi
 
-    # Copy hosts
+    # Copy hosts, replacing earlier entries of the same names when files are refreshed
     if [ -f "hosts" ]; then
+        local host
+        for host in $(awk '!/^#/ { for (i = 2; i <= NF; i++) print $i }' hosts) "$VM_NAME"; do
+            sudo sed -i "/[[:space:]]${host//./\\.}\$/d" /etc/hosts
+        done
         sudo sh -c "cat $WORK_DIR/hosts >> /etc/hosts"
         sudo sh -c "echo '127.0.0.1 $VM_NAME' >> /etc/hosts"
         print_status "✓ Cluster hosts configured"
@@ -229,6 +239,13 @@ install_istio_components() {
         exit 1
     fi
 
+    # Copy custom Envoy bootstrap override (referenced by ISTIO_BOOTSTRAP_OVERRIDE in cluster.env)
+    if [ -f "bootstrap-override.json" ]; then
+        sudo cp bootstrap-override.json /etc/istio/proxy/bootstrap-override.json
+        sudo chmod 644 /etc/istio/proxy/bootstrap-override.json
+        print_status "✓ Envoy bootstrap override configured"
+    fi
+
     sudo chown -R istio-proxy \
         /etc/certs \
         /var/run/secrets \
@@ -240,6 +257,48 @@ install_istio_components() {
     print_status "✓ Istio workload integration components configured"
 }
 
+# Apply sidecar resource limits and Envoy concurrency to the istio systemd unit
+configure_sidecar_resources() {
+    if [ ! -f "/tmp/vm-files/sidecar-resources.env" ]; then
+        return 0
+    fi
+
+    print_status "Configuring sidecar resource limits..."
+    source /tmp/vm-files/sidecar-resources.env
+
+    sudo mkdir -p /etc/systemd/system/istio.service.d
+    {
+        echo "[Service]"
+        if [ -n "$SIDECAR_CPU_LIMIT" ]; then
+            echo "CPUQuota=$(awk -v cores="$SIDECAR_CPU_LIMIT" 'BEGIN { printf "%d%%", cores * 100 }')"
+        fi
+        if [ -n "$SIDECAR_MEMORY_LIMIT" ]; then
+            echo "MemoryMax=$SIDECAR_MEMORY_LIMIT"
+        fi
+        if [ -n "$SIDECAR_CONCURRENCY" ]; then
+            echo "Environment=ISTIO_AGENT_FLAGS=--concurrency=$SIDECAR_CONCURRENCY"
+        fi
+    } | sudo tee /etc/systemd/system/istio.service.d/resources.conf > /dev/null
+
+    sudo systemctl daemon-reload
+    print_status "✓ Sidecar limits configured (CPU: ${SIDECAR_CPU_LIMIT:-unlimited}, memory: ${SIDECAR_MEMORY_LIMIT:-unlimited}, concurrency: ${SIDECAR_CONCURRENCY:-default})"
+}
+
+# Install the environment file and the files of the deployment rendered by vm-mesh-integration.sh
+install_deployment_files() {
+    local dir="/tmp/vm-files/deployment-files"
+    if [ ! -f "$dir/manifest" ]; then
+        return 0
+    fi
+
+    print_status "Installing deployment files..."
+    local source destination mode
+    while IFS='|' read -r source destination mode; do
+        sudo install -D -m "$mode" "$dir/$source" "$destination"
+        print_status "  $destination"
+    done < "$dir/manifest"
+}
+
 # Create sample web service (the actual workload)
 create_sample_service() {
     print_status "Creating VM web service workload..."
@@ -358,6 +417,7 @@ ExecStart=/usr/bin/python3 /home/azureuser/vm-service/app.py
 Restart=always
 RestartSec=10
 Environment=FLASK_ENV=production
+EnvironmentFile=-/etc/default/vm-web-service
 Environment=PYTHONPATH=/home/azureuser/.local/lib/python3.10/site-packages
 KillMode=mixed
 TimeoutStartSec=30
@@ -518,6 +578,12 @@ start_services() {
         sleep 2
     done
     
+    # In ambient mode there is no sidecar, the waypoint in the cluster handles the traffic
+    if [ "$MESH_MODE" = "ambient" ]; then
+        print_status "Ambient mode: no Istio sidecar to start on the VM"
+        return 0
+    fi
+
     # Now start Istio
     print_status "Starting Istio..."
     sudo systemctl start istio.service
@@ -543,15 +609,50 @@ start_services() {
     fi
 }
 
+# Apply regenerated mesh files (new identity, namespace or istiod address) and restart the sidecar
+refresh_mesh_config() {
+    print_status "Refreshing Istio workload configuration..."
+
+    validate_prerequisites
+    install_deployment_files
+    if [ "$MESH_MODE" = "ambient" ]; then
+        print_status "Ambient mode: no Istio sidecar to refresh on the VM"
+        return 0
+    fi
+
+    install_istio_certificates
+    install_istio_components
+    configure_sidecar_resources
+
+    sudo systemctl restart istio.service
+    sleep 15
+    if sudo systemctl is-active --quiet istio; then
+        print_status "✓ Istio restarted with the refreshed configuration"
+    else
+        print_error "✗ Istio failed to restart"
+        sudo journalctl -u istio.service -n 20 --no-pager
+        exit 1
+    fi
+}
+
 # Main execution
 main() {
+    if [ "$1" = "update" ]; then
+        refresh_mesh_config
+        return 0
+    fi
+
     print_status "Setting up VM as Istio mesh workload..."
 
     validate_prerequisites
     install_packages
-    install_istio_certificates
-    install_istio
-    install_istio_components
+    install_deployment_files
+    if [ "$MESH_MODE" != "ambient" ]; then
+        install_istio_certificates
+        install_istio
+        install_istio_components
+        configure_sidecar_resources
+    fi
     create_sample_service
     configure_networking
     setup_monitoring
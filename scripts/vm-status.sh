@@ -0,0 +1,166 @@
+#!/bin/bash
+
+# VM Status Script
+# Lists the VMs of resource groups with their power state and addresses in a few bulk
+# calls per resource group: one compute list with the instance view expanded, one NIC
+# list and one public IP list. `az vm list -d` gets the same fields with several calls
+# per VM, which takes minutes for fleets of dozens of VMs. The output has the field
+# names of `az vm list -d` (name, resourceGroup, powerState, privateIps, publicIps,
+# tags, hardwareProfile.vmSize), so callers filter it with jq as they would the CLI.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+INTEGRATION_MODE="${INTEGRATION_MODE:-istio}"
+
+# KEY=VALUE tag the VMs of status must have, e.g. a deployment label (empty: all VMs)
+TAG_SELECTOR="${TAG_SELECTOR:-}"
+
+COMPUTE_API_VERSION="2024-07-01"
+POOL_TAG="istio-warm-pool"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1" >&2
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 list [RESOURCE_GROUP...] | status"
+    echo ""
+    echo "  list     Print the VMs of the resource groups (default: RESOURCE_GROUP) as a JSON array"
+    echo "  status   Show the power state, addresses and mesh registration of every VM of the"
+    echo "           deployment: RESOURCE_GROUP ($RESOURCE_GROUP) and the resource groups of its VMs"
+    echo ""
+    echo "Environment:"
+    echo "  TAG_SELECTOR   KEY=VALUE tag of the VMs shown by status (default: all)"
+}
+
+# VMs of one resource group with their instance view, following the pages of the list
+list_compute() {
+    local url="/subscriptions/{subscriptionId}/resourceGroups/$1/providers/Microsoft.Compute/virtualMachines?api-version=$COMPUTE_API_VERSION&\$expand=instanceView"
+    local page items="[]"
+    while [ -n "$url" ]; do
+        page=$(az rest --method get --url "$url" -o json)
+        items=$(jq -c --argjson page "$page" '. + $page.value' <<< "$items")
+        url=$(jq -r '.nextLink // empty' <<< "$page")
+    done
+    echo "$items"
+}
+
+# VMs of one resource group in the shape of `az vm list -d`
+list_resource_group() {
+    local rg=$1
+    local vms nics public_ips
+    vms=$(list_compute "$rg") || return 1
+    nics=$(az network nic list --resource-group "$rg" -o json 2>/dev/null || echo '[]')
+    public_ips=$(az network public-ip list --resource-group "$rg" -o json 2>/dev/null || echo '[]')
+
+    # Resource IDs come back with different casings from different APIs
+    jq -c -n --arg rg "$rg" --argjson vms "$vms" --argjson nics "$nics" --argjson pips "$public_ips" '
+        ($nics | map({key: (.id | ascii_downcase), value: .ipConfigurations}) | from_entries) as $configs |
+        ($pips | map({key: (.id | ascii_downcase), value: (.ipAddress // "")}) | from_entries) as $addresses |
+        $vms | map(
+            ([.properties.networkProfile.networkInterfaces[]?.id | ascii_downcase | $configs[.] // [] | .[]]) as $ip_configs |
+            {
+                name,
+                resourceGroup: $rg,
+                location,
+                tags: (.tags // {}),
+                hardwareProfile: {vmSize: .properties.hardwareProfile.vmSize},
+                powerState: ([.properties.instanceView.statuses[]? | select(.code | startswith("PowerState/")) | .displayStatus] | first // ""),
+                privateIps: ([$ip_configs[].privateIPAddress // empty] | join(",")),
+                publicIps: ([$ip_configs[].publicIPAddress.id // empty | ascii_downcase | $addresses[.] // empty | select(. != "")] | join(","))
+            })'
+}
+
+# VMs of all the given resource groups as one JSON array
+list_vms() {
+    local rg all="[]" vms
+    for rg in "$@"; do
+        if ! vms=$(list_resource_group "$rg"); then
+            print_error "Could not list the VMs of $rg"
+            exit 1
+        fi
+        all=$(jq -c --argjson vms "$vms" '. + $vms' <<< "$all")
+    done
+    echo "$all"
+}
+
+# RESOURCE_GROUP and the resource groups created for its VMs
+deployment_resource_groups() {
+    echo "$RESOURCE_GROUP"
+    az group list --tag istio-deployment=$RESOURCE_GROUP --query "[].name" -o tsv 2>/dev/null
+}
+
+# One line per VM of the deployment: NAME RESOURCE_GROUP POWER PRIVATE_IP PUBLIC_IP MESH
+fleet_status() {
+    local vms=$(list_vms $(deployment_resource_groups))
+    if [ -n "$TAG_SELECTOR" ]; then
+        vms=$(jq -c --arg key "${TAG_SELECTOR%%=*}" --arg value "${TAG_SELECTOR#*=}" '[.[] | select(.tags[$key] == $value)]' <<< "$vms")
+    fi
+    if [ "$(jq 'length' <<< "$vms")" -eq 0 ]; then
+        print_warning "No VMs in $RESOURCE_GROUP${TAG_SELECTOR:+ with tag $TAG_SELECTOR}"
+        return 0
+    fi
+
+    # Addresses with a WorkloadEntry, or a ready endpoint of a mirrored EndpointSlice, in any namespace
+    local registered
+    if [ "$INTEGRATION_MODE" = "endpointslice" ]; then
+        registered=$(kubectl get endpointslice -A -l endpointslice.kubernetes.io/managed-by=istio-azure-setup -o json 2>/dev/null \
+            | jq -c '[.items[].endpoints[] | select(.conditions.ready != false) | .addresses[]]' || echo '[]')
+    else
+        registered=$(kubectl get workloadentry -A -o json 2>/dev/null | jq -c '[.items[].spec.address]' || echo '[]')
+    fi
+
+    printf "%-30s %-26s %-16s %-16s %-16s %s\n" "VM" "RESOURCE GROUP" "POWER" "PRIVATE IP" "PUBLIC IP" "MESH"
+    jq -r --argjson registered "${registered:-[]}" --arg pool_tag "$POOL_TAG" '
+        sort_by(.resourceGroup, .name) | .[] |
+        (if .tags[$pool_tag] != null then "warm pool (\(.tags[$pool_tag]))"
+         elif ((.privateIps | split(",")) + (.publicIps | split(",")) | any(. as $a | $registered | index($a))) then "registered"
+         else "not registered" end) as $mesh |
+        [.name, .resourceGroup, (.powerState | ltrimstr("VM ") | if . == "" then "-" else . end),
+         (.privateIps | split(",")[0] // "-"), (.publicIps | split(",")[0] // "-"), $mesh] | @tsv' <<< "$vms" \
+        | while IFS=$'\t' read -r name rg power private public mesh; do
+            printf "%-30s %-26s %-16s %-16s %-16s %s\n" "$name" "$rg" "$power" "$private" "$public" "$mesh"
+        done
+}
+
+# Main function
+main() {
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to list VM states"
+        exit 1
+    fi
+
+    case $1 in
+        list)
+            shift
+            list_vms "${@:-$RESOURCE_GROUP}"
+            ;;
+        status)
+            fleet_status
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
@@ -0,0 +1,271 @@
+#!/bin/bash
+
+# VM Tunnel Script
+# Forwards a local port to a port of a VM for debugging, like kubectl port-forward for mesh
+# VMs: the Envoy admin port (admin), the application port (app) or any other port. The port
+# is reached through SSH on the VM, so ports bound to localhost such as the Envoy admin are
+# reachable too. A VM without a public IP is reached through a relay pod the tunnel starts
+# in the cluster, which is in the VM network: kubectl port-forward to the relay, then SSH
+# through it. Opening a tunnel needs the SSH key of the VM and, for private VMs, the
+# Kubernetes permission to create pods and port-forward in VM_NAMESPACE. A tunnel closes
+# after TUNNEL_MINUTES, its relay pod has the same deadline, and every opening, closing and
+# expiry is appended to an audit log.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+VM_RESOURCE_GROUP="${VM_RESOURCE_GROUP:-$RESOURCE_GROUP}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_NAMESPACE="${VM_NAMESPACE:-vm-workloads}"
+VM_PUBLIC_IP="${VM_PUBLIC_IP:-true}"
+VM_WORKLOAD_PORTS="${VM_WORKLOAD_PORTS:-http=8080,metrics=15020,health=15021}"
+
+# Tunnel configuration
+TUNNEL_MINUTES="${TUNNEL_MINUTES:-30}"
+TUNNEL_LOCAL_PORT="${TUNNEL_LOCAL_PORT:-}"          # Empty: the port of the VM
+TUNNEL_RELAY_IMAGE="${TUNNEL_RELAY_IMAGE:-alpine/socat:1.8.0.0}"
+
+ENVOY_ADMIN_PORT=15000
+RELAY_PORT=2222
+RELAY_LOCAL_PORT="${RELAY_LOCAL_PORT:-12222}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+AUDIT_LOG="$(dirname "$SCRIPT_DIR")/workspace/configs/vm-tunnel-audit.log"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 open admin|app|PORT | list | close [VM_NAME]"
+    echo ""
+    echo "  open TARGET     Forward localhost to the Envoy admin port (admin), the application port (app)"
+    echo "                  or PORT of VM_NAME, until Ctrl+C or TUNNEL_MINUTES"
+    echo "  list            Show the open tunnels of the audit log and the relay pods"
+    echo "  close [VM]      Delete the relay pods of the VM (every VM without it), closing their tunnels"
+    echo ""
+    echo "Environment:"
+    echo "  TUNNEL_MINUTES       Lifetime of the tunnel (default: 30)"
+    echo "  TUNNEL_LOCAL_PORT    Local port (default: the port of the VM)"
+    echo "  TUNNEL_RELAY_IMAGE   Image of the relay pod for VMs without a public IP (default: alpine/socat:1.8.0.0)"
+}
+
+# Append an audit record: TIME|ACTION|TUNNEL|VM|PORT|LOCAL_PORT|EXPIRES|USER
+audit() {
+    mkdir -p "$(dirname "$AUDIT_LOG")"
+    echo "$(date -u +%Y-%m-%dT%H:%M:%SZ)|$1|$2|$3|$4|$5|$6|$(current_user)" >> "$AUDIT_LOG"
+}
+
+current_user() {
+    az account show --query user.name -o tsv 2>/dev/null || whoami
+}
+
+# Port of the VM for a target: admin, app (the http port of VM_WORKLOAD_PORTS) or a number
+target_port() {
+    case $1 in
+        admin)
+            echo $ENVOY_ADMIN_PORT
+            ;;
+        app)
+            echo "$VM_WORKLOAD_PORTS" | tr ',' '\n' | sed -n 's/^http=\([0-9]*\).*/\1/p' | head -1
+            ;;
+        *)
+            if [[ ! "$1" =~ ^[0-9]+$ ]] || [ "$1" -lt 1 ] || [ "$1" -gt 65535 ]; then
+                print_error "Unknown tunnel target: $1 (valid: admin, app or a port)"
+                exit 1
+            fi
+            echo "$1"
+            ;;
+    esac
+}
+
+# Address SSH reaches the VM on: its public IP, or its private IP from the relay pod
+vm_address() {
+    local query="publicIps"
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        query="privateIps"
+    fi
+    az vm show -d -g $VM_RESOURCE_GROUP -n $VM_NAME --query $query -o tsv 2>/dev/null | tr ',' '\n' | grep -v ':' | head -1
+}
+
+# Relay pod forwarding RELAY_PORT to SSH on the VM, without a sidecar so the connection
+# leaves the cluster as plain TCP. It is deleted by Kubernetes at the tunnel deadline
+start_relay() {
+    local pod=$1
+    local address=$2
+    local seconds=$3
+    kubectl apply -f - > /dev/null <<EOF
+apiVersion: v1
+kind: Pod
+metadata:
+  name: $pod
+  namespace: $VM_NAMESPACE
+  labels:
+    app: vm-tunnel
+    vm: $VM_NAME
+    sidecar.istio.io/inject: "false"
+  annotations:
+    vm-tunnel/opened-by: "$(current_user)"
+    vm-tunnel/expires: "$(($(date +%s) + seconds))"
+spec:
+  activeDeadlineSeconds: $seconds
+  restartPolicy: Never
+  securityContext:
+    runAsNonRoot: true
+    runAsUser: 65534
+  containers:
+  - name: relay
+    image: $TUNNEL_RELAY_IMAGE
+    args: ["TCP-LISTEN:$RELAY_PORT,fork,reuseaddr", "TCP:$address:22"]
+    securityContext:
+      allowPrivilegeEscalation: false
+      readOnlyRootFilesystem: true
+      capabilities:
+        drop: ["ALL"]
+EOF
+    kubectl wait --for=condition=Ready pod/$pod -n $VM_NAMESPACE --timeout=120s > /dev/null
+}
+
+# Remove the relay of the tunnel and record how it ended
+end_tunnel() {
+    if [ -n "$RELAY_FORWARD_PID" ]; then
+        kill $RELAY_FORWARD_PID 2>/dev/null || true
+    fi
+    if [ -n "$RELAY_POD" ]; then
+        kubectl delete pod $RELAY_POD -n $VM_NAMESPACE --wait=false &> /dev/null || true
+    fi
+    audit "${TUNNEL_END:-closed}" "$TUNNEL_ID" "$VM_NAME" "$TUNNEL_PORT" "$TUNNEL_LOCAL_PORT" ""
+    print_status "Tunnel $TUNNEL_ID ${TUNNEL_END:-closed}"
+}
+
+open_tunnel() {
+    TUNNEL_PORT=$(target_port "$1")
+    if [ -z "$TUNNEL_PORT" ]; then
+        print_error "No http port in VM_WORKLOAD_PORTS ($VM_WORKLOAD_PORTS)"
+        exit 1
+    fi
+    TUNNEL_LOCAL_PORT=${TUNNEL_LOCAL_PORT:-$TUNNEL_PORT}
+    TUNNEL_ID="$VM_NAME-$(date +%s)"
+
+    local address=$(vm_address)
+    if [ -z "$address" ]; then
+        print_error "No address found for VM $VM_NAME in $VM_RESOURCE_GROUP"
+        exit 1
+    fi
+
+    local seconds=$((TUNNEL_MINUTES * 60))
+    local expires=$(($(date +%s) + seconds))
+    local ssh_host=$address
+    local ssh_opts=(-o StrictHostKeyChecking=no -o ExitOnForwardFailure=yes -o ServerAliveInterval=30)
+    audit open "$TUNNEL_ID" "$VM_NAME" "$TUNNEL_PORT" "$TUNNEL_LOCAL_PORT" "$expires"
+    trap end_tunnel EXIT
+
+    if [ "$VM_PUBLIC_IP" = false ]; then
+        TUNNEL_END="failed"
+        RELAY_POD="vm-tunnel-$TUNNEL_ID"
+        print_status "Starting relay pod $RELAY_POD in $VM_NAMESPACE to $address..."
+        start_relay "$RELAY_POD" "$address" "$seconds"
+        kubectl port-forward -n $VM_NAMESPACE pod/$RELAY_POD $RELAY_LOCAL_PORT:$RELAY_PORT &> /dev/null &
+        RELAY_FORWARD_PID=$!
+        local i
+        for i in {1..15}; do
+            (echo > /dev/tcp/127.0.0.1/$RELAY_LOCAL_PORT) 2>/dev/null && break
+            sleep 1
+        done
+        # The relay port of localhost is a different host at each tunnel
+        ssh_host=127.0.0.1
+        ssh_opts+=(-p $RELAY_LOCAL_PORT -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR)
+        TUNNEL_END=""
+    fi
+
+    print_status "✓ localhost:$TUNNEL_LOCAL_PORT -> $VM_NAME:$TUNNEL_PORT until $(date -d @$expires '+%Y-%m-%d %H:%M %Z') (Ctrl+C to close)"
+
+    local rc=0
+    # In the foreground process group, so Ctrl+C reaches ssh
+    timeout --foreground $seconds ssh -N "${ssh_opts[@]}" -L $TUNNEL_LOCAL_PORT:127.0.0.1:$TUNNEL_PORT azureuser@$ssh_host || rc=$?
+    if [ $rc -eq 124 ]; then
+        TUNNEL_END="expired"
+    elif [ $rc -ne 0 ] && [ $rc -ne 130 ]; then
+        TUNNEL_END="failed"
+        print_error "SSH to $VM_NAME failed (exit code $rc)"
+        exit 1
+    fi
+}
+
+# Tunnels opened from this workspace and not closed yet, and the relay pods of the cluster
+list_tunnels() {
+    echo "Open tunnels (audit log):"
+    if [ -f "$AUDIT_LOG" ]; then
+        awk -F'|' -v now="$(date +%s)" '
+            $2 == "open" { open[$3] = $0 }
+            $2 != "open" { delete open[$3] }
+            END {
+                for (id in open) {
+                    split(open[id], f, "|")
+                    if (f[7] > now) printf "  %s: localhost:%s -> %s:%s, by %s, %d minutes left\n", id, f[6], f[4], f[5], f[8], (f[7] - now) / 60
+                }
+            }' "$AUDIT_LOG"
+    fi
+    echo ""
+    echo "Relay pods:"
+    kubectl get pods -n $VM_NAMESPACE -l app=vm-tunnel \
+        -o custom-columns='NAME:.metadata.name,VM:.metadata.labels.vm,PHASE:.status.phase,BY:.metadata.annotations.vm-tunnel/opened-by' \
+        2>/dev/null | sed 's/^/  /'
+}
+
+close_tunnels() {
+    local selector="app=vm-tunnel"
+    if [ -n "$1" ]; then
+        selector="$selector,vm=$1"
+    fi
+    local pods=$(kubectl get pods -n $VM_NAMESPACE -l "$selector" \
+        -o jsonpath='{range .items[*]}{.metadata.name}{" "}{.metadata.labels.vm}{"\n"}{end}' 2>/dev/null)
+    if [ -z "$pods" ]; then
+        print_status "No relay pod${1:+ for $1}"
+        return 0
+    fi
+    local pod vm
+    while read -r pod vm; do
+        kubectl delete pod $pod -n $VM_NAMESPACE --wait=false > /dev/null
+        audit revoked "${pod#vm-tunnel-}" "$vm" "" "" ""
+    done <<< "$pods"
+    print_status "✓ $(echo "$pods" | wc -l | tr -d ' ') relay pod(s) deleted, their tunnels are closed"
+}
+
+# Main function
+main() {
+    case $1 in
+        open)
+            [ -n "$2" ] || { show_usage; exit 1; }
+            open_tunnel "$2"
+            ;;
+        list)
+            list_tunnels
+            ;;
+        close)
+            close_tunnels "$2"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
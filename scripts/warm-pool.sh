@@ -0,0 +1,309 @@
+#!/bin/bash
+
+# VM Warm Pool Script
+# Keeps a pool of pre-created VMs with the Istio sidecar package already installed
+# and deallocated, so a VM can be claimed and started in about a minute instead of
+# creating and provisioning a new one. A bake spec (BAKE_SPEC) adds provisioners run
+# after the sidecar installation: inline shell or a script, an Ansible playbook, or a
+# container image provisioning the VM over SSH. Each one logs to its own file. "bake"
+# provisions a single VM the same way and leaves it running, for gallery image builds.
+
+set -e
+
+# Shared configuration variables
+RESOURCE_GROUP="${RESOURCE_GROUP:-istio-playground-rg}"
+LOCATION="${LOCATION:-westus}"
+VM_NAME="${VM_NAME:-istio-vm}"
+VM_SIZE="${VM_SIZE:-Standard_B2s}"
+VM_IMAGE="${VM_IMAGE:-Ubuntu2204}"
+
+# Pool configuration
+POOL_SIZE="${POOL_SIZE:-2}"
+POOL_PREFIX="${POOL_PREFIX:-$VM_NAME-pool}"
+POOL_TAG="istio-warm-pool"
+ISTIO_VERSION="1.27.0"
+
+# JSON file of the provisioners ({"provisioners": [...]}), relative paths in it are
+# relative to the file
+BAKE_SPEC="${BAKE_SPEC:-}"
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+BAKE_LOG_DIR="$(dirname "$SCRIPT_DIR")/workspace/warm-pool"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1" >&2
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1" >&2
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+show_usage() {
+    echo "Usage: $0 fill|list|claim|drain|bake NAME"
+    echo ""
+    echo "  fill     Create VMs until the pool has POOL_SIZE ($POOL_SIZE) available VMs"
+    echo "  list     List pool VMs and their state"
+    echo "  claim    Start an available VM, mark it as claimed and print its name"
+    echo "  drain    Delete all available (unclaimed) pool VMs"
+    echo "  bake     Create VM NAME with the sidecar package and the bake spec, and leave it running"
+    echo ""
+    echo "Environment:"
+    echo "  BAKE_SPEC   JSON file of the provisioners run on each new pool VM (default: none)"
+}
+
+# Check the bake spec before any VM is created: known types, existing files, local tools
+check_bake_spec() {
+    if [ -z "$BAKE_SPEC" ]; then
+        return 0
+    fi
+    if [ ! -f "$BAKE_SPEC" ]; then
+        print_error "Bake spec not found: $BAKE_SPEC"
+        exit 1
+    fi
+    if ! command -v jq &> /dev/null; then
+        print_error "jq is required to read the bake spec"
+        exit 1
+    fi
+
+    local errors=$(jq -r '
+        if (.provisioners | type) != "array" then "provisioners must be a list" else
+        .provisioners | to_entries[] | .key as $i | .value |
+        if .type == "shell" then (if (.inline | type) != "array" and (.script | type) != "string" then "provisioner \($i + 1): shell needs inline or script" else empty end)
+        elif .type == "ansible" then (if (.playbook | type) != "string" then "provisioner \($i + 1): ansible needs playbook" else empty end)
+        elif .type == "container" then (if (.image | type) != "string" then "provisioner \($i + 1): container needs image" else empty end)
+        else "provisioner \($i + 1): unknown type \(.type) (valid: shell, ansible, container)" end end' "$BAKE_SPEC" 2>&1)
+    if [ -n "$errors" ]; then
+        echo "$errors" | while read -r line; do
+            print_error "$BAKE_SPEC: $line"
+        done
+        exit 1
+    fi
+
+    local dir=$(dirname "$BAKE_SPEC") file
+    for file in $(jq -r '.provisioners[] | .script // .playbook // empty' "$BAKE_SPEC"); do
+        if [[ "$file" != /* ]]; then
+            file="$dir/$file"
+        fi
+        if [ ! -f "$file" ]; then
+            print_error "$BAKE_SPEC: file not found: $file"
+            exit 1
+        fi
+    done
+    if jq -e '[.provisioners[].type] | index("ansible")' "$BAKE_SPEC" > /dev/null && ! command -v ansible-playbook &> /dev/null; then
+        print_error "ansible-playbook is required by the ansible provisioners of $BAKE_SPEC"
+        exit 1
+    fi
+    if jq -e '[.provisioners[].type] | index("container")' "$BAKE_SPEC" > /dev/null && ! command -v docker &> /dev/null; then
+        print_error "docker is required by the container provisioners of $BAKE_SPEC"
+        exit 1
+    fi
+}
+
+# Run one provisioner of the bake spec against a pool VM
+run_provisioner() {
+    local provisioner=$1
+    local vm_ip=$2
+    local dir=$(dirname "$BAKE_SPEC")
+    local type=$(jq -r '.type' <<< "$provisioner")
+    local file=$(jq -r '.script // .playbook // empty' <<< "$provisioner")
+    if [ -n "$file" ] && [[ "$file" != /* ]]; then
+        file="$dir/$file"
+    fi
+
+    case $type in
+        shell)
+            if [ -n "$file" ]; then
+                ssh -o StrictHostKeyChecking=no azureuser@$vm_ip "bash -s" < "$file"
+            else
+                jq -r '.inline | join("\n")' <<< "$provisioner" | ssh -o StrictHostKeyChecking=no azureuser@$vm_ip "bash -se"
+            fi
+            ;;
+        ansible)
+            ANSIBLE_HOST_KEY_CHECKING=False ansible-playbook -i "$vm_ip," -u azureuser --become \
+                --extra-vars "$(jq -c '.extra_vars // {}' <<< "$provisioner")" "$file"
+            ;;
+        container)
+            # The container reaches the VM over SSH with the local keys, as these scripts do
+            local env_args=() command=() line
+            while IFS= read -r line; do
+                env_args+=(-e "$line")
+            done < <(jq -r '.env // {} | to_entries[] | "\(.key)=\(.value)"' <<< "$provisioner")
+            while IFS= read -r line; do
+                command+=("$line")
+            done < <(jq -r '.command // [] | .[]' <<< "$provisioner")
+            docker run --rm -e TARGET_HOST=$vm_ip -e TARGET_USER=azureuser "${env_args[@]}" \
+                -v "$HOME/.ssh:/root/.ssh:ro" "$(jq -r '.image' <<< "$provisioner")" "${command[@]}"
+            ;;
+    esac
+}
+
+# Run the provisioners of the bake spec in order, each with its log in BAKE_LOG_DIR/VM
+run_bake_spec() {
+    local name=$1
+    local vm_ip=$2
+    if [ -z "$BAKE_SPEC" ]; then
+        return 0
+    fi
+
+    local log_dir="$BAKE_LOG_DIR/$name"
+    mkdir -p "$log_dir"
+    local count=$(jq '.provisioners | length' "$BAKE_SPEC")
+    local i provisioner label log
+    for ((i = 0; i < count; i++)); do
+        provisioner=$(jq -c ".provisioners[$i]" "$BAKE_SPEC")
+        label=$(jq -r '.name // .type' <<< "$provisioner")
+        log="$log_dir/$(printf '%02d' $((i + 1)))-$(echo "$label" | tr -c 'a-zA-Z0-9-' '-' | sed 's/-*$//').log"
+        print_status "Provisioner $((i + 1))/$count on $name: $label"
+        if ! run_provisioner "$provisioner" "$vm_ip" > "$log" 2>&1; then
+            print_error "Provisioner $label failed on $name, log: $log"
+            print_error "$name is left tagged $POOL_TAG=baking for inspection, 'drain' deletes it"
+            exit 1
+        fi
+    done
+    print_status "✓ $count provisioner(s) applied on $name, logs: $log_dir"
+}
+
+# Names of the pool VMs with the given state
+pool_vms() {
+    az vm list --resource-group $RESOURCE_GROUP \
+        --query "[?tags.\"$POOL_TAG\"=='$1'].name" -o tsv 2>/dev/null
+}
+
+# Create a VM tagged as baking, install the sidecar package and run the bake spec
+bake_vm() {
+    local name=$1
+
+    print_status "Creating VM: $name"
+    az vm create \
+        --resource-group $RESOURCE_GROUP \
+        --name "$name" \
+        --image "$VM_IMAGE" \
+        --size $VM_SIZE \
+        --admin-username azureuser \
+        --generate-ssh-keys \
+        --public-ip-sku Standard \
+        --tags "$POOL_TAG=baking" > /dev/null
+
+    local vm_ip=$(az vm show -d -g $RESOURCE_GROUP -n "$name" --query publicIps -o tsv)
+
+    print_status "Installing packages and Istio sidecar $ISTIO_VERSION on $name..."
+    ssh -o StrictHostKeyChecking=no azureuser@$vm_ip "sudo apt update && \
+        sudo apt install -y curl python3 python3-pip iptables wget systemd unzip && \
+        pip3 install --user flask gunicorn && \
+        wget -q --timeout=30 --tries=3 -O /tmp/istio-sidecar.deb https://storage.googleapis.com/istio-release/releases/${ISTIO_VERSION}/deb/istio-sidecar.deb && \
+        sudo dpkg -i /tmp/istio-sidecar.deb && rm -f /tmp/istio-sidecar.deb"
+
+    run_bake_spec "$name" "$vm_ip"
+}
+
+# Create one pool VM, bake the sidecar package into it and deallocate it
+create_pool_vm() {
+    local name=$1
+
+    bake_vm "$name"
+
+    print_status "Deallocating $name..."
+    az vm deallocate --resource-group $RESOURCE_GROUP --name "$name"
+    az vm update --resource-group $RESOURCE_GROUP --name "$name" --set "tags.$POOL_TAG=available" > /dev/null
+
+    print_status "✓ Pool VM $name is available"
+}
+
+# Create VMs until the pool has POOL_SIZE available VMs
+fill_pool() {
+    local available=$(pool_vms available | wc -l | tr -d ' ')
+    print_status "Warm pool has $available/$POOL_SIZE available VM(s)"
+
+    local index=1
+    while [ "$available" -lt "$POOL_SIZE" ]; do
+        local name="$POOL_PREFIX-$index"
+        if ! az vm show --resource-group $RESOURCE_GROUP --name "$name" &> /dev/null; then
+            create_pool_vm "$name"
+            available=$((available + 1))
+        fi
+        index=$((index + 1))
+    done
+
+    print_status "✓ Warm pool filled"
+}
+
+# List pool VMs and their state
+list_pool() {
+    printf "%-30s %-12s %-16s %s\n" "Name" "Pool" "Power" "Size"
+    bash "$SCRIPT_DIR/vm-status.sh" list $RESOURCE_GROUP | jq -r --arg tag "$POOL_TAG" \
+        '.[] | select(.tags[$tag] != null) | [.name, .tags[$tag], .powerState, .hardwareProfile.vmSize] | @tsv' \
+        | while IFS=$'\t' read -r name pool power size; do
+            printf "%-30s %-12s %-16s %s\n" "$name" "$pool" "$power" "$size"
+        done
+}
+
+# Claim an available VM: mark it, start it and print its name on stdout
+claim_vm() {
+    local name=$(pool_vms available | head -1)
+
+    if [ -z "$name" ]; then
+        print_error "No available VM in the warm pool, run: $0 fill"
+        exit 1
+    fi
+
+    az vm update --resource-group $RESOURCE_GROUP --name "$name" --set "tags.$POOL_TAG=claimed" > /dev/null
+    print_status "Starting claimed VM: $name"
+    az vm start --resource-group $RESOURCE_GROUP --name "$name" > /dev/null
+
+    print_status "✓ VM $name claimed from warm pool"
+    echo "$name"
+}
+
+# Delete all available (unclaimed) pool VMs
+drain_pool() {
+    local name
+    for name in $(pool_vms available) $(pool_vms baking); do
+        print_status "Deleting pool VM: $name"
+        az vm delete --resource-group $RESOURCE_GROUP --name "$name" --yes
+    done
+    print_status "✓ Warm pool drained"
+}
+
+# Main function
+main() {
+    case $1 in
+        fill)
+            check_bake_spec
+            fill_pool
+            ;;
+        list)
+            list_pool
+            ;;
+        claim)
+            claim_vm
+            ;;
+        drain)
+            drain_pool
+            ;;
+        bake)
+            if [ -z "$2" ]; then
+                show_usage
+                exit 1
+            fi
+            check_bake_spec
+            bake_vm "$2"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"
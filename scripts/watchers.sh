@@ -0,0 +1,213 @@
+#!/bin/bash
+
+# Watchers Script
+# Runs the long-running loops of setup-istio.sh in the background: autoreg (autoreg watch),
+# onboard (onboard-watch), wake (idle wake-watch), reconcile (reconcile watch) and operator
+# (operator run). Each watcher runs in its own process group with its pid, arguments and log
+# in WATCHERS_DIR, so it can be listed with its last activity and error count, paused and
+# resumed (SIGSTOP/SIGCONT), restarted with the same arguments or stopped, without touching
+# the other ones.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+SETUP_SCRIPT="$(dirname "$SCRIPT_DIR")/setup-istio.sh"
+WATCHERS_DIR="${WATCHERS_DIR:-$(dirname "$SCRIPT_DIR")/workspace/watchers}"
+
+WATCHERS="autoreg onboard wake reconcile operator"
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+NC='\033[0m' # No Color
+
+print_status() {
+    echo -e "${GREEN}[INFO]${NC} $1"
+}
+
+print_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+print_error() {
+    echo -e "${RED}[ERROR]${NC} $1"
+}
+
+show_usage() {
+    echo "Usage: $0 status | start NAME [OPTIONS...] | stop NAME | pause NAME | resume NAME | restart NAME"
+    echo ""
+    echo "  status    State, start time, last activity, errors and restarts of each watcher"
+    echo "  start     Run the watcher in the background with the setup-istio.sh OPTIONS"
+    echo "  stop      Stop the watcher"
+    echo "  pause     Suspend the watcher, it keeps its place in the loop"
+    echo "  resume    Continue a paused watcher"
+    echo "  restart   Stop the watcher and start it again with the same options"
+    echo ""
+    echo "Watchers: autoreg (autoreg watch), onboard (onboard-watch), wake (idle wake-watch), reconcile (reconcile watch),"
+    echo "          operator (operator run)"
+}
+
+# setup-istio.sh command of a watcher
+watcher_command() {
+    case $1 in
+        autoreg) echo "autoreg watch" ;;
+        onboard) echo "onboard-watch" ;;
+        wake) echo "idle wake-watch" ;;
+        reconcile) echo "reconcile watch" ;;
+        operator) echo "operator run" ;;
+        *)
+            print_error "Unknown watcher: $1 (valid: ${WATCHERS// /, })"
+            exit 1
+            ;;
+    esac
+}
+
+# running, paused, exited (died on its own) or stopped
+watcher_state() {
+    local pid_file="$WATCHERS_DIR/$1.pid"
+    if [ ! -f "$pid_file" ]; then
+        echo "stopped"
+        return 0
+    fi
+    local pid=$(cat "$pid_file")
+    if ! kill -0 "$pid" 2>/dev/null; then
+        echo "exited"
+    elif [ "$(ps -o stat= -p "$pid" | cut -c1)" = "T" ]; then
+        echo "paused"
+    else
+        echo "running"
+    fi
+}
+
+start_watcher() {
+    local name=$1
+    shift
+    local command=$(watcher_command "$name")
+    local state=$(watcher_state "$name")
+    if [ "$state" = "running" ] || [ "$state" = "paused" ]; then
+        print_error "Watcher $name is already $state, use: $0 restart $name"
+        exit 1
+    fi
+
+    mkdir -p "$WATCHERS_DIR"
+    printf '%s\n' "$@" > "$WATCHERS_DIR/$name.args"
+    echo "--- $(date -u +%Y-%m-%dT%H:%M:%SZ) started: $command $*" >> "$WATCHERS_DIR/$name.log"
+    # Its own session and process group, so its kubectl and az children are paused and stopped with it
+    setsid nohup bash "$SETUP_SCRIPT" $command "$@" < /dev/null >> "$WATCHERS_DIR/$name.log" 2>&1 &
+    echo $! > "$WATCHERS_DIR/$name.pid"
+    date +%s > "$WATCHERS_DIR/$name.started"
+    print_status "✓ Watcher $name started (PID $!), log: $WATCHERS_DIR/$name.log"
+}
+
+# Send a signal to the process group of a running or paused watcher
+signal_watcher() {
+    local name=$1
+    local signal=$2
+    local state=$(watcher_state "$name")
+    if [ "$state" != "running" ] && [ "$state" != "paused" ]; then
+        print_error "Watcher $name is $state"
+        exit 1
+    fi
+    kill -$signal -- -"$(cat "$WATCHERS_DIR/$name.pid")"
+}
+
+stop_watcher() {
+    local name=$1
+    watcher_command "$name" > /dev/null
+    local state=$(watcher_state "$name")
+    if [ "$state" = "running" ] || [ "$state" = "paused" ]; then
+        local pid=$(cat "$WATCHERS_DIR/$name.pid")
+        # A paused group does not handle SIGTERM until it continues
+        kill -TERM -- -"$pid" 2>/dev/null || true
+        kill -CONT -- -"$pid" 2>/dev/null || true
+        local i
+        for i in {1..10}; do
+            kill -0 "$pid" 2>/dev/null || break
+            sleep 1
+        done
+        kill -KILL -- -"$pid" 2>/dev/null || true
+    fi
+    rm -f "$WATCHERS_DIR/$name.pid"
+    print_status "✓ Watcher $name stopped"
+}
+
+restart_watcher() {
+    local name=$1
+    watcher_command "$name" > /dev/null
+    if [ ! -f "$WATCHERS_DIR/$name.args" ]; then
+        print_error "Watcher $name was never started, use: $0 start $name [OPTIONS...]"
+        exit 1
+    fi
+    local args=()
+    mapfile -t args < "$WATCHERS_DIR/$name.args"
+    stop_watcher "$name"
+    echo $(( $(cat "$WATCHERS_DIR/$name.restarts" 2>/dev/null || echo 0) + 1 )) > "$WATCHERS_DIR/$name.restarts"
+    start_watcher "$name" "${args[@]}"
+}
+
+# One line per watcher. Last activity is the last write to its log, errors the [ERROR] lines
+# logged since it was last started
+show_watchers() {
+    printf "%-10s %-9s %-8s %-20s %-20s %-7s %s\n" "WATCHER" "STATE" "PID" "STARTED" "LAST ACTIVITY" "ERRORS" "RESTARTS"
+    local name state pid started activity errors restarts log
+    for name in $WATCHERS; do
+        log="$WATCHERS_DIR/$name.log"
+        state=$(watcher_state "$name")
+        pid="-"
+        started="-"
+        activity="-"
+        errors=0
+        if [ "$state" != "stopped" ]; then
+            pid=$(cat "$WATCHERS_DIR/$name.pid")
+            started=$(date -u -d "@$(cat "$WATCHERS_DIR/$name.started")" +%Y-%m-%dT%H:%M:%SZ)
+        fi
+        if [ -f "$log" ]; then
+            activity=$(date -u -r "$log" +%Y-%m-%dT%H:%M:%SZ)
+            errors=$(awk '/^--- .* started: /{n=0} /\[ERROR\]/{n++} END{print n+0}' "$log")
+        fi
+        restarts=$(cat "$WATCHERS_DIR/$name.restarts" 2>/dev/null || echo 0)
+        printf "%-10s %-9s %-8s %-20s %-20s %-7s %s\n" "$name" "$state" "$pid" "$started" "$activity" "$errors" "$restarts"
+    done
+}
+
+# Main function
+main() {
+    local action=${1:-status}
+    local name=$2
+    if [ "$action" != "status" ] && [ -z "$name" ]; then
+        show_usage
+        exit 1
+    fi
+
+    case $action in
+        status)
+            show_watchers
+            ;;
+        start)
+            shift 2
+            start_watcher "$name" "$@"
+            ;;
+        stop)
+            stop_watcher "$name"
+            ;;
+        pause)
+            signal_watcher "$name" STOP
+            print_status "✓ Watcher $name paused"
+            ;;
+        resume)
+            signal_watcher "$name" CONT
+            print_status "✓ Watcher $name resumed"
+            ;;
+        restart)
+            restart_watcher "$name"
+            ;;
+        *)
+            show_usage
+            exit 1
+            ;;
+    esac
+}
+
+# Run main function
+main "$@"